@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// config is the configuration file read with --config.
+type config struct {
+	Routes []routeConfig `json:"routes"`
+}
+
+// routeConfig configures a handler.Route. Profile names the shared config
+// profile its requests are signed with, resolved like AWS_PROFILE would be so
+// role_arn, source_profile and credential_process are honored, the default
+// credentials are used when empty.
+type routeConfig struct {
+	Host        string `json:"host"`
+	PathPrefix  string `json:"path_prefix"`
+	StripPrefix bool   `json:"strip_prefix"`
+	Upstream    string `json:"upstream"`
+	Service     string `json:"service"`
+	Region      string `json:"region"`
+	Profile     string `json:"profile"`
+	// Headers are applied after those of the --set-header and related flags.
+	Headers *headerRulesConfig `json:"headers"`
+}
+
+// headerRulesConfig configures handler.HeaderRules.
+type headerRulesConfig struct {
+	SetRequest      map[string]string     `json:"set_request"`
+	RemoveRequest   []string              `json:"remove_request"`
+	SetResponse     map[string]string     `json:"set_response"`
+	RewriteResponse []headerRewriteConfig `json:"rewrite_response"`
+	RemoveResponse  []string              `json:"remove_response"`
+}
+
+// headerRewriteConfig configures a handler.HeaderRewrite.
+type headerRewriteConfig struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// signerSetHeaders are set by the signer, or from the URL, and cannot be set
+// by header rules.
+var signerSetHeaders = []string{"Authorization", "Host", "X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"}
+
+// rules returns the handler.HeaderRules of the configuration, nil if it has
+// none.
+func (c *headerRulesConfig) rules() (*handler.HeaderRules, error) {
+	if c == nil || len(c.SetRequest)+len(c.RemoveRequest)+len(c.SetResponse)+len(c.RewriteResponse)+len(c.RemoveResponse) == 0 {
+		return nil, nil
+	}
+	rules := &handler.HeaderRules{
+		SetRequestHeaders:     http.Header{},
+		RemoveRequestHeaders:  c.RemoveRequest,
+		SetResponseHeaders:    http.Header{},
+		RemoveResponseHeaders: c.RemoveResponse,
+	}
+	for name, value := range c.SetRequest {
+		for _, h := range signerSetHeaders {
+			if strings.EqualFold(name, h) {
+				return nil, fmt.Errorf("cannot set request header %s, it is set when signing", h)
+			}
+		}
+		rules.SetRequestHeaders.Set(name, value)
+	}
+	for name, value := range c.SetResponse {
+		rules.SetResponseHeaders.Set(name, value)
+	}
+	for _, rc := range c.RewriteResponse {
+		if rc.Name == "" {
+			return nil, errors.New("response header rewrite without a header name")
+		}
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern rewriting response header %s: %v", rc.Name, err)
+		}
+		rules.RewriteResponseHeaders = append(rules.RewriteResponseHeaders, handler.HeaderRewrite{Name: rc.Name, Pattern: re, Replacement: rc.Replacement})
+	}
+	return rules, nil
+}
+
+// loadConfig reads the JSON configuration file at path, rejecting unknown
+// fields so typos do not go unnoticed.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// routes returns the routes of the configuration, after validating them.
+func (c *config) routes() ([]handler.Route, error) {
+	routes := make([]handler.Route, 0, len(c.Routes))
+	for i, rc := range c.Routes {
+		upstream, err := parseUpstreamURL(rc.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream of route %d: %v", i+1, err)
+		}
+		route := handler.Route{
+			Host:        rc.Host,
+			PathPrefix:  rc.PathPrefix,
+			StripPrefix: rc.StripPrefix,
+			Upstream:    upstream,
+			Service:     rc.Service,
+			Region:      rc.Region,
+		}
+		if err := route.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid route %d: %v", i+1, err)
+		}
+		if route.HeaderRules, err = rc.Headers.rules(); err != nil {
+			return nil, fmt.Errorf("invalid headers of route %d: %v", i+1, err)
+		}
+		if rc.Profile != "" {
+			sess, err := session.NewSessionWithOptions(session.Options{Profile: rc.Profile, SharedConfigState: session.SharedConfigEnable})
+			if err != nil {
+				return nil, fmt.Errorf("invalid profile of route %d: %v", i+1, err)
+			}
+			route.Signer = v4.NewSigner(sess.Config.Credentials)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// reloadConfig reads the configuration file at path again and replaces the
+// routes of p with its own, keeping the current ones if it is invalid.
+func reloadConfig(path string, p *handler.ProxyClient) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		log.WithError(err).Error("Unable to reload the configuration, keeping the current one")
+		return err
+	}
+	routes, err := c.routes()
+	if err != nil {
+		log.WithError(err).Error("Unable to reload the configuration, keeping the current one")
+		return err
+	}
+	p.SetRoutes(routes)
+	log.WithField("routes", len(routes)).Info("Reloaded the configuration")
+	return nil
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// credentialsExpiryWindow is how long before they expire the credentials the
+// proxy retrieves itself are refreshed, so no request is signed with
+// credentials about to expire.
+const credentialsExpiryWindow = 5 * time.Minute
+
+// credentialsRefreshInterval is how often --refresh-ahead checks whether the
+// credentials are about to expire.
+const credentialsRefreshInterval = 15 * time.Second
+
+// ecsCredentialsHost serves the credentials of ECS tasks at
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+const ecsCredentialsHost = "http://169.254.170.2"
+
+// credentialSources are the values of --credential-source.
+var credentialSources = []string{"auto", "env", "shared", "process", "sso", "web-identity", "ec2", "ecs"}
+
+// resolveCredentials returns the credentials of source and the source they
+// come from, which auto picks: a web identity token file (IRSA) unless keys
+// are set in the environment, then the SSO role of an SSO profile, then the
+// ECS or EKS Pod Identity endpoint of the container unless the profile has
+// keys, otherwise the SDK's default chain, which runs the credential_process
+// of profiles.
+// lookup reads the environment.
+func resolveCredentials(sess *session.Session, source string, lookup func(string) (string, bool)) (*credentials.Credentials, string, error) {
+	getenv := func(name string) string {
+		v, _ := lookup(name)
+		return v
+	}
+
+	profileName := getenv("AWS_PROFILE")
+	if profileName == "" {
+		profileName = getenv("AWS_DEFAULT_PROFILE")
+	}
+	if profileName == "" {
+		profileName = "default"
+	}
+	profile, err := loadSharedProfile(profileName, lookup)
+	if err != nil {
+		return nil, source, err
+	}
+
+	if source == "auto" {
+		switch {
+		case getenv("AWS_ACCESS_KEY_ID") != "" || getenv("AWS_ACCESS_KEY") != "":
+			return sess.Config.Credentials, "env", nil
+		case getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+			source = "web-identity"
+		case profile["sso_start_url"] != "":
+			source = "sso"
+		case (getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "") && profile["aws_access_key_id"] == "":
+			source = "ecs"
+		default:
+			return sess.Config.Credentials, "auto", nil
+		}
+	}
+
+	switch source {
+	case "env":
+		return credentials.NewEnvCredentials(), source, nil
+	case "shared":
+		return credentials.NewSharedCredentials(getenv("AWS_SHARED_CREDENTIALS_FILE"), profileName), source, nil
+	case "process":
+		command := profile["credential_process"]
+		if command == "" {
+			return nil, source, fmt.Errorf("profile %s has no credential_process", profileName)
+		}
+		return processcreds.NewCredentials(command, func(p *processcreds.ProcessProvider) {
+			p.ExpiryWindow = credentialsExpiryWindow
+		}), source, nil
+	case "sso":
+		for _, key := range []string{"sso_start_url", "sso_region", "sso_account_id", "sso_role_name"} {
+			if profile[key] == "" {
+				return nil, source, fmt.Errorf("profile %s has no %s", profileName, key)
+			}
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, source, err
+		}
+		return credentials.NewCredentials(&ssoProvider{
+			client:    sso.New(sess, aws.NewConfig().WithRegion(profile["sso_region"])),
+			startURL:  profile["sso_start_url"],
+			accountID: profile["sso_account_id"],
+			roleName:  profile["sso_role_name"],
+			cacheDir:  filepath.Join(home, ".aws", "sso", "cache"),
+		}), source, nil
+	case "web-identity":
+		tokenFile, roleARN := getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), getenv("AWS_ROLE_ARN")
+		if tokenFile == "" {
+			tokenFile, roleARN = profile["web_identity_token_file"], profile["role_arn"]
+		}
+		if tokenFile == "" || roleARN == "" {
+			return nil, source, fmt.Errorf("web identity credentials require AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, or a profile with web_identity_token_file and role_arn")
+		}
+		sessionName := getenv("AWS_ROLE_SESSION_NAME")
+		if sessionName == "" {
+			sessionName = roleSessionName()
+		}
+		p := stscreds.NewWebIdentityRoleProvider(sts.New(sess), roleARN, sessionName, tokenFile)
+		p.ExpiryWindow = credentialsExpiryWindow
+		return credentials.NewCredentials(p), source, nil
+	case "ec2":
+		return ec2rolecreds.NewCredentials(sess, func(p *ec2rolecreds.EC2RoleProvider) {
+			p.ExpiryWindow = credentialsExpiryWindow
+		}), source, nil
+	case "ecs":
+		uri := getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		if relative := getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+			uri = ecsCredentialsHost + relative
+		} else if uri == "" {
+			return nil, source, fmt.Errorf("ECS credentials require AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		} else if err := validateContainerCredentialsURI(uri); err != nil {
+			return nil, source, err
+		}
+		p := endpointcreds.NewProviderClient(*sess.Config, sess.Handlers, uri, func(p *endpointcreds.Provider) {
+			p.ExpiryWindow = credentialsExpiryWindow
+			p.AuthorizationToken = getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		}).(*endpointcreds.Provider)
+		// EKS Pod Identity rotates the token of the file
+		if tokenFile := getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+			return credentials.NewCredentials(&tokenFileProvider{Provider: p, tokenFile: tokenFile}), source, nil
+		}
+		return credentials.NewCredentials(p), source, nil
+	}
+	return nil, source, fmt.Errorf("unknown credential source %q", source)
+}
+
+// containerCredentialsHosts are the hosts AWS_CONTAINER_CREDENTIALS_FULL_URI
+// may name over plain HTTP besides loopback ones: those of the ECS and EKS
+// Pod Identity agents.
+var containerCredentialsHosts = map[string]bool{"169.254.170.2": true, "169.254.170.23": true, "fd00:ec2::23": true}
+
+// validateContainerCredentialsURI checks that credentials are retrieved from
+// uri over HTTPS or from a host of the instance, so they are not sent to
+// whoever can set the environment.
+func validateContainerCredentialsURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid AWS_CONTAINER_CREDENTIALS_FULL_URI: %v", err)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" || containerCredentialsHosts[host] {
+			return nil
+		}
+	}
+	return fmt.Errorf("AWS_CONTAINER_CREDENTIALS_FULL_URI must use HTTPS or a loopback, ECS or EKS Pod Identity host, not %s", uri)
+}
+
+// tokenFileProvider retrieves credentials from a container credentials
+// endpoint with the token of a file, read again on every retrieval.
+type tokenFileProvider struct {
+	*endpointcreds.Provider
+	tokenFile string
+}
+
+func (p *tokenFileProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(aws.BackgroundContext())
+}
+
+func (p *tokenFileProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	b, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: endpointcreds.ProviderName}, err
+	}
+	p.AuthorizationToken = strings.TrimSpace(string(b))
+	return p.Provider.RetrieveWithContext(ctx)
+}
+
+// loadSharedProfile returns the keys of profile in the shared config file,
+// overridden by those of the shared credentials file, the files being those
+// of the SDK. Missing files hold no profile.
+func loadSharedProfile(profile string, lookup func(string) (string, bool)) (map[string]string, error) {
+	home, _ := os.UserHomeDir()
+	configFile, ok := lookup("AWS_CONFIG_FILE")
+	if !ok || configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+	credentialsFile, ok := lookup("AWS_SHARED_CREDENTIALS_FILE")
+	if !ok || credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+
+	// Only the default profile is not prefixed in the config file
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = profile
+	}
+
+	keys := map[string]string{}
+	for _, f := range []struct{ path, section string }{{configFile, configSection}, {credentialsFile, profile}} {
+		b, err := ioutil.ReadFile(f.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range parseINISection(b, f.section) {
+			keys[k] = v
+		}
+	}
+	return keys, nil
+}
+
+// parseINISection returns the key = value pairs of section in the INI file
+// b, the last one winning when a key is repeated.
+func parseINISection(b []byte, section string) map[string]string {
+	keys := map[string]string{}
+	in := false
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			in = strings.Join(strings.Fields(line[1:len(line)-1]), " ") == section
+		case in:
+			if i := strings.Index(line, "="); i > 0 {
+				keys[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return keys
+}
+
+// ssoProvider retrieves the credentials of an AWS SSO role with the access
+// token cached by `aws sso login`, which the proxy never refreshes itself.
+type ssoProvider struct {
+	credentials.Expiry
+
+	client    ssoiface.SSOAPI
+	startURL  string
+	accountID string
+	roleName  string
+	cacheDir  string
+}
+
+func (p *ssoProvider) Retrieve() (credentials.Value, error) {
+	token, err := p.cachedToken()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	out, err := p.client.GetRoleCredentials(&sso.GetRoleCredentialsInput{
+		AccessToken: aws.String(token),
+		AccountId:   aws.String(p.accountID),
+		RoleName:    aws.String(p.roleName),
+	})
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to get the SSO role credentials of %s in %s: %v", p.roleName, p.accountID, err)
+	}
+
+	c := out.RoleCredentials
+	p.SetExpiration(time.Unix(0, aws.Int64Value(c.Expiration)*int64(time.Millisecond)), credentialsExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(c.AccessKeyId),
+		SecretAccessKey: aws.StringValue(c.SecretAccessKey),
+		SessionToken:    aws.StringValue(c.SessionToken),
+		ProviderName:    "SSOProvider",
+	}, nil
+}
+
+// cachedToken returns the access token cached for p.startURL, in the file
+// named after its SHA-1.
+func (p *ssoProvider) cachedToken() (string, error) {
+	sum := sha1.Sum([]byte(p.startURL))
+	b, err := ioutil.ReadFile(filepath.Join(p.cacheDir, hex.EncodeToString(sum[:])+".json"))
+	if err != nil {
+		return "", fmt.Errorf("no cached SSO token for %s, run aws sso login: %v", p.startURL, err)
+	}
+
+	var token struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresAt   string `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(b, &token); err != nil {
+		return "", fmt.Errorf("invalid cached SSO token for %s: %v", p.startURL, err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	if err != nil {
+		return "", fmt.Errorf("invalid cached SSO token for %s: %v", p.startURL, err)
+	}
+	if token.AccessToken == "" || !time.Now().Before(expiresAt) {
+		return "", fmt.Errorf("cached SSO token for %s expired, run aws sso login", p.startURL)
+	}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dnsFallbackDelay is how long a dial to an address of a host is waited for
+// before the next address is dialed as well, that of net.Dialer.
+const dnsFallbackDelay = 300 * time.Millisecond
+
+// dnsCache caches the addresses upstream hosts resolve to for ttl. Expired
+// entries keep being used while they are refreshed in the background, so
+// only the first dial to a host waits for its resolution. Entries not used
+// for a ttl after they expired are dropped.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs      []string
+	expires    time.Time
+	refreshing bool
+}
+
+// newDNSCache returns a dnsCache resolving hosts with the default resolver.
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		now:     time.Now,
+		entries: map[string]*dnsEntry{},
+	}
+}
+
+// resolve returns the cached addresses of host, resolving it if it was never
+// resolved and refreshing them in the background once they expired.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok {
+		if !entry.refreshing && !c.now().Before(entry.expires) {
+			entry.refreshing = true
+			go c.refresh(host)
+		}
+		addrs := entry.addrs
+		c.mu.Unlock()
+		return addrs, nil
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.store(host, addrs)
+	return addrs, nil
+}
+
+// refresh resolves host again, keeping its stale addresses if that fails.
+func (c *dnsCache) refresh(host string) {
+	addrs, err := c.lookup(context.Background(), host)
+	if err != nil {
+		log.WithError(err).WithField("host", host).Warn("Unable to refresh cached DNS entry, using stale addresses")
+		c.mu.Lock()
+		c.entries[host].refreshing = false
+		c.mu.Unlock()
+		return
+	}
+	c.store(host, addrs)
+}
+
+func (c *dnsCache) store(host string, addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for h, entry := range c.entries {
+		if !entry.refreshing && now.Sub(entry.expires) >= c.ttl {
+			delete(c.entries, h)
+		}
+	}
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: now.Add(c.ttl)}
+}
+
+// dialContext wraps dial so hosts are resolved through the cache, dialing
+// their addresses in order, the next one as soon as a dial fails or once it
+// did not connect within dnsFallbackDelay, and using the first connection.
+func (c *dnsCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := c.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return dialParallel(ctx, dial, network, addrs, port)
+	}
+}
+
+// dialParallel dials ips, staggered by dnsFallbackDelay, returning the first
+// connection, or the last error if none connects.
+func dialParallel(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, ips []string, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start()
+	fallback := time.NewTimer(dnsFallbackDelay)
+	defer fallback.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Dials still pending are canceled, those connecting anyway closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+				fallback.Reset(dnsFallbackDelay)
+			}
+		case <-fallback.C:
+			if next < len(ips) {
+				start()
+				fallback.Reset(dnsFallbackDelay)
+			}
+		}
+	}
+	return nil, err
+}
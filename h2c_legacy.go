@@ -0,0 +1,28 @@
+//go:build !go1.24
+// +build !go1.24
+
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import "net/http"
+
+// h2cSupported reports whether HTTP/2 can be served without TLS, which
+// needs the http.Protocols of Go 1.24.
+const h2cSupported = false
+
+// enableH2C is never called, HTTP/2 is only served over TLS.
+func enableH2C(s *http.Server) {}
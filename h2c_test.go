@@ -0,0 +1,54 @@
+//go:build go1.24
+// +build go1.24
+
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableH2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	enableH2C(server)
+	go server.Serve(l)
+	defer server.Close()
+
+	get := func(protocols *http.Protocols) string {
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Clients starting with HTTP/2 get it, others still get HTTP/1.1
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	assert.Equal(t, "HTTP/2.0", get(&h2c))
+	assert.Equal(t, "HTTP/1.1", get(nil))
+}
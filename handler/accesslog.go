@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// writeAccessLog writes a Common Log Format line for r, received at start, to
+// w: client IP, time, request line, status and response body bytes. The
+// values of the query parameters matching one of redact are redacted.
+func writeAccessLog(w io.Writer, r *http.Request, start time.Time, status int, bytes int64, redact []*regexp.Regexp) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || clientIP == "" {
+		clientIP = "-"
+	}
+
+	uri := r.RequestURI
+	if uri == "" && r.URL != nil {
+		uri = r.URL.RequestURI()
+	}
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri = uri[:i+1] + redactQuery(uri[i+1:], redact)
+	}
+
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+
+	// A single write per line, so lines of concurrent requests never interleave
+	fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %s\n", clientIP, start.Format(clfTimeFormat), r.Method, uri, r.Proto, status, size)
+}
+
+// redacted replaces the values redacted from JSON access log records.
+const redacted = "REDACTED"
+
+// JSONAccessLog writes a JSON record for every proxied request to Writer, one
+// per line. The values of RedactHeaders, and of the query parameters whose
+// name matches one of RedactQuery, are replaced by REDACTED so records are
+// safe to ship to centralized logging.
+type JSONAccessLog struct {
+	Writer        io.Writer
+	RedactHeaders []string
+	RedactQuery   []*regexp.Regexp
+}
+
+// accessLogRecord is the record written for a request. Identity is only
+// known when the request was authenticated.
+type accessLogRecord struct {
+	Time          time.Time         `json:"time"`
+	ClientIP      string            `json:"client_ip"`
+	Identity      string            `json:"identity,omitempty"`
+	Method        string            `json:"method"`
+	Path          string            `json:"path"`
+	Query         string            `json:"query,omitempty"`
+	UpstreamHost  string            `json:"upstream_host,omitempty"`
+	Service       string            `json:"service,omitempty"`
+	Region        string            `json:"region,omitempty"`
+	Status        int               `json:"status"`
+	LatencyMs     float64           `json:"latency_ms"`
+	RequestBytes  int64             `json:"request_bytes"`
+	ResponseBytes int64             `json:"response_bytes"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	TraceID       string            `json:"trace_id,omitempty"`
+}
+
+// write writes the record of r, received at start with header, to l.Writer.
+// The header is that of r before it was proxied, which removes some.
+func (l *JSONAccessLog) write(r *http.Request, header http.Header, start time.Time, info *requestInfo, status int) error {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	record := accessLogRecord{
+		Time:          start.UTC(),
+		ClientIP:      clientIP,
+		Identity:      info.Identity,
+		Method:        r.Method,
+		UpstreamHost:  info.UpstreamHost,
+		Service:       info.Service,
+		Region:        info.Region,
+		Status:        status,
+		LatencyMs:     float64(time.Since(start)) / float64(time.Millisecond),
+		RequestBytes:  info.RequestBytes,
+		ResponseBytes: info.ResponseBytes,
+		Headers:       make(map[string]string, len(header)),
+	}
+	if r.URL != nil {
+		record.Path = r.URL.Path
+		record.Query = redactQuery(r.URL.RawQuery, l.RedactQuery)
+	}
+	for name, values := range header {
+		record.Headers[name] = strings.Join(values, ", ")
+	}
+	for _, name := range l.RedactHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			record.Headers[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	if info.Span != nil && info.Span.Sampled {
+		record.TraceID = hex.EncodeToString(info.Span.TraceID[:])
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// A single write per record, like writeAccessLog
+	_, err = l.Writer.Write(append(b, '\n'))
+	return err
+}
+
+// redactQuery returns rawQuery with the values of the parameters matching
+// one of patterns redacted, keeping the order of parameters.
+func redactQuery(rawQuery string, patterns []*regexp.Regexp) string {
+	if rawQuery == "" || len(patterns) == 0 {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name := param
+		if j := strings.Index(param, "="); j >= 0 {
+			name = param[:j]
+		}
+		unescaped, err := url.QueryUnescape(name)
+		if err != nil {
+			unescaped = name
+		}
+		for _, pattern := range patterns {
+			if pattern.MatchString(unescaped) {
+				params[i] = name + "=" + redacted
+				break
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAccessLog(t *testing.T) {
+	start := time.Date(2020, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+	tests := []struct {
+		name       string
+		request    *http.Request
+		status     int
+		bytes      int64
+		expectLine string
+	}{
+		{
+			name: "should write a CLF line for a representative request",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/bucket/key?versionId=1", nil)
+				r.RemoteAddr = "10.0.0.1:43210"
+				return r
+			}(),
+			status:     http.StatusOK,
+			bytes:      2326,
+			expectLine: "10.0.0.1 - - [10/Oct/2020:13:55:36 -0700] \"GET /bucket/key?versionId=1 HTTP/1.1\" 200 2326\n",
+		},
+		{
+			name: "should write a dash for empty responses",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodDelete, "/bucket/key", nil)
+				r.RemoteAddr = "[::1]:43210"
+				return r
+			}(),
+			status:     http.StatusNoContent,
+			expectLine: "::1 - - [10/Oct/2020:13:55:36 -0700] \"DELETE /bucket/key HTTP/1.1\" 204 -\n",
+		},
+		{
+			name: "should write a dash for unknown clients",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = ""
+				return r
+			}(),
+			status:     http.StatusOK,
+			bytes:      2,
+			expectLine: "- - - [10/Oct/2020:13:55:36 -0700] \"GET / HTTP/1.1\" 200 2\n",
+		},
+		{
+			name: "should redact the signature of presigned URLs",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKID%2F20201010%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Security-Token=token&X-Amz-Signature=abc123", nil)
+				r.RemoteAddr = "10.0.0.1:43210"
+				return r
+			}(),
+			status:     http.StatusOK,
+			bytes:      2,
+			expectLine: "10.0.0.1 - - [10/Oct/2020:13:55:36 -0700] \"GET /bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=REDACTED&X-Amz-Security-Token=REDACTED&X-Amz-Signature=REDACTED HTTP/1.1\" 200 2\n",
+		},
+	}
+	redact := []*regexp.Regexp{regexp.MustCompile("^X-Amz-Signature$"), regexp.MustCompile("^X-Amz-Credential$"), regexp.MustCompile("^X-Amz-Security-Token$")}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeAccessLog(&buf, tt.request, start, tt.status, tt.bytes, redact)
+			assert.Equal(t, tt.expectLine, buf.String())
+		})
+	}
+}
+
+func TestHandler_AccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusNotFound,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("not found")),
+			},
+		},
+		AccessLog: &buf,
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "/bucket/key", nil)
+	request.RemoteAddr = "10.0.0.1:43210"
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Regexp(t, regexp.MustCompile(`^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "PUT /bucket/key HTTP/1\.1" 404 9\n$`), buf.String())
+}
+
+func TestHandler_JSONAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := &Handler{
+		ProxyClient: &signingProxyClient{
+			mockProxyClient: mockProxyClient{
+				Response: &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(bytes.NewBufferString("hello")),
+				},
+			},
+			service: "s3",
+			region:  "eu-west-1",
+		},
+		Authenticators: []Authenticator{&APIKeyAuth{Header: "X-Api-Key", Keys: []string{"second"}}},
+		JSONAccessLog: &JSONAccessLog{
+			Writer:        &buf,
+			RedactHeaders: []string{"authorization", "X-Api-Key"},
+			RedactQuery:   []*regexp.Regexp{regexp.MustCompile("^X-Amz-Signature$")},
+		},
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "/bucket/key?X-Amz-Signature=abc&versionId=1", bytes.NewBufferString("body"))
+	request.RemoteAddr = "10.0.0.1:43210"
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("X-Api-Key", "second")
+	request.Header.Set("User-Agent", "test")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	var record accessLogRecord
+	assert.True(t, strings.HasSuffix(buf.String(), "}\n"))
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.WithinDuration(t, time.Now(), record.Time, time.Minute)
+	assert.True(t, record.LatencyMs >= 0)
+	record.Time, record.LatencyMs = time.Time{}, 0
+	assert.Equal(t, accessLogRecord{
+		ClientIP:      "10.0.0.1",
+		Identity:      "api-key:16367aac",
+		Method:        http.MethodPut,
+		Path:          "/bucket/key",
+		Query:         "X-Amz-Signature=REDACTED&versionId=1",
+		Service:       "s3",
+		Region:        "eu-west-1",
+		Status:        http.StatusOK,
+		RequestBytes:  4,
+		ResponseBytes: 5,
+		Headers: map[string]string{
+			"Authorization": "REDACTED",
+			"X-Api-Key":     "REDACTED",
+			"User-Agent":    "test",
+		},
+	}, record)
+	assert.NotContains(t, buf.String(), "secret")
+}
+
+func TestRedactQuery(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile("^X-Amz-(Signature|Credential)$"), regexp.MustCompile("^token$")}
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "empty"},
+		{name: "nothing to redact", query: "versionId=1&prefix=a%2Fb", want: "versionId=1&prefix=a%2Fb"},
+		{name: "keeps order", query: "b=1&X-Amz-Signature=abc&a=2&X-Amz-Credential=AKID%2F20201001", want: "b=1&X-Amz-Signature=REDACTED&a=2&X-Amz-Credential=REDACTED"},
+		{name: "escaped name", query: "%74oken=secret", want: "%74oken=REDACTED"},
+		{name: "without value", query: "token", want: "token=REDACTED"},
+		{name: "repeated", query: "token=a&token=b", want: "token=REDACTED&token=REDACTED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, redactQuery(tt.query, patterns))
+		})
+	}
+}
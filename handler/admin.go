@@ -0,0 +1,276 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Admin serves the operator endpoints under /admin/. Every request must
+// carry the admin token as a bearer token.
+type Admin struct {
+	// Token authenticates admin requests, it must not be empty.
+	Token string
+	// Credentials are the credentials requests are signed with.
+	Credentials *credentials.Credentials
+	// Proxy, when set, is the ProxyClient whose configuration /admin/config
+	// reports.
+	Proxy *ProxyClient
+	// Reload, when set, reloads the configuration on POST /admin/reload.
+	Reload func() error
+
+	now func() time.Time
+
+	mu           sync.Mutex
+	refreshErr   error
+	refreshErrAt time.Time
+}
+
+// credentialsResponse is the body of /admin/credentials. It never contains
+// key material.
+type credentialsResponse struct {
+	Provider           string `json:"provider"`
+	ProviderName       string `json:"provider_name"`
+	Expiry             string `json:"expiry"`
+	ExpiresInSeconds   *int64 `json:"expires_in_seconds,omitempty"`
+	Error              string `json:"error,omitempty"`
+	LastRefreshError   string `json:"last_refresh_error,omitempty"`
+	LastRefreshErrorAt string `json:"last_refresh_error_at,omitempty"`
+}
+
+// configResponse is the body of /admin/config.
+type configResponse struct {
+	Routes  []routeResponse `json:"routes"`
+	Signing signingResponse `json:"signing"`
+}
+
+type routeResponse struct {
+	Host           string `json:"host,omitempty"`
+	PathPrefix     string `json:"path_prefix,omitempty"`
+	StripPrefix    bool   `json:"strip_prefix"`
+	Upstream       string `json:"upstream"`
+	Service        string `json:"service,omitempty"`
+	Region         string `json:"region,omitempty"`
+	OwnCredentials bool   `json:"own_credentials"`
+	HeaderRules    bool   `json:"header_rules"`
+}
+
+type signingResponse struct {
+	Service             string            `json:"service,omitempty"`
+	Region              string            `json:"region,omitempty"`
+	Host                string            `json:"host,omitempty"`
+	SignVersion         string            `json:"sign_version"`
+	SignedHeaders       []string          `json:"signed_headers"`
+	Endpoints           map[string]string `json:"endpoints,omitempty"`
+	S3VirtualHostSuffix string            `json:"s3_virtual_host_suffix,omitempty"`
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var method string
+	var serve func(w http.ResponseWriter)
+	switch {
+	case r.URL.Path == "/admin/credentials":
+		method, serve = http.MethodGet, a.serveCredentials
+	case r.URL.Path == "/admin/config" && a.Proxy != nil:
+		method, serve = http.MethodGet, a.serveConfig
+	case r.URL.Path == "/admin/reload" && a.Reload != nil:
+		method, serve = http.MethodPost, a.serveReload
+	case r.URL.Path == "/admin/presign" && a.Proxy != nil:
+		method, serve = http.MethodPost, func(w http.ResponseWriter) { a.servePresign(w, r) }
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	serve(w)
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if a.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.Token)) == 1
+}
+
+func (a *Admin) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+func (a *Admin) serveCredentials(w http.ResponseWriter) {
+	status, err := GetCredentialsStatus(a.Credentials)
+	var resp credentialsResponse
+	if refreshErr, at := a.lastRefreshError(); refreshErr != nil {
+		resp.LastRefreshError, resp.LastRefreshErrorAt = refreshErr.Error(), at.UTC().Format(time.RFC3339)
+	}
+	if err != nil {
+		resp.Provider, resp.Expiry, resp.Error = "unknown", "unknown", err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	resp.Provider = ProviderType(status.Provider)
+	resp.ProviderName = status.Provider
+	resp.Expiry = "static"
+	if !status.Expiry.IsZero() {
+		remaining := int64(status.Expiry.Sub(a.clock()).Seconds())
+		resp.Expiry = status.Expiry.UTC().Format(time.RFC3339)
+		resp.ExpiresInSeconds = &remaining
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *Admin) serveConfig(w http.ResponseWriter) {
+	p := a.Proxy
+	resp := configResponse{
+		Routes: []routeResponse{},
+		Signing: signingResponse{
+			Service:             p.SigningNameOverride,
+			Region:              p.RegionOverride,
+			Host:                p.HostOverride,
+			SignVersion:         string(p.SignVersion),
+			SignedHeaders:       append([]string{}, p.SignedHeaders...),
+			S3VirtualHostSuffix: p.S3VirtualHostSuffix,
+		},
+	}
+	if resp.Signing.SignVersion == "" {
+		resp.Signing.SignVersion = "auto"
+	}
+	sort.Strings(resp.Signing.SignedHeaders)
+	if len(p.Endpoints) > 0 {
+		resp.Signing.Endpoints = make(map[string]string, len(p.Endpoints))
+		for service, u := range p.Endpoints {
+			resp.Signing.Endpoints[service] = u.Redacted()
+		}
+	}
+	for _, route := range p.currentRoutes() {
+		resp.Routes = append(resp.Routes, routeResponse{
+			Host:           route.Host,
+			PathPrefix:     route.PathPrefix,
+			StripPrefix:    route.StripPrefix,
+			Upstream:       route.Upstream.Redacted(),
+			Service:        route.Service,
+			Region:         route.Region,
+			OwnCredentials: route.Signer != nil,
+			HeaderRules:    route.HeaderRules != nil,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *Admin) serveReload(w http.ResponseWriter) {
+	if err := a.Reload(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// presignRequest is the body of POST /admin/presign. Method defaults to GET,
+// ExpiresIn, in seconds, to 15 minutes.
+type presignRequest struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	ExpiresIn int64  `json:"expires_in"`
+	Service   string `json:"service"`
+	Region    string `json:"region"`
+}
+
+type presignResponse struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+func (a *Admin) servePresign(w http.ResponseWriter, r *http.Request) {
+	var req presignRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid presign request: " + err.Error()})
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	expires := 15 * time.Minute
+	if req.ExpiresIn != 0 {
+		expires = time.Duration(req.ExpiresIn) * time.Second
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid presign request: " + err.Error()})
+		return
+	}
+
+	presigned, expiresAt, err := a.Proxy.Presign(req.Method, target, req.Service, req.Region, expires)
+	if err != nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, presignResponse{
+		Method:    strings.ToUpper(req.Method),
+		URL:       presigned.String(),
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// RecordRefreshError records a failure to refresh the credentials, reported
+// by /admin/credentials, it is meant to be passed to
+// NewRefreshLimitedCredentials.
+func (a *Admin) RecordRefreshError(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refreshErr, a.refreshErrAt = err, a.clock()
+}
+
+// lastRefreshError returns the last error retrieving the credentials and
+// when it happened, nil if there was none.
+func (a *Admin) lastRefreshError() (error, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.refreshErr, a.refreshErrAt
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// The headers naming the role a request is signed as, and the external ID
+// to assume it with.
+const (
+	assumeRoleARNHeader        = "X-Assume-Role-Arn"
+	assumeRoleExternalIDHeader = "X-Assume-Role-External-Id"
+)
+
+// assumedRole returns the signer for the role named by the X-Assume-Role-Arn
+// header of req, nil if there is none, and removes the role headers so they
+// are never forwarded. The role must be one of AllowedRoleARNs.
+func (p *ProxyClient) assumedRole(req *http.Request) (*v4.Signer, error) {
+	arn := req.Header.Get(assumeRoleARNHeader)
+	externalID := req.Header.Get(assumeRoleExternalIDHeader)
+	req.Header.Del(assumeRoleARNHeader)
+	req.Header.Del(assumeRoleExternalIDHeader)
+
+	if arn == "" {
+		if externalID != "" {
+			return nil, &statusError{
+				status: http.StatusBadRequest,
+				err:    fmt.Errorf("%s requires %s", assumeRoleExternalIDHeader, assumeRoleARNHeader),
+			}
+		}
+		return nil, nil
+	}
+	if !isRoleAllowed(arn, p.AllowedRoleARNs) {
+		loggerFrom(req.Context()).WithField("role", arn).Warn("rejecting request for a role which is not allowed")
+		return nil, &statusError{
+			status: http.StatusForbidden,
+			err:    fmt.Errorf("role is not allowed: %s", arn),
+		}
+	}
+
+	// Credentials refresh themselves, each role is only assumed again once
+	// they expire
+	key := arn + "\x00" + externalID
+	signer, ok := p.roleSigners.get(key)
+	if !ok {
+		if allowed, wait := p.roleSigners.allowAssume(arn); !allowed {
+			return nil, &statusError{
+				status: http.StatusTooManyRequests,
+				err:    fmt.Errorf("role %s was assumed too often, retry in %s", arn, wait.Round(time.Second)),
+			}
+		}
+		signer = v4.NewSigner(p.AssumeRoleCredentials(arn, externalID))
+	}
+	// Failed assumptions are not kept, the next request assumes the role
+	// again within the rate limit instead of on every request
+	if _, err := signer.Credentials.Get(); err != nil {
+		p.roleSigners.remove(key)
+		return nil, fmt.Errorf("unable to assume role %s: %w", arn, err)
+	}
+	if !ok {
+		p.roleSigners.add(key, signer)
+	}
+	return signer, nil
+}
+
+// Bounds of the assumed role signers, the external IDs of which clients
+// choose.
+const (
+	maxRoleSigners  = 1024
+	roleAssumeRate  = 1.0
+	roleAssumeBurst = 10
+)
+
+// roleSignerCache caches the signers of assumed roles, evicting the least
+// recently used ones past maxRoleSigners, and rate limits how often each
+// role is assumed.
+type roleSignerCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	assumes *RateLimiter
+}
+
+type roleSignerEntry struct {
+	key    string
+	signer *v4.Signer
+}
+
+func (c *roleSignerCache) init() {
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.lru = list.New()
+		c.assumes = NewRateLimiter(roleAssumeRate, roleAssumeBurst)
+	}
+}
+
+func (c *roleSignerCache) get(key string) (*v4.Signer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*roleSignerEntry).signer, true
+}
+
+func (c *roleSignerCache) add(key string, signer *v4.Signer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&roleSignerEntry{key: key, signer: signer})
+	for c.lru.Len() > maxRoleSigners {
+		c.removeLocked(c.lru.Back().Value.(*roleSignerEntry).key)
+	}
+}
+
+func (c *roleSignerCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	c.removeLocked(key)
+}
+
+func (c *roleSignerCache) removeLocked(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// allowAssume reports whether arn may be assumed now, and otherwise how long
+// until it may.
+func (c *roleSignerCache) allowAssume(arn string) (bool, time.Duration) {
+	c.mu.Lock()
+	c.init()
+	assumes := c.assumes
+	c.mu.Unlock()
+	return assumes.Allow(arn)
+}
+
+// isRoleAllowed reports whether arn matches one of the allowed patterns,
+// which may contain wildcards.
+func isRoleAllowed(arn string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, arn); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Do_AssumeRoleHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		arn            string
+		externalID     string
+		wantErr        error
+		wantAccess     string
+		wantExternalID string
+	}{
+		{name: "signs with the default credentials without a role", wantAccess: "Credential=AKIDdefault1/"},
+		{
+			name:       "signs as allowed roles",
+			arn:        "arn:aws:iam::123456789012:role/app-reader",
+			wantAccess: "Credential=AKIDapp-reader1/",
+		},
+		{
+			name:           "assumes roles with the external ID",
+			arn:            "arn:aws:iam::123456789012:role/app-reader",
+			externalID:     "tenant-42",
+			wantAccess:     "Credential=AKIDapp-reader1/",
+			wantExternalID: "tenant-42",
+		},
+		{
+			name:    "rejects roles which are not allowed",
+			arn:     "arn:aws:iam::123456789012:role/admin",
+			wantErr: &statusError{status: http.StatusForbidden, err: fmt.Errorf("role is not allowed: arn:aws:iam::123456789012:role/admin")},
+		},
+		{
+			name:       "rejects external IDs without a role",
+			externalID: "tenant-42",
+			wantErr:    &statusError{status: http.StatusBadRequest, err: fmt.Errorf("X-Assume-Role-External-Id requires X-Assume-Role-Arn")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var externalID string
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewCredentials(&tenantProvider{tenant: "default"})),
+				Client: client,
+				AssumeRoleCredentials: func(arn, id string) *credentials.Credentials {
+					externalID = id
+					return credentials.NewCredentials(&tenantProvider{tenant: strings.TrimPrefix(arn, "arn:aws:iam::123456789012:role/")})
+				},
+				AllowedRoleARNs: []string{"arn:aws:iam::123456789012:role/app-*"},
+			}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.us-west-2.amazonaws.com/", nil)
+			if tt.arn != "" {
+				request.Header.Set("X-Assume-Role-Arn", tt.arn)
+			}
+			if tt.externalID != "" {
+				request.Header.Set("X-Assume-Role-External-Id", tt.externalID)
+			}
+			_, err := proxyClient.Do(request)
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr != nil {
+				assert.Nil(t, client.Request)
+				return
+			}
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantAccess)
+			assert.Equal(t, tt.wantExternalID, externalID)
+			assert.Empty(t, client.Request.Header.Values("X-Assume-Role-Arn"))
+			assert.Empty(t, client.Request.Header.Values("X-Assume-Role-External-Id"))
+		})
+	}
+}
+
+func TestProxyClient_Do_CachesAssumedRoles(t *testing.T) {
+	assumed := map[string]int{}
+	providers := map[string]*tenantProvider{}
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+		AssumeRoleCredentials: func(arn, externalID string) *credentials.Credentials {
+			assumed[arn+"/"+externalID]++
+			providers[arn+"/"+externalID] = &tenantProvider{tenant: externalID}
+			return credentials.NewCredentials(providers[arn+"/"+externalID])
+		},
+		AllowedRoleARNs: []string{"arn:aws:iam::123456789012:role/app"},
+	}
+
+	send := func(externalID string) string {
+		request, _ := http.NewRequest(http.MethodGet, "http://sqs.us-west-2.amazonaws.com/", nil)
+		request.Header.Set("X-Assume-Role-Arn", "arn:aws:iam::123456789012:role/app")
+		request.Header.Set("X-Assume-Role-External-Id", externalID)
+		_, err := proxyClient.Do(request)
+		assert.Nil(t, err)
+		return client.Request.Header.Get("Authorization")
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Contains(t, send("a"), "Credential=AKIDa1/")
+	}
+	// Each external ID is a session of its own
+	assert.Contains(t, send("b"), "Credential=AKIDb1/")
+	assert.Equal(t, map[string]int{"arn:aws:iam::123456789012:role/app/a": 1, "arn:aws:iam::123456789012:role/app/b": 1}, assumed)
+	assert.Equal(t, 1, providers["arn:aws:iam::123456789012:role/app/a"].retrievals)
+}
+
+// failingProvider never retrieves credentials.
+type failingProvider struct{}
+
+func (failingProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{}, fmt.Errorf("AccessDenied")
+}
+
+func (failingProvider) IsExpired() bool {
+	return true
+}
+
+func TestProxyClient_Do_AssumeRoleFailures(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	assumed := 0
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+		AssumeRoleCredentials: func(arn, externalID string) *credentials.Credentials {
+			assumed++
+			return credentials.NewCredentials(failingProvider{})
+		},
+		AllowedRoleARNs: []string{"arn:aws:iam::123456789012:role/app"},
+	}
+	proxyClient.roleSigners.init()
+	proxyClient.roleSigners.assumes.now = func() time.Time { return now }
+
+	send := func(externalID string) error {
+		request, _ := http.NewRequest(http.MethodGet, "http://sqs.us-west-2.amazonaws.com/", nil)
+		request.Header.Set("X-Assume-Role-Arn", "arn:aws:iam::123456789012:role/app")
+		request.Header.Set("X-Assume-Role-External-Id", externalID)
+		_, err := proxyClient.Do(request)
+		return err
+	}
+
+	// Failed assumptions are not cached, and retried within the rate limit
+	// whatever the external ID
+	for i := 0; i < roleAssumeBurst; i++ {
+		err := send(fmt.Sprint(i))
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusBadGateway, errorStatus(err))
+	}
+	assert.Equal(t, roleAssumeBurst, assumed)
+	assert.Empty(t, proxyClient.roleSigners.entries)
+
+	err := send("again")
+	assert.Equal(t, http.StatusTooManyRequests, errorStatus(err))
+	assert.Equal(t, roleAssumeBurst, assumed)
+	assert.Nil(t, client.Request)
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusBadGateway, errorStatus(send("again")))
+	assert.Equal(t, roleAssumeBurst+1, assumed)
+}
+
+func TestRoleSignerCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := &roleSignerCache{}
+	for i := 0; i < maxRoleSigners; i++ {
+		c.add(fmt.Sprint(i), &v4.Signer{})
+	}
+	// 0 was used recently, 1 is the least recently used
+	_, ok := c.get("0")
+	assert.True(t, ok)
+	c.add("new", &v4.Signer{})
+
+	assert.Equal(t, maxRoleSigners, c.lru.Len())
+	_, ok = c.get("0")
+	assert.True(t, ok)
+	_, ok = c.get("1")
+	assert.False(t, ok)
+	_, ok = c.get("new")
+	assert.True(t, ok)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditEvent is the record delivered to the audit webhook for every proxied
+// request. It never contains credentials or bodies.
+type AuditEvent struct {
+	Time     time.Time `json:"timestamp"`
+	ClientIP string    `json:"client_ip"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Service  string    `json:"service,omitempty"`
+	Region   string    `json:"region,omitempty"`
+	Status   int       `json:"status"`
+	// RequestBytes and ResponseBytes are the body sizes, for data transfer
+	// estimates.
+	RequestBytes  int64 `json:"request_bytes"`
+	ResponseBytes int64 `json:"response_bytes"`
+}
+
+// AuditWebhook POSTs audit events as JSON to a webhook in the background.
+// Delivery is best-effort: when the buffer is full events are dropped rather
+// than delaying requests.
+type AuditWebhook struct {
+	URL    string
+	Client Client
+
+	events   chan AuditEvent
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	dropped  uint64
+	failed   uint64
+}
+
+func newAuditEvent(r *http.Request, info *requestInfo, status int) AuditEvent {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	e := AuditEvent{
+		Time:          time.Now().UTC(),
+		ClientIP:      clientIP,
+		Method:        r.Method,
+		Service:       info.Service,
+		Region:        info.Region,
+		Status:        status,
+		RequestBytes:  info.RequestBytes,
+		ResponseBytes: info.ResponseBytes,
+	}
+	if r.URL != nil {
+		e.Path = r.URL.Path
+	}
+	return e
+}
+
+// NewAuditWebhook returns an AuditWebhook buffering up to bufferSize events
+// and starts delivering them.
+func NewAuditWebhook(url string, client Client, bufferSize int) *AuditWebhook {
+	a := &AuditWebhook{
+		URL:    url,
+		Client: client,
+		events: make(chan AuditEvent, bufferSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Close delivers the events queued so far, waiting for them until ctx is
+// done. Events sent afterwards are not delivered.
+func (a *AuditWebhook) Close(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send queues e for delivery without blocking.
+func (a *AuditWebhook) Send(e AuditEvent) {
+	select {
+	case a.events <- e:
+	default:
+		if atomic.AddUint64(&a.dropped, 1) == 1 {
+			log.Warn("audit buffer is full, dropping audit events")
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (a *AuditWebhook) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Failed returns the number of events which could not be delivered.
+func (a *AuditWebhook) Failed() uint64 {
+	return atomic.LoadUint64(&a.failed)
+}
+
+func (a *AuditWebhook) run() {
+	defer close(a.done)
+	send := func(e AuditEvent) {
+		if err := a.deliver(e); err != nil {
+			atomic.AddUint64(&a.failed, 1)
+			log.WithError(err).Error("unable to deliver audit event")
+		}
+	}
+	for {
+		select {
+		case e := <-a.events:
+			send(e)
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.events:
+					send(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *AuditWebhook) deliver(e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook responded with %s", resp.Status)
+	}
+	return nil
+}
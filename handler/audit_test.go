@@ -0,0 +1,180 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signingProxyClient records a signing decision like ProxyClient.Do does.
+type signingProxyClient struct {
+	mockProxyClient
+	service string
+	region  string
+}
+
+func (m *signingProxyClient) Do(req *http.Request) (*http.Response, error) {
+	info := requestInfoFrom(req.Context())
+	info.Service = m.service
+	info.Region = m.region
+	if req.Body != nil {
+		ioutil.ReadAll(req.Body)
+	}
+	return m.mockProxyClient.Do(req)
+}
+
+// blockingClient blocks every request until release is closed.
+type blockingClient struct {
+	release chan struct{}
+}
+
+func (b *blockingClient) Do(req *http.Request) (*http.Response, error) {
+	<-b.release
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}, nil
+}
+
+func TestHandler_ServeHTTP_SendsAuditEvent(t *testing.T) {
+	received := make(chan []byte, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- b
+	}))
+	defer webhook.Close()
+
+	h := &Handler{
+		ProxyClient: &signingProxyClient{
+			mockProxyClient: mockProxyClient{
+				Response: &http.Response{
+					StatusCode: http.StatusNotFound,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(bytes.NewBufferString("not found")),
+				},
+			},
+			service: "s3",
+			region:  "eu-west-1",
+		},
+		AuditWebhook: NewAuditWebhook(webhook.URL, webhook.Client(), 10),
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "http://localhost:8080/bucket/key?secret=query", strings.NewReader("secret body"))
+	request.RemoteAddr = "10.0.0.1:43210"
+	request.Header.Set("Authorization", "secret credentials")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	select {
+	case b := <-received:
+		var event AuditEvent
+		assert.Nil(t, json.Unmarshal(b, &event))
+		assert.WithinDuration(t, time.Now(), event.Time, time.Minute)
+		assert.Equal(t, AuditEvent{
+			Time:          event.Time,
+			ClientIP:      "10.0.0.1",
+			Method:        http.MethodPut,
+			Path:          "/bucket/key",
+			Service:       "s3",
+			Region:        "eu-west-1",
+			Status:        http.StatusNotFound,
+			RequestBytes:  int64(len("secret body")),
+			ResponseBytes: int64(len("not found")),
+		}, event)
+		assert.NotContains(t, string(b), "secret")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit event received")
+	}
+}
+
+func TestAuditWebhook_Send(t *testing.T) {
+	t.Run("drops events instead of blocking when the buffer is full", func(t *testing.T) {
+		client := &blockingClient{release: make(chan struct{})}
+		defer close(client.release)
+		a := NewAuditWebhook("http://audit.local", client, 1)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				a.Send(AuditEvent{Method: http.MethodGet})
+			}
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Send blocked on a slow webhook")
+		}
+		// At most one event is being delivered and one is buffered.
+		assert.True(t, a.Dropped() >= 3, a.Dropped())
+	})
+
+	t.Run("counts failed deliveries", func(t *testing.T) {
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer webhook.Close()
+		a := NewAuditWebhook(webhook.URL, webhook.Client(), 1)
+
+		a.Send(AuditEvent{Method: http.MethodGet})
+
+		for deadline := time.Now().Add(5 * time.Second); a.Failed() == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, uint64(1), a.Failed())
+		assert.Equal(t, uint64(0), a.Dropped())
+	})
+}
+
+func TestAuditWebhook_Close(t *testing.T) {
+	t.Run("delivers the queued events", func(t *testing.T) {
+		var delivered int32
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&delivered, 1)
+		}))
+		defer webhook.Close()
+		a := NewAuditWebhook(webhook.URL, webhook.Client(), 10)
+
+		for i := 0; i < 3; i++ {
+			a.Send(AuditEvent{Method: http.MethodGet})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, a.Close(ctx))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&delivered))
+	})
+
+	t.Run("gives up once the context is done", func(t *testing.T) {
+		client := &blockingClient{release: make(chan struct{})}
+		defer close(client.release)
+		a := NewAuditWebhook("http://audit.local", client, 1)
+
+		a.Send(AuditEvent{Method: http.MethodGet})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, a.Close(ctx))
+	})
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Authenticator decides whether a request may be proxied, before it is
+// signed with the proxy's credentials.
+type Authenticator interface {
+	// Authenticate returns nil if r may be proxied, otherwise a statusError
+	// with the status to reject it with. It may remove the credentials it
+	// checked from r so they are not forwarded, and record the identity of
+	// the caller in the requestInfo of r.
+	Authenticate(r *http.Request) error
+}
+
+// APIKeyAuth only lets through requests carrying one of Keys in Header,
+// which is not forwarded. The caller is identified by a hash prefix of its
+// key, never the key itself.
+type APIKeyAuth struct {
+	Header string
+	Keys   []string
+}
+
+func (a *APIKeyAuth) Authenticate(r *http.Request) error {
+	key := r.Header.Get(a.Header)
+	r.Header.Del(a.Header)
+	if key == "" {
+		return &statusError{status: http.StatusUnauthorized, err: fmt.Errorf("missing API key in %s", http.CanonicalHeaderKey(a.Header))}
+	}
+	for _, k := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			sum := sha256.Sum256([]byte(key))
+			requestInfoFrom(r.Context()).Identity = "api-key:" + hex.EncodeToString(sum[:4])
+			return nil
+		}
+	}
+	return &statusError{status: http.StatusUnauthorized, err: errors.New("invalid API key")}
+}
+
+// CIDRAuth only lets through requests from clients connecting from an
+// address in one of Allowed. Forwarding headers such as X-Forwarded-For are
+// not trusted.
+type CIDRAuth struct {
+	Allowed []*net.IPNet
+}
+
+func (a *CIDRAuth) Authenticate(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range a.Allowed {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return &statusError{status: http.StatusForbidden, err: fmt.Errorf("client address is not allowed: %s", host)}
+}
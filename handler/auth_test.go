@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyAuth_Authenticate(t *testing.T) {
+	auth := &APIKeyAuth{Header: "X-Api-Key", Keys: []string{"first", "second"}}
+
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+	}{
+		{name: "known key", key: "second"},
+		{name: "missing key", wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", key: "third", wantStatus: http.StatusUnauthorized},
+		{name: "prefix of a key", key: "firs", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &requestInfo{}
+			r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(withRequestInfo(context.Background(), info))
+			if tt.key != "" {
+				r.Header.Set("X-Api-Key", tt.key)
+			}
+
+			err := auth.Authenticate(r)
+
+			if tt.wantStatus == 0 {
+				assert.Nil(t, err)
+				// The first bytes of the SHA-256 of second
+				assert.Equal(t, "api-key:16367aac", info.Identity)
+			} else {
+				assert.Empty(t, info.Identity)
+				assert.Equal(t, tt.wantStatus, errorStatus(err))
+			}
+			// The key is never forwarded
+			assert.Empty(t, r.Header.Get("X-Api-Key"))
+		})
+	}
+}
+
+func TestCIDRAuth_Authenticate(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, local, _ := net.ParseCIDR("::1/128")
+	auth := &CIDRAuth{Allowed: []*net.IPNet{private, local}}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		wantStatus int
+	}{
+		{remoteAddr: "10.1.2.3:5000"},
+		{remoteAddr: "[::1]:5000"},
+		{remoteAddr: "192.168.1.1:5000", wantStatus: http.StatusForbidden},
+		{remoteAddr: "192.168.1.1:5000", forwarded: "10.1.2.3", wantStatus: http.StatusForbidden},
+		{remoteAddr: "not an address", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			err := auth.Authenticate(r)
+
+			if tt.wantStatus == 0 {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tt.wantStatus, errorStatus(err))
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_Authenticators(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		key        string
+		wantStatus int
+	}{
+		{name: "authenticated", remoteAddr: "10.0.0.1:5000", key: "secret", wantStatus: http.StatusOK},
+		{name: "missing key", remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusUnauthorized},
+		{name: "outside the allowed addresses", remoteAddr: "192.0.2.1:5000", key: "secret", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}}
+			h := &Handler{
+				ProxyClient: client,
+				Authenticators: []Authenticator{
+					&CIDRAuth{Allowed: []*net.IPNet{private}},
+					&APIKeyAuth{Header: "X-Api-Key", Keys: []string{"secret"}},
+				},
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.key != "" {
+				r.Header.Set("X-Api-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, r)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Empty(t, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+
+	t.Run("health checks are not authenticated", func(t *testing.T) {
+		h := &Handler{Authenticators: []Authenticator{&APIKeyAuth{Header: "X-Api-Key", Keys: []string{"secret"}}}}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
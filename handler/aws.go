@@ -17,6 +17,10 @@ package handler
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/endpoints"
@@ -32,6 +36,11 @@ func init() {
 			for _, endpoint := range service.Endpoints() {
 				resolvedEndpoint, _ := endpoint.ResolveEndpoint()
 				host := strings.Replace(resolvedEndpoint.URL, "https://", "", 1)
+				if resolvedEndpoint.SigningName == "transcribestreaming" {
+					// Transcribe streaming signs for transcribe, set by its
+					// client rather than the endpoints
+					resolvedEndpoint.SigningName = "transcribe"
+				}
 				services[host] = resolvedEndpoint
 			}
 		}
@@ -49,11 +58,134 @@ func init() {
 	}
 }
 
+// lambdaFunctionURLHost matches Lambda function URL hosts,
+// <url-id>.lambda-url.<region>.on.aws, capturing the region.
+var lambdaFunctionURLHost = regexp.MustCompile(`^[a-z0-9]+\.lambda-url\.([a-z0-9-]+)\.on\.aws$`)
+
+// multiRegionAccessPointHost matches S3 Multi-Region Access Point hosts,
+// <alias>.accesspoint.s3-global.amazonaws.com, signed with SigV4A for all
+// regions.
+var multiRegionAccessPointHost = regexp.MustCompile(`^[a-z0-9.-]+\.accesspoint\.s3-global\.amazonaws\.com$`)
+
 func determineAWSServiceFromHost(host string) *endpoints.ResolvedEndpoint {
 	for endpoint, service := range services {
 		if host == endpoint {
 			return &service
 		}
 	}
+
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	if m := lambdaFunctionURLHost.FindStringSubmatch(hostname); m != nil {
+		return &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", host), SigningMethod: "v4", SigningRegion: m[1], SigningName: "lambda", PartitionID: "aws"}
+	}
+	if multiRegionAccessPointHost.MatchString(hostname) {
+		return &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", host), SigningMethod: "v4a", SigningRegion: "*", SigningName: "s3", PartitionID: "aws"}
+	}
+
 	return nil
 }
+
+// globalServiceHost matches hosts of global services, which carry no region,
+// <service>.amazonaws.com, capturing the service.
+var globalServiceHost = regexp.MustCompile(`^([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// determineGlobalServiceFromHost returns the global service host targets,
+// signed for region, or nil if host is not a global service host.
+func determineGlobalServiceFromHost(host, region string) *endpoints.ResolvedEndpoint {
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	if m := globalServiceHost.FindStringSubmatch(hostname); m != nil {
+		return &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", host), SigningMethod: "v4", SigningRegion: region, SigningName: m[1]}
+	}
+	return nil
+}
+
+// stripEndpointSuffix maps host under one of the custom DNS suffixes to the
+// AWS host it stands for, e.g. sqs.us-east-1.aws.corp.example.com or
+// sqs.us-east-1.amazonaws.com.corp to sqs.us-east-1.amazonaws.com. Other
+// hosts are returned unchanged.
+func stripEndpointSuffix(host string, suffixes []string) string {
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	for _, suffix := range suffixes {
+		suffix = "." + strings.Trim(strings.ToLower(suffix), ".")
+		if !strings.HasSuffix(hostname, suffix) || len(hostname) == len(suffix) {
+			continue
+		}
+		stripped := strings.TrimSuffix(hostname, suffix)
+		if strings.HasSuffix(stripped, ".amazonaws.com") || strings.HasSuffix(stripped, ".amazonaws.com.cn") || strings.HasSuffix(stripped, ".on.aws") {
+			return stripped
+		}
+		return stripped + ".amazonaws.com"
+	}
+	return host
+}
+
+// credentialScope is the scope of a SigV4 credential,
+// <key id>/<date>/<region>/<service>/aws4_request.
+type credentialScope struct {
+	AccessKeyID string
+	Date        string
+	Region      string
+	Service     string
+}
+
+// parseCredentialScope parses the value of a SigV4 Credential field.
+func parseCredentialScope(credential string) (credentialScope, bool) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[2] == "" || parts[3] == "" {
+		return credentialScope{}, false
+	}
+	return credentialScope{AccessKeyID: parts[0], Date: parts[1], Region: parts[2], Service: parts[3]}, true
+}
+
+// parseIncomingCredentialScope returns the credential scope of a request
+// already signed with SigV4, either through its Authorization header or a
+// presigned query string.
+func parseIncomingCredentialScope(req *http.Request) (credentialScope, bool) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			if credential := strings.TrimSpace(field); strings.HasPrefix(credential, "Credential=") {
+				return parseCredentialScope(strings.TrimPrefix(credential, "Credential="))
+			}
+		}
+		return credentialScope{}, false
+	}
+
+	if req.URL != nil {
+		if query := req.URL.Query(); query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+			return parseCredentialScope(query.Get("X-Amz-Credential"))
+		}
+	}
+	return credentialScope{}, false
+}
+
+// presignQueryParameters are the query parameters making up a SigV4 query
+// string signature.
+var presignQueryParameters = []string{
+	"X-Amz-Algorithm",
+	"X-Amz-Credential",
+	"X-Amz-Date",
+	"X-Amz-Expires",
+	"X-Amz-SignedHeaders",
+	"X-Amz-Signature",
+	"X-Amz-Security-Token",
+}
+
+func removePresignQueryParameters(u *url.URL) {
+	query := u.Query()
+	if query.Get("X-Amz-Signature") == "" {
+		return
+	}
+	for _, name := range presignQueryParameters {
+		query.Del(name)
+	}
+	u.RawQuery = query.Encode()
+}
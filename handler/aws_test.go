@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIncomingCredentialScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   credentialScope
+		wantOk bool
+	}{
+		{
+			name:   "parses the Authorization header",
+			header: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20201001/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=abcdef",
+			want:   credentialScope{AccessKeyID: "AKIDEXAMPLE", Date: "20201001", Region: "eu-west-1", Service: "s3"},
+			wantOk: true,
+		},
+		{
+			name:   "parses a presigned query string",
+			query:  "X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F20201001%2Fap-south-1%2Fexecute-api%2Faws4_request&X-Amz-Signature=abcdef",
+			want:   credentialScope{AccessKeyID: "AKIDEXAMPLE", Date: "20201001", Region: "ap-south-1", Service: "execute-api"},
+			wantOk: true,
+		},
+		{
+			name:   "ignores other authorization schemes",
+			header: "Bearer abcdef",
+		},
+		{
+			name:   "ignores malformed credential scopes",
+			header: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20201001/eu-west-1, SignedHeaders=host, Signature=abcdef",
+		},
+		{
+			name: "ignores unsigned requests",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{URL: &url.URL{RawQuery: tt.query}, Header: http.Header{}}
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			scope, ok := parseIncomingCredentialScope(req)
+
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, scope)
+		})
+	}
+}
+
+func TestDetermineAWSServiceFromHost_LambdaFunctionURL(t *testing.T) {
+	tests := []struct {
+		host   string
+		region string
+	}{
+		{host: "abcdefghijklmnopqrstuvwxyz012345.lambda-url.us-east-1.on.aws", region: "us-east-1"},
+		{host: "4vdkp3ez7hcggxq2hnrujdnnnm0ybpnb.lambda-url.eu-central-1.on.aws", region: "eu-central-1"},
+		{host: "4vdkp3ez7hcggxq2hnrujdnnnm0ybpnb.lambda-url.ap-southeast-2.on.aws:443", region: "ap-southeast-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			service := determineAWSServiceFromHost(tt.host)
+
+			assert.NotNil(t, service)
+			assert.Equal(t, "lambda", service.SigningName)
+			assert.Equal(t, tt.region, service.SigningRegion)
+			assert.Equal(t, "v4", service.SigningMethod)
+		})
+	}
+
+	assert.Nil(t, determineAWSServiceFromHost("lambda-url.us-east-1.on.aws"))
+	assert.Nil(t, determineAWSServiceFromHost("abc.lambda-url.us-east-1.on.aws.example.com"))
+}
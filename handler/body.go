@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// requestBody is a request body read from the client, held in memory or,
+// past the spill threshold, in a temporary file.
+type requestBody struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// bodySpill configures when request bodies are written to disk rather than
+// held in memory.
+type bodySpill struct {
+	// threshold is the size past which bodies are spilled, zero to never
+	// spill.
+	threshold int64
+	// dir is where the temporary files are created, the default temporary
+	// directory when empty.
+	dir string
+}
+
+// read reads r as a requestBody. Like ioutil.ReadAll, what was read is
+// returned along with any error; it must be closed either way.
+func (s bodySpill) read(r io.Reader) (*requestBody, error) {
+	if s.threshold <= 0 {
+		data, err := ioutil.ReadAll(r)
+		return &requestBody{data: data, size: int64(len(data))}, err
+	}
+
+	head, err := ioutil.ReadAll(io.LimitReader(r, s.threshold+1))
+	if err != nil || int64(len(head)) <= s.threshold {
+		return &requestBody{data: head, size: int64(len(head))}, err
+	}
+
+	file, err := ioutil.TempFile(s.dir, "aws-sigv4-proxy-body-")
+	if err != nil {
+		return &requestBody{}, err
+	}
+	body := &requestBody{file: file}
+	body.size, err = io.Copy(file, io.MultiReader(bytes.NewReader(head), r))
+	return body, err
+}
+
+// spilled reports whether the body is held in a temporary file.
+func (b *requestBody) spilled() bool {
+	return b.file != nil
+}
+
+// reader returns a new reader of the whole body.
+func (b *requestBody) reader() io.ReadSeeker {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// Close removes the temporary file of a spilled body.
+func (b *requestBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// closeWithBody closes a request body once the response to it is closed, as
+// the request body may be sent upstream until then.
+type closeWithBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (c *closeWithBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.body.Close()
+	return err
+}
+
+// limitedBody fails reads of a request body past max bytes with 413.
+type limitedBody struct {
+	io.ReadCloser
+	max       int64
+	remaining int64
+}
+
+func newLimitedBody(body io.ReadCloser, max int64) *limitedBody {
+	return &limitedBody{ReadCloser: body, max: max, remaining: max}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.tooLarge()
+	}
+	// Read one byte past the limit to tell a body of exactly max bytes from
+	// a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return &statusError{
+		status: http.StatusRequestEntityTooLarge,
+		err:    fmt.Errorf("request body exceeds the maximum of %d bytes", b.max),
+	}
+}
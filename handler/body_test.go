@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodySpill_read(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   int64
+		size        int
+		wantSpilled bool
+	}{
+		{name: "never spills without a threshold", size: 4096},
+		{name: "keeps bodies up to the threshold in memory", threshold: 1024, size: 1024},
+		{name: "spills bodies past the threshold", threshold: 1024, size: 1025, wantSpilled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			payload := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+
+			body, err := bodySpill{threshold: tt.threshold, dir: dir}.read(bytes.NewReader(payload))
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantSpilled, body.spilled())
+			assert.Equal(t, int64(tt.size), body.size)
+			files, _ := ioutil.ReadDir(dir)
+			assert.Equal(t, tt.wantSpilled, len(files) == 1)
+
+			// Every reader covers the whole body
+			for i := 0; i < 2; i++ {
+				read, _ := ioutil.ReadAll(body.reader())
+				assert.Equal(t, payload, read)
+			}
+
+			assert.Nil(t, body.Close())
+			files, _ = ioutil.ReadDir(dir)
+			assert.Len(t, files, 0)
+		})
+	}
+}
+
+func TestBodySpill_read_Fails(t *testing.T) {
+	dir := t.TempDir()
+
+	body, err := bodySpill{threshold: 4, dir: dir + string(os.PathSeparator) + "missing"}.read(bytes.NewReader([]byte("too large")))
+
+	assert.NotNil(t, err)
+	assert.Nil(t, body.Close())
+}
@@ -0,0 +1,531 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheStatusHeader tells clients whether their response came from the
+// cache.
+const cacheStatusHeader = "X-Sigv4Proxy-Cache"
+
+// cacheKeyHeaders are request headers responses are assumed to vary on,
+// besides those named in their Vary header.
+var cacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Range"}
+
+// uncachedRequestHeaders mark requests the cache never answers nor stores
+// the response of: conditional requests, and those of S3 objects encrypted
+// with a key of the client's.
+var uncachedRequestHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+	"X-Amz-Server-Side-Encryption-Customer-Key",
+}
+
+// cacheableStatuses are the statuses of the responses cached.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CacheStore holds the entries of a ResponseCache.
+type CacheStore interface {
+	// Get returns the value of key, false if it is missing or expired.
+	Get(key string) ([]byte, bool)
+	// Set stores value for key, for ttl.
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// ResponseCache answers GET and HEAD requests with the responses previously
+// received for them, for TTL, unless the upstream asked for them not to be
+// cached. Entries are keyed on the method, host and URI of the request, what
+// picks the credentials it is signed with, and the values of the headers the
+// response varies on. Requests with Cache-Control: no-cache, or carrying
+// BypassHeader, are sent upstream and refresh their entry.
+type ResponseCache struct {
+	Store CacheStore
+	TTL   time.Duration
+	// MaxEntrySize, when not zero, is the size of the largest body cached.
+	MaxEntrySize int64
+	BypassHeader string
+
+	hits     uint64
+	misses   uint64
+	bypasses uint64
+}
+
+// cachedResponse is the entry of a response.
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored time.Time   `json:"stored"`
+	// Service, Region and UpstreamHost are restored into the requestInfo of
+	// the requests the response answers.
+	Service      string `json:"service,omitempty"`
+	Region       string `json:"region,omitempty"`
+	UpstreamHost string `json:"upstream_host,omitempty"`
+}
+
+// Hits, Misses and Bypasses return the number of requests answered from the
+// cache, those sent upstream because their response was not cached, and
+// those sent upstream because they asked to bypass the cache.
+func (c *ResponseCache) Hits() uint64     { return atomic.LoadUint64(&c.hits) }
+func (c *ResponseCache) Misses() uint64   { return atomic.LoadUint64(&c.misses) }
+func (c *ResponseCache) Bypasses() uint64 { return atomic.LoadUint64(&c.bypasses) }
+
+// cacheable reports whether the response to req may come from the cache.
+func (c *ResponseCache) cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if upgradeProtocol(req.Header) != "" {
+		return false
+	}
+	for _, name := range uncachedRequestHeaders {
+		if _, ok := req.Header[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// bypass reports whether req asks for a fresh response.
+func (c *ResponseCache) bypass(req *http.Request) bool {
+	if c.BypassHeader != "" && req.Header.Get(c.BypassHeader) != "" {
+		return true
+	}
+	for _, directive := range cacheControlDirectives(req.Header) {
+		if directive == "no-cache" {
+			return true
+		}
+	}
+	return strings.EqualFold(req.Header.Get("Pragma"), "no-cache")
+}
+
+// do answers req from the cache, under key, or with send, storing its
+// response.
+func (c *ResponseCache) do(req *http.Request, key string, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	// The headers are those of the client, before send removes some
+	header := req.Header.Clone()
+	status := "BYPASS"
+	bypass := c.bypass(req)
+	if c.BypassHeader != "" {
+		req.Header.Del(c.BypassHeader)
+	}
+	if bypass {
+		atomic.AddUint64(&c.bypasses, 1)
+	} else if resp, ok := c.lookup(req, key, header); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return resp, nil
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+		status = "MISS"
+	}
+
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = c.store(req, key, header, resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(cacheStatusHeader, status)
+	return resp, nil
+}
+
+// lookup returns the cached response to req, if any.
+func (c *ResponseCache) lookup(req *http.Request, key string, header http.Header) (*http.Response, bool) {
+	vary, ok := c.Store.Get("vary " + key)
+	if !ok {
+		return nil, false
+	}
+	b, ok := c.Store.Get(variantKey(key, strings.Split(string(vary), ","), header))
+	if !ok {
+		return nil, false
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(b, &entry); err != nil {
+		loggerFrom(req.Context()).WithError(err).Warn("ignoring invalid cache entry")
+		return nil, false
+	}
+
+	info := requestInfoFrom(req.Context())
+	info.Service, info.Region, info.UpstreamHost = entry.Service, entry.Region, entry.UpstreamHost
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(entry.Status) + " " + http.StatusText(entry.Status),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	resp.Header.Set(cacheStatusHeader, "HIT")
+	return resp, true
+}
+
+// store caches resp, unless it may not be, returning it with a body that
+// can still be read.
+func (c *ResponseCache) store(req *http.Request, key string, header http.Header, resp *http.Response) (*http.Response, error) {
+	ttl := c.TTL
+	if !cacheableStatuses[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" {
+		return resp, nil
+	}
+	for _, directive := range cacheControlDirectives(resp.Header) {
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return resp, nil
+		case strings.HasPrefix(directive, "max-age=") || strings.HasPrefix(directive, "s-maxage="):
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err == nil && time.Duration(seconds)*time.Second < ttl {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	vary := append([]string(nil), cacheKeyHeaders...)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return resp, nil
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	if ttl <= 0 {
+		return resp, nil
+	}
+
+	// Bodies too large are relayed as they are read
+	var body []byte
+	if resp.Body != nil {
+		limit := c.MaxEntrySize
+		if limit <= 0 {
+			limit = 1<<63 - 1
+		} else {
+			limit++
+		}
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(resp.Body, limit)); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if c.MaxEntrySize > 0 && int64(len(body)) > c.MaxEntrySize {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	info := requestInfoFrom(req.Context())
+	entry, err := json.Marshal(cachedResponse{
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		Stored:       time.Now(),
+		Service:      info.Service,
+		Region:       info.Region,
+		UpstreamHost: info.UpstreamHost,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(vary)
+	c.Store.Set("vary "+key, []byte(strings.Join(vary, ",")), ttl)
+	c.Store.Set(variantKey(key, vary, header), entry, ttl)
+	return resp, nil
+}
+
+// variantKey returns the key of the entry of the variant of key with the
+// values in header of the vary headers.
+func variantKey(key string, vary []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// cacheControlDirectives returns the lower case directives of the
+// Cache-Control of h.
+func cacheControlDirectives(h http.Header) []string {
+	var directives []string
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if directive = strings.ToLower(strings.TrimSpace(directive)); directive != "" {
+				directives = append(directives, directive)
+			}
+		}
+	}
+	return directives
+}
+
+// cacheKey returns the key of the response to req, covering what selects the
+// credentials it is signed with, so responses are never shared by callers
+// signing as different principals.
+func (p *ProxyClient) cacheKey(req *http.Request) string {
+	parts := []string{req.Method, req.Host, req.URL.RequestURI(), requestInfoFrom(req.Context()).Identity}
+	for _, name := range []string{p.TenantHeader, p.SignWhenHeader, assumeRoleARNHeader, assumeRoleExternalIDHeader} {
+		if name != "" {
+			parts = append(parts, strings.Join(req.Header.Values(name), ", "))
+		}
+	}
+	if p.ForwardAuthorizationAs != "" {
+		parts = append(parts, strings.Join(req.Header.Values("Authorization"), ", "))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// MemoryCacheStore keeps cache entries in memory, evicting the least
+// recently used ones past MaxBytes.
+type MemoryCacheStore struct {
+	MaxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCacheStore returns an empty MemoryCacheStore holding up to
+// maxBytes of keys and values.
+func NewMemoryCacheStore(maxBytes int64) *MemoryCacheStore {
+	return &MemoryCacheStore{MaxBytes: maxBytes, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (s *MemoryCacheStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*memoryCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		s.remove(e)
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return entry.value, true
+}
+
+func (s *MemoryCacheStore) Set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+	size := int64(len(key) + len(value))
+	if size > s.MaxBytes {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&memoryCacheEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+	s.size += size
+	for s.size > s.MaxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *MemoryCacheStore) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*memoryCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= int64(len(entry.key) + len(entry.value))
+}
+
+// FileCacheStore keeps cache entries in files of Dir, named after the
+// SHA-256 of their key, e.g. to share them between proxies or keep them
+// across restarts. Expired entries are removed once read, or by Sweep along
+// with the least recently used ones past MaxBytes, unless zero.
+type FileCacheStore struct {
+	Dir      string
+	MaxBytes int64
+}
+
+// fileCacheTempMaxAge is how old temporary files left behind, e.g. by a
+// proxy killed while writing an entry, are before Sweep removes them.
+const fileCacheTempMaxAge = time.Hour
+
+func (s *FileCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:]))
+}
+
+// The files hold the expiry, in nanoseconds since the epoch, followed by
+// the value.
+func (s *FileCacheStore) Get(key string) ([]byte, bool) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if err != nil || len(b) < 8 {
+		return nil, false
+	}
+	now := time.Now()
+	if !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(b)))) {
+		os.Remove(s.path(key))
+		return nil, false
+	}
+	// The modification time tells Sweep when the entry was last used
+	os.Chtimes(s.path(key), now, now)
+	return b[8:], true
+}
+
+func (s *FileCacheStore) Set(key string, value []byte, ttl time.Duration) {
+	b := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ttl).UnixNano()))
+	b = append(b, value...)
+
+	// Readers never see a partially written file
+	f, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		log.WithError(err).Warn("unable to write cache entry")
+		return
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.WithError(err).Warn("unable to write cache entry")
+	}
+}
+
+// Run sweeps Dir every interval, forever.
+func (s *FileCacheStore) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Sweep()
+	}
+}
+
+// Sweep removes the expired entries of Dir, and old temporary files, then
+// the least recently used entries while they take more than MaxBytes.
+func (s *FileCacheStore) Sweep() {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		log.WithError(err).Warn("unable to sweep cache entries")
+		return
+	}
+
+	now := time.Now()
+	var entries []os.FileInfo
+	var size int64
+	for _, fi := range files {
+		path := filepath.Join(s.Dir, fi.Name())
+		switch {
+		case fi.IsDir():
+		case strings.HasPrefix(fi.Name(), ".tmp-"):
+			if now.Sub(fi.ModTime()) > fileCacheTempMaxAge {
+				os.Remove(path)
+			}
+		case !isFileCacheEntry(fi.Name()):
+		case fileCacheEntryExpired(path, now):
+			os.Remove(path)
+		default:
+			entries = append(entries, fi)
+			size += fi.Size()
+		}
+	}
+
+	if s.MaxBytes <= 0 || size <= s.MaxBytes {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, fi := range entries {
+		if size <= s.MaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.Dir, fi.Name())); err == nil || os.IsNotExist(err) {
+			size -= fi.Size()
+		}
+	}
+}
+
+// isFileCacheEntry reports whether name is that of an entry, the hex SHA-256
+// of its key.
+func isFileCacheEntry(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == sha256.Size
+}
+
+// fileCacheEntryExpired reports whether the entry of path expired at now,
+// unreadable ones being expired.
+func fileCacheEntryExpired(path string, now time.Time) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	defer f.Close()
+	var expiry [8]byte
+	if _, err := io.ReadFull(f, expiry[:]); err != nil {
+		return true
+	}
+	return !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(expiry[:]))))
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// versionedUpstream answers the nth request with the body vn, and Header.
+type versionedUpstream struct {
+	Status   int
+	Header   http.Header
+	Body     string
+	requests []*http.Request
+}
+
+func (u *versionedUpstream) Do(req *http.Request) (*http.Response, error) {
+	u.requests = append(u.requests, req)
+	status := u.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := u.Body
+	if body == "" {
+		body = fmt.Sprintf("v%d", len(u.requests))
+	}
+	return &http.Response{StatusCode: status, Header: u.Header.Clone(), Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func newCachingProxyClient(upstream Client, cache *ResponseCache) *ProxyClient {
+	if cache.Store == nil {
+		cache.Store = NewMemoryCacheStore(1 << 20)
+	}
+	if cache.TTL == 0 {
+		cache.TTL = time.Minute
+	}
+	return &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: upstream,
+		Cache:  cache,
+	}
+}
+
+// get sends a request through p, returning the cache status and body of its
+// response.
+func get(t *testing.T, p *ProxyClient, method, path string, header http.Header) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = "s3.eu-west-1.amazonaws.com"
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := p.Do(req.WithContext(withRequestInfo(context.Background(), &requestInfo{})))
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Body.Close())
+	return resp.Header.Get("X-Sigv4Proxy-Cache"), string(body)
+}
+
+func TestProxyClient_Do_Cache(t *testing.T) {
+	upstream := &versionedUpstream{Header: http.Header{"Content-Type": {"text/plain"}}}
+	cache := &ResponseCache{}
+	p := newCachingProxyClient(upstream, cache)
+
+	status, body := get(t, p, http.MethodGet, "/bucket/key", nil)
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, "v1", body)
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/key", nil)
+	req.Host = "s3.eu-west-1.amazonaws.com"
+	info := &requestInfo{}
+	resp, err := p.Do(req.WithContext(withRequestInfo(context.Background(), info)))
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "v1", string(b))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Sigv4Proxy-Cache"))
+	assert.Equal(t, "0", resp.Header.Get("Age"))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	// Hits are reported as signed for the service of the cached response
+	assert.Equal(t, "s3", info.Service)
+	assert.Equal(t, "eu-west-1", info.Region)
+	assert.Len(t, upstream.requests, 1)
+
+	// Other methods, URLs and variants have entries of their own
+	status, _ = get(t, p, http.MethodHead, "/bucket/key", nil)
+	assert.Equal(t, "MISS", status)
+	status, _ = get(t, p, http.MethodGet, "/bucket/key?versionId=1", nil)
+	assert.Equal(t, "MISS", status)
+	status, _ = get(t, p, http.MethodGet, "/bucket/key", http.Header{"Range": {"bytes=0-1"}})
+	assert.Equal(t, "MISS", status)
+	status, _ = get(t, p, http.MethodPost, "/bucket/key", nil)
+	assert.Equal(t, "", status)
+	assert.Len(t, upstream.requests, 5)
+
+	assert.Equal(t, uint64(1), cache.Hits())
+	assert.Equal(t, uint64(4), cache.Misses())
+
+	metrics := NewMetrics()
+	metrics.Cache = cache
+	var buf bytes.Buffer
+	metrics.write(&buf, false)
+	assert.Contains(t, buf.String(), "proxy_cache_requests_total{result=\"hit\"} 1\n")
+	assert.Contains(t, buf.String(), "proxy_cache_requests_total{result=\"miss\"} 4\n")
+	assert.Contains(t, buf.String(), "proxy_cache_requests_total{result=\"bypass\"} 0\n")
+}
+
+func TestProxyClient_Do_CacheBypass(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "no-cache", header: http.Header{"Cache-Control": {"max-age=0, no-cache"}}},
+		{name: "pragma", header: http.Header{"Pragma": {"no-cache"}}},
+		{name: "bypass header", header: http.Header{"X-Cache-Bypass": {"1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &versionedUpstream{}
+			cache := &ResponseCache{BypassHeader: "X-Cache-Bypass"}
+			p := newCachingProxyClient(upstream, cache)
+
+			get(t, p, http.MethodGet, "/bucket/key", nil)
+			status, body := get(t, p, http.MethodGet, "/bucket/key", nil)
+			assert.Equal(t, "HIT", status)
+			assert.Equal(t, "v1", body)
+
+			// A warm entry is bypassed, and refreshed
+			status, body = get(t, p, http.MethodGet, "/bucket/key", tt.header)
+			assert.Equal(t, "BYPASS", status)
+			assert.Equal(t, "v2", body)
+			assert.Len(t, upstream.requests, 2)
+			assert.Empty(t, upstream.requests[1].Header.Get("X-Cache-Bypass"))
+
+			status, body = get(t, p, http.MethodGet, "/bucket/key", nil)
+			assert.Equal(t, "HIT", status)
+			assert.Equal(t, "v2", body)
+			assert.Equal(t, uint64(1), cache.Bypasses())
+		})
+	}
+}
+
+func TestProxyClient_Do_CacheVary(t *testing.T) {
+	upstream := &versionedUpstream{Header: http.Header{"Vary": {"Accept-Language, X-Tenant"}}}
+	p := newCachingProxyClient(upstream, &ResponseCache{})
+
+	get(t, p, http.MethodGet, "/", http.Header{"Accept-Language": {"fr"}})
+	status, body := get(t, p, http.MethodGet, "/", http.Header{"Accept-Language": {"fr"}})
+	assert.Equal(t, "HIT", status)
+	assert.Equal(t, "v1", body)
+	status, body = get(t, p, http.MethodGet, "/", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, "v2", body)
+	status, _ = get(t, p, http.MethodGet, "/", http.Header{"Accept-Language": {"fr"}, "X-Tenant": {"a"}})
+	assert.Equal(t, "MISS", status)
+}
+
+func TestProxyClient_Do_CacheIdentity(t *testing.T) {
+	upstream := &versionedUpstream{}
+	p := newCachingProxyClient(upstream, &ResponseCache{})
+	p.TenantHeader = "X-Tenant"
+	p.TenantSigners = map[string]*v4.Signer{"a": p.Signer, "b": p.Signer}
+
+	do := func(tenant, identity string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "s3.eu-west-1.amazonaws.com"
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := p.Do(req.WithContext(withRequestInfo(context.Background(), &requestInfo{Identity: identity})))
+		assert.Nil(t, err)
+		return resp.Header.Get("X-Sigv4Proxy-Cache")
+	}
+
+	assert.Equal(t, "MISS", do("a", "alice"))
+	assert.Equal(t, "HIT", do("a", "alice"))
+	assert.Equal(t, "MISS", do("b", "alice"))
+	assert.Equal(t, "MISS", do("a", "bob"))
+}
+
+func TestProxyClient_Do_CacheNotStored(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *versionedUpstream
+		header   http.Header
+		status   string
+	}{
+		{name: "no-store", upstream: &versionedUpstream{Header: http.Header{"Cache-Control": {"no-store"}}}, status: "MISS"},
+		{name: "private", upstream: &versionedUpstream{Header: http.Header{"Cache-Control": {"Private"}}}, status: "MISS"},
+		{name: "max-age=0", upstream: &versionedUpstream{Header: http.Header{"Cache-Control": {"max-age=0"}}}, status: "MISS"},
+		{name: "vary on anything", upstream: &versionedUpstream{Header: http.Header{"Vary": {"*"}}}, status: "MISS"},
+		{name: "cookie", upstream: &versionedUpstream{Header: http.Header{"Set-Cookie": {"a=b"}}}, status: "MISS"},
+		{name: "server error", upstream: &versionedUpstream{Status: http.StatusInternalServerError}, status: "MISS"},
+		{name: "too large", upstream: &versionedUpstream{Body: strings.Repeat("x", 11)}, status: "MISS"},
+		{name: "conditional request", upstream: &versionedUpstream{}, header: http.Header{"If-None-Match": {`"etag"`}}},
+		{name: "customer key", upstream: &versionedUpstream{}, header: http.Header{"X-Amz-Server-Side-Encryption-Customer-Key": {"key"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newCachingProxyClient(tt.upstream, &ResponseCache{MaxEntrySize: 10})
+
+			first, body := get(t, p, http.MethodGet, "/bucket/key", tt.header)
+			if tt.upstream.Body != "" {
+				// Too large bodies are still relayed in full
+				assert.Equal(t, tt.upstream.Body, body)
+			}
+			second, _ := get(t, p, http.MethodGet, "/bucket/key", tt.header)
+			assert.Equal(t, tt.status, first)
+			assert.Equal(t, tt.status, second)
+			assert.Len(t, tt.upstream.requests, 2)
+		})
+	}
+}
+
+func TestProxyClient_Do_CacheMaxAge(t *testing.T) {
+	store := NewMemoryCacheStore(1 << 20)
+	upstream := &versionedUpstream{Header: http.Header{"Cache-Control": {"public, max-age=30"}}}
+	p := newCachingProxyClient(upstream, &ResponseCache{Store: store, TTL: time.Hour})
+
+	get(t, p, http.MethodGet, "/", nil)
+	for _, e := range store.entries {
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), e.Value.(*memoryCacheEntry).expires, 5*time.Second)
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	s := NewMemoryCacheStore(10)
+
+	s.Set("a", []byte("1234"), time.Minute)
+	s.Set("b", []byte("1234"), time.Minute)
+	v, ok := s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1234", string(v))
+
+	// b is the least recently used
+	s.Set("c", []byte("1234"), time.Minute)
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+	_, ok = s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), s.size)
+
+	// Values too large are not kept
+	s.Set("d", []byte("0123456789"), time.Minute)
+	_, ok = s.Get("d")
+	assert.False(t, ok)
+
+	s.Set("a", []byte("1"), -time.Second)
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(5), s.size)
+}
+
+func TestFileCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := &FileCacheStore{Dir: dir}
+
+	_, ok := s.Get("a")
+	assert.False(t, ok)
+
+	s.Set("a", []byte("value"), time.Minute)
+	v, ok := s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(v))
+
+	s.Set("a", []byte("expired"), -time.Second)
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFileCacheStore_Sweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// Each entry takes 8 bytes of expiry and 10 of value
+	s := &FileCacheStore{Dir: dir, MaxBytes: 40}
+
+	s.Set("expired", []byte("0123456789"), -time.Second)
+	s.Set("old", []byte("0123456789"), time.Minute)
+	s.Set("used", []byte("0123456789"), time.Minute)
+	s.Set("new", []byte("0123456789"), time.Minute)
+	past := time.Now().Add(-time.Hour)
+	for i, key := range []string{"old", "used", "new"} {
+		modified := past.Add(time.Duration(i) * time.Minute)
+		assert.Nil(t, os.Chtimes(s.path(key), modified, modified))
+	}
+	_, ok := s.Get("used")
+	assert.True(t, ok)
+
+	// Temporary files left behind are removed once old, other files are kept
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".tmp-left"), nil, 0600))
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, ".tmp-left"), past, past))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".tmp-writing"), nil, 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not an entry"), 0600))
+
+	s.Sweep()
+
+	var names []string
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	assert.ElementsMatch(t, []string{".tmp-writing", "README", filepath.Base(s.path("used")), filepath.Base(s.path("new"))}, names)
+}
+
+func TestProxyClient_Do_CacheFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := &versionedUpstream{}
+	get(t, newCachingProxyClient(upstream, &ResponseCache{Store: &FileCacheStore{Dir: dir}}), http.MethodGet, "/", nil)
+
+	// Another proxy sharing the directory
+	status, body := get(t, newCachingProxyClient(upstream, &ResponseCache{Store: &FileCacheStore{Dir: dir}}), http.MethodGet, "/", nil)
+	assert.Equal(t, "HIT", status)
+	assert.Equal(t, "v1", body)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// streamingPayload is the payload hash of requests whose aws-chunked body is
+// signed chunk by chunk, unsignedPayload that of requests whose body is not
+// signed at all.
+const (
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+// streamingChunkSize is the size of the chunks of aws-chunked bodies, bar
+// the last. S3 requires at least 8 KiB.
+const streamingChunkSize = 64 * 1024
+
+// bodyStreaming is how a request body is sent upstream.
+type bodyStreaming int
+
+const (
+	// bodyBuffered bodies are read in full to compute their payload hash.
+	bodyBuffered bodyStreaming = iota
+	// bodyChunkSigned bodies are sent as aws-chunked, each chunk signed as it
+	// is relayed.
+	bodyChunkSigned
+	// bodyUnsigned bodies are relayed as they are received, unsigned.
+	bodyUnsigned
+)
+
+// bodyStreaming returns how the body of req is sent when StreamingSigning is
+// set: S3 bodies of a known length are chunk signed, others, or those of
+// requests not signed with SigV4 headers, are relayed unsigned.
+func (p *ProxyClient) bodyStreaming(req *http.Request, service *endpoints.ResolvedEndpoint) bodyStreaming {
+	if !p.StreamingSigning || service.SigningName != "s3" || req.Method == http.MethodHead ||
+		req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return bodyBuffered
+	}
+	if req.ContentLength > 0 && (service.SigningMethod == "v4" || service.SigningMethod == "s3v4") {
+		return bodyChunkSigned
+	}
+	return bodyUnsigned
+}
+
+// setStreamingHeaders sets the headers, signed, announcing how the body of a
+// request of length decoded bytes, whose client sent clientHeader, is
+// streamed.
+func setStreamingHeaders(h, clientHeader http.Header, streaming bodyStreaming, decoded int64) {
+	switch streaming {
+	case bodyChunkSigned:
+		h.Set("X-Amz-Content-Sha256", streamingPayload)
+		h.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(decoded, 10))
+		encoding := "aws-chunked"
+		if ce := clientHeader.Get("Content-Encoding"); ce != "" {
+			encoding += "," + ce
+		}
+		h.Set("Content-Encoding", encoding)
+	case bodyUnsigned:
+		h.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+}
+
+// chunkedLength returns the length of the aws-chunked encoding of a body of
+// decoded bytes.
+func chunkedLength(decoded int64) int64 {
+	chunk := func(size int64) int64 {
+		return int64(len(strconv.FormatInt(size, 16))+len(";chunk-signature=")+64+2) + size + 2
+	}
+	full := decoded / streamingChunkSize
+	length := full * chunk(streamingChunkSize)
+	if rest := decoded % streamingChunkSize; rest > 0 {
+		length += chunk(rest)
+	}
+	return length + chunk(0)
+}
+
+// staticSigner returns a copy of signer signing with the credentials it holds
+// now, so the chunks or messages of a streamed body are signed with the key
+// of the seed signature even if the credentials are refreshed meanwhile.
+func staticSigner(signer *v4.Signer) (*v4.Signer, error) {
+	if signer.Credentials == credentials.AnonymousCredentials {
+		return signer, nil
+	}
+	v, err := signer.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	static := *signer
+	static.Credentials = credentials.NewCredentials(heldProvider{v})
+	return &static, nil
+}
+
+// heldProvider provides credentials retrieved before, which never expire.
+// Unlike credentials.StaticProvider, it accepts empty keys.
+type heldProvider struct {
+	value credentials.Value
+}
+
+func (p heldProvider) Retrieve() (credentials.Value, error) {
+	return p.value, nil
+}
+
+func (p heldProvider) IsExpired() bool {
+	return false
+}
+
+// attachChunkedBody sets the body of proxyReq, signed at signTime with the
+// streaming payload hash, to the aws-chunked encoding of the size bytes of
+// body, each chunk signed as it is received.
+func (p *ProxyClient) attachChunkedBody(proxyReq *http.Request, body io.Reader, size int64, signer *v4.Signer, service *endpoints.ResolvedEndpoint, signTime time.Time) error {
+	seed, err := requestSignature(proxyReq)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go signChunks(pw, body, size, v4.NewStreamSigner(service.SigningRegion, service.SigningName, seed, signer.Credentials), signTime)
+
+	proxyReq.Body = pr
+	proxyReq.ContentLength = chunkedLength(size)
+	proxyReq.GetBody = nil
+	return nil
+}
+
+// signChunks writes the size bytes read from r to w as aws-chunked, each
+// chunk signed with a signature chaining from the previous one, then ends
+// the body with a signed empty chunk. It returns once r or w fails.
+func signChunks(w *io.PipeWriter, r io.Reader, size int64, signer *v4.StreamSigner, signTime time.Time) {
+	buf := make([]byte, streamingChunkSize)
+	for remaining := size; ; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			w.CloseWithError(fmt.Errorf("unable to read request body: %w", err))
+			return
+		}
+		remaining -= n
+
+		// The chunk signature is the event stream signature of a message
+		// without headers
+		signature, err := signer.GetSignature(nil, buf[:n], signTime)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		header := strconv.FormatInt(n, 16) + ";chunk-signature=" + hex.EncodeToString(signature) + "\r\n"
+		if _, err := io.WriteString(w, header); err != nil {
+			return
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		if _, err := io.WriteString(w, "\r\n"); err != nil {
+			return
+		}
+		if n == 0 {
+			w.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, wildcardQ := "", ""
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := part, "1"
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding = part[:i]
+			for _, param := range strings.Split(part[i+1:], ";") {
+				if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+					q = strings.TrimPrefix(param, "q=")
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+
+	if gzipQ == "" {
+		gzipQ = wildcardQ
+	}
+	if gzipQ == "" {
+		return false
+	}
+	q, err := strconv.ParseFloat(gzipQ, 64)
+	return err == nil && q > 0
+}
+
+// shouldCompress reports whether the buffered response to r, of size bytes,
+// is gzipped before being sent to the client.
+func (h *Handler) shouldCompress(r *http.Request, resp *http.Response, size int) bool {
+	if !h.CompressResponses || size < h.CompressMinSize {
+		return false
+	}
+	// Already compressed, or a partial/empty response
+	if resp.Header.Get("Content-Encoding") != "" || resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return acceptsGzip(r.Header.Get("Accept-Encoding"))
+}
+
+// gzipBody compresses body, updating header to describe the compressed body.
+func gzipBody(header http.Header, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	header.Add("Vary", "Accept-Encoding")
+	// The upstream's strong validator describes the uncompressed body
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipRequestServices are the signing names of services accepting gzip
+// encoded request bodies.
+var gzipRequestServices = map[string]bool{
+	"monitoring": true, // CloudWatch PutMetricData
+	"es":         true,
+}
+
+// shouldCompressRequest reports whether the body of req, targeting service,
+// should be gzipped before it is signed.
+func (p *ProxyClient) shouldCompressRequest(req *http.Request, body *requestBody, service *endpoints.ResolvedEndpoint) bool {
+	// Already encoded, or carrying a checksum of the uncompressed body
+	if body.size == 0 || req.Header.Get("Content-Encoding") != "" || req.Header.Get("Content-Md5") != "" {
+		return false
+	}
+	if !gzipRequestServices[service.SigningName] {
+		if _, warned := p.compressSkipped.LoadOrStore(service.SigningName, true); !warned {
+			loggerFrom(req.Context()).WithField("service", service.SigningName).Warn("Not compressing requests, service does not accept gzip request bodies")
+		}
+		return false
+	}
+	return true
+}
+
+// gzipRequestBody returns body compressed with gzip.
+func gzipRequestBody(body *requestBody, spill bodySpill) (*requestBody, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body.reader())
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	compressed, err := spill.read(pr)
+	// Unblocks the compression if reading stopped early
+	pr.Close()
+	if err != nil {
+		compressed.Close()
+		return nil, fmt.Errorf("unable to compress request body: %w", err)
+	}
+	return compressed, nil
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{acceptEncoding: "", want: false},
+		{acceptEncoding: "gzip", want: true},
+		{acceptEncoding: "deflate, gzip;q=1.0, *;q=0.5", want: true},
+		{acceptEncoding: "GZIP", want: true},
+		{acceptEncoding: "br", want: false},
+		{acceptEncoding: "gzip;q=0", want: false},
+		{acceptEncoding: "*", want: true},
+		{acceptEncoding: "*;q=0", want: false},
+		{acceptEncoding: "gzip;q=0, *", want: false},
+		{acceptEncoding: "identity, *;q=0.1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			assert.Equal(t, tt.want, acceptsGzip(tt.acceptEncoding))
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_CompressesResponses(t *testing.T) {
+	large := []byte(strings.Repeat(`{"key":"value"}`, 200))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		header         http.Header
+		body           []byte
+		wantGzip       bool
+	}{
+		{
+			name:           "compresses large bodies for clients accepting gzip",
+			acceptEncoding: "gzip, deflate",
+			header:         http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{strconv.Itoa(len(large))}},
+			body:           large,
+			wantGzip:       true,
+		},
+		{
+			name:   "leaves bodies for clients not accepting gzip",
+			header: http.Header{"Content-Type": []string{"application/json"}},
+			body:   large,
+		},
+		{
+			name:           "leaves bodies below the threshold",
+			acceptEncoding: "gzip",
+			header:         http.Header{"Content-Type": []string{"application/json"}},
+			body:           []byte(`{"key":"value"}`),
+		},
+		{
+			name:           "leaves already encoded bodies",
+			acceptEncoding: "gzip",
+			header:         http.Header{"Content-Encoding": []string{"br"}},
+			body:           large,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				ProxyClient: &mockProxyClient{
+					Response: &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     tt.header,
+						Body:       ioutil.NopCloser(bytes.NewReader(tt.body)),
+					},
+				},
+				CompressResponses: true,
+				CompressMinSize:   1024,
+			}
+			request := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			if tt.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			body := r.Body.Bytes()
+			if tt.wantGzip {
+				assert.Equal(t, "gzip", r.Header().Get("Content-Encoding"))
+				assert.Equal(t, "Accept-Encoding", r.Header().Get("Vary"))
+				assert.Equal(t, strconv.Itoa(len(body)), r.Header().Get("Content-Length"))
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				assert.Nil(t, err)
+				body, _ = ioutil.ReadAll(zr)
+			} else {
+				assert.Equal(t, tt.header.Get("Content-Encoding"), r.Header().Get("Content-Encoding"))
+			}
+			assert.Equal(t, tt.body, body)
+		})
+	}
+}
+
+func TestProxyClient_Do_CompressRequests(t *testing.T) {
+	payload := strings.Repeat("Action=PutMetricData&MetricData.member.1.MetricName=Latency&", 64)
+
+	tests := []struct {
+		name           string
+		host           string
+		header         http.Header
+		spillThreshold int64
+		wantGzipped    bool
+	}{
+		{name: "compresses bodies for services accepting gzip", host: "monitoring.us-east-1.amazonaws.com", header: http.Header{}, wantGzipped: true},
+		{name: "compresses spilled bodies", host: "monitoring.us-east-1.amazonaws.com", header: http.Header{}, spillThreshold: 512, wantGzipped: true},
+		{name: "skips bodies already encoded", host: "monitoring.us-east-1.amazonaws.com", header: http.Header{"Content-Encoding": []string{"deflate"}}},
+		{name: "skips bodies with a checksum", host: "monitoring.us-east-1.amazonaws.com", header: http.Header{"Content-Md5": []string{"c2x1Zw=="}}},
+		{name: "skips other services", host: "sqs.us-east-1.amazonaws.com", header: http.Header{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds := credentials.NewCredentials(&mockProvider{})
+			client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}}
+			proxyClient := &ProxyClient{
+				Signer:             v4.NewSigner(creds),
+				Client:             client,
+				CompressRequests:   true,
+				BodySpillThreshold: tt.spillThreshold,
+				BodySpillDir:       t.TempDir(),
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        "POST",
+				URL:           &url.URL{Path: "/"},
+				Host:          tt.host,
+				Header:        tt.header,
+				ContentLength: int64(len(payload)),
+				Body:          ioutil.NopCloser(strings.NewReader(payload)),
+			})
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			sent, _ := ioutil.ReadAll(client.Request.Body)
+			assert.Equal(t, int64(len(sent)), client.Request.ContentLength)
+			if !tt.wantGzipped {
+				assert.Equal(t, payload, string(sent))
+				assert.Equal(t, tt.header.Get("Content-Encoding"), client.Request.Header.Get("Content-Encoding"))
+				return
+			}
+
+			assert.Equal(t, "gzip", client.Request.Header.Get("Content-Encoding"))
+			zr, err := gzip.NewReader(bytes.NewReader(sent))
+			assert.Nil(t, err)
+			decompressed, _ := ioutil.ReadAll(zr)
+			assert.Equal(t, payload, string(decompressed))
+
+			// The signature covers the compressed body and its encoding
+			date, _ := time.Parse("20060102T150405Z", client.Request.Header.Get("X-Amz-Date"))
+			verify, _ := http.NewRequest(http.MethodPost, client.Request.URL.String(), nil)
+			verify.Header.Set("Content-Encoding", "gzip")
+			v4.NewSigner(creds).Sign(verify, bytes.NewReader(sent), "monitoring", "us-east-1", date)
+			assert.Equal(t, verify.Header.Get("Authorization"), client.Request.Header.Get("Authorization"))
+		})
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requestInfo collects what ProxyClient.Do decided for a request, so the
+// Handler can report on it once the request completes.
+type requestInfo struct {
+	Service string
+	Region  string
+	// UpstreamDuration is how long the upstream took to respond with the
+	// headers of its response, zero if it was not sent.
+	UpstreamDuration time.Duration
+	// SigningDuration is the time spent signing the request, and any copy of
+	// it sent on redirects.
+	SigningDuration time.Duration
+	// RequestBytes and ResponseBytes count the body bytes read from and
+	// written to the client, set once the request completes.
+	RequestBytes  int64
+	ResponseBytes int64
+	// UpstreamHost is the host the request was sent to.
+	UpstreamHost string
+	// Identity identifies the caller, when an Authenticator established it.
+	Identity string
+	// Span, when the Handler traces requests, is the span of the request.
+	Span *span
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the requestInfo attached to ctx. Requests which
+// did not go through the Handler get a throwaway value, so callers never
+// need to check for nil.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger, which the Handler and
+// ProxyClient then use for the log lines of the request ctx belongs to, e.g.
+// so they carry the fields of an embedding application's request logger.
+func WithLogger(ctx context.Context, logger log.FieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger attached to ctx, the standard logger if
+// there is none.
+func loggerFrom(ctx context.Context) log.FieldLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(log.FieldLogger); ok {
+		return logger
+	}
+	return log.StandardLogger()
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures the CORS headers the proxy answers browsers with, instead
+// of forwarding preflight requests upstream.
+type CORS struct {
+	// AllowOrigins lists the origins allowed to call the proxy, "*" allows
+	// every origin.
+	AllowOrigins []string
+	// AllowMethods lists the methods allowed in preflight responses.
+	AllowMethods []string
+	// AllowHeaders lists the request headers allowed in preflight responses.
+	// When empty the headers requested by the browser are allowed.
+	AllowHeaders []string
+	// ExposeHeaders lists the response headers browsers may read.
+	ExposeHeaders []string
+	// MaxAge is how long browsers may cache preflight responses, zero for
+	// their default.
+	MaxAge time.Duration
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// false if the origin is not allowed.
+func (c *CORS) allowOrigin(origin string) (string, bool) {
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if allowed == origin {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// setOriginHeaders sets the headers shared by preflight and actual responses
+// to an allowed origin.
+func (c *CORS) setOriginHeaders(h http.Header, allowOrigin string) {
+	h.Set("Access-Control-Allow-Origin", allowOrigin)
+	if allowOrigin != "*" {
+		h.Add("Vary", "Origin")
+	}
+}
+
+// servePreflight answers a preflight request without forwarding it.
+func (c *CORS) servePreflight(w http.ResponseWriter, r *http.Request) {
+	allowOrigin, ok := c.allowOrigin(r.Header.Get("Origin"))
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("origin is not allowed"))
+		return
+	}
+
+	h := w.Header()
+	c.setOriginHeaders(h, allowOrigin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowMethods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// corsResponseWriter replaces any CORS headers of the upstream response with
+// the configured ones before the response is sent.
+type corsResponseWriter struct {
+	http.ResponseWriter
+	cors        *CORS
+	allowOrigin string
+	wroteHeader bool
+}
+
+func (w *corsResponseWriter) WriteHeader(status int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// setHeaders replaces any upstream CORS headers with the proxy's, once.
+func (w *corsResponseWriter) setHeaders() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+	w.cors.setOriginHeaders(h, w.allowOrigin)
+	if len(w.cors.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(w.cors.ExposeHeaders, ", "))
+	}
+}
+
+func (w *corsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack takes over the client connection to switch protocols, after
+// adding the CORS headers to the handshake response.
+func (w *corsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	w.setHeaders()
+	return hijacker.Hijack()
+}
+
+func (w *corsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
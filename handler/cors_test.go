@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSTestHandler(cors *CORS) *Handler {
+	return &Handler{
+		CORS: cors,
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Access-Control-Allow-Origin": []string{"https://upstream.example.com"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("upstream")),
+			},
+		},
+	}
+}
+
+func TestHandler_ServeHTTP_CORSPreflight(t *testing.T) {
+	tests := []struct {
+		name       string
+		cors       *CORS
+		header     http.Header
+		wantStatus int
+		wantHeader http.Header
+	}{
+		{
+			name: "answers allowed origins locally",
+			cors: &CORS{
+				AllowOrigins: []string{"https://app.example.com"},
+				AllowMethods: []string{"GET", "PUT"},
+				AllowHeaders: []string{"Content-Type", "X-Amz-Meta-A"},
+				MaxAge:       10 * time.Minute,
+			},
+			header: http.Header{
+				"Origin":                         []string{"https://app.example.com"},
+				"Access-Control-Request-Method":  []string{"PUT"},
+				"Access-Control-Request-Headers": []string{"content-type"},
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin":  []string{"https://app.example.com"},
+				"Access-Control-Allow-Methods": []string{"GET, PUT"},
+				"Access-Control-Allow-Headers": []string{"Content-Type, X-Amz-Meta-A"},
+				"Access-Control-Max-Age":       []string{"600"},
+				"Vary":                         []string{"Origin"},
+			},
+		},
+		{
+			name: "allows the requested headers when none are configured",
+			cors: &CORS{AllowOrigins: []string{"*"}, AllowMethods: []string{"GET"}},
+			header: http.Header{
+				"Origin":                         []string{"https://app.example.com"},
+				"Access-Control-Request-Method":  []string{"GET"},
+				"Access-Control-Request-Headers": []string{"x-amz-meta-a"},
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeader: http.Header{
+				"Access-Control-Allow-Origin":  []string{"*"},
+				"Access-Control-Allow-Methods": []string{"GET"},
+				"Access-Control-Allow-Headers": []string{"x-amz-meta-a"},
+				"Vary":                         []string{"Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name: "rejects other origins",
+			cors: &CORS{AllowOrigins: []string{"https://app.example.com"}, AllowMethods: []string{"GET"}},
+			header: http.Header{
+				"Origin":                        []string{"https://evil.example.com"},
+				"Access-Control-Request-Method": []string{"GET"},
+			},
+			wantStatus: http.StatusForbidden,
+			wantHeader: http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodOptions, "http://localhost:8080/bucket/key", nil)
+			request.Header = tt.header
+			r := httptest.NewRecorder()
+
+			newCORSTestHandler(tt.cors).ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			r.Header().Del("Content-Type")
+			assert.Equal(t, tt.wantHeader, r.Header())
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_CORSDisabledForwardsOptions(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodOptions, "http://localhost:8080/bucket/key", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Access-Control-Request-Method", "GET")
+	r := httptest.NewRecorder()
+
+	newCORSTestHandler(nil).ServeHTTP(r, request)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "upstream", r.Body.String())
+	assert.Equal(t, "https://upstream.example.com", r.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestHandler_ServeHTTP_CORSHeadersOnProxiedResponses(t *testing.T) {
+	h := newCORSTestHandler(&CORS{
+		AllowOrigins:  []string{"https://app.example.com"},
+		ExposeHeaders: []string{"ETag"},
+	})
+
+	request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/key", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	r := httptest.NewRecorder()
+
+	h.ServeHTTP(r, request)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "upstream", r.Body.String())
+	assert.Equal(t, []string{"https://app.example.com"}, r.Header()["Access-Control-Allow-Origin"])
+	assert.Equal(t, "ETag", r.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", r.Header().Get("Vary"))
+
+	// Disallowed origins get the upstream response unchanged.
+	request.Header.Set("Origin", "https://evil.example.com")
+	r = httptest.NewRecorder()
+
+	h.ServeHTTP(r, request)
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "https://upstream.example.com", r.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// CredentialsStatus describes the credentials used for signing. It never
+// holds any secret material.
+type CredentialsStatus struct {
+	// Provider is the name of the provider the credentials came from.
+	Provider string
+	// Expiry is when the credentials expire, zero if they do not or the
+	// provider does not report it.
+	Expiry time.Time
+}
+
+// providerTypes maps the names of the SDK's credential providers to the kind
+// of source they retrieve credentials from.
+var providerTypes = map[string]string{
+	"EnvProvider":                 "env",
+	"EnvConfigCredentials":        "env",
+	"SharedCredentialsProvider":   "shared-config",
+	"StaticProvider":              "static",
+	"AssumeRoleProvider":          "role",
+	"WebIdentityCredentials":      "web-identity",
+	"EC2RoleProvider":             "imds",
+	"CredentialsEndpointProvider": "container",
+	"ProcessProvider":             "process",
+}
+
+// ProviderType returns the kind of source, e.g. env, role or imds, the
+// credentials of the named provider come from.
+func ProviderType(providerName string) string {
+	if t, ok := providerTypes[providerName]; ok {
+		return t
+	}
+	// Static keys read from the shared files are named after the file
+	if strings.HasPrefix(providerName, "SharedConfigCredentials") {
+		return "shared-config"
+	}
+	return "unknown"
+}
+
+// GetCredentialsStatus retrieves creds, from cache when possible, and
+// returns their status.
+func GetCredentialsStatus(creds *credentials.Credentials) (CredentialsStatus, error) {
+	v, err := creds.Get()
+	if err != nil {
+		return CredentialsStatus{}, err
+	}
+
+	status := CredentialsStatus{Provider: v.ProviderName}
+	if expiry, err := creds.ExpiresAt(); err == nil {
+		status.Expiry = expiry
+	}
+	return status, nil
+}
+
+// ReloadCredentials discards the cached credentials so they are retrieved
+// again from their provider, e.g. refreshing assumed role credentials.
+func ReloadCredentials(creds *credentials.Credentials) (CredentialsStatus, error) {
+	creds.Expire()
+	return GetCredentialsStatus(creds)
+}
+
+// NewRefreshLimitedCredentials wraps creds so that refreshes start a random
+// duration of up to jitter, at most half of their remaining lifetime, before
+// the credentials expire, spreading out the refreshes of proxies sharing a
+// role, and are attempted at most once per
+// minInterval, even when they keep failing. The errors of failed refreshes
+// are passed to onRefreshError, e.g. to count or report them.
+func NewRefreshLimitedCredentials(creds *credentials.Credentials, jitter, minInterval time.Duration, onRefreshError ...func(error)) *credentials.Credentials {
+	return credentials.NewCredentials(&refreshLimitedProvider{
+		creds:          creds,
+		jitter:         jitter,
+		minInterval:    minInterval,
+		onRefreshError: onRefreshError,
+		now:            time.Now,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	})
+}
+
+// refreshLimitedProvider retrieves credentials from creds, limiting how often
+// and when they are refreshed.
+type refreshLimitedProvider struct {
+	creds          *credentials.Credentials
+	jitter         time.Duration
+	minInterval    time.Duration
+	onRefreshError []func(error)
+	now            func() time.Time
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	lastAttempt time.Time
+	lastValue   credentials.Value
+	lastErr     error
+	expiry      time.Time
+	refreshAt   time.Time
+}
+
+func (p *refreshLimitedProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if !p.lastAttempt.IsZero() && now.Sub(p.lastAttempt) < p.minInterval {
+		if p.lastErr != nil {
+			return credentials.Value{}, p.lastErr
+		}
+		return p.lastValue, nil
+	}
+	p.lastAttempt = now
+
+	p.creds.Expire()
+	v, err := p.creds.Get()
+	if err != nil {
+		p.lastErr = err
+		for _, f := range p.onRefreshError {
+			f(err)
+		}
+		return credentials.Value{}, err
+	}
+	p.lastValue, p.lastErr = v, nil
+
+	p.expiry, p.refreshAt = time.Time{}, time.Time{}
+	if expiry, err := p.creds.ExpiresAt(); err == nil && !expiry.IsZero() {
+		p.expiry, p.refreshAt = expiry, expiry
+		// The jitter is clamped to half of the remaining lifetime, whatever
+		// the source of the credentials, so they are not refreshed right away
+		jitter := p.jitter
+		if half := expiry.Sub(now) / 2; jitter > half {
+			jitter = half
+		}
+		if jitter > 0 {
+			p.refreshAt = expiry.Add(-time.Duration(p.rand.Int63n(int64(jitter))))
+		}
+	}
+	return v, nil
+}
+
+func (p *refreshLimitedProvider) IsExpired() bool {
+	p.mu.Lock()
+	refreshAt := p.refreshAt
+	p.mu.Unlock()
+
+	if !refreshAt.IsZero() && !p.now().Before(refreshAt) {
+		return true
+	}
+	return p.creds.IsExpired()
+}
+
+// ExpiresAt returns when the credentials expire, not when they will be
+// refreshed.
+func (p *refreshLimitedProvider) ExpiresAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiry
+}
+
+// CredentialsRefresher refreshes credentials in the background ahead of
+// their expiry, so requests are signed with the credentials on hand instead
+// of waiting for, or failing on, a refresh. Until they actually expire, the
+// credentials on hand keep being used when a background refresh fails.
+type CredentialsRefresher struct {
+	creds   *credentials.Credentials
+	ahead   time.Duration
+	now     func() time.Time
+	wrapped *credentials.Credentials
+
+	mu     sync.Mutex
+	value  credentials.Value
+	expiry time.Time
+	fresh  bool
+}
+
+// NewCredentialsRefresher returns a refresher of creds, refreshing them ahead
+// before they expire once Run.
+func NewCredentialsRefresher(creds *credentials.Credentials, ahead time.Duration) *CredentialsRefresher {
+	r := &CredentialsRefresher{creds: creds, ahead: ahead, now: time.Now}
+	r.wrapped = credentials.NewCredentials(r)
+	return r
+}
+
+// Credentials returns the credentials to sign with.
+func (r *CredentialsRefresher) Credentials() *credentials.Credentials {
+	return r.wrapped
+}
+
+// Retrieve hands out the credentials refreshed in the background, or
+// retrieves them when there are none, e.g. at startup or on reloads.
+func (r *CredentialsRefresher) Retrieve() (credentials.Value, error) {
+	r.mu.Lock()
+	if r.fresh {
+		r.fresh = false
+		defer r.mu.Unlock()
+		return r.value, nil
+	}
+	r.mu.Unlock()
+
+	v, expiry, err := r.retrieve()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.value, r.expiry = v, expiry
+	return v, nil
+}
+
+// IsExpired reports whether credentials were refreshed in the background or
+// those on hand expired, without refreshing them once in the window ahead of
+// their expiry.
+func (r *CredentialsRefresher) IsExpired() bool {
+	r.mu.Lock()
+	fresh, expiry := r.fresh, r.expiry
+	r.mu.Unlock()
+
+	if fresh {
+		return true
+	}
+	if !expiry.IsZero() {
+		return !r.now().Before(expiry)
+	}
+	return r.creds.IsExpired()
+}
+
+// ExpiresAt returns when the credentials on hand expire.
+func (r *CredentialsRefresher) ExpiresAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expiry
+}
+
+// Run refreshes the credentials every interval once they come within ahead
+// of their expiry, forever.
+func (r *CredentialsRefresher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.refresh()
+	}
+}
+
+// refresh retrieves new credentials when those on hand are about to expire.
+func (r *CredentialsRefresher) refresh() {
+	r.mu.Lock()
+	expiry := r.expiry
+	r.mu.Unlock()
+	if expiry.IsZero() || r.now().Before(expiry.Add(-r.ahead)) {
+		return
+	}
+
+	v, newExpiry, err := r.retrieve()
+	if err != nil {
+		log.WithError(err).WithField("seconds_until_expiry", int64(expiry.Sub(r.now()).Seconds())).Warn("Unable to refresh AWS credentials ahead of their expiry")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A refresh limited provider hands out the credentials on hand again
+	// within its minimum interval, they are not fresh
+	r.fresh = r.fresh || v != r.value
+	r.value, r.expiry = v, newExpiry
+}
+
+// retrieve retrieves new credentials from creds and when they expire, zero
+// if creds does not report it.
+func (r *CredentialsRefresher) retrieve() (credentials.Value, time.Time, error) {
+	r.creds.Expire()
+	v, err := r.creds.Get()
+	if err != nil {
+		return credentials.Value{}, time.Time{}, err
+	}
+	expiry, err := r.creds.ExpiresAt()
+	if err != nil {
+		expiry = time.Time{}
+	}
+	return v, expiry, nil
+}
+
+// CredentialsExpiryWatcher warns when the credentials come within a
+// threshold of their expiry, e.g. because refreshing them keeps failing.
+type CredentialsExpiryWatcher struct {
+	creds     *credentials.Credentials
+	threshold time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	warned bool
+}
+
+// NewCredentialsExpiryWatcher returns a watcher of creds warning threshold
+// before they expire.
+func NewCredentialsExpiryWatcher(creds *credentials.Credentials, threshold time.Duration) *CredentialsExpiryWatcher {
+	return &CredentialsExpiryWatcher{creds: creds, threshold: threshold, now: time.Now}
+}
+
+// SecondsUntilExpiry returns the seconds left before the credentials expire,
+// false if they do not or have not been retrieved yet.
+func (w *CredentialsExpiryWatcher) SecondsUntilExpiry() (float64, bool) {
+	expiry, err := w.creds.ExpiresAt()
+	if err != nil || expiry.IsZero() {
+		return 0, false
+	}
+	return expiry.Sub(w.now()).Seconds(), true
+}
+
+// Run checks the credentials every interval, forever.
+func (w *CredentialsExpiryWatcher) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.check()
+	}
+}
+
+// check warns once when the credentials cross the threshold, and again only
+// after they have been refreshed past it.
+func (w *CredentialsExpiryWatcher) check() {
+	seconds, ok := w.SecondsUntilExpiry()
+	if !ok {
+		return
+	}
+	below := seconds < w.threshold.Seconds()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if below && !w.warned {
+		log.WithFields(log.Fields{
+			"seconds_until_expiry": int64(seconds),
+			"threshold":            w.threshold,
+		}).Warn("AWS credentials are about to expire")
+	}
+	w.warned = below
+}
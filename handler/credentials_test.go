@@ -0,0 +1,361 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// rotatingProvider hands out new credentials on every retrieval.
+type rotatingProvider struct {
+	credentials.Expiry
+	retrievals int
+	fail       bool
+}
+
+func (p *rotatingProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	if p.fail {
+		return credentials.Value{}, fmt.Errorf("rotatingProvider.Retrieve failed")
+	}
+	p.SetExpiration(time.Date(2020, 10, 1, p.retrievals, 0, 0, 0, time.UTC), 0)
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("AKID%d", p.retrievals),
+		SecretAccessKey: "secret",
+		ProviderName:    "rotatingProvider",
+	}, nil
+}
+
+func (p *rotatingProvider) IsExpired() bool {
+	return false
+}
+
+func TestReloadCredentials(t *testing.T) {
+	provider := &rotatingProvider{}
+	creds := credentials.NewCredentials(provider)
+
+	status, err := GetCredentialsStatus(creds)
+	assert.Nil(t, err)
+	assert.Equal(t, CredentialsStatus{Provider: "rotatingProvider", Expiry: time.Date(2020, 10, 1, 1, 0, 0, 0, time.UTC)}, status)
+
+	// Cached credentials are reused until reloaded
+	_, _ = GetCredentialsStatus(creds)
+	assert.Equal(t, 1, provider.retrievals)
+
+	status, err = ReloadCredentials(creds)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, provider.retrievals)
+	assert.Equal(t, CredentialsStatus{Provider: "rotatingProvider", Expiry: time.Date(2020, 10, 1, 2, 0, 0, 0, time.UTC)}, status)
+
+	v, _ := creds.Get()
+	assert.Equal(t, "AKID2", v.AccessKeyID)
+
+	provider.fail = true
+	_, err = ReloadCredentials(creds)
+	assert.EqualError(t, err, "rotatingProvider.Retrieve failed")
+}
+
+func TestGetCredentialsStatus_StaticCredentials(t *testing.T) {
+	status, err := GetCredentialsStatus(credentials.NewStaticCredentials("AKID", "SECRET", ""))
+
+	assert.Nil(t, err)
+	assert.Equal(t, CredentialsStatus{Provider: credentials.StaticProviderName}, status)
+}
+
+func TestRefreshLimitedProvider_MinInterval(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	provider := &rotatingProvider{fail: true}
+	creds := credentials.NewCredentials(&refreshLimitedProvider{
+		creds:       credentials.NewCredentials(provider),
+		minInterval: time.Minute,
+		now:         func() time.Time { return now },
+		rand:        rand.New(rand.NewSource(1)),
+	})
+
+	// Repeated failures within the interval are not retried
+	for i := 0; i < 5; i++ {
+		_, err := creds.Get()
+		assert.EqualError(t, err, "rotatingProvider.Retrieve failed")
+		now = now.Add(10 * time.Second)
+	}
+	assert.Equal(t, 1, provider.retrievals)
+
+	now = now.Add(10 * time.Second)
+	_, err := creds.Get()
+	assert.EqualError(t, err, "rotatingProvider.Retrieve failed")
+	assert.Equal(t, 2, provider.retrievals)
+
+	// Forced reloads are bounded too
+	provider.fail = false
+	now = now.Add(time.Minute)
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID3", v.AccessKeyID)
+
+	_, err = ReloadCredentials(creds)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, provider.retrievals)
+}
+
+func TestRefreshLimitedProvider_Jitter(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	provider := &rotatingProvider{}
+	limited := &refreshLimitedProvider{
+		creds:  credentials.NewCredentials(provider),
+		jitter: 10 * time.Minute,
+		now:    func() time.Time { return now },
+		rand:   rand.New(rand.NewSource(1)),
+	}
+	creds := credentials.NewCredentials(limited)
+
+	status, err := GetCredentialsStatus(creds)
+	assert.Nil(t, err)
+
+	// The first credentials expire at 01:00, which is reported rather than
+	// when they are refreshed
+	expiry := time.Date(2020, 10, 1, 1, 0, 0, 0, time.UTC)
+	assert.Equal(t, expiry, status.Expiry)
+	assert.True(t, limited.refreshAt.After(expiry.Add(-10*time.Minute)), limited.refreshAt)
+	assert.True(t, limited.refreshAt.Before(expiry), limited.refreshAt)
+
+	now = expiry.Add(-10 * time.Minute)
+	assert.False(t, creds.IsExpired())
+
+	now = limited.refreshAt
+	assert.True(t, creds.IsExpired())
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID2", v.AccessKeyID)
+}
+
+func TestRefreshLimitedProvider_JitterClampedToLifetime(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	for seed := int64(1); seed <= 20; seed++ {
+		provider := &rotatingProvider{}
+		limited := &refreshLimitedProvider{
+			creds:  credentials.NewCredentials(provider),
+			jitter: 2 * time.Hour,
+			now:    func() time.Time { return now },
+			rand:   rand.New(rand.NewSource(seed)),
+		}
+		_, err := credentials.NewCredentials(limited).Get()
+		assert.Nil(t, err)
+
+		// The credentials expire in an hour, shorter than the jitter
+		assert.False(t, limited.refreshAt.Before(now.Add(30*time.Minute)), limited.refreshAt)
+		assert.True(t, limited.refreshAt.Before(time.Date(2020, 10, 1, 1, 0, 0, 0, time.UTC)), limited.refreshAt)
+	}
+}
+
+func TestCredentialsRefresher(t *testing.T) {
+	hook := logtest.NewGlobal()
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	provider := &rotatingProvider{}
+	r := NewCredentialsRefresher(credentials.NewCredentials(provider), 10*time.Minute)
+	r.now = func() time.Time { return now }
+	creds := r.Credentials()
+
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID1", v.AccessKeyID)
+
+	// Nothing is refreshed before the window ahead of the expiry at 01:00
+	now = now.Add(45 * time.Minute)
+	r.refresh()
+	assert.Equal(t, 1, provider.retrievals)
+
+	// Credentials refreshed in the background are used without retrieving
+	// them again
+	now = now.Add(10 * time.Minute)
+	r.refresh()
+	assert.Equal(t, 2, provider.retrievals)
+	status, err := GetCredentialsStatus(creds)
+	assert.Nil(t, err)
+	assert.Equal(t, CredentialsStatus{Provider: "rotatingProvider", Expiry: time.Date(2020, 10, 1, 2, 0, 0, 0, time.UTC)}, status)
+	assert.Equal(t, 2, provider.retrievals)
+
+	// Failed refreshes keep the credentials on hand until they expire
+	provider.fail = true
+	now = time.Date(2020, 10, 1, 1, 55, 0, 0, time.UTC)
+	r.refresh()
+	assert.Equal(t, 3, provider.retrievals)
+	assert.Equal(t, "Unable to refresh AWS credentials ahead of their expiry", hook.LastEntry().Message)
+	assert.Equal(t, int64(300), hook.LastEntry().Data["seconds_until_expiry"])
+	v, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID2", v.AccessKeyID)
+	assert.Equal(t, 3, provider.retrievals)
+
+	now = now.Add(5 * time.Minute)
+	_, err = creds.Get()
+	assert.EqualError(t, err, "rotatingProvider.Retrieve failed")
+	assert.Equal(t, 4, provider.retrievals)
+}
+
+func TestCredentialsRefresher_RefreshLimited(t *testing.T) {
+	newRefresher := func(provider *rotatingProvider, minInterval time.Duration, now *time.Time) (*CredentialsRefresher, *credentials.Credentials) {
+		limited := credentials.NewCredentials(&refreshLimitedProvider{
+			creds:       credentials.NewCredentials(provider),
+			jitter:      20 * time.Minute,
+			minInterval: minInterval,
+			now:         func() time.Time { return *now },
+			rand:        rand.New(rand.NewSource(1)),
+		})
+		r := NewCredentialsRefresher(limited, 10*time.Minute)
+		r.now = func() time.Time { return *now }
+		return r, r.Credentials()
+	}
+	signedWith := func(creds *credentials.Credentials, now time.Time) string {
+		req, _ := http.NewRequest(http.MethodGet, "https://sqs.us-west-2.amazonaws.com/", nil)
+		_, err := v4.NewSigner(creds).Sign(req, nil, "sqs", "us-west-2", now)
+		assert.Nil(t, err)
+		return req.Header.Get("Authorization")
+	}
+
+	t.Run("refreshes ahead of the real expiry, not the jittered one", func(t *testing.T) {
+		now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+		provider := &rotatingProvider{}
+		r, creds := newRefresher(provider, 0, &now)
+		_, err := creds.Get()
+		assert.Nil(t, err)
+
+		now = now.Add(45 * time.Minute)
+		r.refresh()
+		assert.Equal(t, 1, provider.retrievals)
+		assert.Equal(t, time.Date(2020, 10, 1, 1, 0, 0, 0, time.UTC), r.ExpiresAt())
+
+		now = now.Add(5 * time.Minute)
+		r.refresh()
+		assert.Equal(t, 2, provider.retrievals)
+		assert.Contains(t, signedWith(creds, now), "Credential=AKID2/")
+	})
+
+	t.Run("values cached within the minimum interval are not fresh", func(t *testing.T) {
+		now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+		provider := &rotatingProvider{}
+		r, creds := newRefresher(provider, time.Hour, &now)
+		_, err := creds.Get()
+		assert.Nil(t, err)
+
+		now = now.Add(52 * time.Minute)
+		r.refresh()
+		assert.Equal(t, 1, provider.retrievals)
+		assert.False(t, creds.IsExpired())
+		assert.Contains(t, signedWith(creds, now), "Credential=AKID1/")
+	})
+
+	t.Run("failed refreshes keep signing with the credentials on hand", func(t *testing.T) {
+		now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+		provider := &rotatingProvider{}
+		r, creds := newRefresher(provider, time.Minute, &now)
+		_, err := creds.Get()
+		assert.Nil(t, err)
+
+		provider.fail = true
+		for _, at := range []time.Duration{52 * time.Minute, 55 * time.Minute, 58 * time.Minute} {
+			now = time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC).Add(at)
+			r.refresh()
+			assert.Contains(t, signedWith(creds, now), "Credential=AKID1/", "at %s", at)
+		}
+		assert.Equal(t, 4, provider.retrievals)
+	})
+}
+
+func TestCredentialsRefresher_StaticCredentials(t *testing.T) {
+	r := NewCredentialsRefresher(credentials.NewStaticCredentials("AKID", "SECRET", ""), time.Minute)
+
+	status, err := GetCredentialsStatus(r.Credentials())
+	assert.Nil(t, err)
+	assert.Equal(t, CredentialsStatus{Provider: credentials.StaticProviderName}, status)
+	assert.False(t, r.Credentials().IsExpired())
+
+	// Credentials without an expiry are never refreshed
+	r.refresh()
+	v, err := r.Credentials().Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID", v.AccessKeyID)
+}
+
+func TestCredentialsExpiryWatcher_WarnsOncePerCrossing(t *testing.T) {
+	hook := logtest.NewGlobal()
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	creds := credentials.NewCredentials(&rotatingProvider{})
+	w := NewCredentialsExpiryWatcher(creds, 10*time.Minute)
+	w.now = func() time.Time { return now }
+
+	warnings := func() int {
+		n := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == log.WarnLevel && entry.Message == "AWS credentials are about to expire" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Nothing is known about credentials not retrieved yet
+	w.check()
+	_, ok := w.SecondsUntilExpiry()
+	assert.False(t, ok)
+
+	// The first credentials expire at 01:00
+	_, err := creds.Get()
+	assert.Nil(t, err)
+	now = now.Add(40 * time.Minute)
+	w.check()
+	seconds, ok := w.SecondsUntilExpiry()
+	assert.True(t, ok)
+	assert.Equal(t, float64(20*60), seconds)
+	assert.Equal(t, 0, warnings())
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(3 * time.Minute)
+		w.check()
+	}
+	assert.Equal(t, 1, warnings())
+	assert.Equal(t, int64(8*60), hook.LastEntry().Data["seconds_until_expiry"])
+
+	// Refreshed credentials, expiring at 02:00, re-arm the warning
+	_, err = ReloadCredentials(creds)
+	assert.Nil(t, err)
+	w.check()
+	assert.Equal(t, 1, warnings())
+
+	now = time.Date(2020, 10, 1, 1, 55, 0, 0, time.UTC)
+	w.check()
+	w.check()
+	assert.Equal(t, 2, warnings())
+}
+
+func TestProviderType(t *testing.T) {
+	assert.Equal(t, "env", ProviderType("EnvConfigCredentials"))
+	assert.Equal(t, "role", ProviderType("AssumeRoleProvider"))
+	assert.Equal(t, "imds", ProviderType("EC2RoleProvider"))
+	assert.Equal(t, "web-identity", ProviderType("WebIdentityCredentials"))
+	assert.Equal(t, "process", ProviderType("ProcessProvider"))
+	assert.Equal(t, "shared-config", ProviderType("SharedConfigCredentials: /root/.aws/credentials"))
+	assert.Equal(t, "unknown", ProviderType("CustomProvider"))
+}
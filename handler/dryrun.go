@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// DebugHeader asks for a dry run of the request carrying it with a value of
+// true, when ProxyClient.AllowDebugHeader is set.
+const DebugHeader = "X-Sigv4Proxy-Debug"
+
+// signingInfoLogFormat is the format of the signing details the SDK's signer
+// logs at aws.LogDebugWithSigning.
+const signingInfoLogFormat = `DEBUG: Request Signature:
+---[ CANONICAL STRING  ]-----------------------------
+%s
+---[ STRING TO SIGN ]--------------------------------
+%s%s
+-----------------------------------------------------`
+
+const (
+	canonicalStringMarker = "---[ CANONICAL STRING  ]-----------------------------\n"
+	stringToSignMarker    = "\n---[ STRING TO SIGN ]--------------------------------\n"
+	signedURLMarker       = "\n---[ SIGNED URL ]"
+	signingInfoEndMarker  = "\n-----------------------------------------------------"
+)
+
+// signingDebug records the canonical request and string to sign a signer
+// computed, from the signing details it logs.
+type signingDebug struct {
+	CanonicalRequest string
+	StringToSign     string
+}
+
+// capture returns a copy of signer logging its signing details to d.
+func (d *signingDebug) capture(signer *v4.Signer) *v4.Signer {
+	s := *signer
+	s.Debug = aws.LogDebugWithSigning
+	s.Logger = aws.LoggerFunc(d.log)
+	return &s
+}
+
+func (d *signingDebug) log(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	start := strings.Index(msg, canonicalStringMarker)
+	middle := strings.Index(msg, stringToSignMarker)
+	if start < 0 || middle < start {
+		return
+	}
+	d.CanonicalRequest = msg[start+len(canonicalStringMarker) : middle]
+	rest := msg[middle+len(stringToSignMarker):]
+	if end := strings.Index(rest, signedURLMarker); end >= 0 {
+		rest = rest[:end]
+	} else if end := strings.LastIndex(rest, signingInfoEndMarker); end >= 0 {
+		rest = rest[:end]
+	}
+	d.StringToSign = rest
+}
+
+// dryRunResponse is the body of the response to a dry run.
+type dryRunResponse struct {
+	Method           string              `json:"method"`
+	URL              string              `json:"url"`
+	Service          string              `json:"service"`
+	Region           string              `json:"region"`
+	SigningMethod    string              `json:"signing_method"`
+	CanonicalRequest string              `json:"canonical_request"`
+	StringToSign     string              `json:"string_to_sign"`
+	SignedHeaders    []string            `json:"signed_headers"`
+	Headers          map[string][]string `json:"headers"`
+}
+
+// newDryRunResponse returns the response describing how req, with header,
+// was signed for service instead of sending it upstream. Session tokens are
+// redacted, the signature is left as it only covers req.
+func newDryRunResponse(req *http.Request, header http.Header, service *endpoints.ResolvedEndpoint, debug *signingDebug) (*http.Response, error) {
+	token := header.Get("X-Amz-Security-Token")
+	if token == "" {
+		token = req.URL.Query().Get("X-Amz-Security-Token")
+	}
+	redact := func(s string) string {
+		if token == "" {
+			return s
+		}
+		s = strings.Replace(s, token, "REDACTED", -1)
+		return strings.Replace(s, url.QueryEscape(token), "REDACTED", -1)
+	}
+
+	dryRun := dryRunResponse{
+		Method:           req.Method,
+		URL:              redact(req.URL.String()),
+		Service:          service.SigningName,
+		Region:           service.SigningRegion,
+		SigningMethod:    service.SigningMethod,
+		CanonicalRequest: redact(debug.CanonicalRequest),
+		StringToSign:     debug.StringToSign,
+		Headers:          map[string][]string{},
+	}
+	// The signed headers are listed before the payload hash
+	if lines := strings.Split(debug.CanonicalRequest, "\n"); len(lines) >= 2 {
+		dryRun.SignedHeaders = strings.Split(lines[len(lines)-2], ";")
+	}
+	for name, vv := range header {
+		values := make([]string, len(vv))
+		for i, v := range vv {
+			values[i] = redact(v)
+		}
+		dryRun.Headers[name] = values
+	}
+
+	b, err := json.Marshal(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{strconv.Itoa(len(b))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Do_DryRun(t *testing.T) {
+	const token = "session/token+value="
+	tests := []struct {
+		name              string
+		host              string
+		path              string
+		wantSigningMethod string
+		wantSignedHeaders []string
+		wantAlgorithm     string
+	}{
+		{
+			name:              "describes SigV4 signatures",
+			host:              "sqs.eu-west-1.amazonaws.com",
+			path:              "/queue",
+			wantSigningMethod: "v4",
+			wantSignedHeaders: []string{"host", "x-amz-date", "x-amz-security-token"},
+			wantAlgorithm:     "AWS4-HMAC-SHA256",
+		},
+		{
+			name:              "describes presigned S3 requests",
+			host:              "s3.eu-west-1.amazonaws.com",
+			path:              "/bucket/key",
+			wantSigningMethod: "s3",
+			wantSignedHeaders: []string{"host"},
+			wantAlgorithm:     "AWS4-HMAC-SHA256",
+		},
+		{
+			name:              "describes SigV4A signatures",
+			host:              "mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com",
+			path:              "/key",
+			wantSigningMethod: "v4a",
+			wantSignedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date", "x-amz-region-set", "x-amz-security-token"},
+			wantAlgorithm:     sigV4AAlgorithm,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", token)),
+				Client: client,
+				DryRun: true,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: tt.path},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			assert.Nil(t, client.Request, "the request was sent upstream")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var body dryRunResponse
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+
+			assert.Equal(t, http.MethodGet, body.Method)
+			assert.Equal(t, tt.wantSigningMethod, body.SigningMethod)
+			assert.Equal(t, tt.wantSignedHeaders, body.SignedHeaders)
+			assert.True(t, strings.HasPrefix(body.CanonicalRequest, "GET\n"+tt.path+"\n"), body.CanonicalRequest)
+			assert.True(t, strings.HasPrefix(body.StringToSign, tt.wantAlgorithm+"\n"), body.StringToSign)
+			// Restoring the token gives back the canonical request signed,
+			// presigned ones carry it in their query
+			restored := strings.Replace(body.CanonicalRequest, "REDACTED", token, -1)
+			if tt.wantSigningMethod == "s3" {
+				restored = strings.Replace(body.CanonicalRequest, "REDACTED", url.QueryEscape(token), -1)
+			}
+			sum := sha256.Sum256([]byte(restored))
+			assert.True(t, strings.HasSuffix(body.StringToSign, "\n"+hex.EncodeToString(sum[:])), "the canonical request does not match the string to sign")
+
+			// Session tokens are never returned
+			raw, _ := json.Marshal(body)
+			assert.False(t, strings.Contains(string(raw), token))
+			assert.False(t, strings.Contains(string(raw), url.QueryEscape(token)))
+			assert.True(t, strings.Contains(body.CanonicalRequest, "REDACTED"))
+		})
+	}
+}
+
+func TestProxyClient_Do_DebugHeader(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowDebugHeader bool
+		wantDryRun       bool
+		wantForwarded    string
+	}{
+		{
+			name:          "forwards the header by default",
+			wantForwarded: "true",
+		},
+		{
+			name:             "answers with a dry run when allowed",
+			allowDebugHeader: true,
+			wantDryRun:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:           v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:           client,
+				AllowDebugHeader: tt.allowDebugHeader,
+			}
+
+			req := &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/"},
+				Host:   "sqs.eu-west-1.amazonaws.com",
+				Header: http.Header{},
+			}
+			req.Header.Set(DebugHeader, "true")
+			resp, err := proxyClient.Do(req)
+
+			assert.Nil(t, err)
+			if tt.wantDryRun {
+				assert.Nil(t, client.Request)
+				var body dryRunResponse
+				assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+				assert.NotContains(t, body.Headers, http.CanonicalHeaderKey(DebugHeader))
+				assert.NotContains(t, body.SignedHeaders, strings.ToLower(DebugHeader))
+				return
+			}
+			if assert.NotNil(t, client.Request) {
+				assert.Equal(t, tt.wantForwarded, client.Request.Header.Get(DebugHeader))
+			}
+		})
+	}
+}
+
+func TestSigningDebug_Log(t *testing.T) {
+	d := &signingDebug{}
+	d.log("DEBUG: Request Signature:\n---[ CANONICAL STRING  ]-----------------------------\nGET\n/\n\nhost:example.com\n\nhost\nhash\n---[ STRING TO SIGN ]--------------------------------\nAWS4-HMAC-SHA256\n20200101T000000Z\nscope\nsum\n---[ SIGNED URL ]------------------------------------\nhttps://example.com/?X-Amz-Signature=sig\n-----------------------------------------------------")
+
+	assert.Equal(t, "GET\n/\n\nhost:example.com\n\nhost\nhash", d.CanonicalRequest)
+	assert.Equal(t, "AWS4-HMAC-SHA256\n20200101T000000Z\nscope\nsum", d.StringToSign)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream/eventstreamapi"
+)
+
+// eventStreamContentType is the media type of AWS event streams, sent in
+// both directions by streaming services such as Transcribe streaming.
+const eventStreamContentType = "application/vnd.amazon.eventstream"
+
+// streamingEventsPayload is the payload hash of requests whose event stream
+// body is signed message by message.
+const streamingEventsPayload = "STREAMING-AWS4-HMAC-SHA256-EVENTS"
+
+// isEventStreamRequest reports whether req sends an event stream.
+func isEventStreamRequest(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == eventStreamContentType
+}
+
+// requestSignature returns the signature of a request signed with an
+// Authorization header.
+func requestSignature(req *http.Request) ([]byte, error) {
+	auth := req.Header.Get("Authorization")
+	i := strings.LastIndex(auth, "Signature=")
+	if i < 0 {
+		return nil, fmt.Errorf("request carries no signature")
+	}
+	return hex.DecodeString(auth[i+len("Signature="):])
+}
+
+// attachEventStream sets the body of proxyReq, signed with the streaming
+// events payload hash, to the messages of the event stream body, each
+// wrapped in a signed envelope as they are received.
+func (p *ProxyClient) attachEventStream(proxyReq *http.Request, body io.Reader, signer *v4.Signer, service *endpoints.ResolvedEndpoint) error {
+	seed, err := requestSignature(proxyReq)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		body = http.NoBody
+	}
+
+	pr, pw := io.Pipe()
+	go signEventStream(pw, body, v4.NewStreamSigner(service.SigningRegion, service.SigningName, seed, signer.Credentials))
+
+	proxyReq.Body = pr
+	proxyReq.ContentLength = -1
+	proxyReq.GetBody = nil
+	return nil
+}
+
+// signEventStream writes the messages read from r to w, each in an envelope
+// whose signature chains from the previous one, then ends the stream with an
+// empty envelope. It returns once r or w fails.
+func signEventStream(w *io.PipeWriter, r io.Reader, signer eventstreamapi.StreamSigner) {
+	encoder := eventstreamapi.NewSignEncoder(signer, eventstream.NewEncoder(w))
+	decoder := eventstream.NewDecoder(r)
+	for {
+		msg, err := decoder.Decode(nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.CloseWithError(fmt.Errorf("unable to read event stream: %w", err))
+			return
+		}
+		if err := encoder.Encode(msg); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+	}
+	w.CloseWithError(encoder.Close())
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream/eventstreamapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func audioEvent(chunk string) eventstream.Message {
+	var msg eventstream.Message
+	msg.Headers.Set(":message-type", eventstream.StringValue("event"))
+	msg.Headers.Set(":event-type", eventstream.StringValue("AudioEvent"))
+	msg.Payload = []byte(chunk)
+	return msg
+}
+
+func TestProxyClient_Do_EventStream(t *testing.T) {
+	creds := credentials.NewCredentials(&mockProvider{})
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(creds),
+		Client: client,
+	}
+	clientBody, clientStream := io.Pipe()
+	defer clientStream.Close()
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/stream-transcription"},
+		Host:   "transcribestreaming.us-west-2.amazonaws.com",
+		Header: http.Header{"Content-Type": []string{"application/vnd.amazon.eventstream"}},
+		Body:   clientBody,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "STREAMING-AWS4-HMAC-SHA256-EVENTS", client.Request.Header.Get("X-Amz-Content-Sha256"))
+	assert.Contains(t, client.Request.Header.Get("Authorization"), "/us-west-2/transcribe/aws4_request")
+	assert.Equal(t, int64(-1), client.Request.ContentLength)
+
+	seed, err := requestSignature(client.Request)
+	assert.Nil(t, err)
+	verifier := v4.NewStreamSigner("us-west-2", "transcribe", seed, creds)
+	upstream := eventstream.NewDecoder(client.Request.Body)
+
+	// readEnvelope reads the next envelope sent upstream, checks its signature
+	// and returns the message it carries.
+	readEnvelope := func() []byte {
+		envelope, err := upstream.Decode(nil)
+		assert.Nil(t, err)
+
+		date := time.Time(envelope.Headers.Get(eventstreamapi.DateHeader).(eventstream.TimestampValue))
+		var headers bytes.Buffer
+		var signed eventstream.Headers
+		signed.Set(eventstreamapi.DateHeader, eventstream.TimestampValue(date))
+		eventstream.EncodeHeaders(&headers, signed)
+		want, _ := verifier.GetSignature(headers.Bytes(), envelope.Payload, date)
+		assert.Equal(t, want, []byte(envelope.Headers.Get(eventstreamapi.ChunkSignatureHeader).(eventstream.BytesValue)))
+
+		return envelope.Payload
+	}
+
+	// Each message is relayed as soon as it is received
+	encoder := eventstream.NewEncoder(clientStream)
+	for _, chunk := range []string{"first chunk", "second chunk"} {
+		go encoder.Encode(audioEvent(chunk))
+
+		msg, err := eventstream.Decode(bytes.NewReader(readEnvelope()), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, audioEvent(chunk), msg)
+	}
+
+	clientStream.Close()
+	assert.Empty(t, readEnvelope())
+	_, err = upstream.Decode(nil)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProxyClient_Do_EventStreamMalformed(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/stream-transcription"},
+		Host:   "transcribestreaming.us-west-2.amazonaws.com",
+		Header: http.Header{"Content-Type": []string{"application/vnd.amazon.eventstream"}},
+		Body:   ioutil.NopCloser(strings.NewReader("not an event stream")),
+	})
+
+	assert.Nil(t, err)
+	_, err = eventstream.NewDecoder(client.Request.Body).Decode(nil)
+	assert.Contains(t, err.Error(), "unable to read event stream")
+}
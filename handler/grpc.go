@@ -0,0 +1,44 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isGRPCContentType reports whether contentType is that of gRPC messages,
+// including gRPC-Web.
+func isGRPCContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "application/grpc")
+}
+
+// isGRPCRequest reports whether req is a gRPC call, whose messages are
+// streamed both ways for as long as it lasts, and whose status is carried by
+// the trailers of its response.
+func isGRPCRequest(req *http.Request) bool {
+	return isGRPCContentType(req.Header.Get("Content-Type"))
+}
+
+// setTrailers sets trailer on the response written to w, once its body has
+// been written. They need not have been announced in a Trailer header.
+func setTrailers(w http.ResponseWriter, trailer http.Header) {
+	for name, vv := range trailer {
+		w.Header()[http.TrailerPrefix+name] = vv
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsGRPCContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "application/grpc", want: true},
+		{contentType: "application/grpc+proto", want: true},
+		{contentType: "application/grpc-web-text", want: true},
+		{contentType: "Application/GRPC; charset=utf-8", want: true},
+		{contentType: "application/json", want: false},
+		{contentType: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			assert.Equal(t, tt.want, isGRPCContentType(tt.contentType))
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_GRPC(t *testing.T) {
+	upstreamRequests := make(chan *http.Request, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests <- r
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// Echo each message as soon as it is received
+		message := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(r.Body, message); err != nil {
+				break
+			}
+			w.Write(message)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(&Handler{ProxyClient: &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              upstream.Client(),
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-west-2",
+		HostOverride:        upstream.Listener.Addr().String(),
+	}})
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	body, messages := io.Pipe()
+	request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/helloworld.Greeter/SayHello", body)
+	request.Header.Set("Content-Type", "application/grpc")
+	resp, err := proxy.Client().Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Messages are relayed both ways while the call is in progress
+	for _, message := range []string{"hello", "world"} {
+		messages.Write([]byte(message))
+		echoed := make([]byte, len(message))
+		_, err = io.ReadFull(resp.Body, echoed)
+		assert.Nil(t, err)
+		assert.Equal(t, message, string(echoed))
+	}
+	messages.Close()
+	rest, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "done", resp.Trailer.Get("Grpc-Message"))
+
+	forwarded := <-upstreamRequests
+	assert.Equal(t, 2, forwarded.ProtoMajor)
+	assert.Equal(t, "UNSIGNED-PAYLOAD", forwarded.Header.Get("X-Amz-Content-Sha256"))
+	assert.True(t, strings.Contains(forwarded.Header.Get("Authorization"), "x-amz-content-sha256"), forwarded.Header.Get("Authorization"))
+	assert.Equal(t, "trailers", forwarded.Header.Get("Te"))
+}
@@ -17,15 +17,193 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Handler struct {
 	ProxyClient Client
+	// Authenticators must all let a request through before it is signed,
+	// otherwise it is rejected with the status of the first one failing.
+	// Health checks and the Admin endpoints are not authenticated.
+	Authenticators []Authenticator
+	// RequestLogger, when set, returns the logger used for the log lines of
+	// requests whose context carries none, see WithLogger.
+	RequestLogger func(r *http.Request) log.FieldLogger
+	// AuditWebhook, when set, receives an audit event for every proxied
+	// request.
+	AuditWebhook *AuditWebhook
+	// AccessLog, when set, receives a Common Log Format line for every
+	// proxied request, with the values of the query parameters matching one
+	// of AccessLogRedactQuery redacted.
+	AccessLog            io.Writer
+	AccessLogRedactQuery []*regexp.Regexp
+	// JSONAccessLog, when set, receives a JSON record for every proxied
+	// request.
+	JSONAccessLog *JSONAccessLog
+	// CORS, when set, answers CORS preflight requests locally and adds CORS
+	// headers to responses for allowed origins. Otherwise OPTIONS requests are
+	// signed and forwarded like any other.
+	CORS *CORS
+	// EchoSigningInfo adds the service and region a request was signed for
+	// to its response, in the X-Sigv4-Proxy-Service and X-Sigv4-Proxy-Region
+	// headers.
+	EchoSigningInfo bool
+	// ExposeUpstreamTiming adds how long the upstream took to respond, in
+	// milliseconds, to responses in the X-Upstream-Duration-Ms header.
+	ExposeUpstreamTiming bool
+	// EchoRequestHeaders are copied from the request onto its response, in
+	// place of any upstream values, when present.
+	EchoRequestHeaders []string
+	// RequiredHeaders are headers every proxied request must carry, requests
+	// where one is absent or empty are rejected with 400 before signing.
+	RequiredHeaders []string
+	// AllowedMethods, when not empty, are the only methods proxied, requests
+	// with others are rejected with 405 before signing.
+	AllowedMethods []string
+	// MaxURLLength, when not zero, bounds the length of the path and query of
+	// proxied requests, longer ones are rejected with 414 before signing.
+	MaxURLLength int
+	// MaxRequestBodySize, when not zero, bounds the size of request bodies,
+	// larger ones are rejected with 413.
+	MaxRequestBodySize int64
+	// MaxResponseBodySize, when not zero, bounds the size of the responses
+	// buffered before they are relayed, larger ones are answered with 502.
+	// Streamed responses are not buffered and not bounded.
+	MaxResponseBodySize int64
+	// LoadShedder, when set, rejects a share of requests with 503 while
+	// upstream latency is too high, and observes the latency of the others.
+	LoadShedder *LoadShedder
+	// ConcurrencyLimiter, when set, bounds the requests proxied at the same
+	// time, those over the limit are rejected with 429.
+	ConcurrencyLimiter *ConcurrencyLimiter
+	// RateLimiter, when set, rejects requests with 429 once their client
+	// exceeds its rate, clients being told apart by their IP, or by the
+	// identity an Authenticator established if RateLimitByIdentity is set.
+	RateLimiter         *RateLimiter
+	RateLimitByIdentity bool
+	// HealthResponseBody and HealthResponseStatus are what /health responds
+	// with, an empty body and 200 by default.
+	HealthResponseBody   string
+	HealthResponseStatus int
+	// DisableReady proxies /ready instead of serving it, e.g. when it would
+	// shadow the S3 bucket named ready, see ServeReady.
+	DisableReady bool
+	// Admin, when set, serves the operator endpoints under /admin/ instead of
+	// proxying those paths.
+	Admin *Admin
+	// CompressResponses gzips buffered responses of at least CompressMinSize
+	// bytes for clients accepting gzip, unless they are already encoded.
+	CompressResponses bool
+	CompressMinSize   int
+	// Metrics, when set, records the metrics of proxied requests.
+	Metrics *Metrics
+	// UpgradeIdleTimeout, when not zero, closes connections switched to
+	// another protocol, e.g. WebSockets, once no data went either way for
+	// that long.
+	UpgradeIdleTimeout time.Duration
+	// Tracer, when set, records a span for every proxied request, whose
+	// trace context is passed on to the upstream in the traceparent header.
+	Tracer *Tracer
+
+	draining     int32
+	shuttingDown int32
+
+	// upgrades tracks the connections switched to another protocol, which
+	// the http.Server no longer does once hijacked.
+	upgrades     sync.WaitGroup
+	upgradesMu   sync.Mutex
+	upgradeConns map[net.Conn]struct{}
+}
+
+// SetDraining toggles drain mode. While draining, proxied requests are
+// rejected with 503 and /ready fails so load balancers stop routing to the
+// proxy, while /health keeps reporting the process as alive.
+func (h *Handler) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&h.draining, v)
+}
+
+// Draining reports whether the handler is in drain mode.
+func (h *Handler) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// SetShuttingDown marks the proxy as shutting down, for good. Unlike in drain
+// mode, requests are still proxied while both /health and /ready fail, so
+// load balancers stop routing to the proxy, and clients are asked to close
+// their connections.
+func (h *Handler) SetShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether the proxy is shutting down.
+func (h *Handler) ShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) == 1
+}
+
+// Shutdown waits for the connections switched to another protocol and the
+// mirrored requests of a *ProxyClient to complete, closing the connections
+// still open once ctx is done, then delivers the queued audit events and
+// spans, waiting for them until flushCtx is done. It is meant to be called
+// once the http.Server shut down.
+func (h *Handler) Shutdown(ctx, flushCtx context.Context) error {
+	err := waitGroupWithin(ctx, &h.upgrades)
+	if err != nil {
+		h.upgradesMu.Lock()
+		for conn := range h.upgradeConns {
+			conn.Close()
+		}
+		h.upgradesMu.Unlock()
+	}
+	if p, ok := h.ProxyClient.(*ProxyClient); ok {
+		if werr := p.WaitMirrors(ctx); err == nil {
+			err = werr
+		}
+	}
+
+	if h.AuditWebhook != nil {
+		if cerr := h.AuditWebhook.Close(flushCtx); cerr != nil {
+			log.WithError(cerr).Warn("Unable to deliver the queued audit events")
+		}
+	}
+	if h.Tracer != nil {
+		if cerr := h.Tracer.Close(flushCtx); cerr != nil {
+			log.WithError(cerr).Warn("Unable to export the queued spans")
+		}
+	}
+	return err
+}
+
+// waitGroupWithin waits for wg, or for ctx to be done.
+func waitGroupWithin(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (h *Handler) write(w http.ResponseWriter, status int, body []byte) {
@@ -33,36 +211,397 @@ func (h *Handler) write(w http.ResponseWriter, status int, body []byte) {
 	w.Write(body)
 }
 
+// abortRead sends the response written so far and closes the connection
+// without reading the rest of the request body, which the server would
+// otherwise wait for even from a client that stopped sending it. HTTP/2
+// connections cannot be hijacked, their streams are reset instead.
+func abortRead(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// ServeReady answers readiness checks, failing while draining or shutting
+// down.
+func (h *Handler) ServeReady(w http.ResponseWriter, r *http.Request) {
+	if h.Draining() || h.ShuttingDown() {
+		h.write(w, http.StatusServiceUnavailable, nil)
+		return
+	}
+	h.write(w, http.StatusOK, nil)
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.ShuttingDown() {
+		w.Header().Set("Connection", "close")
+	}
+
 	if r.URL != nil && r.URL.Path == "/health" {
-		h.write(w, http.StatusOK, nil)
+		if h.ShuttingDown() {
+			h.write(w, http.StatusServiceUnavailable, []byte("proxy is shutting down"))
+			return
+		}
+		status := http.StatusOK
+		if h.HealthResponseStatus != 0 {
+			status = h.HealthResponseStatus
+		}
+		h.write(w, status, []byte(h.HealthResponseBody))
 		return
 	}
 
+	if !h.DisableReady && r.URL != nil && r.URL.Path == "/ready" {
+		h.ServeReady(w, r)
+		return
+	}
+
+	if h.Admin != nil && r.URL != nil && strings.HasPrefix(r.URL.Path, "/admin/") {
+		h.Admin.ServeHTTP(w, r)
+		return
+	}
+
+	if h.CORS != nil && isPreflight(r) {
+		h.CORS.servePreflight(w, r)
+		return
+	}
+
+	start := time.Now()
+	ctx := r.Context()
+	if _, ok := ctx.Value(loggerKey{}).(log.FieldLogger); !ok && h.RequestLogger != nil {
+		ctx = WithLogger(ctx, h.RequestLogger(r))
+	}
+	info := &requestInfo{}
+	if h.Tracer != nil {
+		info.Span = h.Tracer.start(r)
+	}
+	r = r.WithContext(withRequestInfo(ctx, info))
+	rec := &responseRecorder{ResponseWriter: w}
+	body := &countingReadCloser{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+
+	var pw http.ResponseWriter = rec
+	if origin := r.Header.Get("Origin"); h.CORS != nil && origin != "" {
+		if allowOrigin, ok := h.CORS.allowOrigin(origin); ok {
+			pw = &corsResponseWriter{ResponseWriter: rec, cors: h.CORS, allowOrigin: allowOrigin}
+		}
+	}
+
+	// Proxying removes some headers, e.g. those of Authenticators
+	var header http.Header
+	if h.JSONAccessLog != nil {
+		header = r.Header.Clone()
+	}
+
+	if h.Metrics != nil {
+		defer h.Metrics.start()()
+	}
+	h.proxy(pw, r)
+
+	info.RequestBytes = body.Bytes()
+	info.ResponseBytes = rec.bytes
+	if h.Metrics != nil {
+		h.Metrics.observe(info, rec.status)
+	}
+	if h.Tracer != nil {
+		h.Tracer.end(info.Span, r, info, rec.status)
+	}
+
+	loggerFrom(r.Context()).WithFields(log.Fields{
+		"method":         r.Method,
+		"service":        info.Service,
+		"region":         info.Region,
+		"status":         rec.status,
+		"request_bytes":  info.RequestBytes,
+		"response_bytes": info.ResponseBytes,
+	}).Debug("proxied request")
+
+	if h.AccessLog != nil {
+		writeAccessLog(h.AccessLog, r, start, rec.status, rec.bytes, h.AccessLogRedactQuery)
+	}
+
+	if h.JSONAccessLog != nil {
+		if err := h.JSONAccessLog.write(r, header, start, info, rec.status); err != nil {
+			loggerFrom(r.Context()).WithError(err).Error("unable to write access log record")
+		}
+	}
+
+	if h.AuditWebhook != nil {
+		h.AuditWebhook.Send(newAuditEvent(r, info, rec.status))
+	}
+}
+
+func (h *Handler) proxy(w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		w.Header().Set("Connection", "close")
+		h.write(w, http.StatusServiceUnavailable, []byte("proxy is draining"))
+		return
+	}
+
+	for _, auth := range h.Authenticators {
+		if err := auth.Authenticate(r); err != nil {
+			loggerFrom(r.Context()).WithError(err).Warn("rejected unauthenticated request")
+			status := errorStatus(err)
+			if _, ok := auth.(*JWTAuth); ok && status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			h.write(w, status, []byte(err.Error()))
+			return
+		}
+	}
+
+	if len(h.AllowedMethods) > 0 && !h.methodAllowed(r.Method) {
+		w.Header().Set("Allow", strings.Join(h.AllowedMethods, ", "))
+		h.write(w, http.StatusMethodNotAllowed, []byte(fmt.Sprintf("method %s is not allowed", r.Method)))
+		return
+	}
+
+	if h.MaxURLLength > 0 && r.URL != nil {
+		if uri := r.URL.RequestURI(); len(uri) > h.MaxURLLength {
+			h.write(w, http.StatusRequestURITooLong, []byte(fmt.Sprintf("request URL of %d bytes exceeds the maximum of %d", len(uri), h.MaxURLLength)))
+			return
+		}
+	}
+
+	if h.MaxRequestBodySize > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > h.MaxRequestBodySize {
+			// The body is left unread, don't reuse the connection
+			w.Header().Set("Connection", "close")
+			h.write(w, http.StatusRequestEntityTooLarge, []byte(fmt.Sprintf("request body of %d bytes exceeds the maximum of %d", r.ContentLength, h.MaxRequestBodySize)))
+			return
+		}
+		r.Body = newLimitedBody(r.Body, h.MaxRequestBodySize)
+	}
+
+	for _, name := range h.RequiredHeaders {
+		if r.Header.Get(name) == "" {
+			h.write(w, http.StatusBadRequest, []byte(fmt.Sprintf("missing required header %s", http.CanonicalHeaderKey(name))))
+			return
+		}
+	}
+
+	if h.RateLimiter != nil {
+		if ok, wait := h.RateLimiter.Allow(h.rateLimitKey(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.write(w, http.StatusTooManyRequests, []byte("rate limit exceeded"))
+			return
+		}
+	}
+
+	if h.ConcurrencyLimiter != nil {
+		release, ok := h.ConcurrencyLimiter.Acquire(r.Context())
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			h.write(w, http.StatusTooManyRequests, []byte("too many requests in flight"))
+			return
+		}
+		defer release()
+	}
+
+	if h.LoadShedder != nil && !h.LoadShedder.Allow() {
+		w.Header().Set("Retry-After", "1")
+		h.write(w, http.StatusServiceUnavailable, []byte("proxy is overloaded"))
+		return
+	}
+
+	logger := loggerFrom(r.Context())
 	resp, err := h.ProxyClient.Do(r)
+	// Only the upstream's latency is observed, not how long the client took
+	// to send the body
+	if d := requestInfoFrom(r.Context()).UpstreamDuration; h.LoadShedder != nil && d > 0 {
+		h.LoadShedder.Observe(d)
+	}
+	if h.EchoSigningInfo {
+		setSigningInfoHeaders(w.Header(), requestInfoFrom(r.Context()))
+	}
+	if d := requestInfoFrom(r.Context()).UpstreamDuration; h.ExposeUpstreamTiming && d > 0 {
+		w.Header().Set("X-Upstream-Duration-Ms", strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64))
+	}
+	for _, name := range h.EchoRequestHeaders {
+		if vals := r.Header.Values(name); len(vals) > 0 {
+			w.Header()[http.CanonicalHeaderKey(name)] = vals
+			if resp != nil {
+				resp.Header.Del(name)
+			}
+		}
+	}
 	if err != nil {
 		errorMsg := "unable to proxy request"
-		log.WithError(err).Error(errorMsg)
-		h.write(w, http.StatusBadGateway, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		logger.WithError(err).Error(errorMsg)
+		status := errorStatus(err)
+		body := []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error()))
+		if status == http.StatusRequestTimeout || status == http.StatusRequestEntityTooLarge {
+			// The rest of the body may never arrive, or is left unread: the
+			// connection is closed without waiting for it
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			h.write(w, status, body)
+			abortRead(w)
+			return
+		}
+		h.write(w, status, body)
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := h.serveUpgrade(w, resp); err == errUpgradeIdle {
+			logger.Info("closed idle upgraded connection")
+		} else if err != nil {
+			logger.WithError(err).Error("error while relaying upgraded connection")
+		}
+		return
+	}
+
+	// Responses to HEAD never have a body, even if the upstream sent one.
+	if r.Method == http.MethodHead {
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	if isStreamingResponse(resp) {
+		copyHeader(w.Header(), resp.Header)
+		if err := h.stream(w, resp); err != nil {
+			logger.WithError(err).Error("error while streaming response from upstream")
+		}
+		return
+	}
+
+	if h.MaxResponseBodySize > 0 && resp.ContentLength > h.MaxResponseBodySize {
+		logger.WithField("size", resp.ContentLength).Error("upstream response too large")
+		h.write(w, http.StatusBadGateway, []byte(fmt.Sprintf("upstream response body of %d bytes exceeds the maximum of %d", resp.ContentLength, h.MaxResponseBodySize)))
+		return
+	}
+
 	// read response body
 	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
+	var src io.Reader = resp.Body
+	if h.MaxResponseBodySize > 0 {
+		src = io.LimitReader(resp.Body, h.MaxResponseBodySize+1)
+	}
+	if _, err := io.Copy(&buf, src); err != nil {
 		errorMsg := "error while reading response from upstream"
-		log.WithError(err).Error(errorMsg)
+		logger.WithError(err).Error(errorMsg)
 		h.write(w, http.StatusInternalServerError, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
 		return
 	}
 
-	// copy headers
-	for k, vals := range resp.Header {
-		for _, v := range vals {
-			w.Header().Add(k, v)
+	if h.MaxResponseBodySize > 0 && int64(buf.Len()) > h.MaxResponseBodySize {
+		logger.Error("upstream response too large")
+		h.write(w, http.StatusBadGateway, []byte(fmt.Sprintf("upstream response body exceeds the maximum of %d bytes", h.MaxResponseBodySize)))
+		return
+	}
+
+	copyHeader(w.Header(), resp.Header)
+
+	body := buf.Bytes()
+	if h.shouldCompress(r, resp, len(body)) {
+		compressed, err := gzipBody(w.Header(), body)
+		if err != nil {
+			logger.WithError(err).Error("unable to compress response")
+		} else {
+			body = compressed
+		}
+	}
+
+	h.write(w, resp.StatusCode, body)
+}
+
+func (h *Handler) methodAllowed(method string) bool {
+	for _, allowed := range h.AllowedMethods {
+		if method == allowed {
+			return true
 		}
 	}
+	return false
+}
+
+// setSigningInfoHeaders sets the headers describing what the request was
+// signed for, if it got that far.
+func setSigningInfoHeaders(h http.Header, info *requestInfo) {
+	if info.Service != "" {
+		h.Set("X-Sigv4-Proxy-Service", info.Service)
+	}
+	if info.Region != "" {
+		h.Set("X-Sigv4-Proxy-Region", info.Region)
+	}
+}
+
+// stream relays the response body to the client as it is received, flushing
+// after every chunk so event streams are delivered without delay.
+func (h *Handler) stream(w http.ResponseWriter, resp *http.Response) error {
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
 
-	h.write(w, resp.StatusCode, buf.Bytes())
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			// Trailers, e.g. the status of gRPC calls, are only complete once
+			// the body was read
+			setTrailers(w, resp.Trailer)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamingMediaTypes are the response content types relayed to the client
+// as they arrive.
+var streamingMediaTypes = map[string]bool{
+	"text/event-stream":    true,
+	eventStreamContentType: true,
+	// Lambda function URLs using response streaming
+	"application/vnd.awslambda.http-integration-response": true,
+}
+
+// isStreamingResponse reports whether resp should be relayed to the client
+// incrementally rather than buffered, i.e. event streams, gRPC responses or
+// any response using chunked transfer encoding.
+func isStreamingResponse(resp *http.Response) bool {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); streamingMediaTypes[mediaType] {
+		return true
+	}
+	if isGRPCContentType(resp.Header.Get("Content-Type")) {
+		return true
+	}
+
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vals := range src {
+		for _, v := range vals {
+			dst.Add(k, v)
+		}
+	}
 }
@@ -16,18 +16,33 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockProxyClient struct {
 	Fail     bool
+	Err      error
 	Response *http.Response
 }
 
@@ -35,6 +50,9 @@ func (m *mockProxyClient) Do(req *http.Request) (*http.Response, error) {
 	if m.Fail {
 		return nil, fmt.Errorf("mockProxyClient.Do failed")
 	}
+	if m.Err != nil {
+		return nil, m.Err
+	}
 
 	return m.Response, nil
 }
@@ -71,6 +89,18 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				header:     http.Header{},
 			},
 		},
+		{
+			name: "responds with the status carried by the proxy error",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{Err: &statusError{status: http.StatusBadRequest, err: fmt.Errorf("bad body")}},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: http.StatusBadRequest,
+				body:       []byte(`unable to proxy request - bad body`),
+				header:     http.Header{},
+			},
+		},
 		{
 			name: "responds with proxied response if everything is 👍",
 			handler: &Handler{
@@ -93,6 +123,47 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				body: []byte(`proxy call successful`),
 			},
 		},
+		{
+			name: "never writes a body for HEAD requests",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{
+					Response: &http.Response{
+						StatusCode: 200,
+						Header: http.Header{
+							"Content-Length": []string{"21"},
+						},
+						Body: ioutil.NopCloser(bytes.NewBuffer([]byte(`proxy call successful`))),
+					},
+				},
+			},
+			request: &http.Request{Method: http.MethodHead},
+			want: &want{
+				statusCode: http.StatusOK,
+				header: http.Header{
+					"Content-Length": []string{"21"},
+				},
+				body: []byte{},
+			},
+		},
+		{
+			name: "never writes a body for streamed HEAD responses",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{
+					Response: &http.Response{
+						StatusCode:       200,
+						Header:           http.Header{"Content-Type": []string{"text/event-stream"}},
+						TransferEncoding: []string{"chunked"},
+						Body:             ioutil.NopCloser(bytes.NewBuffer([]byte("data: one\n\n"))),
+					},
+				},
+			},
+			request: &http.Request{Method: http.MethodHead},
+			want: &want{
+				statusCode: http.StatusOK,
+				header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+				body:       []byte{},
+			},
+		},
 		{
 			name: "responds with OK on health path",
 			handler: &Handler{
@@ -105,6 +176,20 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				body:       []byte{},
 			},
 		},
+		{
+			name: "responds with the configured health response",
+			handler: &Handler{
+				ProxyClient:          &mockProxyClient{Fail: false},
+				HealthResponseBody:   "OK",
+				HealthResponseStatus: http.StatusAccepted,
+			},
+			request: BuildHealthRequest(),
+			want: &want{
+				statusCode: http.StatusAccepted,
+				header:     http.Header{},
+				body:       []byte("OK"),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -124,3 +209,830 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes [][]byte
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes = append(f.flushes, append([]byte(nil), f.Body.Bytes()...))
+	f.ResponseRecorder.Flush()
+}
+
+// chunkReader returns one chunk per Read call.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+func TestHandler_ServeHTTP_StreamsEventStream(t *testing.T) {
+	events := [][]byte{[]byte("data: one\n\n"), []byte("data: two\n\n")}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		te     []string
+	}{
+		{
+			name:   "text/event-stream",
+			header: http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}},
+		},
+		{
+			name:   "lambda response streaming",
+			header: http.Header{"Content-Type": []string{"application/vnd.awslambda.http-integration-response"}},
+		},
+		{
+			name:   "aws event stream",
+			header: http.Header{"Content-Type": []string{"application/vnd.amazon.eventstream"}},
+		},
+		{
+			name:   "chunked transfer encoding",
+			header: http.Header{"Content-Type": []string{"application/json"}},
+			te:     []string{"chunked"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				ProxyClient: &mockProxyClient{
+					Response: &http.Response{
+						StatusCode:       http.StatusOK,
+						Header:           tt.header,
+						TransferEncoding: tt.te,
+						Body:             ioutil.NopCloser(&chunkReader{chunks: events}),
+					},
+				},
+			}
+			r := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+			h.ServeHTTP(r, &http.Request{})
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, tt.header.Get("Content-Type"), r.Header().Get("Content-Type"))
+			assert.Equal(t, "", r.Header().Get("Content-Length"))
+			assert.Equal(t, [][]byte{nil, []byte("data: one\n\n"), []byte("data: one\n\ndata: two\n\n")}, r.flushes)
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_Draining(t *testing.T) {
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewBuffer(nil)),
+			},
+		},
+	}
+
+	status := func(path string) int {
+		request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+		r := httptest.NewRecorder()
+		h.ServeHTTP(r, request)
+		return r.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("/health"))
+	assert.Equal(t, http.StatusOK, status("/ready"))
+	assert.Equal(t, http.StatusOK, status("/bucket/key"))
+
+	h.SetDraining(true)
+	assert.True(t, h.Draining())
+	assert.Equal(t, http.StatusOK, status("/health"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/ready"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/bucket/key"))
+
+	h.SetDraining(false)
+	assert.Equal(t, http.StatusOK, status("/ready"))
+	assert.Equal(t, http.StatusOK, status("/bucket/key"))
+}
+
+func TestHandler_ServeHTTP_DisableReady(t *testing.T) {
+	h := &Handler{
+		DisableReady: true,
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("<ListBucketResult/>")),
+			},
+		},
+	}
+	h.SetDraining(true)
+
+	// The bucket named ready is proxied, readiness is served elsewhere
+	request := httptest.NewRequest(http.MethodGet, "http://s3.amazonaws.com/ready", nil)
+	r := httptest.NewRecorder()
+	(&Handler{DisableReady: true, ProxyClient: h.ProxyClient}).ServeHTTP(r, request)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "<ListBucketResult/>", r.Body.String())
+
+	r = httptest.NewRecorder()
+	h.ServeReady(r, request)
+	assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+}
+
+func TestHandler_ServeHTTP_ShuttingDown(t *testing.T) {
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewBuffer(nil)),
+			},
+		},
+	}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+		r := httptest.NewRecorder()
+		h.ServeHTTP(r, request)
+		return r
+	}
+
+	assert.Equal(t, "", serve("/bucket/key").Header().Get("Connection"))
+
+	h.SetShuttingDown()
+	assert.True(t, h.ShuttingDown())
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/health").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/ready").Code)
+	r := serve("/bucket/key")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "close", r.Header().Get("Connection"))
+}
+
+func TestHandler_ServeHTTP_MapsErrorsToStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{
+			name:       "credential errors",
+			err:        &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("NoCredentialProviders: no valid providers in chain")},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "context deadlines",
+			err:        &url.Error{Op: "Get", URL: "https://s3.amazonaws.com", Err: context.DeadlineExceeded},
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "network timeouts",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: &timeoutError{}},
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "refused connections",
+			err:        &url.Error{Op: "Get", URL: "https://s3.amazonaws.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "other errors",
+			err:        fmt.Errorf("tls: handshake failure"),
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{ProxyClient: &mockProxyClient{Err: tt.err}}
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, &http.Request{})
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			assert.Equal(t, "unable to proxy request - "+tt.err.Error(), r.Body.String())
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestHandler_ServeHTTP_EchoSigningInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		proxyClient *ProxyClient
+		host        string
+		wantService string
+		wantRegion  string
+	}{
+		{
+			name:        "reports the service and region detected from the host",
+			proxyClient: &ProxyClient{},
+			host:        "sqs.eu-west-1.amazonaws.com",
+			wantService: "sqs",
+			wantRegion:  "eu-west-1",
+		},
+		{
+			name:        "reports overrides",
+			proxyClient: &ProxyClient{SigningNameOverride: "execute-api", RegionOverride: "us-east-2"},
+			host:        "api.example.com",
+			wantService: "execute-api",
+			wantRegion:  "us-east-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.proxyClient.Signer = v4.NewSigner(credentials.NewCredentials(&mockProvider{}))
+			tt.proxyClient.Client = &mockHTTPClient{
+				Response: &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(bytes.NewBuffer(nil)),
+				},
+			}
+			request, _ := http.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			r := httptest.NewRecorder()
+
+			(&Handler{ProxyClient: tt.proxyClient, EchoSigningInfo: true}).ServeHTTP(r, request)
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, tt.wantService, r.Header().Get("X-Sigv4-Proxy-Service"))
+			assert.Equal(t, tt.wantRegion, r.Header().Get("X-Sigv4-Proxy-Region"))
+		})
+	}
+
+	t.Run("is off by default", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+		r := httptest.NewRecorder()
+
+		(&Handler{ProxyClient: &ProxyClient{
+			Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+			Client: &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}},
+		}}).ServeHTTP(r, request)
+
+		assert.Equal(t, "", r.Header().Get("X-Sigv4-Proxy-Service"))
+		assert.Equal(t, "", r.Header().Get("X-Sigv4-Proxy-Region"))
+	})
+}
+
+func TestHandler_ServeHTTP_EchoRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestHeader  http.Header
+		upstreamHeader http.Header
+		want           http.Header
+	}{
+		{
+			name:          "echoes present headers",
+			requestHeader: http.Header{"X-Trace-Id": []string{"abc"}, "X-Other": []string{"x"}},
+			want:          http.Header{"X-Trace-Id": []string{"abc"}},
+		},
+		{
+			name:           "replaces upstream values",
+			requestHeader:  http.Header{"X-Trace-Id": []string{"abc"}},
+			upstreamHeader: http.Header{"X-Trace-Id": []string{"upstream"}},
+			want:           http.Header{"X-Trace-Id": []string{"abc"}},
+		},
+		{
+			name:           "skips absent headers",
+			requestHeader:  http.Header{},
+			upstreamHeader: http.Header{"X-Trace-Id": []string{"upstream"}},
+			want:           http.Header{"X-Trace-Id": []string{"upstream"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamHeader := http.Header{}
+			copyHeader(upstreamHeader, tt.upstreamHeader)
+			h := &Handler{
+				ProxyClient: &ProxyClient{
+					Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+					Client: &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: upstreamHeader, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}},
+				},
+				EchoRequestHeaders: []string{"x-trace-id", "X-Request-Id"},
+			}
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			request.Header = tt.requestHeader
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, tt.want, r.Header())
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_RequiredHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+		wantSigned bool
+	}{
+		{
+			name:       "forwards and signs requests carrying the headers",
+			header:     http.Header{"X-Tenant-Id": []string{"team-a"}, "X-Env": []string{"prod"}},
+			wantStatus: http.StatusOK,
+			wantSigned: true,
+		},
+		{
+			name:       "rejects requests missing a header",
+			header:     http.Header{"X-Env": []string{"prod"}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "missing required header X-Tenant-Id",
+		},
+		{
+			name:       "rejects requests with an empty header",
+			header:     http.Header{"X-Tenant-Id": []string{"team-a"}, "X-Env": []string{""}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "missing required header X-Env",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}}
+			h := &Handler{
+				ProxyClient: &ProxyClient{
+					Signer:        v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+					Client:        client,
+					SignedHeaders: []string{"X-Tenant-Id"},
+				},
+				RequiredHeaders: []string{"x-tenant-id", "X-Env"},
+			}
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			request.Header = tt.header
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, r.Body.String())
+			}
+			assert.Equal(t, tt.wantSigned, client.Request != nil)
+			if tt.wantSigned {
+				assert.Equal(t, "team-a", client.Request.Header.Get("X-Tenant-Id"))
+				assert.Contains(t, client.Request.Header.Get("Authorization"), "x-tenant-id")
+			}
+		})
+	}
+}
+
+// slowHTTPClient responds after delay.
+type slowHTTPClient struct {
+	delay time.Duration
+}
+
+func (c *slowHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	time.Sleep(c.delay)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}, nil
+}
+
+func TestHandler_ServeHTTP_ExposeUpstreamTiming(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			h := &Handler{
+				ProxyClient: &ProxyClient{
+					Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+					Client: &slowHTTPClient{delay: 20 * time.Millisecond},
+					// Time spent before the upstream call is not counted
+					RequestBodyTransformer: func(req *http.Request, body io.Reader) (io.Reader, error) {
+						time.Sleep(200 * time.Millisecond)
+						return body, nil
+					},
+				},
+				ExposeUpstreamTiming: enabled,
+			}
+			request, _ := http.NewRequest(http.MethodPost, "http://sqs.eu-west-1.amazonaws.com/", strings.NewReader("body"))
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, http.StatusOK, r.Code)
+			if !enabled {
+				assert.Empty(t, r.Header().Values("X-Upstream-Duration-Ms"))
+				return
+			}
+			ms, err := strconv.ParseFloat(r.Header().Get("X-Upstream-Duration-Ms"), 64)
+			assert.Nil(t, err)
+			assert.True(t, ms >= 20 && ms < 200, "upstream took %vms", ms)
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_AllowedMethods(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{name: "allows all methods by default", method: http.MethodDelete, wantStatus: http.StatusOK},
+		{name: "proxies allowed methods", allowed: []string{"GET", "HEAD"}, method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "proxies every allowed method", allowed: []string{"GET", "HEAD"}, method: http.MethodHead, wantStatus: http.StatusOK},
+		{name: "rejects other methods", allowed: []string{"GET", "HEAD"}, method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "compares methods exactly", allowed: []string{"GET"}, method: "get", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}}
+			h := &Handler{
+				ProxyClient:    &ProxyClient{Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})), Client: client},
+				AllowedMethods: tt.allowed,
+			}
+			request, _ := http.NewRequest(tt.method, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			assert.Equal(t, tt.wantAllow, r.Header().Get("Allow"))
+			assert.Equal(t, tt.wantStatus == http.StatusOK, client.Request != nil)
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				assert.Equal(t, fmt.Sprintf("method %s is not allowed", tt.method), r.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_MaxURLLength(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "forwards URLs at the limit", url: "http://sqs.eu-west-1.amazonaws.com/123/q?a=bcd", wantStatus: http.StatusOK},
+		{name: "rejects long paths", url: "http://sqs.eu-west-1.amazonaws.com/123/queue-name", wantStatus: http.StatusRequestURITooLong, wantBody: "request URL of 15 bytes exceeds the maximum of 12"},
+		{name: "counts the query", url: "http://sqs.eu-west-1.amazonaws.com/123/q?a=bcde", wantStatus: http.StatusRequestURITooLong, wantBody: "request URL of 13 bytes exceeds the maximum of 12"},
+		{name: "counts escaped characters", url: "http://sqs.eu-west-1.amazonaws.com/123/%E2%9C%93", wantStatus: http.StatusRequestURITooLong, wantBody: "request URL of 14 bytes exceeds the maximum of 12"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}}
+			h := &Handler{
+				ProxyClient:  &ProxyClient{Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})), Client: client},
+				MaxURLLength: 12,
+			}
+			request, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			assert.Equal(t, tt.wantBody, r.Body.String())
+			assert.Equal(t, tt.wantStatus == http.StatusOK, client.Request != nil)
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_MaxRequestBodySize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+		wantBody      string
+	}{
+		{name: "forwards bodies at the limit", body: "0123456789", contentLength: 10, wantStatus: http.StatusOK},
+		{name: "rejects larger declared bodies before reading them", body: "0123456789a", contentLength: 11, wantStatus: http.StatusRequestEntityTooLarge, wantBody: "request body of 11 bytes exceeds the maximum of 10"},
+		{name: "rejects larger chunked bodies", body: "0123456789a", contentLength: -1, wantStatus: http.StatusRequestEntityTooLarge, wantBody: "unable to proxy request - request body exceeds the maximum of 10 bytes"},
+		{name: "forwards chunked bodies at the limit", body: "0123456789", contentLength: -1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))}}
+			h := &Handler{
+				ProxyClient:        &ProxyClient{Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})), Client: client},
+				MaxRequestBodySize: 10,
+			}
+			request := httptest.NewRequest(http.MethodPost, "http://sqs.eu-west-1.amazonaws.com/", ioutil.NopCloser(strings.NewReader(tt.body)))
+			request.ContentLength = tt.contentLength
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			assert.Equal(t, tt.wantBody, r.Body.String())
+			if tt.wantStatus == http.StatusOK {
+				body, _ := ioutil.ReadAll(client.Request.Body)
+				assert.Equal(t, tt.body, string(body))
+			} else {
+				assert.Equal(t, "close", r.Header().Get("Connection"))
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_MaxResponseBodySize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+		wantBody      string
+	}{
+		{name: "relays bodies at the limit", body: "0123456789", contentLength: 10, wantStatus: http.StatusOK, wantBody: "0123456789"},
+		{name: "rejects larger declared bodies", body: "0123456789a", contentLength: 11, wantStatus: http.StatusBadGateway, wantBody: "upstream response body of 11 bytes exceeds the maximum of 10"},
+		{name: "rejects larger bodies of unknown length", body: "0123456789a", contentLength: -1, wantStatus: http.StatusBadGateway, wantBody: "upstream response body exceeds the maximum of 10 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				ProxyClient:         &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: tt.contentLength, Body: ioutil.NopCloser(strings.NewReader(tt.body))}},
+				MaxResponseBodySize: 10,
+			}
+			request := httptest.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			assert.Equal(t, tt.wantBody, r.Body.String())
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_LogErrorBodies(t *testing.T) {
+	hook := logtest.NewGlobal()
+	large := strings.Repeat("x", maxLoggedErrorBody+1)
+
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantLogged    bool
+		wantMessage   string
+		wantTruncated bool
+	}{
+		{
+			name:        "logs and relays error bodies",
+			status:      http.StatusForbidden,
+			body:        `{"message":"The security token included in the request is invalid."}`,
+			wantLogged:  true,
+			wantMessage: `{"message":"The security token included in the request is invalid."}`,
+		},
+		{
+			name:          "caps logged bodies",
+			status:        http.StatusInternalServerError,
+			body:          large,
+			wantLogged:    true,
+			wantMessage:   large[:maxLoggedErrorBody],
+			wantTruncated: true,
+		},
+		{
+			name:   "ignores successful responses",
+			status: http.StatusOK,
+			body:   "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			h := &Handler{ProxyClient: &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client: &mockHTTPClient{Response: &http.Response{
+					StatusCode: tt.status,
+					Header:     http.Header{},
+					Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+				}},
+				LogErrorBodies: true,
+			}}
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			r := httptest.NewRecorder()
+
+			h.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.status, r.Code)
+			assert.Equal(t, tt.body, r.Body.String())
+
+			var logged *log.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "error proxying request" {
+					logged = entry
+				}
+			}
+			assert.Equal(t, tt.wantLogged, logged != nil)
+			if logged != nil {
+				assert.Equal(t, tt.status, logged.Data["status"])
+				assert.Equal(t, tt.wantMessage, logged.Data["message"])
+				assert.Equal(t, tt.wantTruncated, logged.Data["truncated"])
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_RequestLogger(t *testing.T) {
+	global := logtest.NewGlobal()
+
+	tests := []struct {
+		name          string
+		contextLogger bool
+		factory       bool
+		wantRequestID string
+	}{
+		{name: "uses the logger of the request context", contextLogger: true, wantRequestID: "from-context"},
+		{name: "uses the logger of the factory", factory: true, wantRequestID: "from-factory"},
+		{name: "prefers the logger of the request context", contextLogger: true, factory: true, wantRequestID: "from-context"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global.Reset()
+			logger, hook := logtest.NewNullLogger()
+			h := &Handler{ProxyClient: &ProxyClient{
+				Signer:        v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:        &mockHTTPClient{},
+				TenantHeader:  "X-Tenant",
+				TenantSigners: map[string]*v4.Signer{"team-a": v4.NewSigner(credentials.NewCredentials(&mockProvider{}))},
+			}}
+			if tt.factory {
+				h.RequestLogger = func(r *http.Request) log.FieldLogger {
+					return logger.WithField("request_id", "from-factory")
+				}
+			}
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+			request.Header.Set("X-Tenant", "team-b")
+			if tt.contextLogger {
+				request = request.WithContext(WithLogger(request.Context(), logger.WithField("request_id", "from-context")))
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), request)
+
+			// Both the ProxyClient and the Handler log the rejected request
+			var messages []string
+			for _, entry := range hook.AllEntries() {
+				messages = append(messages, entry.Message)
+				assert.Equal(t, tt.wantRequestID, entry.Data["request_id"])
+			}
+			assert.Equal(t, []string{"rejecting request of unknown tenant", "unable to proxy request"}, messages)
+			assert.Empty(t, global.AllEntries())
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_CountsBodyBytes(t *testing.T) {
+	hook := logtest.NewGlobal()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	tests := []struct {
+		name     string
+		response *http.Response
+		wantOut  int64
+	}{
+		{
+			name: "buffered responses",
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewReader(make([]byte, 2048))),
+			},
+			wantOut: 2048,
+		},
+		{
+			name: "streamed responses",
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+				Body:       ioutil.NopCloser(&chunkReader{chunks: [][]byte{make([]byte, 1000), make([]byte, 500)}}),
+			},
+			wantOut: 1500,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			h := &Handler{ProxyClient: &signingProxyClient{
+				mockProxyClient: mockProxyClient{Response: tt.response},
+				service:         "s3",
+				region:          "eu-west-1",
+			}}
+
+			request := httptest.NewRequest(http.MethodPut, "http://localhost:8080/bucket/key", bytes.NewReader(make([]byte, 4096)))
+			h.ServeHTTP(httptest.NewRecorder(), request)
+
+			entry := hook.LastEntry()
+			if assert.NotNil(t, entry) {
+				assert.Equal(t, "proxied request", entry.Message)
+				assert.Equal(t, "s3", entry.Data["service"])
+				assert.Equal(t, int64(4096), entry.Data["request_bytes"])
+				assert.Equal(t, tt.wantOut, entry.Data["response_bytes"])
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_ClientBodyTimeout(t *testing.T) {
+	client := &mockHTTPClient{}
+	server := httptest.NewServer(&Handler{ProxyClient: &ProxyClient{
+		Signer:            v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:            client,
+		ClientBodyTimeout: 50 * time.Millisecond,
+	}})
+	defer server.Close()
+
+	// Trickle the body, never finishing it within the timeout
+	body, trickle := io.Pipe()
+	defer trickle.Close()
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := trickle.Write([]byte("a")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	request, _ := http.NewRequest(http.MethodPut, server.URL+"/bucket/key", body)
+	request.Host = "s3.us-west-2.amazonaws.com"
+	request.ContentLength = 100
+	resp, err := server.Client().Do(request)
+
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	}
+	assert.Nil(t, client.Request, "the request must not be forwarded")
+}
+
+func TestHandler_ServeHTTP_ClientBodyTimeout_Stalled(t *testing.T) {
+	server := httptest.NewServer(&Handler{ProxyClient: &ProxyClient{
+		Signer:            v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:            &mockHTTPClient{},
+		ClientBodyTimeout: 50 * time.Millisecond,
+	}})
+	// Closing the server waits for the connection to be closed
+	defer server.Close()
+
+	// Send a single byte of the body, then stop sending anything
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PUT /bucket/key HTTP/1.1\r\nHost: s3.us-west-2.amazonaws.com\r\nContent-Length: 100\r\n\r\na"))
+	assert.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+	}
+
+	// The proxy closes the connection without waiting for the body
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHandler_ServeHTTP_HeadAsGet(t *testing.T) {
+	signer := v4.NewSigner(credentials.NewCredentials(&mockProvider{}))
+	client := &mockHTTPClient{Response: &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": []string{"11"}, "Etag": []string{`"abc"`}},
+		ContentLength: 11,
+		Body:          ioutil.NopCloser(bytes.NewBufferString("hello world")),
+	}}
+	h := &Handler{ProxyClient: &ProxyClient{Signer: signer, Client: client, HeadAsGet: true}}
+
+	request, _ := http.NewRequest(http.MethodHead, "http://execute-api.us-west-2.amazonaws.com/prod/items", nil)
+	r := httptest.NewRecorder()
+	h.ServeHTTP(r, request)
+
+	forwarded := client.Request
+	assert.Equal(t, http.MethodGet, forwarded.Method)
+
+	// The signature covers the GET method
+	signTime, err := time.Parse("20060102T150405Z", forwarded.Header.Get("X-Amz-Date"))
+	assert.Nil(t, err)
+	expected, _ := http.NewRequest(http.MethodGet, "https://execute-api.us-west-2.amazonaws.com/prod/items", nil)
+	_, err = signer.Sign(expected, nil, "execute-api", "us-west-2", signTime)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Header.Get("Authorization"), forwarded.Header.Get("Authorization"))
+
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, `"abc"`, r.Header().Get("Etag"))
+	assert.Equal(t, "11", r.Header().Get("Content-Length"))
+	assert.Empty(t, r.Body.String())
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// HeaderRules add, remove and rewrite the headers of signed requests and of
+// their responses.
+type HeaderRules struct {
+	// SetRequestHeaders are set on upstream requests, replacing those of the
+	// client, before they are signed so the signature covers them.
+	SetRequestHeaders http.Header
+	// RemoveRequestHeaders are stripped from client requests before signing.
+	RemoveRequestHeaders []string
+	// SetResponseHeaders are set on responses, replacing the upstream's.
+	SetResponseHeaders http.Header
+	// RewriteResponseHeaders rewrite the values of response headers.
+	RewriteResponseHeaders []HeaderRewrite
+	// RemoveResponseHeaders are dropped from responses.
+	RemoveResponseHeaders []string
+}
+
+// HeaderRewrite replaces the parts of the values of the Name header matched
+// by Pattern with Replacement, which may reference capture groups as $1.
+type HeaderRewrite struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// applyRequest applies the rules to a request about to be signed, whose
+// client headers are copied onto the upstream ones once it is.
+func (r *HeaderRules) applyRequest(client, upstream http.Header) {
+	for _, name := range r.RemoveRequestHeaders {
+		client.Del(name)
+		upstream.Del(name)
+	}
+	for name, values := range r.SetRequestHeaders {
+		client.Del(name)
+		upstream[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+}
+
+// applyResponse applies the rules to the header of a response.
+func (r *HeaderRules) applyResponse(h http.Header) {
+	for _, name := range r.RemoveResponseHeaders {
+		h.Del(name)
+	}
+	for _, rewrite := range r.RewriteResponseHeaders {
+		values := h.Values(rewrite.Name)
+		for i, v := range values {
+			values[i] = rewrite.Pattern.ReplaceAllString(v, rewrite.Replacement)
+		}
+	}
+	for name, values := range r.SetResponseHeaders {
+		h[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+}
+
+// headerRules returns the rules applying to requests for route, those of
+// the ProxyClient first so the route's take precedence.
+func (p *ProxyClient) headerRules(route *Route) []*HeaderRules {
+	var rules []*HeaderRules
+	if p.HeaderRules != nil {
+		rules = append(rules, p.HeaderRules)
+	}
+	if route != nil && route.HeaderRules != nil {
+		rules = append(rules, route.HeaderRules)
+	}
+	return rules
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Do_HeaderRules(t *testing.T) {
+	client := &mockHTTPClient{Response: &http.Response{Header: http.Header{
+		"Server":   {"AmazonS3"},
+		"Location": {"https://bucket.s3.amazonaws.com/key"},
+		"X-Amz-Id": {"id"},
+	}}}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+		HeaderRules: &HeaderRules{
+			SetRequestHeaders:      http.Header{"X-Amz-Acl": {"private"}},
+			RemoveRequestHeaders:   []string{"x-debug"},
+			RewriteResponseHeaders: []HeaderRewrite{{Name: "location", Pattern: regexp.MustCompile(`^https://([^.]+)\.s3\.amazonaws\.com/`), Replacement: "/$1/"}},
+			RemoveResponseHeaders:  []string{"server"},
+		},
+		Routes: []Route{{
+			PathPrefix: "/uploads",
+			Upstream:   &url.URL{Scheme: "https", Host: "s3.eu-west-1.amazonaws.com"},
+			HeaderRules: &HeaderRules{
+				SetRequestHeaders:  http.Header{"X-Amz-Acl": {"bucket-owner-full-control"}, "X-Amz-Server-Side-Encryption": {"aws:kms"}},
+				SetResponseHeaders: http.Header{"Cache-Control": {"no-store"}},
+			},
+		}},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		wantACL      string
+		wantSSE      string
+		wantSigned   string
+		wantResponse http.Header
+	}{
+		{
+			name:       "applies the proxy's rules",
+			path:       "/key",
+			wantACL:    "private",
+			wantSigned: "host;x-amz-acl",
+			wantResponse: http.Header{
+				"Location": {"/bucket/key"},
+				"X-Amz-Id": {"id"},
+			},
+		},
+		{
+			name:       "applies the route's rules last",
+			path:       "/uploads/key",
+			wantACL:    "bucket-owner-full-control",
+			wantSSE:    "aws:kms",
+			wantSigned: "host;x-amz-acl;x-amz-server-side-encryption",
+			wantResponse: http.Header{
+				"Location":      {"/bucket/key"},
+				"X-Amz-Id":      {"id"},
+				"Cache-Control": {"no-store"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.Response.Header = http.Header{
+				"Server":   {"AmazonS3"},
+				"Location": {"https://bucket.s3.amazonaws.com/key"},
+				"X-Amz-Id": {"id"},
+			}
+			resp, err := proxyClient.Do(&http.Request{
+				Method: http.MethodPut,
+				URL:    &url.URL{Path: tt.path},
+				Host:   "s3.eu-west-1.amazonaws.com",
+				Header: http.Header{
+					"X-Amz-Acl": {"public-read"},
+					"X-Debug":   {"1"},
+				},
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, []string{tt.wantACL}, client.Request.Header.Values("X-Amz-Acl"))
+			assert.Equal(t, tt.wantSSE, client.Request.Header.Get("X-Amz-Server-Side-Encryption"))
+			assert.Empty(t, client.Request.Header.Get("X-Debug"))
+			assert.Equal(t, tt.wantSigned, client.Request.URL.Query().Get("X-Amz-SignedHeaders"))
+			assert.Equal(t, tt.wantResponse, resp.Header)
+		})
+	}
+}
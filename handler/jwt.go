@@ -0,0 +1,396 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long keys fetched from a JWKS are used before it is
+	// fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefreshInterval is how often, at most, the JWKS is fetched again
+	// for tokens signed by a key it did not have.
+	jwksMinRefreshInterval = time.Minute
+	// jwtLeeway is the clock skew tolerated on expiry and not before times.
+	jwtLeeway = time.Minute
+)
+
+// jwtAlgorithms are the hashes of the supported signing algorithms.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurves are the curves of the keys the ES algorithms sign with.
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// JWTAuth only lets through requests whose Authorization header carries a
+// bearer JWT signed by a key of the JWKS at JWKSURL and not expired, issued
+// by Issuer and for Audience when they are set. The token is still
+// forwarded with ForwardAuthorizationAs.
+type JWTAuth struct {
+	JWKSURL  string
+	Issuer   string
+	Audience string
+	Client   Client
+
+	// now returns the current time, time.Now when nil.
+	now func() time.Time
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching *jwksFetch
+}
+
+// jwksFetch is a fetch of the JWKS in progress, waited for by the requests
+// needing a key that is not cached.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWTAuth returns a JWTAuth fetching the JWKS at jwksURL with client.
+func NewJWTAuth(jwksURL, issuer, audience string, client Client) *JWTAuth {
+	return &JWTAuth{JWKSURL: jwksURL, Issuer: issuer, Audience: audience, Client: client}
+}
+
+func (a *JWTAuth) Authenticate(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return &statusError{status: http.StatusUnauthorized, err: errors.New("missing bearer token")}
+	}
+	claims, err := a.verify(strings.TrimSpace(auth[len("Bearer "):]))
+	if err != nil {
+		return &statusError{status: http.StatusUnauthorized, err: fmt.Errorf("invalid bearer token: %w", err)}
+	}
+	if claims.Subject != "" {
+		requestInfoFrom(r.Context()).Identity = "jwt:" + claims.Subject
+	}
+	return nil
+}
+
+func (a *JWTAuth) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// jwtClaims are the registered claims checked by JWTAuth.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// audiences returns the audience claim, a single string or a list.
+func (c *jwtClaims) audiences() []string {
+	var aud []string
+	if err := json.Unmarshal(c.Audience, &aud); err == nil {
+		return aud
+	}
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return []string{single}
+	}
+	return nil
+}
+
+// verify checks the signature and claims of token, returning the claims.
+func (a *JWTAuth) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := a.clock()
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.Add(-jwtLeeway).After(unixTime(*claims.ExpiresAt)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.Audience != "" && !containsString(claims.audiences(), a.Audience) {
+		return nil, errors.New("token is not meant for this audience")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks signature is that of input by key with alg.
+func verifyJWTSignature(alg string, key crypto.PublicKey, input string, signature []byte) error {
+	hash := jwtAlgorithms[alg]
+	h := hash.New()
+	io.WriteString(h, input)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match the RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if jwtCurves[alg] != key.Curve {
+			return fmt.Errorf("algorithm %s does not match the EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+// key returns the JWKS key kid, the only key when kid is empty, fetching the
+// JWKS again when the keys are too old or kid is unknown. The JWKS is fetched
+// by one request at a time, without holding the lock, the others using the
+// cached keys in the meantime or waiting for it when they do not have kid.
+func (a *JWTAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock()
+	lookup := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(a.keys) == 1 {
+			for _, k := range a.keys {
+				return k, true
+			}
+		}
+		k, ok := a.keys[kid]
+		return k, ok
+	}
+
+	key, ok := lookup()
+	stale := a.fetched.IsZero() || now.Sub(a.fetched) >= jwksMaxAge
+	if stale || (!ok && now.Sub(a.fetched) >= jwksMinRefreshInterval) {
+		if f := a.fetching; f != nil {
+			if ok {
+				return key, nil
+			}
+			a.mu.Unlock()
+			<-f.done
+			a.mu.Lock()
+			if f.err != nil && len(a.keys) == 0 {
+				return nil, f.err
+			}
+		} else {
+			f := &jwksFetch{done: make(chan struct{})}
+			a.fetching = f
+			a.mu.Unlock()
+			keys, err := a.fetchKeys()
+			a.mu.Lock()
+			a.fetching = nil
+			f.err = err
+			close(f.done)
+			// The previous keys keep being used if the JWKS cannot be fetched
+			if err != nil && len(a.keys) == 0 {
+				return nil, err
+			}
+			a.fetched = now
+			if err == nil {
+				a.keys = keys
+			}
+		}
+		key, ok = lookup()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// jwk is a JSON Web Key, of the RSA or EC types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys returns the signing keys of the JWKS by key ID.
+func (a *JWTAuth) fetchKeys() (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, a.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("malformed key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("malformed key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signJWT returns a token with claims signed by key with alg.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+
+	h := jwtAlgorithms[alg].New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, jwtAlgorithms[alg], digest)
+		assert.Nil(t, err)
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		assert.Nil(t, err)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	return input + "." + b64(signature)
+}
+
+// jwksServer serves the public keys in keys and counts the fetches.
+func jwksServer(keys map[string]crypto.Signer, fetches *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		var set []map[string]string
+		for kid, key := range keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				set = append(set, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())})
+			case *ecdsa.PublicKey:
+				set = append(set, map[string]string{"kty": "EC", "kid": kid, "crv": pub.Curve.Params().Name, "x": b64(pub.X.Bytes()), "y": b64(pub.Y.Bytes())})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+}
+
+func TestJWTAuth_Authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	var fetches int32
+	jwks := jwksServer(map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}, &fetches)
+	defer jwks.Close()
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://issuer", "sub": "alice", "aud": []string{"proxy", "other"}, "exp": now.Add(time.Hour).Unix()}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantError string
+	}{
+		{name: "RS256", token: signJWT(t, "RS256", "rsa", rsaKey, claims(nil))},
+		{name: "ES256", token: signJWT(t, "ES256", "ec", ecKey, claims(nil))},
+		{name: "single audience", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": "proxy"}))},
+		{name: "expired within leeway", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))},
+		{name: "expired", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), wantError: "invalid bearer token: token has expired"},
+		{name: "no expiry", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"exp": nil})), wantError: "invalid bearer token: token has no expiry"},
+		{name: "not valid yet", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), wantError: "invalid bearer token: token is not valid yet"},
+		{name: "other issuer", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"iss": "https://other"})), wantError: `invalid bearer token: unexpected issuer "https://other"`},
+		{name: "other audience", token: signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": "other"})), wantError: "invalid bearer token: token is not meant for this audience"},
+		{name: "signed by another key", token: signJWT(t, "ES256", "ec", otherKey, claims(nil)), wantError: "invalid bearer token: invalid signature"},
+		{name: "algorithm of another key type", token: signJWT(t, "ES256", "rsa", ecKey, claims(nil)), wantError: "invalid bearer token: algorithm ES256 does not match the RSA key"},
+		{name: "unsigned", token: b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{}`)) + ".", wantError: `invalid bearer token: unsupported algorithm "none"`},
+		{name: "malformed", token: "not-a-token", wantError: "invalid bearer token: malformed token"},
+		{name: "missing token", wantError: "missing bearer token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := NewJWTAuth(jwks.URL, "https://issuer", "proxy", http.DefaultClient)
+			auth.now = func() time.Time { return now }
+			info := &requestInfo{}
+			r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(withRequestInfo(context.Background(), info))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			err := auth.Authenticate(r)
+
+			if tt.wantError == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, "jwt:alice", info.Identity)
+			} else {
+				assert.EqualError(t, err, tt.wantError)
+				assert.Equal(t, http.StatusUnauthorized, errorStatus(err))
+			}
+		})
+	}
+}
+
+func TestJWTAuth_KeyRotation(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	keys := map[string]crypto.Signer{"old": oldKey}
+	var fetches int32
+	jwks := jwksServer(keys, &fetches)
+	defer jwks.Close()
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	auth := NewJWTAuth(jwks.URL, "", "", http.DefaultClient)
+	auth.now = func() time.Time { return now }
+	exp := map[string]interface{}{"exp": now.Add(24 * time.Hour).Unix()}
+	verify := func(token string) error {
+		_, err := auth.verify(token)
+		return err
+	}
+
+	assert.Nil(t, verify(signJWT(t, "ES256", "old", oldKey, exp)))
+	assert.Nil(t, verify(signJWT(t, "ES256", "old", oldKey, exp)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Unknown keys are fetched at most once per interval
+	keys["new"] = newKey
+	assert.EqualError(t, verify(signJWT(t, "ES256", "new", newKey, exp)), `unknown signing key "new"`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	now = now.Add(jwksMinRefreshInterval)
+	assert.Nil(t, verify(signJWT(t, "ES256", "new", newKey, exp)))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// Keys are kept when the JWKS cannot be fetched
+	jwks.Close()
+	now = now.Add(jwksMaxAge)
+	assert.Nil(t, verify(signJWT(t, "ES256", "old", oldKey, exp)))
+}
+
+// blockingJWKSClient blocks fetches of the JWKS until release is closed.
+type blockingJWKSClient struct {
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (c *blockingJWKSClient) Do(req *http.Request) (*http.Response, error) {
+	c.fetching <- struct{}{}
+	<-c.release
+	return http.DefaultClient.Do(req)
+}
+
+func TestJWTAuth_FetchesOnce(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	var fetches int32
+	jwks := jwksServer(map[string]crypto.Signer{"current": key}, &fetches)
+	defer jwks.Close()
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	client := &blockingJWKSClient{fetching: make(chan struct{}, 10), release: make(chan struct{})}
+	auth := NewJWTAuth(jwks.URL, "", "", client)
+	auth.now = func() time.Time { return now }
+	token := signJWT(t, "ES256", "current", key, map[string]interface{}{"exp": now.Add(24 * time.Hour).Unix()})
+
+	// Requests without keys wait for the fetch in progress
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := auth.verify(token)
+			errs <- err
+		}()
+	}
+	<-client.fetching
+	close(client.release)
+	for i := 0; i < cap(errs); i++ {
+		assert.Nil(t, <-errs)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Stale keys are used while they are fetched again
+	client.release = make(chan struct{})
+	now = now.Add(jwksMaxAge)
+	go func() {
+		_, err := auth.verify(token)
+		errs <- err
+	}()
+	<-client.fetching
+	_, err = auth.verify(token)
+	assert.Nil(t, err)
+	close(client.release)
+	assert.Nil(t, <-errs)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram
+// buckets, those of the Prometheus client libraries.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the metrics of proxied requests, served in the Prometheus
+// text format, or in the OpenMetrics one to scrapers accepting it. When
+// requests are traced, the upstream latency buckets of OpenMetrics carry the
+// trace ID of their latest request as an exemplar.
+type Metrics struct {
+	// CredentialsExpiry, when set, returns the seconds left before the
+	// credentials expire, false if unknown, see
+	// CredentialsExpiryWatcher.SecondsUntilExpiry.
+	CredentialsExpiry func() (float64, bool)
+	// Cache, when set, is the response cache whose hits, misses and bypasses
+	// are counted.
+	Cache *ResponseCache
+	// MirrorsDropped, when set, returns how many mirrored requests were
+	// dropped, see ProxyClient.MirrorsDropped.
+	MirrorsDropped func() uint64
+	// AuditDropped and AuditFailed, when set, return how many audit events
+	// were dropped and could not be delivered, see AuditWebhook.Dropped and
+	// AuditWebhook.Failed.
+	AuditDropped func() uint64
+	AuditFailed  func() uint64
+
+	inFlight        int64
+	refreshFailures uint64
+
+	mu              sync.Mutex
+	requests        map[requestKey]uint64
+	requestBytes    map[string]int64
+	responseBytes   map[string]int64
+	signingDuration *histogram
+	upstreamLatency map[string]*histogram
+}
+
+// requestKey identifies the requests counted together.
+type requestKey struct {
+	service string
+	code    int
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        map[requestKey]uint64{},
+		requestBytes:    map[string]int64{},
+		responseBytes:   map[string]int64{},
+		signingDuration: newHistogram(),
+		upstreamLatency: map[string]*histogram{},
+	}
+}
+
+// start counts a request in flight and returns a function to call once it
+// completes.
+func (m *Metrics) start() func() {
+	atomic.AddInt64(&m.inFlight, 1)
+	return func() { atomic.AddInt64(&m.inFlight, -1) }
+}
+
+// observe records a completed request answered with status.
+func (m *Metrics) observe(info *requestInfo, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{service: info.Service, code: status}]++
+	m.requestBytes[info.Service] += info.RequestBytes
+	m.responseBytes[info.Service] += info.ResponseBytes
+	if info.SigningDuration > 0 {
+		m.signingDuration.observe(info.SigningDuration, "")
+	}
+	if info.UpstreamDuration > 0 {
+		h, ok := m.upstreamLatency[info.Service]
+		if !ok {
+			h = newHistogram()
+			m.upstreamLatency[info.Service] = h
+		}
+		traceID := ""
+		if info.Span != nil && info.Span.Sampled {
+			traceID = hex.EncodeToString(info.Span.TraceID[:])
+		}
+		h.observe(info.UpstreamDuration, traceID)
+	}
+}
+
+// CountRefreshFailure counts a failure to refresh the credentials, it is
+// meant to be passed to NewRefreshLimitedCredentials.
+func (m *Metrics) CountRefreshFailure(error) {
+	atomic.AddUint64(&m.refreshFailures, 1)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	m.write(w, openMetrics)
+}
+
+// write writes the metrics to w in the Prometheus text format, or the
+// OpenMetrics one.
+func (m *Metrics) write(w io.Writer, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "proxy_requests_total", "counter", "Proxied requests by service and response status code.", openMetrics)
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "proxy_requests_total{service=%s,code=\"%d\"} %d\n", labelValue(k.service), k.code, m.requests[k])
+	}
+
+	writeHeader(w, "proxy_requests_in_flight", "gauge", "Requests being proxied.", openMetrics)
+	fmt.Fprintf(w, "proxy_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+
+	writeHeader(w, "proxy_request_bytes_total", "counter", "Request body bytes read from clients by service.", openMetrics)
+	for _, service := range sortedKeys(m.requestBytes) {
+		fmt.Fprintf(w, "proxy_request_bytes_total{service=%s} %d\n", labelValue(service), m.requestBytes[service])
+	}
+	writeHeader(w, "proxy_response_bytes_total", "counter", "Response body bytes written to clients by service.", openMetrics)
+	for _, service := range sortedKeys(m.responseBytes) {
+		fmt.Fprintf(w, "proxy_response_bytes_total{service=%s} %d\n", labelValue(service), m.responseBytes[service])
+	}
+
+	writeHeader(w, "proxy_signing_duration_seconds", "histogram", "Time spent signing requests.", openMetrics)
+	m.signingDuration.write(w, "proxy_signing_duration_seconds", "", openMetrics)
+
+	writeHeader(w, "proxy_upstream_duration_seconds", "histogram", "Time until upstreams responded with the headers of their response, by service.", openMetrics)
+	services := make([]string, 0, len(m.upstreamLatency))
+	for service := range m.upstreamLatency {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		m.upstreamLatency[service].write(w, "proxy_upstream_duration_seconds", "service="+labelValue(service)+",", openMetrics)
+	}
+
+	writeHeader(w, "proxy_credential_refresh_failures_total", "counter", "Failed attempts to retrieve AWS credentials.", openMetrics)
+	fmt.Fprintf(w, "proxy_credential_refresh_failures_total %d\n", atomic.LoadUint64(&m.refreshFailures))
+
+	if m.CredentialsExpiry != nil {
+		if seconds, ok := m.CredentialsExpiry(); ok {
+			writeHeader(w, "proxy_credentials_seconds_until_expiry", "gauge", "Seconds left before the AWS credentials expire.", openMetrics)
+			fmt.Fprintf(w, "proxy_credentials_seconds_until_expiry %s\n", formatFloat(seconds))
+		}
+	}
+
+	if m.Cache != nil {
+		writeHeader(w, "proxy_cache_requests_total", "counter", "Cacheable requests by result, hit, miss or bypass.", openMetrics)
+		fmt.Fprintf(w, "proxy_cache_requests_total{result=\"hit\"} %d\n", m.Cache.Hits())
+		fmt.Fprintf(w, "proxy_cache_requests_total{result=\"miss\"} %d\n", m.Cache.Misses())
+		fmt.Fprintf(w, "proxy_cache_requests_total{result=\"bypass\"} %d\n", m.Cache.Bypasses())
+	}
+
+	if m.MirrorsDropped != nil {
+		writeHeader(w, "proxy_mirrors_dropped_total", "counter", "Mirrored requests dropped as too many were in flight.", openMetrics)
+		fmt.Fprintf(w, "proxy_mirrors_dropped_total %d\n", m.MirrorsDropped())
+	}
+
+	if m.AuditDropped != nil {
+		writeHeader(w, "proxy_audit_events_dropped_total", "counter", "Audit events dropped as the buffer was full.", openMetrics)
+		fmt.Fprintf(w, "proxy_audit_events_dropped_total %d\n", m.AuditDropped())
+	}
+	if m.AuditFailed != nil {
+		writeHeader(w, "proxy_audit_events_failed_total", "counter", "Audit events which could not be delivered.", openMetrics)
+		fmt.Fprintf(w, "proxy_audit_events_failed_total %d\n", m.AuditFailed())
+	}
+
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family, named
+// without the _total suffix of counters in OpenMetrics.
+func writeHeader(w io.Writer, name, kind, help string, openMetrics bool) {
+	if openMetrics && kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns v quoted as a label value.
+func labelValue(v string) string {
+	return `"` + labelValueReplacer.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// histogram counts observed durations in latencyBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	// exemplars holds the latest traced observation of each bucket, the last
+	// one being +Inf.
+	exemplars []*exemplar
+}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)), exemplars: make([]*exemplar, len(latencyBuckets)+1)}
+}
+
+// observe counts d, kept as the exemplar of its bucket when traceID is not
+// empty.
+func (h *histogram) observe(d time.Duration, traceID string) {
+	seconds := d.Seconds()
+	bucket := len(latencyBuckets)
+	for i := len(latencyBuckets) - 1; i >= 0; i-- {
+		if seconds <= latencyBuckets[i] {
+			h.counts[i]++
+			bucket = i
+		}
+	}
+	h.count++
+	h.sum += seconds
+	if traceID != "" {
+		h.exemplars[bucket] = &exemplar{traceID: traceID, value: seconds, time: time.Now()}
+	}
+}
+
+// write writes the series of h, labels being those, each followed by a
+// comma, preceding the bucket bound. Exemplars are only written in
+// OpenMetrics.
+func (h *histogram) write(w io.Writer, name, labels string, openMetrics bool) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d%s\n", name, labels, formatFloat(bound), h.counts[i], h.exemplar(i, openMetrics))
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d%s\n", name, labels, h.count, h.exemplar(len(latencyBuckets), openMetrics))
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// exemplar returns the exemplar of a bucket to append to its line, if any.
+func (h *histogram) exemplar(bucket int, openMetrics bool) string {
+	e := h.exemplars[bucket]
+	if !openMetrics || e == nil {
+		return ""
+	}
+	return fmt.Sprintf(" # {trace_id=%s} %s %s", labelValue(e.traceID), formatFloat(e.value), strconv.FormatFloat(float64(e.time.UnixNano())/1e9, 'f', 3, 64))
+}
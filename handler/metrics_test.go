@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_ServeHTTP_Metrics(t *testing.T) {
+	metrics := NewMetrics()
+	client := &mockHTTPClient{}
+	h := &Handler{
+		ProxyClient: &ProxyClient{
+			Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+			Client: client,
+		},
+		Metrics: metrics,
+	}
+
+	for i := 0; i < 2; i++ {
+		client.Response = &http.Response{
+			StatusCode: http.StatusCreated,
+			Body:       ioutil.NopCloser(strings.NewReader("created")),
+		}
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("Action=SendMessage"))
+		request.Host = "sqs.us-west-2.amazonaws.com"
+		h.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, out, "# TYPE proxy_requests_total counter\n")
+	assert.Contains(t, out, `proxy_requests_total{service="",code="502"} 1`+"\n")
+	assert.Contains(t, out, `proxy_requests_total{service="sqs",code="201"} 2`+"\n")
+	assert.Contains(t, out, "proxy_requests_in_flight 0\n")
+	assert.Contains(t, out, `proxy_request_bytes_total{service="sqs"} 36`+"\n")
+	assert.Contains(t, out, `proxy_response_bytes_total{service="sqs"} 14`+"\n")
+	assert.Contains(t, out, "proxy_signing_duration_seconds_count 2\n")
+	assert.Contains(t, out, `proxy_upstream_duration_seconds_bucket{service="sqs",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, `proxy_upstream_duration_seconds_count{service="sqs"} 2`+"\n")
+	assert.Contains(t, out, "proxy_credential_refresh_failures_total 0\n")
+	assert.NotContains(t, out, "proxy_credentials_seconds_until_expiry")
+}
+
+func TestHandler_ServeHTTP_MetricsOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		tracer    *Tracer
+		exemplars bool
+	}{
+		{name: "untraced"},
+		{name: "traced", tracer: &Tracer{SampleRatio: 1, spans: make(chan otlpSpan, 1)}, exemplars: true},
+		{name: "not sampled", tracer: &Tracer{SampleRatio: 0, spans: make(chan otlpSpan, 1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			h := &Handler{
+				ProxyClient: &ProxyClient{
+					Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+					Client: &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}},
+				},
+				Metrics: metrics,
+				Tracer:  tt.tracer,
+			}
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("Action=SendMessage"))
+			request.Host = "sqs.us-west-2.amazonaws.com"
+			h.ServeHTTP(httptest.NewRecorder(), request)
+
+			rec := httptest.NewRecorder()
+			scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			scrape.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+			metrics.ServeHTTP(rec, scrape)
+			out := rec.Body.String()
+
+			assert.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", rec.Header().Get("Content-Type"))
+			assert.Contains(t, out, "# TYPE proxy_requests counter\n")
+			assert.Contains(t, out, `proxy_requests_total{service="sqs",code="200"} 1`+"\n")
+			assert.True(t, strings.HasSuffix(out, "# EOF\n"))
+			if tt.exemplars {
+				span := <-tt.tracer.spans
+				assert.Contains(t, out, ` # {trace_id="`+span.TraceID+`"} `)
+			} else {
+				assert.NotContains(t, out, "trace_id")
+			}
+		})
+	}
+}
+
+func TestMetrics_CountRefreshFailure(t *testing.T) {
+	metrics := NewMetrics()
+	provider := &rotatingProvider{fail: true}
+	creds := NewRefreshLimitedCredentials(credentials.NewCredentials(provider), 0, 0, metrics.CountRefreshFailure)
+
+	_, err := creds.Get()
+	assert.NotNil(t, err)
+	_, err = creds.Get()
+	assert.NotNil(t, err)
+
+	provider.fail = false
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID3", v.AccessKeyID)
+	expiry, err := creds.ExpiresAt()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 10, 1, 3, 0, 0, 0, time.UTC), expiry)
+
+	// Reloading refreshes the wrapped credentials
+	status, err := ReloadCredentials(creds)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 10, 1, 4, 0, 0, 0, time.UTC), status.Expiry)
+
+	metrics.CredentialsExpiry = func() (float64, bool) { return 90.5, true }
+	var buf bytes.Buffer
+	metrics.write(&buf, false)
+	assert.Contains(t, buf.String(), "proxy_credential_refresh_failures_total 2\n")
+	assert.Contains(t, buf.String(), "proxy_credentials_seconds_until_expiry 90.5\n")
+}
+
+func TestMetrics_Audit(t *testing.T) {
+	metrics := NewMetrics()
+	var buf bytes.Buffer
+	metrics.write(&buf, false)
+	assert.NotContains(t, buf.String(), "proxy_audit_events")
+
+	metrics.AuditDropped = func() uint64 { return 3 }
+	metrics.AuditFailed = func() uint64 { return 2 }
+	buf.Reset()
+	metrics.write(&buf, true)
+	assert.Contains(t, buf.String(), "# TYPE proxy_audit_events_dropped counter\nproxy_audit_events_dropped_total 3\n")
+	assert.Contains(t, buf.String(), "# TYPE proxy_audit_events_failed counter\nproxy_audit_events_failed_total 2\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(3*time.Millisecond, "")
+	h.observe(200*time.Millisecond, "")
+	h.observe(20*time.Second, "")
+
+	var buf bytes.Buffer
+	h.write(&buf, "latency_seconds", `service="s3",`, true)
+
+	assert.Equal(t, strings.Join([]string{
+		`latency_seconds_bucket{service="s3",le="0.005"} 1`,
+		`latency_seconds_bucket{service="s3",le="0.01"} 1`,
+		`latency_seconds_bucket{service="s3",le="0.025"} 1`,
+		`latency_seconds_bucket{service="s3",le="0.05"} 1`,
+		`latency_seconds_bucket{service="s3",le="0.1"} 1`,
+		`latency_seconds_bucket{service="s3",le="0.25"} 2`,
+		`latency_seconds_bucket{service="s3",le="0.5"} 2`,
+		`latency_seconds_bucket{service="s3",le="1"} 2`,
+		`latency_seconds_bucket{service="s3",le="2.5"} 2`,
+		`latency_seconds_bucket{service="s3",le="5"} 2`,
+		`latency_seconds_bucket{service="s3",le="10"} 2`,
+		`latency_seconds_bucket{service="s3",le="+Inf"} 3`,
+		`latency_seconds_sum{service="s3"} 20.203`,
+		`latency_seconds_count{service="s3"} 3`,
+	}, "\n")+"\n", buf.String())
+}
+
+func TestHistogram_Exemplars(t *testing.T) {
+	h := newHistogram()
+	h.observe(200*time.Millisecond, "4bf92f3577b34da6a3ce929d0e0e4736")
+	h.observe(300*time.Millisecond, "")
+	h.observe(20*time.Second, "0af7651916cd43dd8448eb211c80319c")
+
+	var buf bytes.Buffer
+	h.write(&buf, "latency_seconds", "", true)
+	out := buf.String()
+	assert.Regexp(t, `(?m)^latency_seconds_bucket\{le="0\.25"\} 1 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\} 0\.2 \d+\.\d{3}$`, out)
+	assert.Regexp(t, `(?m)^latency_seconds_bucket\{le="0\.5"\} 2$`, out)
+	assert.Regexp(t, `(?m)^latency_seconds_bucket\{le="\+Inf"\} 3 # \{trace_id="0af7651916cd43dd8448eb211c80319c"\} 20 \d+\.\d{3}$`, out)
+
+	// The Prometheus text format has no exemplars
+	buf.Reset()
+	h.write(&buf, "latency_seconds", "", false)
+	assert.NotContains(t, buf.String(), "trace_id")
+}
+
+func TestLabelValue(t *testing.T) {
+	assert.Equal(t, `"a\"b\\c\nd"`, labelValue("a\"b\\c\nd"))
+}
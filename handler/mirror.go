@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// shouldMirror reports whether a copy of a request with body, unless
+// streamed, should be sent to MirrorUpstream.
+func (p *ProxyClient) shouldMirror(body *requestBody, streamed bool, logger log.FieldLogger) bool {
+	if p.MirrorUpstream == nil || streamed {
+		return false
+	}
+	if body.spilled() || (p.MirrorMaxBodySize > 0 && body.size > p.MirrorMaxBodySize) {
+		logger.WithField("size", body.size).Debug("not mirroring request, body too large")
+		return false
+	}
+	return true
+}
+
+// mirror sends a copy of a request to MirrorUpstream in the background,
+// signed for service by signer, and discards the response. signed holds the headers to
+// sign and unsigned the client's headers sent along, neither may be modified
+// afterwards.
+func (p *ProxyClient) mirror(logger log.FieldLogger, method string, u url.URL, signed, unsigned http.Header, body []byte, signer *v4.Signer, service *endpoints.ResolvedEndpoint) {
+	applyEndpoint(&u, p.MirrorUpstream)
+	if err := p.checkUpstreamTLS(&u); err != nil {
+		logger.WithError(err).Warn("not mirroring request")
+		return
+	}
+
+	release, ok := p.acquireMirrorSlot()
+	if !ok {
+		atomic.AddUint64(&p.mirrorsDropped, 1)
+		logger.WithField("upstream", u.Host).Warn("not mirroring request, too many mirrored requests in flight")
+		return
+	}
+
+	p.mirrors.Add(1)
+	go func() {
+		defer p.mirrors.Done()
+		defer release()
+
+		// The client going away must not cancel the mirrored request
+		ctx, cancel := context.WithCancel(context.Background())
+		if p.MirrorTimeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), p.MirrorTimeout)
+		}
+		defer cancel()
+		mirrorReq, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			logger.WithError(err).Warn("unable to mirror request")
+			return
+		}
+		mirrorReq.Header = signed.Clone()
+		if err := p.sign(mirrorReq, bytes.NewReader(body), signer, service, p.clock()); err != nil {
+			logger.WithError(err).Warn("unable to sign mirrored request")
+			return
+		}
+		copyHeaderWithoutOverwrite(mirrorReq.Header, unsigned)
+
+		resp, err := p.send(mirrorReq, p.upstreamTimeout(service.SigningName))
+		if err != nil {
+			logger.WithError(err).WithField("upstream", u.Host).Warn("unable to mirror request")
+			return
+		}
+		if resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logger.WithFields(log.Fields{"upstream": u.Host, "status": resp.StatusCode}).Debug("mirrored request")
+	}()
+}
+
+// WaitMirrors waits for the mirrored requests in flight to complete, or for
+// ctx to be done.
+func (p *ProxyClient) WaitMirrors(ctx context.Context) error {
+	return waitGroupWithin(ctx, &p.mirrors)
+}
+
+// acquireMirrorSlot returns a function releasing a slot for a mirrored
+// request, false if all MirrorMaxInFlight slots are taken.
+func (p *ProxyClient) acquireMirrorSlot() (func(), bool) {
+	p.mirrorSlotsOnce.Do(func() {
+		if p.MirrorMaxInFlight > 0 {
+			p.mirrorSlots = make(chan struct{}, p.MirrorMaxInFlight)
+		}
+	})
+
+	if p.mirrorSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case p.mirrorSlots <- struct{}{}:
+		return func() { <-p.mirrorSlots }, true
+	default:
+		return nil, false
+	}
+}
+
+// MirrorsDropped returns how many mirrored requests were dropped because
+// MirrorMaxInFlight were in flight.
+func (p *ProxyClient) MirrorsDropped() uint64 {
+	return atomic.LoadUint64(&p.mirrorsDropped)
+}
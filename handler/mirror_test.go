@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// mirroredRequest is a request received by mirrorTestClient's mirror.
+type mirroredRequest struct {
+	req  *http.Request
+	body string
+}
+
+// mirrorTestClient answers requests to the primary upstream and hands
+// requests to the mirror upstream to mirrored.
+type mirrorTestClient struct {
+	mirrorHost string
+	mirrorFail bool
+	mirrored   chan mirroredRequest
+}
+
+func (c *mirrorTestClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != c.mirrorHost {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Upstream": []string{"primary"}}, Body: ioutil.NopCloser(bytes.NewBufferString("primary"))}, nil
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	c.mirrored <- mirroredRequest{req: req, body: string(body)}
+	if c.mirrorFail {
+		return nil, fmt.Errorf("mirror is down")
+	}
+	return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(bytes.NewBufferString("mirror"))}, nil
+}
+
+func TestProxyClient_Do_MirrorsRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		mirrorFail   bool
+		wantMirrored bool
+	}{
+		{name: "mirrors a signed copy", body: `{"name":"copy"}`, wantMirrored: true},
+		{name: "ignores mirror failures", body: `{"name":"copy"}`, mirrorFail: true, wantMirrored: true},
+		{name: "does not mirror bodies over the limit", body: `{"name":"too large to mirror"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The mirror blocks until read, after the primary response
+			client := &mirrorTestClient{mirrorHost: "shadow.internal:8443", mirrorFail: tt.mirrorFail, mirrored: make(chan mirroredRequest)}
+			proxyClient := &ProxyClient{
+				Signer:            v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:            client,
+				MirrorUpstream:    &url.URL{Scheme: "https", Host: "shadow.internal:8443", Path: "/shadow/"},
+				MirrorMaxBodySize: 16,
+			}
+
+			request, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/prod/items?limit=1", bytes.NewBufferString(tt.body))
+			request.Host = "execute-api.us-west-2.amazonaws.com"
+			request.Header.Set("Content-Type", "application/json")
+			resp, err := proxyClient.Do(request)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "primary", resp.Header.Get("X-Upstream"))
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, "primary", string(body))
+
+			select {
+			case m := <-client.mirrored:
+				assert.True(t, tt.wantMirrored, "unexpected mirrored request")
+				assert.Equal(t, http.MethodPost, m.req.Method)
+				assert.Equal(t, "/shadow/prod/items", m.req.URL.Path)
+				assert.Equal(t, "limit=1", m.req.URL.RawQuery)
+				assert.Equal(t, tt.body, m.body)
+				assert.Equal(t, "application/json", m.req.Header.Get("Content-Type"))
+				assert.Regexp(t, `Credential=/\d{8}/us-west-2/execute-api/aws4_request`, m.req.Header.Get("Authorization"))
+			case <-time.After(time.Second):
+				assert.False(t, tt.wantMirrored, "request not mirrored")
+			}
+		})
+	}
+}
+
+// hangingMirrorClient answers requests to the primary upstream, and never
+// answers those to the mirror until they are canceled.
+type hangingMirrorClient struct {
+	mirrorHost string
+	started    chan struct{}
+	canceled   chan error
+}
+
+func (c *hangingMirrorClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != c.mirrorHost {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBufferString("primary"))}, nil
+	}
+	c.started <- struct{}{}
+	<-req.Context().Done()
+	c.canceled <- req.Context().Err()
+	return nil, req.Context().Err()
+}
+
+func TestProxyClient_Do_MirrorBounds(t *testing.T) {
+	client := &hangingMirrorClient{mirrorHost: "shadow.internal:8443", started: make(chan struct{}, 3), canceled: make(chan error, 3)}
+	proxyClient := &ProxyClient{
+		Signer:            v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:            client,
+		MirrorUpstream:    &url.URL{Scheme: "https", Host: "shadow.internal:8443"},
+		MirrorMaxInFlight: 1,
+		MirrorTimeout:     100 * time.Millisecond,
+	}
+	send := func() {
+		request, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/prod/items", bytes.NewBufferString("{}"))
+		request.Host = "execute-api.us-west-2.amazonaws.com"
+		resp, err := proxyClient.Do(request)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	send()
+	<-client.started
+
+	// Copies are dropped while the mirror is hanging
+	send()
+	assert.Equal(t, uint64(1), proxyClient.MirrorsDropped())
+
+	// Until the hanging copy times out
+	select {
+	case err := <-client.canceled:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(time.Second):
+		t.Fatal("mirrored request never timed out")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		send()
+		select {
+		case <-client.started:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mirroring never resumed")
+		}
+	}
+}
+
+func TestProxyClient_WaitMirrors(t *testing.T) {
+	client := &hangingMirrorClient{mirrorHost: "shadow.internal:8443", started: make(chan struct{}, 1), canceled: make(chan error, 1)}
+	proxyClient := &ProxyClient{
+		Signer:         v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:         client,
+		MirrorUpstream: &url.URL{Scheme: "https", Host: "shadow.internal:8443"},
+		MirrorTimeout:  200 * time.Millisecond,
+	}
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/prod/items", bytes.NewBufferString("{}"))
+	request.Host = "execute-api.us-west-2.amazonaws.com"
+	_, err := proxyClient.Do(request)
+	assert.Nil(t, err)
+	<-client.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, proxyClient.WaitMirrors(ctx))
+
+	// The mirrored request completes once it times out
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, proxyClient.WaitMirrors(ctx))
+}
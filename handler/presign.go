@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// maxPresignExpiry is the longest a SigV4 presigned URL may be valid for.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// Presign returns target presigned for method, valid for expires, and when
+// it expires. The service and region signed for are determined from its host
+// like those of proxied requests, unless set.
+func (p *ProxyClient) Presign(method string, target *url.URL, service, region string, expires time.Duration) (*url.URL, time.Time, error) {
+	if !target.IsAbs() || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return nil, time.Time{}, &statusError{status: http.StatusBadRequest, err: fmt.Errorf("%q is not an absolute http(s) URL", target.String())}
+	}
+	if expires <= 0 || expires > maxPresignExpiry {
+		return nil, time.Time{}, &statusError{status: http.StatusBadRequest, err: fmt.Errorf("expiry must be between 1s and %s", maxPresignExpiry)}
+	}
+	if !isUpstreamHostAllowed(target, p.AllowedUpstreamHosts) {
+		return nil, time.Time{}, &statusError{status: http.StatusForbidden, err: fmt.Errorf("upstream host is not allowed: %s", target.Host)}
+	}
+
+	endpoint := &endpoints.ResolvedEndpoint{URL: target.Scheme + "://" + target.Host, SigningMethod: "v4", SigningName: service, SigningRegion: region}
+	if service == "" || region == "" {
+		detected, err := p.resolveService(&http.Request{Host: target.Host, URL: target, Header: http.Header{}}, target)
+		if err != nil {
+			return nil, time.Time{}, &statusError{status: http.StatusBadRequest, err: err}
+		}
+		if service == "" {
+			endpoint.SigningName = detected.SigningName
+		}
+		if region == "" {
+			endpoint.SigningRegion = detected.SigningRegion
+		}
+		endpoint.SigningMethod = detected.SigningMethod
+	}
+	if alias, ok := p.SigningNameAliases[endpoint.SigningName]; ok {
+		endpoint.SigningName = alias
+	}
+	if endpoint.SigningMethod == "v4a" {
+		return nil, time.Time{}, &statusError{status: http.StatusBadRequest, err: errors.New("presigning SigV4A requests is not supported")}
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), target.String(), nil)
+	if err != nil {
+		return nil, time.Time{}, &statusError{status: http.StatusBadRequest, err: err}
+	}
+	now := p.clock()
+	if _, err := p.signer(nil, "", nil, endpoint).Presign(req, nil, endpoint.SigningName, endpoint.SigningRegion, expires, now); err != nil {
+		return nil, time.Time{}, &statusError{status: http.StatusInternalServerError, err: err}
+	}
+	return req.URL, now.Add(expires), nil
+}
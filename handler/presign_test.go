@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin_Presign(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	proxy := &ProxyClient{
+		Signer:               v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "TOKEN")),
+		AllowedUpstreamHosts: []string{"*.amazonaws.com"},
+		now:                  func() time.Time { return now },
+	}
+	admin := &Admin{Token: "s3cr3t", Proxy: proxy}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantMethod string
+		wantURL    string
+		wantExpiry string
+		wantQuery  url.Values
+		wantError  string
+	}{
+		{
+			name:       "presigns S3 downloads",
+			body:       `{"url": "https://s3.eu-west-1.amazonaws.com/my-bucket/photos/cat.jpg", "expires_in": 600}`,
+			wantStatus: http.StatusOK,
+			wantMethod: http.MethodGet,
+			wantURL:    "https://s3.eu-west-1.amazonaws.com/my-bucket/photos/cat.jpg",
+			wantExpiry: "2020-10-01T12:10:00Z",
+			wantQuery: url.Values{
+				"X-Amz-Algorithm":      {"AWS4-HMAC-SHA256"},
+				"X-Amz-Credential":     {"AKID/20201001/eu-west-1/s3/aws4_request"},
+				"X-Amz-Date":           {"20201001T120000Z"},
+				"X-Amz-Expires":        {"600"},
+				"X-Amz-Security-Token": {"TOKEN"},
+				"X-Amz-SignedHeaders":  {"host"},
+			},
+		},
+		{
+			name:       "presigns for the given service and region",
+			body:       `{"method": "put", "url": "https://my-bucket.s3.eu-west-1.amazonaws.com/upload", "service": "s3", "region": "eu-west-1"}`,
+			wantStatus: http.StatusOK,
+			wantMethod: http.MethodPut,
+			wantURL:    "https://my-bucket.s3.eu-west-1.amazonaws.com/upload",
+			wantExpiry: "2020-10-01T12:15:00Z",
+			wantQuery: url.Values{
+				"X-Amz-Algorithm":      {"AWS4-HMAC-SHA256"},
+				"X-Amz-Credential":     {"AKID/20201001/eu-west-1/s3/aws4_request"},
+				"X-Amz-Date":           {"20201001T120000Z"},
+				"X-Amz-Expires":        {"900"},
+				"X-Amz-Security-Token": {"TOKEN"},
+				"X-Amz-SignedHeaders":  {"host"},
+			},
+		},
+		{
+			name:       "rejects hosts whose service is unknown",
+			body:       `{"url": "https://my-bucket.s3.eu-west-1.amazonaws.com/key"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "unable to determine service from host: my-bucket.s3.eu-west-1.amazonaws.com",
+		},
+		{
+			name:       "rejects hosts that are not allowed",
+			body:       `{"url": "https://example.com/key", "service": "s3", "region": "eu-west-1"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "upstream host is not allowed: example.com",
+		},
+		{
+			name:       "rejects relative URLs",
+			body:       `{"url": "/my-bucket/key"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  `"/my-bucket/key" is not an absolute http(s) URL`,
+		},
+		{
+			name:       "rejects expiries past a week",
+			body:       `{"url": "https://s3.eu-west-1.amazonaws.com/my-bucket/key", "expires_in": 604801}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "expiry must be between 1s and 168h0m0s",
+		},
+		{
+			name:       "rejects unknown fields",
+			body:       `{"url": "https://s3.eu-west-1.amazonaws.com/my-bucket/key", "expiry": 60}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  `invalid presign request: json: unknown field "expiry"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "http://localhost:9091/admin/presign", strings.NewReader(tt.body))
+			request.Header.Set("Authorization", "Bearer s3cr3t")
+			r := httptest.NewRecorder()
+
+			admin.ServeHTTP(r, request)
+
+			assert.Equal(t, tt.wantStatus, r.Code)
+			var got map[string]string
+			assert.Nil(t, json.Unmarshal(r.Body.Bytes(), &got))
+			assert.NotContains(t, r.Body.String(), "SECRET")
+			if tt.wantError != "" {
+				assert.Equal(t, map[string]string{"error": tt.wantError}, got)
+				return
+			}
+			assert.Equal(t, tt.wantMethod, got["method"])
+			assert.Equal(t, tt.wantExpiry, got["expires_at"])
+			presigned, err := url.Parse(got["url"])
+			assert.Nil(t, err)
+			query := presigned.Query()
+			assert.NotEmpty(t, query.Get("X-Amz-Signature"))
+			query.Del("X-Amz-Signature")
+			assert.Equal(t, tt.wantQuery, query)
+			presigned.RawQuery = ""
+			assert.Equal(t, tt.wantURL, presigned.String())
+		})
+	}
+}
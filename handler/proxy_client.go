@@ -17,12 +17,22 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
 	log "github.com/sirupsen/logrus"
@@ -33,35 +43,319 @@ type Client interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// PathRewrite replaces the part of a request path matched by Pattern with
+// Replacement, which may reference capture groups as $1.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
 // ProxyClient implements the Client interface
 type ProxyClient struct {
-	Signer *v4.Signer
-	Client Client
+	Signer              *v4.Signer
+	Client              Client
 	StripRequestHeaders []string
 	SigningNameOverride string
-	HostOverride string
-	RegionOverride string
+	HostOverride        string
+	RegionOverride      string
+	// DefaultRegionForGlobal is the region requests are signed for when the
+	// host they target carries none, e.g. global services such as
+	// iam.amazonaws.com missing from the SDK's endpoints. Unlike
+	// RegionOverride it never replaces a detected region.
+	DefaultRegionForGlobal string
+	// EndpointSuffixes are custom DNS suffixes standing in for (or appended
+	// to) amazonaws.com, e.g. aws.corp.example.com. They are stripped from the
+	// host only to determine the service and region; the host is signed and
+	// forwarded unchanged.
+	EndpointSuffixes []string
+	// S3VirtualHostSuffix, when set, sends requests for <bucket>.<suffix>,
+	// e.g. my-bucket.localhost, to the bucket in S3Region, us-east-1 by
+	// default, and requests for the suffix itself to path-style S3.
+	// S3PathStyle addresses buckets path-style upstream as well.
+	S3VirtualHostSuffix string
+	S3Region            string
+	S3PathStyle         bool
+	// SigningNameAliases replaces detected signing names, e.g. api.ecr with
+	// ecr, for endpoints signing as another service than the SDK reports.
+	SigningNameAliases map[string]string
+	// StripQueryParameters removes every query parameter whose name matches
+	// one of the expressions before the request is signed and forwarded.
+	StripQueryParameters []*regexp.Regexp
+	// PathRewrites rewrite the request path before it is signed and
+	// forwarded. The first rewrite matching the path applies.
+	PathRewrites []PathRewrite
+	// DeriveFromIncomingAuth signs for the service and region found in the
+	// credential scope of an incoming SigV4 Authorization header or presigned
+	// query, when present.
+	DeriveFromIncomingAuth bool
+	// SignedHeaders lists the incoming headers included in the signature, in
+	// addition to the headers the signer always signs (host, x-amz-date, ...).
+	// Other headers are forwarded unsigned.
+	SignedHeaders []string
+	// AllowedUpstreamHosts restricts the hosts requests may be forwarded to.
+	// Entries may contain wildcards (e.g. *.amazonaws.com). When empty every
+	// host is allowed.
+	AllowedUpstreamHosts []string
+	// RequireUpstreamTLS refuses to send signed requests over plaintext HTTP,
+	// e.g. to an http endpoint, except to PlaintextUpstreamHosts such as a
+	// local LocalStack, which may contain wildcards.
+	RequireUpstreamTLS     bool
+	PlaintextUpstreamHosts []string
+	// CostTagHeaders maps trusted incoming headers to the outgoing header
+	// their value is copied to and signed, e.g. for cost allocation per tenant.
+	// Outgoing headers sent by the client itself are dropped.
+	CostTagHeaders map[string]string
+	// CostTagValues lists the values, wildcards supported, a cost tag header
+	// may carry. Requests with any other value are rejected.
+	CostTagValues []string
+	// ForwardClientCert adds the subject and SANs of the client certificate
+	// verified by the listener as signed X-Client-Cert-Subject and
+	// X-Client-Cert-San headers. Headers of that name sent by the client are
+	// always dropped.
+	ForwardClientCert bool
+	// ForwardAuthorizationAs, when set, forwards the client's Authorization
+	// header under this name. The Authorization header itself is never
+	// forwarded, the proxy signs requests with its own.
+	ForwardAuthorizationAs string
+	// UpstreamTimeout bounds the time an upstream request may take, including
+	// reading its response. Zero means no timeout.
+	UpstreamTimeout time.Duration
+	// ServiceTimeouts overrides UpstreamTimeout per signing name, e.g. for
+	// long-polling services such as ssm or appconfig.
+	ServiceTimeouts map[string]time.Duration
+	// Endpoints overrides the upstream URL per signing name, e.g. to reach
+	// LocalStack or private endpoints. Requests are still signed for the
+	// resolved service and region, with the endpoint's host.
+	Endpoints map[string]*url.URL
+	// ServiceSigners overrides Signer per signing name, e.g. to sign for a
+	// service with the credentials of another principal.
+	ServiceSigners map[string]*v4.Signer
+	// TenantHeader, when set, is a trusted header naming the tenant of each
+	// request, which is signed by the tenant's signer in TenantSigners,
+	// overriding any other. Requests without a known tenant are rejected and
+	// the header is never forwarded.
+	TenantHeader  string
+	TenantSigners map[string]*v4.Signer
+	// AssumeRoleCredentials, when set, signs requests naming one of
+	// AllowedRoleARNs (wildcards supported) in an X-Assume-Role-Arn header,
+	// with an optional X-Assume-Role-External-Id, as that role, overriding
+	// any other signer. It returns the credentials of a role, cached per role
+	// and external ID. The headers are never forwarded.
+	AssumeRoleCredentials func(roleARN, externalID string) *credentials.Credentials
+	AllowedRoleARNs       []string
+	// RecomputeContentLength forwards requests whose body length disagrees
+	// with their Content-Length using the actual length, instead of
+	// rejecting them.
+	RecomputeContentLength bool
+	// ClientBodyTimeout bounds how long reading the request body from the
+	// client may take, requests not fully received in time fail with 408.
+	// Zero means no timeout.
+	ClientBodyTimeout time.Duration
+	// SigningConcurrency bounds how many requests may compute their signature
+	// (and payload hash) at the same time. Zero means unbounded.
+	SigningConcurrency int
+	// PinSigningTime signs requests with the time they were received rather
+	// than once their body has been read, and keeps that date when they are
+	// signed again, e.g. for a retry, for as long as AWS accepts it.
+	PinSigningTime bool
+	// LogErrorBodies logs the start of the body of non-2xx upstream
+	// responses as it is relayed to the client. At debug level bodies of 4xx
+	// and 5xx responses are always logged.
+	LogErrorBodies bool
+	// NormalizePath removes dot segments and duplicate slashes from paths, as
+	// in RFC 3986, before they are signed and forwarded. TrailingSlash strips
+	// or adds a trailing slash to them. S3 paths, which are object keys, are
+	// left as is.
+	NormalizePath bool
+	TrailingSlash TrailingSlashPolicy
+	// FollowRedirects follows up to MaxRedirects 307 and 308 redirects to
+	// other endpoints of the same service, e.g. S3's redirects to the region
+	// of a bucket, signing the request again for the new region. Other
+	// redirects are relayed to the client.
+	FollowRedirects bool
+	MaxRedirects    int
+	// HeadAsGet sends HEAD requests upstream as GET, signed as such, for
+	// backends not supporting HEAD. The client still gets no body.
+	HeadAsGet bool
+	// CompressRequests gzips request bodies not already encoded before they
+	// are signed, for services accepting gzip request bodies.
+	CompressRequests bool
+	// BodySpillThreshold is the request body size past which bodies are
+	// written to a temporary file in BodySpillDir, rather than held in
+	// memory, while they are hashed and sent. Zero means never.
+	BodySpillThreshold int64
+	BodySpillDir       string
+	// RequestBodyTransformer, when set, transforms the request body before
+	// it is signed, so the signature covers the transformed body.
+	RequestBodyTransformer func(req *http.Request, body io.Reader) (io.Reader, error)
+	// ResponseBodyTransformer, when set, wraps the upstream response body
+	// before it is relayed to the client.
+	ResponseBodyTransformer func(resp *http.Response, body io.ReadCloser) (io.ReadCloser, error)
+	// SignWhenHeader, when set, only signs requests carrying this marker
+	// header, with the value SignWhenHeaderValue if not empty. Other requests
+	// are forwarded unsigned to UnsignedUpstream. The marker is never
+	// forwarded.
+	SignWhenHeader      string
+	SignWhenHeaderValue string
+	UnsignedUpstream    *url.URL
+	// MirrorUpstream, when set, receives a signed copy of every signed
+	// request, sent once the request has been forwarded, whose response is
+	// discarded. Requests with a body larger than MirrorMaxBodySize, when not
+	// zero, are not mirrored. At most MirrorMaxInFlight copies, unless zero,
+	// are sent at once, further ones being dropped, each given up on after
+	// MirrorTimeout unless zero.
+	MirrorUpstream    *url.URL
+	MirrorMaxBodySize int64
+	MirrorMaxInFlight int
+	MirrorTimeout     time.Duration
+	// Routes send the requests they match to their upstream, signed for their
+	// service, instead of the host they target. The first matching route
+	// applies. SetRoutes replaces them while requests are served.
+	Routes []Route
+	// StreamingSigning relays S3 request bodies as they are received rather
+	// than buffering them to hash them. Bodies of a known length are sent as
+	// aws-chunked, each chunk signed, others are sent unsigned.
+	StreamingSigning bool
+	// DryRun answers every request with how it was signed, see
+	// dryRunResponse, instead of sending it upstream. AllowDebugHeader does
+	// so only for requests carrying DebugHeader.
+	DryRun           bool
+	AllowDebugHeader bool
+	// Retry, when set, sends requests failing to reach the upstream, or
+	// answered with a retryable status, again, signed anew. Streamed request
+	// bodies are never retried.
+	Retry *RetryPolicy
+	// Cache, when set, answers GET and HEAD requests with the responses
+	// cached for them.
+	Cache *ResponseCache
+	// HeaderRules, when set, add, remove and rewrite the headers of signed
+	// requests and their responses, before those of their route.
+	HeaderRules *HeaderRules
+	// SignVersion forces SigV4 or SigV4A, by default SigV4A is only used for
+	// multi-region hosts such as S3 Multi-Region Access Points.
+	SignVersion SignVersion
+
+	signingSlotsOnce sync.Once
+	signingSlots     chan struct{}
+
+	mirrorSlotsOnce sync.Once
+	mirrorSlots     chan struct{}
+	mirrorsDropped  uint64
+	mirrors         sync.WaitGroup
+
+	// routesMu guards Routes, replaced by SetRoutes.
+	routesMu sync.RWMutex
+
+	// now returns the current time, time.Now when nil.
+	now func() time.Time
+
+	// compressSkipped holds the services CompressRequests was skipped for.
+	compressSkipped sync.Map
+	// roleSigners caches the signers of AssumeRoleCredentials.
+	roleSigners roleSignerCache
+	// sigV4AKeys caches up to maxSigV4AKeys SigV4A keys derived per access
+	// key ID, guarded by sigV4AKeysMu.
+	sigV4AKeysMu sync.Mutex
+	sigV4AKeys   map[string]sigV4AKey
 }
 
-func (p *ProxyClient) sign(req *http.Request, service *endpoints.ResolvedEndpoint) error {
-	body := bytes.NewReader([]byte{})
+// maxPinnedSigningAge is how long a pinned signing time is reused. AWS
+// rejects requests dated more than 15 minutes off, the margin leaves room for
+// clock skew.
+const maxPinnedSigningAge = 5 * time.Minute
 
-	if req.Body != nil {
-		b, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			return err
+func (p *ProxyClient) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// signingTime returns the time to sign a request received at received with.
+func (p *ProxyClient) signingTime(received time.Time) time.Time {
+	now := p.clock()
+	if p.PinSigningTime && now.Sub(received) < maxPinnedSigningAge {
+		return received
+	}
+	return now
+}
+
+// resign signs req, signed before, again for a request received at received.
+// Its date is kept while signingTime allows it so only the signature changes.
+func (p *ProxyClient) resign(req *http.Request, body io.ReadSeeker, signer *v4.Signer, service *endpoints.ResolvedEndpoint, received time.Time) error {
+	// The signer ignores the given time for requests already signed
+	req.Header.Del("Authorization")
+	removePresignQueryParameters(req.URL)
+	return p.sign(req, body, signer, service, p.signingTime(received))
+}
+
+// signer returns the signer for requests of tenant, if any, to service
+// through route, when not nil, or role, the signer of an assumed role, when
+// not nil.
+func (p *ProxyClient) signer(route *Route, tenant string, role *v4.Signer, service *endpoints.ResolvedEndpoint) *v4.Signer {
+	signer := p.Signer
+	if s, ok := p.ServiceSigners[service.SigningName]; ok {
+		signer = s
+	}
+	if route != nil && route.Signer != nil {
+		signer = route.Signer
+	}
+	if s, ok := p.TenantSigners[tenant]; ok && tenant != "" {
+		signer = s
+	}
+	if role != nil {
+		signer = role
+	}
+	if service.SigningName == "s3" {
+		// Like the SDK, sign S3 paths as they are sent: S3 does not
+		// double-encode the path in its canonical request.
+		s3 := *signer
+		s3.DisableURIPathEscaping = true
+		signer = &s3
+	}
+	return signer
+}
+
+// acquireSigningSlot blocks until the request may be signed and returns a
+// function releasing the slot.
+func (p *ProxyClient) acquireSigningSlot() func() {
+	p.signingSlotsOnce.Do(func() {
+		if p.SigningConcurrency > 0 {
+			p.signingSlots = make(chan struct{}, p.SigningConcurrency)
 		}
+	})
 
-		body = bytes.NewReader(b)
+	if p.signingSlots == nil {
+		return func() {}
 	}
 
+	p.signingSlots <- struct{}{}
+	return func() { <-p.signingSlots }
+}
+
+func (p *ProxyClient) sign(req *http.Request, body io.ReadSeeker, signer *v4.Signer, service *endpoints.ResolvedEndpoint, signTime time.Time) error {
+	canonicalizeHeaderValues(req.Header)
+
+	// Only the CPU bound hashing and signing is bounded, the body has already
+	// been read from the client.
+	release := p.acquireSigningSlot()
+	defer release()
+
+	start := time.Now()
+	defer func() {
+		requestInfoFrom(req.Context()).SigningDuration += time.Since(start)
+	}()
+
 	var err error
 	switch service.SigningMethod {
 	case "v4", "s3v4":
-		_, err = p.Signer.Sign(req, body, service.SigningName, service.SigningRegion, time.Now())
+		_, err = signer.Sign(req, body, service.SigningName, service.SigningRegion, signTime)
 		break
 	case "s3":
-		_, err = p.Signer.Presign(req, body, service.SigningName, service.SigningRegion, time.Duration(time.Hour), time.Now())
+		_, err = signer.Presign(req, body, service.SigningName, service.SigningRegion, time.Duration(time.Hour), signTime)
+		break
+	case "v4a":
+		err = p.signV4A(req, body, signer, service, signTime)
 		break
 	default:
 		err = fmt.Errorf("unable to sign with specified signing method %s for service %s", service.SigningMethod, service.SigningName)
@@ -69,12 +363,343 @@ func (p *ProxyClient) sign(req *http.Request, service *endpoints.ResolvedEndpoin
 	}
 
 	if err == nil {
-		log.WithFields(log.Fields{"service": service.SigningName, "region": service.SigningRegion}).Debug("signed request")
+		loggerFrom(req.Context()).WithFields(log.Fields{"service": service.SigningName, "region": service.SigningRegion}).Debug("signed request")
 	}
 
 	return err
 }
 
+// hopHeaders are the hop-by-hop headers defined in RFC 7230 section 6.1.
+// They are meaningful only for a single transport-level connection and must
+// not be forwarded by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the standard hop-by-hop headers from h, as
+// well as any header named in the Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, header := range hopHeaders {
+		h.Del(header)
+	}
+}
+
+// canonicalizeHeaderValues folds headers sent multiple times into a single
+// value the way SigV4 canonicalization does: each value trimmed and joined
+// with commas in the order received. Forwarding the folded value guarantees
+// the upstream sees exactly what was signed.
+func canonicalizeHeaderValues(h http.Header) {
+	for k, vv := range h {
+		if len(vv) < 2 {
+			continue
+		}
+
+		sep := ","
+		if k == "Cookie" {
+			sep = "; "
+		}
+
+		values := make([]string, len(vv))
+		for i, v := range vv {
+			values[i] = strings.TrimSpace(v)
+		}
+		h[k] = []string{strings.Join(values, sep)}
+	}
+}
+
+// stripQueryParameters removes the query parameters matching any of patterns
+// from u.
+func stripQueryParameters(u *url.URL, patterns []*regexp.Regexp, logger log.FieldLogger) {
+	if len(patterns) == 0 || u.RawQuery == "" {
+		return
+	}
+
+	query := u.Query()
+	for name := range query {
+		for _, pattern := range patterns {
+			if pattern.MatchString(name) {
+				logger.WithField("StripQuery", name).Debug("Stripping query parameter:")
+				query.Del(name)
+				break
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+}
+
+// readBodyWithin reads the request body like readBody, failing with 408 if
+// the client does not send it within timeout, unless zero.
+func readBodyWithin(req *http.Request, recompute bool, spill bodySpill, timeout time.Duration) (*requestBody, error) {
+	if timeout <= 0 || req.Body == nil {
+		return readBody(req, recompute, spill)
+	}
+
+	type result struct {
+		body *requestBody
+		err  error
+	}
+	// The read is abandoned on timeout; it ends once the handler aborts the
+	// read of the connection after sending the 408.
+	done := make(chan result, 1)
+	go func() {
+		body, err := readBody(req, recompute, spill)
+		done <- result{body, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.body, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.body != nil {
+				r.body.Close()
+			}
+		}()
+		return nil, &statusError{
+			status: http.StatusRequestTimeout,
+			err:    fmt.Errorf("request body not received within %s", timeout),
+		}
+	}
+}
+
+// rewritePath applies the first of rewrites matching u's path to it.
+func rewritePath(u *url.URL, rewrites []PathRewrite, logger log.FieldLogger) {
+	escaped := u.EscapedPath()
+	for _, rewrite := range rewrites {
+		if !rewrite.Pattern.MatchString(escaped) {
+			continue
+		}
+		rewritten := rewrite.Pattern.ReplaceAllString(escaped, rewrite.Replacement)
+		path, err := url.PathUnescape(rewritten)
+		if err != nil {
+			path = rewritten
+		}
+		logger.WithFields(log.Fields{"from": escaped, "to": rewritten}).Debug("rewriting path")
+		u.Path, u.RawPath = path, rewritten
+		return
+	}
+}
+
+// TrailingSlashPolicy is how the trailing slash of request paths is handled.
+type TrailingSlashPolicy string
+
+const (
+	// TrailingSlashKeep forwards paths with or without a trailing slash as
+	// they are received.
+	TrailingSlashKeep TrailingSlashPolicy = ""
+	// TrailingSlashStrip removes the trailing slash of paths.
+	TrailingSlashStrip TrailingSlashPolicy = "strip"
+	// TrailingSlashAdd adds a trailing slash to paths without one.
+	TrailingSlashAdd TrailingSlashPolicy = "add"
+)
+
+// normalizePath normalizes u's path, removing its dot segments and duplicate
+// slashes when dotSegments is set, then applies trailingSlash to it.
+func normalizePath(u *url.URL, dotSegments bool, trailingSlash TrailingSlashPolicy, logger log.FieldLogger) {
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		return
+	}
+
+	normalized := escaped
+	if dotSegments {
+		normalized = path.Clean(normalized)
+		// Clean drops the trailing slash, which RFC 3986 keeps, also when the
+		// last segment is a dot segment.
+		if normalized != "/" && (strings.HasSuffix(escaped, "/") || strings.HasSuffix(escaped, "/.") || strings.HasSuffix(escaped, "/..")) {
+			normalized += "/"
+		}
+	}
+
+	switch trailingSlash {
+	case TrailingSlashStrip:
+		if normalized != "/" {
+			normalized = strings.TrimRight(normalized, "/")
+		}
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(normalized, "/") {
+			normalized += "/"
+		}
+	}
+
+	if normalized == escaped {
+		return
+	}
+	unescaped, err := url.PathUnescape(normalized)
+	if err != nil {
+		unescaped = normalized
+	}
+	logger.WithFields(log.Fields{"from": escaped, "to": normalized}).Debug("normalizing path")
+	u.Path, u.RawPath = unescaped, normalized
+}
+
+// readBody reads the request body, making sure its length agrees with the
+// declared Content-Length. When recompute is set a mismatch is tolerated and
+// the forwarded request will carry the actual length instead.
+func readBody(req *http.Request, recompute bool, spill bodySpill) (*requestBody, error) {
+	if req.Body == nil {
+		return &requestBody{}, nil
+	}
+
+	declared := req.ContentLength
+	if declared <= 0 && req.Header.Get("Content-Length") != "" {
+		declared, _ = strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64)
+	}
+
+	b, err := spill.read(req.Body)
+	if err == io.ErrUnexpectedEOF && declared > 0 {
+		// The server stops reading at Content-Length, so a short body is the
+		// only mismatch it can observe.
+		err = nil
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	if declared > 0 && b.size != declared {
+		if !recompute {
+			b.Close()
+			return nil, &statusError{
+				status: http.StatusBadRequest,
+				err:    fmt.Errorf("request body length %d does not match Content-Length %d", b.size, declared),
+			}
+		}
+		loggerFrom(req.Context()).WithFields(log.Fields{"declared": declared, "actual": b.size}).Debug("recomputing Content-Length")
+	}
+
+	return b, nil
+}
+
+// transformRequestBody returns body as transformed by transform.
+func transformRequestBody(req *http.Request, body *requestBody, spill bodySpill, transform func(*http.Request, io.Reader) (io.Reader, error)) (*requestBody, error) {
+	r, err := transform(req, body.reader())
+	if err != nil {
+		return nil, fmt.Errorf("unable to transform request body: %w", err)
+	}
+	transformed, err := spill.read(r)
+	if err != nil {
+		transformed.Close()
+		return nil, fmt.Errorf("unable to transform request body: %w", err)
+	}
+	return transformed, nil
+}
+
+// isUpstreamHostAllowed reports whether u's host matches one of the allowed
+// host patterns. An empty allowlist allows every host.
+func isUpstreamHostAllowed(u *url.URL, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, pattern := range allowed {
+		for _, host := range []string{u.Host, u.Hostname()} {
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkUpstreamTLS returns an error if a signed request must not be sent to u
+// because it would travel in plaintext.
+func (p *ProxyClient) checkUpstreamTLS(u *url.URL) error {
+	if !p.RequireUpstreamTLS || u.Scheme == "https" {
+		return nil
+	}
+	if len(p.PlaintextUpstreamHosts) > 0 && isUpstreamHostAllowed(u, p.PlaintextUpstreamHosts) {
+		return nil
+	}
+	return &statusError{
+		status: http.StatusBadGateway,
+		err:    fmt.Errorf("upstream TLS is required, refusing to send a signed request over %s to %s", u.Scheme, u.Host),
+	}
+}
+
+// applyCostTags copies the value of every mapped incoming header in src to its
+// outgoing header in dst, after checking it against the allowed values.
+// Outgoing headers are removed from src so clients cannot set them directly.
+func applyCostTags(dst, src http.Header, mapping map[string]string, allowed []string) error {
+	for incoming, outgoing := range mapping {
+		value := src.Get(incoming)
+		src.Del(outgoing)
+		if value == "" {
+			continue
+		}
+		if !isCostTagValueAllowed(value, allowed) {
+			return &statusError{
+				status: http.StatusBadRequest,
+				err:    fmt.Errorf("%s value is not allowed: %q", http.CanonicalHeaderKey(incoming), value),
+			}
+		}
+		dst.Set(outgoing, value)
+	}
+	return nil
+}
+
+func isCostTagValueAllowed(value string, allowed []string) bool {
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return false
+	}
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setClientCertHeaders describes the verified client certificate of req, if
+// any, in dst. Client supplied values are removed from req.
+func setClientCertHeaders(dst http.Header, req *http.Request) {
+	req.Header.Del("X-Client-Cert-Subject")
+	req.Header.Del("X-Client-Cert-San")
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, "URI:"+u.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+
+	dst.Set("X-Client-Cert-Subject", cert.Subject.String())
+	if len(sans) > 0 {
+		dst.Set("X-Client-Cert-San", strings.Join(sans, ","))
+	}
+}
+
 func copyHeaderWithoutOverwrite(dst, src http.Header) {
 	for k, vv := range src {
 		if _, ok := dst[k]; !ok {
@@ -85,7 +710,209 @@ func copyHeaderWithoutOverwrite(dst, src http.Header) {
 	}
 }
 
+// upstreamTimeout returns the timeout for requests to service: its override
+// if one is configured, UpstreamTimeout otherwise.
+func (p *ProxyClient) upstreamTimeout(service string) time.Duration {
+	if timeout, ok := p.ServiceTimeouts[service]; ok {
+		return timeout
+	}
+	return p.UpstreamTimeout
+}
+
+// applyEndpoint points u at endpoint, prefixing u's path with the endpoint's.
+func applyEndpoint(u *url.URL, endpoint *url.URL) {
+	u.Scheme = endpoint.Scheme
+	u.Host = endpoint.Host
+	if prefix := strings.TrimSuffix(endpoint.Path, "/"); prefix != "" {
+		u.Path = prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimSuffix(endpoint.EscapedPath(), "/") + u.RawPath
+		}
+	}
+}
+
+// cancelOnClose cancels the context of an upstream request once its
+// response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// maxLoggedErrorBody caps how much of an error response body is logged.
+const maxLoggedErrorBody = 4096
+
+func (p *ProxyClient) shouldLogErrorBody(status int) bool {
+	if p.LogErrorBodies && (status < 200 || status >= 300) {
+		return true
+	}
+	return log.GetLevel() == log.DebugLevel && status >= 400
+}
+
+// errorBodyLogger logs the first maxLoggedErrorBody bytes read from an
+// upstream error response body once it is closed.
+type errorBodyLogger struct {
+	io.ReadCloser
+	status int
+	logger log.FieldLogger
+	buf    bytes.Buffer
+	read   int64
+	logged bool
+}
+
+func (l *errorBodyLogger) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	if room := maxLoggedErrorBody - l.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		l.buf.Write(p[:room])
+	}
+	l.read += int64(n)
+	return n, err
+}
+
+func (l *errorBodyLogger) Close() error {
+	if !l.logged {
+		l.logged = true
+		l.logger.WithFields(log.Fields{
+			"status":    l.status,
+			"message":   l.buf.String(),
+			"truncated": l.read > int64(l.buf.Len()),
+		}).Error("error proxying request")
+	}
+	return l.ReadCloser.Close()
+}
+
+// send sends req upstream, bounding it and the reading of its response by
+// timeout unless zero.
+func (p *ProxyClient) send(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	}
+
+	start := time.Now()
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	requestInfoFrom(req.Context()).UpstreamDuration = time.Since(start)
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+			err = fmt.Errorf("upstream %s did not respond within %s: %w", req.URL.Host, timeout, err)
+		} else if errorStatus(err) == http.StatusGatewayTimeout {
+			err = fmt.Errorf("timed out reaching upstream %s: %w", req.URL.Host, err)
+		}
+		return nil, err
+	}
+
+	// The deadline also covers reading the body, release it once done
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedConn{ReadWriteCloser: conn, cancel: cancel}
+	} else if resp.Body != nil {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	} else {
+		cancel()
+	}
+	return resp, nil
+}
+
+// shouldSign reports whether req carries the SignWhenHeader marker, which
+// it removes from the request.
+func (p *ProxyClient) shouldSign(req *http.Request) bool {
+	_, present := req.Header[http.CanonicalHeaderKey(p.SignWhenHeader)]
+	value := req.Header.Get(p.SignWhenHeader)
+	req.Header.Del(p.SignWhenHeader)
+	if p.SignWhenHeaderValue != "" {
+		return strings.EqualFold(value, p.SignWhenHeaderValue)
+	}
+	return present
+}
+
+// doUnsigned forwards req as is to UnsignedUpstream.
+func (p *ProxyClient) doUnsigned(req *http.Request) (*http.Response, error) {
+	upstreamURL := *p.UnsignedUpstream
+	upstreamURL.Path = strings.TrimSuffix(upstreamURL.Path, "/") + req.URL.Path
+	upstreamURL.RawPath = ""
+	upstreamURL.RawQuery = req.URL.RawQuery
+
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, upstreamURL.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.ContentLength = req.ContentLength
+
+	removeHopByHopHeaders(req.Header)
+	info := requestInfoFrom(req.Context())
+	info.UpstreamHost = upstreamURL.Host
+	setTraceparent(req.Header, info.Span)
+	copyHeaderWithoutOverwrite(proxyReq.Header, req.Header)
+
+	loggerFrom(req.Context()).WithField("upstream", upstreamURL.Host).Debug("forwarding unsigned request")
+	return p.send(proxyReq, p.UpstreamTimeout)
+}
+
+// resolveService determines the service and region the request is signed
+// for, from the configured overrides, the incoming credential scope or the
+// host the request targets.
+func (p *ProxyClient) resolveService(req *http.Request, proxyURL *url.URL) (*endpoints.ResolvedEndpoint, error) {
+	if p.SigningNameOverride != "" && p.RegionOverride != "" {
+		return &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", proxyURL.Host), SigningMethod: "v4", SigningRegion: p.RegionOverride, SigningName: p.SigningNameOverride}, nil
+	}
+
+	if p.DeriveFromIncomingAuth {
+		if scope, ok := parseIncomingCredentialScope(req); ok {
+			// The incoming signature is replaced by the one computed here
+			req.Header.Del("Authorization")
+			removePresignQueryParameters(proxyURL)
+			return &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", proxyURL.Host), SigningMethod: "v4", SigningRegion: scope.Region, SigningName: scope.Service}, nil
+		}
+	}
+
+	host := stripEndpointSuffix(req.Host, p.EndpointSuffixes)
+	service := determineAWSServiceFromHost(host)
+	if p.DefaultRegionForGlobal != "" {
+		if service == nil {
+			service = determineGlobalServiceFromHost(host, p.DefaultRegionForGlobal)
+		} else if service.SigningRegion == "" || service.SigningRegion == "aws-global" {
+			service.SigningRegion = p.DefaultRegionForGlobal
+		}
+	}
+	if service == nil {
+		return nil, fmt.Errorf("unable to determine service from host: %s", req.Host)
+	}
+	return service, nil
+}
+
 func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
+	if p.Cache != nil && p.Cache.cacheable(req) && !p.dryRun(req) {
+		return p.Cache.do(req, p.cacheKey(req), p.do)
+	}
+	return p.do(req)
+}
+
+// dryRun reports whether req is only signed, not sent.
+func (p *ProxyClient) dryRun(req *http.Request) bool {
+	return p.DryRun || (p.AllowDebugHeader && strings.EqualFold(req.Header.Get(DebugHeader), "true"))
+}
+
+// do signs and sends req, bypassing the cache.
+func (p *ProxyClient) do(req *http.Request) (*http.Response, error) {
+	received := p.clock()
+	logger := loggerFrom(req.Context())
+	dryRun := p.dryRun(req)
+	if p.AllowDebugHeader {
+		req.Header.Del(DebugHeader)
+	}
+
+	if p.SignWhenHeader != "" && !p.shouldSign(req) {
+		return p.doUnsigned(req)
+	}
+
 	proxyURL := *req.URL
 	if p.HostOverride != "" {
 		proxyURL.Host = p.HostOverride
@@ -94,59 +921,312 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 		proxyURL.Host = req.Host
 	}
 	proxyURL.Scheme = "https"
+	route := p.route(req)
+	var s3Service *endpoints.ResolvedEndpoint
+	if route != nil {
+		route.apply(&proxyURL)
+	} else if p.S3VirtualHostSuffix != "" {
+		var err error
+		if s3Service, err = p.mapS3Host(&proxyURL, req.Host); err != nil {
+			return nil, &statusError{status: http.StatusBadGateway, err: err}
+		}
+	}
+	stripQueryParameters(&proxyURL, p.StripQueryParameters, logger)
+	rewritePath(&proxyURL, p.PathRewrites, logger)
+
+	eventStream := req.Method != http.MethodHead && isEventStreamRequest(req)
+	grpc := req.Method != http.MethodHead && isGRPCRequest(req)
 
 	if log.GetLevel() == log.DebugLevel {
-		initialReqDump, err := httputil.DumpRequest(req, true)
+		// Bodies which may be spilled or streamed are too large to dump, event
+		// streams and gRPC calls may never end
+		initialReqDump, err := httputil.DumpRequest(req, p.BodySpillThreshold <= 0 && !p.StreamingSigning && !eventStream && !grpc)
 		if err != nil {
-			log.WithError(err).Error("unable to dump request")
+			logger.WithError(err).Error("unable to dump request")
 		}
-		log.WithField("request", string(initialReqDump)).Debug("Initial request dump:")
+		logger.WithField("request", string(initialReqDump)).Debug("Initial request dump:")
 	}
 
-	proxyReq, err := http.NewRequest(req.Method, proxyURL.String(), req.Body)
+	var service *endpoints.ResolvedEndpoint
+	var err error
+	if route != nil {
+		service, err = route.service()
+	} else if s3Service != nil {
+		service = s3Service
+	} else {
+		service, err = p.resolveService(req, &proxyURL)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if alias, ok := p.SigningNameAliases[service.SigningName]; ok {
+		service.SigningName = alias
+	}
+	applySignVersion(service, p.SignVersion)
+	// Routes name their upstream themselves
+	if endpoint, ok := p.Endpoints[service.SigningName]; ok && route == nil {
+		applyEndpoint(&proxyURL, endpoint)
+	}
+	if service.SigningName != "s3" {
+		normalizePath(&proxyURL, p.NormalizePath, p.TrailingSlash, logger)
+	}
+	// Endpoints are checked too, they are the host connected to
+	if !isUpstreamHostAllowed(&proxyURL, p.AllowedUpstreamHosts) {
+		return nil, &statusError{
+			status: http.StatusForbidden,
+			err:    fmt.Errorf("upstream host is not allowed: %s", proxyURL.Host),
+		}
+	}
+	if err := p.checkUpstreamTLS(&proxyURL); err != nil {
+		return nil, err
+	}
 
-	var service *endpoints.ResolvedEndpoint
-	if p.SigningNameOverride != "" && p.RegionOverride != "" {
-		service = &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", proxyURL.Host), SigningMethod: "v4", SigningRegion: p.RegionOverride, SigningName: p.SigningNameOverride}
-	} else {
-		service = determineAWSServiceFromHost(req.Host)
+	tenant := ""
+	if p.TenantHeader != "" {
+		if tenant, err = p.tenant(req); err != nil {
+			return nil, err
+		}
 	}
-	if service == nil {
-		return nil, fmt.Errorf("unable to determine service from host: %s", req.Host)
+	var role *v4.Signer
+	if p.AssumeRoleCredentials != nil {
+		if role, err = p.assumedRole(req); err != nil {
+			return nil, err
+		}
+	}
+	signer := p.signer(route, tenant, role, service)
+
+	// Presigned requests carry no Authorization of the proxy's which would
+	// replace the client's
+	authorization := req.Header.Values("Authorization")
+	req.Header.Del("Authorization")
+	if p.ForwardAuthorizationAs != "" {
+		req.Header.Del(p.ForwardAuthorizationAs)
+		if len(authorization) > 0 {
+			req.Header[http.CanonicalHeaderKey(p.ForwardAuthorizationAs)] = authorization
+		}
+	}
+
+	// HEAD requests carry no payload, anything sent along is discarded so
+	// they are always signed with the empty payload hash. Event streams are
+	// signed message by message, and streamed bodies chunk by chunk, as they
+	// are relayed instead of buffered. gRPC messages are relayed unsigned as
+	// they are received.
+	streaming := bodyBuffered
+	switch {
+	case grpc:
+		streaming = bodyUnsigned
+	case !eventStream:
+		streaming = p.bodyStreaming(req, service)
+	}
+	body := &requestBody{}
+	gzipped := false
+	if req.Method != http.MethodHead && !eventStream && streaming == bodyBuffered {
+		spill := bodySpill{threshold: p.BodySpillThreshold, dir: p.BodySpillDir}
+		body, err = readBodyWithin(req, p.RecomputeContentLength, spill, p.ClientBodyTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if p.RequestBodyTransformer != nil {
+			transformed, err := transformRequestBody(req, body, spill, p.RequestBodyTransformer)
+			body.Close()
+			if err != nil {
+				return nil, &statusError{status: http.StatusInternalServerError, err: err}
+			}
+			body = transformed
+		}
+		if p.CompressRequests && p.shouldCompressRequest(req, body, service) {
+			compressed, err := gzipRequestBody(body, spill)
+			body.Close()
+			if err != nil {
+				return nil, &statusError{status: http.StatusInternalServerError, err: err}
+			}
+			body = compressed
+			gzipped = true
+		}
+	}
+	// A spilled body is removed once the response has been relayed, or right
+	// away if there is none.
+	closeLater := false
+	defer func() {
+		if !closeLater {
+			body.Close()
+		}
+	}()
+
+	method := req.Method
+	if p.HeadAsGet && method == http.MethodHead {
+		method = http.MethodGet
 	}
 
-	if err := p.sign(proxyReq, service); err != nil {
+	// Tie the upstream request to the client's, so a client going away
+	// cancels the upstream call.
+	proxyReq, err := http.NewRequestWithContext(req.Context(), method, proxyURL.String(), body.reader())
+	if err != nil {
 		return nil, err
 	}
+	if body.spilled() {
+		proxyReq.ContentLength = body.size
+		proxyReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(body.reader()), nil
+		}
+	}
 
-	// Remove any headers specified
+	info := requestInfoFrom(req.Context())
+	info.Service = service.SigningName
+	info.Region = service.SigningRegion
+	info.UpstreamHost = proxyURL.Host
+
+	// Remove hop-by-hop headers and any headers specified, connections are
+	// still asked to switch protocols
+	upgrade := upgradeProtocol(req.Header)
+	removeHopByHopHeaders(req.Header)
 	for _, header := range p.StripRequestHeaders {
-		log.WithField("StripHeader", string(header)).Debug("Stripping Header:")
+		logger.WithField("StripHeader", string(header)).Debug("Stripping Header:")
 		req.Header.Del(header)
 	}
+	canonicalizeHeaderValues(req.Header)
+	setTraceparent(req.Header, info.Span)
+
+	if err := applyCostTags(proxyReq.Header, req.Header, p.CostTagHeaders, p.CostTagValues); err != nil {
+		return nil, err
+	}
+	if p.ForwardClientCert {
+		setClientCertHeaders(proxyReq.Header, req)
+	}
+
+	// Headers present before signing are covered by the signature
+	for _, header := range p.SignedHeaders {
+		if vv, ok := req.Header[http.CanonicalHeaderKey(header)]; ok {
+			proxyReq.Header[http.CanonicalHeaderKey(header)] = vv
+		}
+	}
+	headerRules := p.headerRules(route)
+	for _, rules := range headerRules {
+		rules.applyRequest(req.Header, proxyReq.Header)
+	}
+
+	if eventStream {
+		proxyReq.Header.Set("X-Amz-Content-Sha256", streamingEventsPayload)
+	}
+	setStreamingHeaders(proxyReq.Header, req.Header, streaming, req.ContentLength)
+	if gzipped {
+		proxyReq.Header.Set("Content-Encoding", "gzip")
+	}
+
+	// Snapshot the request before it is signed, its copies, mirrored or
+	// redirected, are signed on their own
+	streamed := eventStream || streaming != bodyBuffered || upgrade != ""
+	mirror := p.shouldMirror(body, streamed, logger)
+	followRedirects := p.FollowRedirects && !streamed
+	retry := p.Retry != nil && !streamed
+	mirrorURL := *proxyReq.URL
+	var signedHeader, unsignedHeader http.Header
+	if mirror || followRedirects || retry {
+		signedHeader, unsignedHeader = proxyReq.Header.Clone(), req.Header.Clone()
+	}
+
+	signTime := p.signingTime(received)
+	if eventStream || streaming == bodyChunkSigned {
+		var err error
+		if signer, err = staticSigner(signer); err != nil {
+			return nil, &statusError{status: http.StatusInternalServerError, err: err}
+		}
+	}
+	var debug *signingDebug
+	if dryRun {
+		debug = &signingDebug{}
+		signer = debug.capture(signer)
+	}
+	if err := p.sign(proxyReq, body.reader(), signer, service, signTime); err != nil {
+		return nil, &statusError{status: http.StatusInternalServerError, err: err}
+	}
+	if dryRun {
+		header := proxyReq.Header.Clone()
+		copyHeaderWithoutOverwrite(header, req.Header)
+		return newDryRunResponse(proxyReq, header, service, debug)
+	}
+
+	switch {
+	case eventStream:
+		if err := p.attachEventStream(proxyReq, req.Body, signer, service); err != nil {
+			return nil, &statusError{status: http.StatusInternalServerError, err: err}
+		}
+	case streaming == bodyChunkSigned:
+		if err := p.attachChunkedBody(proxyReq, req.Body, req.ContentLength, signer, service, signTime); err != nil {
+			return nil, &statusError{status: http.StatusInternalServerError, err: err}
+		}
+	case streaming == bodyUnsigned:
+		proxyReq.Body = req.Body
+		proxyReq.ContentLength = req.ContentLength
+		proxyReq.GetBody = nil
+		proxyReq.Trailer = req.Trailer
+	}
 
 	// Add origin headers after request is signed (no overwrite)
 	copyHeaderWithoutOverwrite(proxyReq.Header, req.Header)
+	if upgrade != "" {
+		proxyReq.Header.Set("Connection", "Upgrade")
+		proxyReq.Header.Set("Upgrade", upgrade)
+	}
+	if grpc {
+		// Removed as hop-by-hop, but gRPC requires it
+		proxyReq.Header.Set("Te", "trailers")
+	}
 
 	if log.GetLevel() == log.DebugLevel {
-		proxyReqDump, err := httputil.DumpRequest(proxyReq, true)
+		proxyReqDump, err := httputil.DumpRequest(proxyReq, !body.spilled() && !streamed)
 		if err != nil {
-			log.WithError(err).Error("unable to dump request")
+			logger.WithError(err).Error("unable to dump request")
 		}
-		log.WithField("request", string(proxyReqDump)).Debug("proxying request")
+		logger.WithField("request", string(proxyReqDump)).Debug("proxying request")
 	}
 
-	resp, err := p.Client.Do(proxyReq)
+	var resp *http.Response
+	if retry {
+		resp, err = p.sendWithRetries(proxyReq, signedHeader, unsignedHeader, body, signer, service, received)
+	} else {
+		resp, err = p.send(proxyReq, p.upstreamTimeout(service.SigningName))
+	}
+	if mirror {
+		p.mirror(logger, proxyReq.Method, mirrorURL, signedHeader, unsignedHeader, body.data, signer, service)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if followRedirects {
+		if resp, err = p.followRedirects(resp, proxyReq, signedHeader, unsignedHeader, body, signer, service, received); err != nil {
+			return nil, err
+		}
+	}
 
-	if log.GetLevel() == log.DebugLevel && resp.StatusCode >= 400 {
-		b, _ := ioutil.ReadAll(resp.Body)
-		log.WithField("message", string(b)).Error("error proxying request")
+	// The body of a response switching protocols is the connection itself
+	upgraded := resp.StatusCode == http.StatusSwitchingProtocols
+	if p.ResponseBodyTransformer != nil && resp.Body != nil && !upgraded {
+		body, err := p.ResponseBodyTransformer(resp, resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to transform response body: %w", err)
+		}
+		// The transformed body's length is unknown
+		resp.Body = body
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+
+	if resp.Body != nil && p.shouldLogErrorBody(resp.StatusCode) && !upgraded {
+		resp.Body = &errorBodyLogger{ReadCloser: resp.Body, status: resp.StatusCode, logger: logger}
+	}
+
+	if body.spilled() && resp.Body != nil {
+		resp.Body = &closeWithBody{ReadCloser: resp.Body, body: body}
+		closeLater = true
+	}
+
+	if len(headerRules) > 0 && resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	for _, rules := range headerRules {
+		rules.applyResponse(resp.Header)
 	}
 
 	return resp, nil
@@ -16,20 +16,39 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
 )
 
 type mockHTTPClient struct {
 	Client
-	Request *http.Request
-	Fail bool
+	Request  *http.Request
+	Response *http.Response
+	Fail     bool
 }
 
 func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
@@ -37,6 +56,9 @@ func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("mockHTTPClient.Do failed")
 	}
 	m.Request = req
+	if m.Response != nil {
+		return m.Response, nil
+	}
 	return &http.Response{}, nil
 }
 
@@ -160,7 +182,7 @@ func TestProxyClient_Do(t *testing.T) {
 			},
 			want: &want{
 				resp: nil,
-				err:  fmt.Errorf(`mockProvider.Retrieve failed`),
+				err:  &statusError{status: http.StatusInternalServerError, err: fmt.Errorf(`mockProvider.Retrieve failed`)},
 			},
 		},
 		{
@@ -178,9 +200,9 @@ func TestProxyClient_Do(t *testing.T) {
 				Client: &mockHTTPClient{},
 			},
 			want: &want{
-				resp: nil,
+				resp:    nil,
 				request: nil,
-				err:  fmt.Errorf(`mockProvider.Retrieve failed`),
+				err:     &statusError{status: http.StatusInternalServerError, err: fmt.Errorf(`mockProvider.Retrieve failed`)},
 			},
 		},
 		{
@@ -264,3 +286,1511 @@ func verifyRequest(received *http.Request, expected *http.Request) bool {
 
 	return received.Host == expected.Host
 }
+
+func TestProxyClient_Do_RemovesHopByHopHeaders(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	request := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{},
+		Host:   "execute-api.us-west-2.amazonaws.com",
+		Header: http.Header{
+			"Connection":          []string{"keep-alive, X-Hop"},
+			"Keep-Alive":          []string{"timeout=5"},
+			"Proxy-Authorization": []string{"Basic Zm9vOmJhcg=="},
+			"Te":                  []string{"gzip"},
+			"Trailer":             []string{"X-Checksum"},
+			"Transfer-Encoding":   []string{"chunked"},
+			"Upgrade":             []string{"h2c"},
+			"X-Hop":               []string{"should not be forwarded"},
+			"X-End-To-End":        []string{"forwarded"},
+		},
+	}
+
+	_, err := proxyClient.Do(request)
+	assert.Nil(t, err)
+
+	for _, header := range append(hopHeaders, "X-Hop") {
+		assert.Empty(t, client.Request.Header.Values(header), header)
+	}
+	assert.NotContains(t, client.Request.Header.Get("Authorization"), "x-hop")
+	assert.Equal(t, "forwarded", client.Request.Header.Get("X-End-To-End"))
+}
+
+func BenchmarkProxyClient_Do_SigningConcurrency(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 1<<20)
+
+	for _, concurrency := range []int{0, 1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			proxyClient := &ProxyClient{
+				Signer:             v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:             &mockHTTPClient{},
+				SigningConcurrency: concurrency,
+			}
+
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					request := &http.Request{
+						Method: "PUT",
+						URL:    &url.URL{},
+						Host:   "execute-api.us-west-2.amazonaws.com",
+						Header: http.Header{},
+						Body:   ioutil.NopCloser(bytes.NewReader(body)),
+					}
+					if _, err := proxyClient.Do(request); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestProxyClient_Do_StripsQueryParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []*regexp.Regexp
+		rawQuery string
+		want     string
+	}{
+		{
+			name:     "keeps query untouched when nothing is configured",
+			rawQuery: "Action=ListUsers&utm_source=mail",
+			want:     "Action=ListUsers&utm_source=mail",
+		},
+		{
+			name:     "strips exact parameter names",
+			patterns: []*regexp.Regexp{regexp.MustCompile(`^(?:_)$`)},
+			rawQuery: "Action=ListUsers&_=1602512345",
+			want:     "Action=ListUsers",
+		},
+		{
+			name:     "strips parameters matching an expression",
+			patterns: []*regexp.Regexp{regexp.MustCompile(`^(?:utm_.*)$`)},
+			rawQuery: "utm_source=mail&Action=ListUsers&utm_medium=email&Version=2010-05-08",
+			want:     "Action=ListUsers&Version=2010-05-08",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:               client,
+				StripQueryParameters: tt.patterns,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/", RawQuery: tt.rawQuery},
+				Host:   "iam.amazonaws.com",
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			// The signer rewrites the forwarded query into its canonical
+			// form, so this is also the query covered by the signature.
+			assert.Equal(t, tt.want, client.Request.URL.RawQuery)
+		})
+	}
+}
+
+func TestProxyClient_Do_ContentLengthMismatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength int64
+		body          string
+		recompute     bool
+		wantLength    int64
+		wantErr       error
+	}{
+		{
+			name:          "forwards body matching Content-Length",
+			contentLength: 5,
+			body:          "hello",
+			wantLength:    5,
+		},
+		{
+			name:          "rejects overstated Content-Length",
+			contentLength: 10,
+			body:          "hello",
+			wantErr:       &statusError{status: http.StatusBadRequest, err: fmt.Errorf("request body length 5 does not match Content-Length 10")},
+		},
+		{
+			name:          "rejects understated Content-Length",
+			contentLength: 2,
+			body:          "hello",
+			wantErr:       &statusError{status: http.StatusBadRequest, err: fmt.Errorf("request body length 5 does not match Content-Length 2")},
+		},
+		{
+			name:          "recomputes overstated Content-Length",
+			contentLength: 10,
+			body:          "hello",
+			recompute:     true,
+			wantLength:    5,
+		},
+		{
+			name:          "recomputes understated Content-Length",
+			contentLength: 2,
+			body:          "hello",
+			recompute:     true,
+			wantLength:    5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                 client,
+				RecomputeContentLength: tt.recompute,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method:        "PUT",
+				URL:           &url.URL{},
+				Host:          "execute-api.us-west-2.amazonaws.com",
+				Header:        http.Header{},
+				ContentLength: tt.contentLength,
+				Body:          ioutil.NopCloser(bytes.NewBufferString(tt.body)),
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.wantLength, client.Request.ContentLength)
+				forwarded, _ := ioutil.ReadAll(client.Request.Body)
+				assert.Equal(t, tt.body, string(forwarded))
+			}
+		})
+	}
+}
+
+func TestProxyClient_Do_AllowedUpstreamHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		allowed []string
+		wantErr error
+	}{
+		{
+			name: "allows every host when the allowlist is empty",
+			host: "execute-api.us-west-2.amazonaws.com",
+		},
+		{
+			name:    "allows exact matches",
+			host:    "execute-api.us-west-2.amazonaws.com",
+			allowed: []string{"execute-api.us-west-2.amazonaws.com"},
+		},
+		{
+			name:    "allows wildcard matches",
+			host:    "execute-api.us-west-2.amazonaws.com",
+			allowed: []string{"*.example.com", "*.amazonaws.com"},
+		},
+		{
+			name:    "allows hosts with a port by host name",
+			host:    "execute-api.us-west-2.amazonaws.com:443",
+			allowed: []string{"*.amazonaws.com"},
+		},
+		{
+			name:    "rejects hosts outside the allowlist",
+			host:    "execute-api.us-west-2.amazonaws.com",
+			allowed: []string{"*.example.com"},
+			wantErr: &statusError{status: http.StatusForbidden, err: fmt.Errorf("upstream host is not allowed: execute-api.us-west-2.amazonaws.com")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:               client,
+				SigningNameOverride:  "execute-api",
+				RegionOverride:       "us-west-2",
+				AllowedUpstreamHosts: tt.allowed,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantErr == nil, client.Request != nil)
+		})
+	}
+}
+
+func TestProxyClient_Do_CanonicalizesDuplicateHeaders(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "PUT",
+		URL:    &url.URL{Path: "/bucket/key"},
+		Host:   "s3.amazonaws.com",
+		Header: http.Header{
+			"X-Amz-Meta-Tag": []string{"alpha", "  beta "},
+			"Cookie":         []string{"a=1", "b=2"},
+			"X-Single":       []string{" untouched "},
+		},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha,beta"}, client.Request.Header["X-Amz-Meta-Tag"])
+	assert.Equal(t, []string{"a=1; b=2"}, client.Request.Header["Cookie"])
+	assert.Equal(t, []string{" untouched "}, client.Request.Header["X-Single"])
+}
+
+func TestProxyClient_sign_DuplicateHeadersMatchFoldedValue(t *testing.T) {
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+	}
+	service := &endpoints.ResolvedEndpoint{SigningMethod: "v4", SigningName: "s3", SigningRegion: "us-east-1"}
+	signTime := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	signature := func(values ...string) string {
+		req, _ := http.NewRequest("PUT", "https://s3.amazonaws.com/bucket/key", nil)
+		req.Header["X-Amz-Meta-Tag"] = values
+		assert.Nil(t, proxyClient.sign(req, bytes.NewReader(nil), proxyClient.signer(nil, "", nil, service), service, signTime))
+		assert.Len(t, req.Header["X-Amz-Meta-Tag"], 1)
+		return req.Header.Get("Authorization")
+	}
+
+	assert.Equal(t, signature("alpha,beta"), signature("alpha", " beta"))
+	assert.Equal(t, signature("alpha,beta"), signature("alpha", "beta"))
+	assert.NotEqual(t, signature("alpha,beta"), signature("beta", "alpha"))
+}
+
+func TestProxyClient_Do_SignsEveryMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+	}{
+		{method: http.MethodGet},
+		{method: http.MethodHead},
+		{method: http.MethodOptions},
+		{method: http.MethodDelete},
+		{method: http.MethodPost, body: `{"name":"post"}`},
+		{method: http.MethodPut, body: `{"name":"put"}`},
+		{method: http.MethodPatch, body: `{"name":"patch"}`},
+		{method: "PROPFIND"},
+	}
+
+	signer := v4.NewSigner(credentials.NewCredentials(&mockProvider{}))
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{Signer: signer, Client: client}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method:        tt.method,
+				URL:           &url.URL{Path: "/prod/items"},
+				Host:          "execute-api.us-west-2.amazonaws.com",
+				Header:        http.Header{},
+				ContentLength: int64(len(tt.body)),
+				Body:          ioutil.NopCloser(bytes.NewBufferString(tt.body)),
+			})
+			assert.Nil(t, err)
+
+			forwarded := client.Request
+			assert.Equal(t, tt.method, forwarded.Method)
+			assert.Equal(t, int64(len(tt.body)), forwarded.ContentLength)
+
+			// Independently sign the same request and make sure the proxy
+			// produced an identical signature.
+			signTime, err := time.Parse("20060102T150405Z", forwarded.Header.Get("X-Amz-Date"))
+			assert.Nil(t, err)
+			expected, _ := http.NewRequest(tt.method, "https://execute-api.us-west-2.amazonaws.com/prod/items", nil)
+			_, err = signer.Sign(expected, bytes.NewReader([]byte(tt.body)), "execute-api", "us-west-2", signTime)
+			assert.Nil(t, err)
+			assert.Equal(t, expected.Header.Get("Authorization"), forwarded.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestProxyClient_Do_CancelsUpstreamWithClient(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer upstream.Close()
+
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              upstream.Client(),
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-west-2",
+		HostOverride:        upstream.Listener.Addr().String(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := (&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Header: http.Header{},
+	}).WithContext(ctx)
+
+	errs := make(chan error)
+	go func() {
+		_, err := proxyClient.Do(request)
+		errs <- err
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Is(err, context.Canceled), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled with the client")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream did not observe the cancellation")
+	}
+}
+
+func TestProxyClient_Do_SignedHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		signedHeaders []string
+		want          string
+	}{
+		{
+			name: "signs only the mandatory headers by default",
+			want: "SignedHeaders=host;x-amz-date,",
+		},
+		{
+			name:          "signs the listed headers",
+			signedHeaders: []string{"content-type", "X-Amz-Meta-A"},
+			want:          "SignedHeaders=content-type;host;x-amz-date;x-amz-meta-a,",
+		},
+		{
+			name:          "ignores listed headers missing from the request",
+			signedHeaders: []string{"x-amz-meta-missing"},
+			want:          "SignedHeaders=host;x-amz-date,",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:        v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:        client,
+				SignedHeaders: tt.signedHeaders,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{
+					"Content-Type": []string{"application/json"},
+					"X-Amz-Meta-A": []string{"a"},
+					"X-Amz-Meta-B": []string{"b"},
+				},
+			})
+
+			assert.Nil(t, err)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.want)
+			// Unsigned headers are still forwarded.
+			assert.Equal(t, "b", client.Request.Header.Get("X-Amz-Meta-B"))
+		})
+	}
+}
+
+func TestProxyClient_Do_DeriveFromIncomingAuth(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:                 client,
+		DeriveFromIncomingAuth: true,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "gateway.internal",
+		Header: http.Header{
+			"Authorization": []string{"AWS4-HMAC-SHA256 Credential=CLIENTKEY/20201001/eu-west-1/execute-api/aws4_request, SignedHeaders=host, Signature=abcdef"},
+		},
+	})
+
+	assert.Nil(t, err)
+	auth := client.Request.Header.Get("Authorization")
+	assert.Regexp(t, `^AWS4-HMAC-SHA256 Credential=/\d{8}/eu-west-1/execute-api/aws4_request, `, auth)
+	assert.NotContains(t, auth, "CLIENTKEY")
+	assert.Len(t, client.Request.Header["Authorization"], 1)
+}
+
+func TestProxyClient_upstreamTimeout(t *testing.T) {
+	proxyClient := &ProxyClient{
+		UpstreamTimeout: 10 * time.Second,
+		ServiceTimeouts: map[string]time.Duration{
+			"ssm":       30 * time.Second,
+			"appconfig": 45 * time.Second,
+		},
+	}
+
+	assert.Equal(t, 30*time.Second, proxyClient.upstreamTimeout("ssm"))
+	assert.Equal(t, 45*time.Second, proxyClient.upstreamTimeout("appconfig"))
+	assert.Equal(t, 10*time.Second, proxyClient.upstreamTimeout("s3"))
+	assert.Equal(t, time.Duration(0), (&ProxyClient{}).upstreamTimeout("s3"))
+}
+
+func TestProxyClient_Do_AppliesServiceTimeout(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              upstream.Client(),
+		SigningNameOverride: "ssm",
+		RegionOverride:      "us-west-2",
+		HostOverride:        upstream.Listener.Addr().String(),
+		UpstreamTimeout:     time.Minute,
+		ServiceTimeouts:     map[string]time.Duration{"ssm": 50 * time.Millisecond},
+	}
+
+	_, err := proxyClient.Do(&http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{}})
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Contains(t, err.Error(), "upstream "+upstream.Listener.Addr().String()+" did not respond within 50ms")
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(err))
+}
+
+func TestProxyClient_Do_SignsLambdaFunctionURLs(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/"},
+		Host:   "abcdefghijklmnopqrstuvwxyz012345.lambda-url.us-west-2.on.aws",
+		Header: http.Header{},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz012345.lambda-url.us-west-2.on.aws", client.Request.URL.Host)
+	assert.Regexp(t, `Credential=/\d{8}/us-west-2/lambda/aws4_request`, client.Request.Header.Get("Authorization"))
+}
+
+func TestProxyClient_Do_CostTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantErr    error
+		wantTag    string
+		wantSigned bool
+	}{
+		{
+			name:       "copies an allowed value into the signed outgoing header",
+			header:     http.Header{"X-Tenant-Id": []string{"team-a"}},
+			wantTag:    "team-a",
+			wantSigned: true,
+		},
+		{
+			name:   "leaves the outgoing header unset without the incoming header",
+			header: http.Header{},
+		},
+		{
+			name:   "drops an outgoing header sent by the client",
+			header: http.Header{"X-Amz-Meta-Tenant": []string{"team-b"}},
+		},
+		{
+			name:    "rejects values outside the allowlist",
+			header:  http.Header{"X-Tenant-Id": []string{"admin"}},
+			wantErr: &statusError{status: http.StatusBadRequest, err: fmt.Errorf(`X-Tenant-Id value is not allowed: "admin"`)},
+		},
+		{
+			name:    "rejects values with control characters",
+			header:  http.Header{"X-Tenant-Id": []string{"team-a\r\nx-injected: 1"}},
+			wantErr: &statusError{status: http.StatusBadRequest, err: fmt.Errorf(`X-Tenant-Id value is not allowed: "team-a\r\nx-injected: 1"`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:         v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:         client,
+				CostTagHeaders: map[string]string{"x-tenant-id": "x-amz-meta-tenant"},
+				CostTagValues:  []string{"team-*"},
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: tt.header,
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr != nil {
+				return
+			}
+			assert.Equal(t, tt.wantTag, client.Request.Header.Get("X-Amz-Meta-Tenant"))
+			assert.Equal(t, tt.wantSigned, strings.Contains(client.Request.Header.Get("Authorization"), "x-amz-meta-tenant"))
+		})
+	}
+}
+
+func TestProxyClient_Do_SignsHEADWithEmptyPayload(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "HEAD",
+		URL:    &url.URL{Path: "/-/vaults/examplevault"},
+		Host:   "glacier.us-west-2.amazonaws.com",
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewBufferString("unexpected")),
+	})
+
+	assert.Nil(t, err)
+	// Glacier exposes the payload hash, the SHA-256 of the empty string
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", client.Request.Header.Get("X-Amz-Content-Sha256"))
+	assert.Equal(t, int64(0), client.Request.ContentLength)
+}
+
+func TestProxyClient_Do_Endpoints(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+		Endpoints: map[string]*url.URL{
+			"sqs":      {Scheme: "http", Host: "localstack:4566"},
+			"dynamodb": {Scheme: "https", Host: "vpce-1234.dynamodb.us-west-2.vpce.amazonaws.com", Path: "/ddb/"},
+		},
+	}
+
+	tests := []struct {
+		host      string
+		path      string
+		wantURL   string
+		wantScope string
+	}{
+		{
+			host:      "sqs.us-east-1.amazonaws.com",
+			path:      "/123456789012/queue",
+			wantURL:   "http://localstack:4566/123456789012/queue",
+			wantScope: "/us-east-1/sqs/aws4_request",
+		},
+		{
+			host:      "dynamodb.us-west-2.amazonaws.com",
+			path:      "/",
+			wantURL:   "https://vpce-1234.dynamodb.us-west-2.vpce.amazonaws.com/ddb/",
+			wantScope: "/us-west-2/dynamodb/aws4_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			_, err := proxyClient.Do(&http.Request{
+				Method: "POST",
+				URL:    &url.URL{Path: tt.path},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantURL, client.Request.URL.String())
+			// The host in the signature is the one the request is sent to
+			assert.Equal(t, client.Request.URL.Host, client.Request.Host)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), "SignedHeaders=host;")
+		})
+	}
+}
+
+func TestProxyClient_Do_EndpointOutsideAllowedUpstreamHosts(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:               client,
+		Endpoints:            map[string]*url.URL{"sqs": {Scheme: "https", Host: "sqs.example.com"}},
+		AllowedUpstreamHosts: []string{"*.amazonaws.com"},
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/123456789012/queue"},
+		Host:   "sqs.us-east-1.amazonaws.com",
+		Header: http.Header{},
+	})
+
+	assert.Equal(t, &statusError{status: http.StatusForbidden, err: fmt.Errorf("upstream host is not allowed: sqs.example.com")}, err)
+	assert.Nil(t, client.Request)
+}
+
+func TestProxyClient_Do_RequireUpstreamTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		require   bool
+		plaintext []string
+		endpoint  *url.URL
+		wantErr   error
+	}{
+		{
+			name:     "allows plaintext endpoints by default",
+			endpoint: &url.URL{Scheme: "http", Host: "sqs.internal.example.com"},
+		},
+		{
+			name:     "allows https endpoints",
+			require:  true,
+			endpoint: &url.URL{Scheme: "https", Host: "vpce-1234.sqs.us-west-2.vpce.amazonaws.com"},
+		},
+		{
+			name:    "allows AWS hosts, always reached over https",
+			require: true,
+		},
+		{
+			name:      "allows explicitly allowed plaintext hosts",
+			require:   true,
+			plaintext: []string{"localhost:4566"},
+			endpoint:  &url.URL{Scheme: "http", Host: "localhost:4566"},
+		},
+		{
+			name:      "allows wildcard matches of plaintext hosts",
+			require:   true,
+			plaintext: []string{"*.localstack.internal"},
+			endpoint:  &url.URL{Scheme: "http", Host: "sqs.localstack.internal:4566"},
+		},
+		{
+			name:      "rejects other plaintext hosts",
+			require:   true,
+			plaintext: []string{"localhost:4566"},
+			endpoint:  &url.URL{Scheme: "http", Host: "sqs.us-west-2.amazonaws.com"},
+			wantErr:   &statusError{status: http.StatusBadGateway, err: fmt.Errorf("upstream TLS is required, refusing to send a signed request over http to sqs.us-west-2.amazonaws.com")},
+		},
+		{
+			name:     "rejects plaintext hosts without an allowlist",
+			require:  true,
+			endpoint: &url.URL{Scheme: "http", Host: "localhost:4566"},
+			wantErr:  &statusError{status: http.StatusBadGateway, err: fmt.Errorf("upstream TLS is required, refusing to send a signed request over http to localhost:4566")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                 client,
+				RequireUpstreamTLS:     tt.require,
+				PlaintextUpstreamHosts: tt.plaintext,
+			}
+			if tt.endpoint != nil {
+				proxyClient.Endpoints = map[string]*url.URL{"sqs": tt.endpoint}
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "POST",
+				URL:    &url.URL{Path: "/123456789012/queue"},
+				Host:   "sqs.us-west-2.amazonaws.com",
+				Header: http.Header{},
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantErr == nil, client.Request != nil)
+		})
+	}
+}
+
+func TestProxyClient_Do_TransformsBodies(t *testing.T) {
+	client := &mockHTTPClient{
+		Response: &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": []string{"16"}},
+			ContentLength: 16,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(`{"secret":"abc"}`)),
+		},
+	}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+		RequestBodyTransformer: func(req *http.Request, body io.Reader) (io.Reader, error) {
+			b, err := ioutil.ReadAll(body)
+			return bytes.NewReader(bytes.ToUpper(b)), err
+		},
+		ResponseBodyTransformer: func(resp *http.Response, body io.ReadCloser) (io.ReadCloser, error) {
+			b, err := ioutil.ReadAll(body)
+			redacted := regexp.MustCompile(`"secret":"[^"]*"`).ReplaceAll(b, []byte(`"secret":"REDACTED"`))
+			return ioutil.NopCloser(bytes.NewReader(redacted)), err
+		},
+	}
+
+	resp, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/-/vaults/examplevault/archives"},
+		Host:   "glacier.us-west-2.amazonaws.com",
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewBufferString("archive")),
+	})
+
+	assert.Nil(t, err)
+	sent, _ := ioutil.ReadAll(client.Request.Body)
+	assert.Equal(t, "ARCHIVE", string(sent))
+	assert.Equal(t, int64(len("ARCHIVE")), client.Request.ContentLength)
+	// Glacier exposes the payload hash, the signature covers the transformed body
+	sum := sha256.Sum256([]byte("ARCHIVE"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), client.Request.Header.Get("X-Amz-Content-Sha256"))
+
+	received, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"secret":"REDACTED"}`, string(received))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "", resp.Header.Get("Content-Length"))
+}
+
+func TestProxyClient_Do_MultipartBody(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("description", "archive")
+	part, _ := mw.CreateFormFile("file", "archive.bin")
+	part.Write([]byte("\x00\x01--not-a-boundary\r\n\xff"))
+	mw.Close()
+	payload := buf.Bytes()
+	contentType := mw.FormDataContentType()
+
+	for _, recompute := range []bool{false, true} {
+		t.Run(fmt.Sprintf("recompute content length %v", recompute), func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                 client,
+				SignedHeaders:          []string{"Content-Type"},
+				RecomputeContentLength: recompute,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method:        "POST",
+				URL:           &url.URL{Path: "/-/vaults/examplevault/archives"},
+				Host:          "glacier.us-west-2.amazonaws.com",
+				Header:        http.Header{"Content-Type": []string{contentType}},
+				ContentLength: int64(len(payload)),
+				Body:          ioutil.NopCloser(bytes.NewReader(payload)),
+			})
+
+			assert.Nil(t, err)
+			sent, _ := ioutil.ReadAll(client.Request.Body)
+			assert.Equal(t, payload, sent)
+			assert.Equal(t, int64(len(payload)), client.Request.ContentLength)
+			// The boundary is forwarded, and signed, exactly as received
+			assert.Equal(t, contentType, client.Request.Header.Get("Content-Type"))
+			assert.Contains(t, client.Request.Header.Get("Authorization"), "content-type")
+			// Glacier exposes the payload hash, the signature covers the forwarded body
+			sum := sha256.Sum256(sent)
+			assert.Equal(t, hex.EncodeToString(sum[:]), client.Request.Header.Get("X-Amz-Content-Sha256"))
+
+			_, params, _ := mime.ParseMediaType(client.Request.Header.Get("Content-Type"))
+			form, err := multipart.NewReader(bytes.NewReader(sent), params["boundary"]).ReadForm(1 << 20)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"archive"}, form.Value["description"])
+			assert.Len(t, form.File["file"], 1)
+		})
+	}
+}
+
+func TestProxyClient_Do_SpillsLargeBodies(t *testing.T) {
+	payload := bytes.Repeat([]byte("archive "), 1024)
+	sum := sha256.Sum256(payload)
+
+	tests := []struct {
+		name        string
+		threshold   int64
+		fail        bool
+		wantSpilled bool
+	}{
+		{name: "keeps bodies up to the threshold in memory", threshold: int64(len(payload))},
+		{name: "spills bodies past the threshold", threshold: 1024, wantSpilled: true},
+		{name: "removes spilled bodies when the upstream request fails", threshold: 1024, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			client := &mockHTTPClient{
+				Fail:     tt.fail,
+				Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBuffer(nil))},
+			}
+			proxyClient := &ProxyClient{
+				Signer:             v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:             client,
+				BodySpillThreshold: tt.threshold,
+				BodySpillDir:       dir,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        "POST",
+				URL:           &url.URL{Path: "/-/vaults/examplevault/archives"},
+				Host:          "glacier.us-west-2.amazonaws.com",
+				Header:        http.Header{},
+				ContentLength: int64(len(payload)),
+				Body:          ioutil.NopCloser(bytes.NewReader(payload)),
+			})
+
+			files, _ := ioutil.ReadDir(dir)
+			spilled := len(files)
+			if tt.fail {
+				assert.NotNil(t, err)
+				assert.Equal(t, 0, spilled)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantSpilled, spilled == 1)
+			sent, _ := ioutil.ReadAll(client.Request.Body)
+			assert.Equal(t, payload, sent)
+			assert.Equal(t, int64(len(payload)), client.Request.ContentLength)
+			// Glacier exposes the payload hash
+			assert.Equal(t, hex.EncodeToString(sum[:]), client.Request.Header.Get("X-Amz-Content-Sha256"))
+			if tt.wantSpilled {
+				retried, _ := client.Request.GetBody()
+				sent, _ = ioutil.ReadAll(retried)
+				assert.Equal(t, payload, sent)
+			}
+
+			resp.Body.Close()
+			files, _ = ioutil.ReadDir(dir)
+			assert.Len(t, files, 0)
+		})
+	}
+}
+
+func TestProxyClient_Do_RequestBodyTransformerFails(t *testing.T) {
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: &mockHTTPClient{},
+		RequestBodyTransformer: func(req *http.Request, body io.Reader) (io.Reader, error) {
+			return nil, fmt.Errorf("no key")
+		},
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{},
+		Host:   "execute-api.us-west-2.amazonaws.com",
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewBufferString("body")),
+	})
+
+	assert.Equal(t, &statusError{status: http.StatusInternalServerError, err: fmt.Errorf("unable to transform request body: %w", fmt.Errorf("no key"))}, err)
+}
+
+func TestProxyClient_Do_DefaultRegionForGlobal(t *testing.T) {
+	tests := []struct {
+		host          string
+		defaultRegion string
+		wantScope     string
+		wantErr       error
+	}{
+		{host: "iam.amazonaws.com", defaultRegion: "us-east-1", wantScope: "/us-east-1/iam/aws4_request"},
+		{host: "route53.amazonaws.com", defaultRegion: "us-east-1", wantScope: "/us-east-1/route53/aws4_request"},
+		// Regions known to the SDK are kept
+		{host: "cloudfront.amazonaws.com", defaultRegion: "eu-west-1", wantScope: "/us-east-1/cloudfront/aws4_request"},
+		{host: "sqs.eu-west-3.amazonaws.com", defaultRegion: "us-east-1", wantScope: "/eu-west-3/sqs/aws4_request"},
+		// Global hosts missing from the SDK's endpoints
+		{host: "newservice.amazonaws.com", defaultRegion: "us-east-1", wantScope: "/us-east-1/newservice/aws4_request"},
+		{host: "newservice.amazonaws.com", wantErr: fmt.Errorf("unable to determine service from host: newservice.amazonaws.com")},
+		{host: "newservice.eu-west-3.amazonaws.com", defaultRegion: "us-east-1", wantErr: fmt.Errorf("unable to determine service from host: newservice.eu-west-3.amazonaws.com")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.defaultRegion, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                 client,
+				DefaultRegionForGlobal: tt.defaultRegion,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestProxyClient_Do_EndpointSuffixes(t *testing.T) {
+	tests := []struct {
+		host      string
+		suffixes  []string
+		wantScope string
+		wantErr   error
+	}{
+		{host: "sqs.us-east-1.aws.corp.example.com", suffixes: []string{"aws.corp.example.com"}, wantScope: "/us-east-1/sqs/aws4_request"},
+		{host: "SQS.US-EAST-1.AWS.CORP.EXAMPLE.COM:443", suffixes: []string{".aws.corp.example.com."}, wantScope: "/us-east-1/sqs/aws4_request"},
+		{host: "execute-api.eu-west-3.amazonaws.com.corp", suffixes: []string{"other.internal", "corp"}, wantScope: "/eu-west-3/execute-api/aws4_request"},
+		{host: "abc123.lambda-url.eu-west-1.on.aws.corp", suffixes: []string{"corp"}, wantScope: "/eu-west-1/lambda/aws4_request"},
+		// Hosts outside the suffixes are detected as before
+		{host: "sqs.eu-west-1.amazonaws.com", suffixes: []string{"corp"}, wantScope: "/eu-west-1/sqs/aws4_request"},
+		{host: "sqs.us-east-1.aws.corp.example.com", wantErr: fmt.Errorf("unable to determine service from host: sqs.us-east-1.aws.corp.example.com")},
+		{host: "corp", suffixes: []string{"corp"}, wantErr: fmt.Errorf("unable to determine service from host: corp")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:           v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:           client,
+				EndpointSuffixes: tt.suffixes,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+				assert.Equal(t, tt.host, client.Request.URL.Host)
+			}
+		})
+	}
+}
+
+func TestProxyClient_Do_SigningNameAliases(t *testing.T) {
+	aliases := map[string]string{"api.ecr": "ecr", "execute-api": "iot"}
+
+	tests := []struct {
+		host      string
+		aliases   map[string]string
+		wantScope string
+	}{
+		{host: "api.ecr.us-west-2.amazonaws.com", aliases: aliases, wantScope: "/us-west-2/ecr/aws4_request"},
+		{host: "iot.us-west-2.amazonaws.com", aliases: aliases, wantScope: "/us-west-2/iot/aws4_request"},
+		{host: "sqs.us-west-2.amazonaws.com", aliases: aliases, wantScope: "/us-west-2/sqs/aws4_request"},
+		{host: "api.ecr.us-west-2.amazonaws.com", wantScope: "/us-west-2/api.ecr/aws4_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:             v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:             client,
+				SigningNameAliases: tt.aliases,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+			assert.Equal(t, tt.host, client.Request.URL.Host)
+		})
+	}
+}
+
+func TestProxyClient_Do_SignWhenHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		header     http.Header
+		wantSigned bool
+		wantURL    string
+	}{
+		{
+			name:       "signs requests carrying the marker",
+			header:     http.Header{"X-Sign": []string{"true"}, "X-Custom": []string{"a"}},
+			wantSigned: true,
+			wantURL:    "https://execute-api.us-west-2.amazonaws.com/items?id=1",
+		},
+		{
+			name:    "forwards requests without the marker unsigned",
+			header:  http.Header{"X-Custom": []string{"a"}},
+			wantURL: "http://backend.internal:8080/base/items?id=1",
+		},
+		{
+			name:       "signs requests with the expected marker value",
+			value:      "true",
+			header:     http.Header{"X-Sign": []string{"TRUE"}, "X-Custom": []string{"a"}},
+			wantSigned: true,
+			wantURL:    "https://execute-api.us-west-2.amazonaws.com/items?id=1",
+		},
+		{
+			name:    "forwards requests with another marker value unsigned",
+			value:   "true",
+			header:  http.Header{"X-Sign": []string{"false"}, "X-Custom": []string{"a"}},
+			wantURL: "http://backend.internal:8080/base/items?id=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:              client,
+				SignWhenHeader:      "x-sign",
+				SignWhenHeaderValue: tt.value,
+				UnsignedUpstream:    &url.URL{Scheme: "http", Host: "backend.internal:8080", Path: "/base/"},
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "POST",
+				URL:    &url.URL{Path: "/items", RawQuery: "id=1"},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: tt.header,
+				Body:   ioutil.NopCloser(bytes.NewBufferString("body")),
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantURL, client.Request.URL.String())
+			assert.Equal(t, tt.wantSigned, client.Request.Header.Get("Authorization") != "")
+			assert.Equal(t, "a", client.Request.Header.Get("X-Custom"))
+			_, forwarded := client.Request.Header["X-Sign"]
+			assert.False(t, forwarded)
+			body, _ := ioutil.ReadAll(client.Request.Body)
+			assert.Equal(t, "body", string(body))
+		})
+	}
+}
+
+func TestProxyClient_Do_RewritesPath(t *testing.T) {
+	rewrites := []PathRewrite{
+		{Pattern: regexp.MustCompile(`^(?:/objects/)`), Replacement: "/my-bucket/"},
+		{Pattern: regexp.MustCompile(`^(?:/v1/users/([^/]+)/avatar)`), Replacement: "/avatars/$1.png"},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		rawPath  string
+		wantPath string
+	}{
+		{name: "rewrites a prefix", path: "/objects/foo/bar.txt", wantPath: "/my-bucket/foo/bar.txt"},
+		{name: "rewrites with capture groups", path: "/v1/users/42/avatar", wantPath: "/avatars/42.png"},
+		{name: "keeps escaping", path: "/objects/a/b c", rawPath: "/objects/a%2Fb%20c", wantPath: "/my-bucket/a%2Fb%20c"},
+		{name: "leaves other paths", path: "/my-bucket/foo", wantPath: "/my-bucket/foo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:       v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:       client,
+				PathRewrites: rewrites,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path, RawPath: tt.rawPath},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			// The request is signed for the path it is sent with
+			assert.Equal(t, tt.wantPath, client.Request.URL.EscapedPath())
+		})
+	}
+}
+
+func TestProxyClient_Do_ForwardClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "client-a", Organization: []string{"Botpress"}},
+		DNSNames:       []string{"client-a.internal"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/client-a"}},
+		EmailAddresses: []string{"ops@example.org"},
+	}
+
+	tests := []struct {
+		name        string
+		tls         *tls.ConnectionState
+		wantSubject string
+		wantSAN     string
+	}{
+		{
+			name:        "forwards the verified certificate as signed headers",
+			tls:         &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			wantSubject: "CN=client-a,O=Botpress",
+			wantSAN:     "DNS:client-a.internal,URI:spiffe://example.org/client-a,email:ops@example.org",
+		},
+		{
+			name: "omits the headers without a verified certificate",
+			tls:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+		},
+		{
+			name: "omits the headers without TLS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:            v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:            client,
+				ForwardClientCert: true,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{},
+				Host:   "execute-api.us-west-2.amazonaws.com",
+				Header: http.Header{"X-Client-Cert-Subject": []string{"CN=spoofed"}},
+				TLS:    tt.tls,
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantSubject, client.Request.Header.Get("X-Client-Cert-Subject"))
+			assert.Equal(t, tt.wantSAN, client.Request.Header.Get("X-Client-Cert-San"))
+			auth := client.Request.Header.Get("Authorization")
+			assert.Equal(t, tt.wantSubject != "", strings.Contains(auth, "x-client-cert-subject"))
+			assert.Equal(t, tt.wantSAN != "", strings.Contains(auth, "x-client-cert-san"))
+		})
+	}
+}
+
+// steppingClock returns each of times in turn, then the last one.
+func steppingClock(times ...time.Time) func() time.Time {
+	return func() time.Time {
+		now := times[0]
+		if len(times) > 1 {
+			times = times[1:]
+		}
+		return now
+	}
+}
+
+func TestProxyClient_Do_PinSigningTime(t *testing.T) {
+	received := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	bodyRead := received.Add(30 * time.Second)
+
+	tests := []struct {
+		name     string
+		pin      bool
+		wantDate time.Time
+	}{
+		{name: "signs with the time the request was received", pin: true, wantDate: received},
+		{name: "signs with the current time by default", wantDate: bodyRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:         v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:         client,
+				PinSigningTime: tt.pin,
+				now:            steppingClock(received, bodyRead),
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   "sqs.us-west-2.amazonaws.com",
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantDate.Format("20060102T150405Z"), client.Request.Header.Get("X-Amz-Date"))
+		})
+	}
+}
+
+func TestProxyClient_resign(t *testing.T) {
+	received := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	service := &endpoints.ResolvedEndpoint{SigningMethod: "v4", SigningName: "sqs", SigningRegion: "us-west-2"}
+
+	tests := []struct {
+		name        string
+		pin         bool
+		retryAt     time.Time
+		wantDate    time.Time
+		wantSameSig bool
+	}{
+		{name: "keeps the date within the allowed age", pin: true, retryAt: received.Add(time.Minute), wantDate: received, wantSameSig: true},
+		{name: "refreshes the date past the allowed age", pin: true, retryAt: received.Add(maxPinnedSigningAge), wantDate: received.Add(maxPinnedSigningAge)},
+		{name: "refreshes the date when not pinned", retryAt: received.Add(time.Minute), wantDate: received.Add(time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyClient := &ProxyClient{
+				Signer:         v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				PinSigningTime: tt.pin,
+				now:            steppingClock(received),
+			}
+			req, _ := http.NewRequest(http.MethodPost, "https://sqs.us-west-2.amazonaws.com/", strings.NewReader("body"))
+
+			assert.Nil(t, proxyClient.sign(req, strings.NewReader("body"), proxyClient.Signer, service, proxyClient.signingTime(received)))
+			first := req.Header.Get("Authorization")
+
+			proxyClient.now = steppingClock(tt.retryAt)
+			assert.Nil(t, proxyClient.resign(req, strings.NewReader("body"), proxyClient.Signer, service, received))
+
+			assert.Equal(t, tt.wantDate.Format("20060102T150405Z"), req.Header.Get("X-Amz-Date"))
+			assert.Equal(t, tt.wantSameSig, first == req.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestProxyClient_Do_SignsS3KeysWithoutDoubleEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		service string
+		region  string
+		path    string
+	}{
+		{name: "s3 key with spaces", host: "s3.eu-central-1.amazonaws.com", service: "s3", region: "eu-central-1", path: "/my-bucket/my%20file.txt"},
+		{name: "s3 key with a plus sign", host: "s3.eu-central-1.amazonaws.com", service: "s3", region: "eu-central-1", path: "/my-bucket/a+b.txt"},
+		{name: "s3 key with an encoded plus sign", host: "s3.eu-central-1.amazonaws.com", service: "s3", region: "eu-central-1", path: "/my-bucket/a%2Bb.txt"},
+		{name: "s3 key with unicode", host: "s3.eu-central-1.amazonaws.com", service: "s3", region: "eu-central-1", path: "/my-bucket/caf%C3%A9/%E2%9C%93.txt"},
+		{name: "other services still double-encode", host: "execute-api.us-west-2.amazonaws.com", service: "execute-api", region: "us-west-2", path: "/prod/items/my%20item"},
+	}
+
+	credentials := credentials.NewCredentials(&mockProvider{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{Signer: v4.NewSigner(credentials), Client: client}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080"+tt.path, nil)
+			request.Host = tt.host
+			_, err := proxyClient.Do(request)
+			assert.Nil(t, err)
+
+			forwarded := client.Request
+			assert.Equal(t, tt.path, forwarded.URL.EscapedPath())
+
+			// Independently sign the same request the way the SDK does for
+			// the service.
+			signTime, err := time.Parse("20060102T150405Z", forwarded.Header.Get("X-Amz-Date"))
+			assert.Nil(t, err)
+			signer := v4.NewSigner(credentials, func(s *v4.Signer) {
+				s.DisableURIPathEscaping = tt.service == "s3"
+			})
+			expected, _ := http.NewRequest(http.MethodGet, "https://"+tt.host+tt.path, nil)
+			_, err = signer.Sign(expected, nil, tt.service, tt.region, signTime)
+			assert.Nil(t, err)
+			assert.Equal(t, expected.Header.Get("Authorization"), forwarded.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestProxyClient_Do_ServiceSigners(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		wantAccess string
+	}{
+		{name: "matching service uses its credentials", host: "sqs.us-west-2.amazonaws.com", wantAccess: "Credential=AKIDSQS/"},
+		{name: "other services use the default credentials", host: "sns.us-west-2.amazonaws.com", wantAccess: "Credential=/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client: client,
+				ServiceSigners: map[string]*v4.Signer{
+					"sqs": v4.NewSigner(credentials.NewStaticCredentials("AKIDSQS", "sqs-secret", "sqs-token")),
+				},
+			}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			request.Host = tt.host
+			_, err := proxyClient.Do(request)
+			assert.Nil(t, err)
+
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantAccess)
+			assert.Equal(t, tt.wantAccess == "Credential=AKIDSQS/", client.Request.Header.Get("X-Amz-Security-Token") == "sqs-token")
+		})
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		dotSegments   bool
+		trailingSlash TrailingSlashPolicy
+		want          string
+	}{
+		{name: "keeps paths by default", path: "/a//b/./c/../d/", want: "/a//b/./c/../d/"},
+		{name: "collapses duplicate slashes", path: "/a//b///c", dotSegments: true, want: "/a/b/c"},
+		{name: "removes single dot segments", path: "/a/./b/.", dotSegments: true, want: "/a/b/"},
+		{name: "removes double dot segments", path: "/a/b/../c/..", dotSegments: true, want: "/a/"},
+		{name: "does not go above the root", path: "/../a", dotSegments: true, want: "/a"},
+		{name: "keeps the trailing slash", path: "//a/b//", dotSegments: true, want: "/a/b/"},
+		{name: "keeps the root", path: "//", dotSegments: true, want: "/"},
+		{name: "keeps escaping", path: "/a%2Fb/./c%20d", dotSegments: true, want: "/a%2Fb/c%20d"},
+		{name: "strips the trailing slash", path: "/a/b/", trailingSlash: TrailingSlashStrip, want: "/a/b"},
+		{name: "strips repeated trailing slashes", path: "/a/b//", trailingSlash: TrailingSlashStrip, want: "/a/b"},
+		{name: "strips after normalizing", path: "/a/b/./", dotSegments: true, trailingSlash: TrailingSlashStrip, want: "/a/b"},
+		{name: "never strips the root", path: "/", trailingSlash: TrailingSlashStrip, want: "/"},
+		{name: "adds a trailing slash", path: "/a/b", trailingSlash: TrailingSlashAdd, want: "/a/b/"},
+		{name: "keeps an existing trailing slash", path: "/a/b/", trailingSlash: TrailingSlashAdd, want: "/a/b/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("https://execute-api.us-west-2.amazonaws.com" + tt.path)
+			assert.Nil(t, err)
+
+			normalizePath(u, tt.dotSegments, tt.trailingSlash, log.StandardLogger())
+
+			assert.Equal(t, tt.want, u.EscapedPath())
+		})
+	}
+}
+
+func TestProxyClient_Do_NormalizesPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		service  string
+		region   string
+		path     string
+		wantPath string
+	}{
+		{name: "normalizes the signed and sent path", host: "execute-api.us-west-2.amazonaws.com", service: "execute-api", region: "us-west-2", path: "/prod//items/./42/", wantPath: "/prod/items/42"},
+		{name: "leaves s3 keys as is", host: "s3.eu-central-1.amazonaws.com", service: "s3", region: "eu-central-1", path: "/my-bucket/a//b/./c/", wantPath: "/my-bucket/a//b/./c/"},
+	}
+
+	credentials := credentials.NewCredentials(&mockProvider{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:        v4.NewSigner(credentials),
+				Client:        client,
+				NormalizePath: true,
+				TrailingSlash: TrailingSlashStrip,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+			assert.Nil(t, err)
+
+			forwarded := client.Request
+			assert.Equal(t, tt.wantPath, forwarded.URL.EscapedPath())
+
+			// The signature covers the path sent
+			signTime, err := time.Parse("20060102T150405Z", forwarded.Header.Get("X-Amz-Date"))
+			assert.Nil(t, err)
+			signer := v4.NewSigner(credentials, func(s *v4.Signer) {
+				s.DisableURIPathEscaping = tt.service == "s3"
+			})
+			expected := &http.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: tt.host, Path: tt.wantPath}, Header: http.Header{}}
+			_, err = signer.Sign(expected, nil, tt.service, tt.region, signTime)
+			assert.Nil(t, err)
+			assert.Equal(t, expected.Header.Get("Authorization"), forwarded.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestProxyClient_Do_DropsClientAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		host          string
+		forwardAs     string
+		spoofed       string
+		wantProxyAuth bool
+		wantForwarded string
+	}{
+		{name: "replaces it with the proxy's signature", host: "sqs.us-west-2.amazonaws.com", wantProxyAuth: true},
+		{name: "drops it from presigned requests", host: "s3.us-west-2.amazonaws.com"},
+		{name: "forwards it under another name", host: "sqs.us-west-2.amazonaws.com", forwardAs: "x-original-authorization", wantProxyAuth: true, wantForwarded: "Bearer client-token"},
+		{name: "forwards it under another name when presigned", host: "s3.us-west-2.amazonaws.com", forwardAs: "X-Original-Authorization", wantForwarded: "Bearer client-token"},
+		{name: "replaces client values of the other name", host: "sqs.us-west-2.amazonaws.com", forwardAs: "X-Original-Authorization", spoofed: "Bearer spoofed", wantProxyAuth: true, wantForwarded: "Bearer client-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:                 v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:                 client,
+				ForwardAuthorizationAs: tt.forwardAs,
+			}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/my-bucket/key", nil)
+			request.Host = tt.host
+			request.Header.Set("Authorization", "Bearer client-token")
+			if tt.spoofed != "" {
+				request.Header.Set("X-Original-Authorization", tt.spoofed)
+			}
+			_, err := proxyClient.Do(request)
+			assert.Nil(t, err)
+
+			forwarded := client.Request
+			for _, v := range forwarded.Header.Values("Authorization") {
+				assert.NotContains(t, v, "client-token")
+			}
+			if tt.wantProxyAuth {
+				assert.Len(t, forwarded.Header.Values("Authorization"), 1)
+				assert.Contains(t, forwarded.Header.Get("Authorization"), "AWS4-HMAC-SHA256")
+			} else {
+				assert.Empty(t, forwarded.Header.Values("Authorization"))
+				assert.NotEmpty(t, forwarded.URL.Query().Get("X-Amz-Signature"))
+			}
+			if tt.wantForwarded != "" {
+				assert.Equal(t, []string{tt.wantForwarded}, forwarded.Header.Values("X-Original-Authorization"))
+			} else {
+				assert.Empty(t, forwarded.Header.Values("X-Original-Authorization"))
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitMaxBuckets is the most buckets kept, the least recently used one
+// is dropped past it.
+const rateLimitMaxBuckets = 1 << 16
+
+// ConcurrencyLimiter bounds the requests proxied at the same time.
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	maxWait time.Duration
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter letting max requests in
+// flight. Others wait up to maxWait for one to complete, or are rejected
+// right away if maxWait is zero.
+func NewConcurrencyLimiter(max int, maxWait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		maxWait: maxWait,
+	}
+}
+
+// Acquire reports whether a request may be proxied, waiting at most maxWait
+// or until ctx is done. If so, release must be called once it completes.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), ok bool) {
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if l.maxWait <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, false
+}
+
+// InFlight returns the number of requests currently holding a slot.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// RateLimiter is a token bucket rate limiter, with a bucket per key.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// recent holds the buckets, the most recently used first.
+	recent *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	at     time.Time
+}
+
+// NewRateLimiter returns a RateLimiter letting each key make rate requests
+// per second, and up to burst at once.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+// Allow reports whether key may make a request now, and otherwise how long
+// until it may.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	e, ok := l.buckets[key]
+	if ok {
+		l.recent.MoveToFront(e)
+	} else {
+		if len(l.buckets) >= rateLimitMaxBuckets {
+			l.remove(l.recent.Back())
+		}
+		e = l.recent.PushFront(&tokenBucket{key: key, tokens: l.burst, at: now})
+		l.buckets[key] = e
+	}
+	b := e.Value.(*tokenBucket)
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops the least recently used buckets which refilled to their burst
+// by now, they behave like new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	for e := l.recent.Back(); e != nil; e = l.recent.Back() {
+		b := e.Value.(*tokenBucket)
+		if b.tokens+now.Sub(b.at).Seconds()*l.rate < l.burst {
+			return
+		}
+		l.remove(e)
+	}
+}
+
+func (l *RateLimiter) remove(e *list.Element) {
+	l.recent.Remove(e)
+	delete(l.buckets, e.Value.(*tokenBucket).key)
+}
+
+// rateLimitKey returns the key r is rate limited by: its client IP, the /64
+// network of IPv6 clients which usually have one, or the identity an
+// Authenticator established if RateLimitByIdentity is set and there is one.
+func (h *Handler) rateLimitKey(r *http.Request) string {
+	if id := requestInfoFrom(r.Context()).Identity; h.RateLimitByIdentity && id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+	}
+	return host
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingProxyClient responds to requests once they are released.
+type blockingProxyClient struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingProxyClient) Do(req *http.Request) (*http.Response, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+}
+
+func newTestRateLimiter(rate float64, burst int, now *time.Time) *RateLimiter {
+	l := NewRateLimiter(rate, burst)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestConcurrencyLimiter_Acquire(t *testing.T) {
+	l := NewConcurrencyLimiter(2, 0)
+	release1, ok := l.Acquire(context.Background())
+	assert.True(t, ok)
+	_, ok = l.Acquire(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, 2, l.InFlight())
+
+	_, ok = l.Acquire(context.Background())
+	assert.False(t, ok)
+
+	release1()
+	assert.Equal(t, 1, l.InFlight())
+	_, ok = l.Acquire(context.Background())
+	assert.True(t, ok)
+}
+
+func TestConcurrencyLimiter_AcquireWaits(t *testing.T) {
+	l := NewConcurrencyLimiter(1, time.Minute)
+	release, ok := l.Acquire(context.Background())
+	assert.True(t, ok)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release, ok = l.Acquire(context.Background())
+	assert.True(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, ok = l.Acquire(ctx)
+	assert.False(t, ok)
+
+	l = NewConcurrencyLimiter(1, 10*time.Millisecond)
+	l.Acquire(context.Background())
+	_, ok = l.Acquire(context.Background())
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newTestRateLimiter(2, 3, &now)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other keys have their own bucket
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, wait = l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+
+	// Buckets refill up to their burst only
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newTestRateLimiter(1, 1, &now)
+	for i := 0; i < 4096; i++ {
+		l.Allow(string(rune('a' + i)))
+	}
+	assert.Len(t, l.buckets, 4096)
+
+	now = now.Add(time.Second)
+	l.Allow("new")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimiter_EvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newTestRateLimiter(0.001, 1, &now)
+	for i := 0; i < rateLimitMaxBuckets; i++ {
+		l.Allow(strconv.Itoa(i))
+	}
+	ok, _ := l.Allow("0")
+	assert.False(t, ok)
+
+	// "1" is the least recently used bucket, dropped for the new one
+	l.Allow("new")
+	assert.Len(t, l.buckets, rateLimitMaxBuckets)
+	assert.NotContains(t, l.buckets, "1")
+	assert.Contains(t, l.buckets, "0")
+}
+
+func TestHandler_RateLimitKey(t *testing.T) {
+	h := &Handler{}
+	for remoteAddr, want := range map[string]string{
+		"10.0.0.1:1234":               "10.0.0.1",
+		"[2001:db8:1:2:3:4:5:6]:1234": "2001:db8:1:2::/64",
+		"[2001:db8:1:2:ff::1]:1234":   "2001:db8:1:2::/64",
+		"[::ffff:10.0.0.1]:1234":      "::ffff:10.0.0.1",
+	} {
+		r := &http.Request{RemoteAddr: remoteAddr}
+		assert.Equal(t, want, h.rateLimitKey(r), remoteAddr)
+	}
+}
+
+func TestHandler_ServeHTTP_RateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		byIdentity bool
+		wantStatus []int
+	}{
+		{
+			name:       "limits clients by IP",
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name:       "limits clients by identity",
+			byIdentity: true,
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1600000000, 0)
+			h := &Handler{
+				ProxyClient:         &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}},
+				Authenticators:      []Authenticator{&APIKeyAuth{Header: "X-Api-Key", Keys: []string{"key1", "key2"}}},
+				RateLimiter:         newTestRateLimiter(0.5, 1, &now),
+				RateLimitByIdentity: tt.byIdentity,
+			}
+
+			for i, key := range []string{"key1", "key2", "key1"} {
+				request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+				request.RemoteAddr = "10.0.0.1:1234"
+				request.Header.Set("X-Api-Key", key)
+				r := httptest.NewRecorder()
+				h.ServeHTTP(r, request)
+				assert.Equal(t, tt.wantStatus[i], r.Code, "request %d", i)
+				if r.Code == http.StatusTooManyRequests {
+					assert.Equal(t, "2", r.Header().Get("Retry-After"))
+					assert.Equal(t, "rate limit exceeded", r.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTP_ConcurrencyLimit(t *testing.T) {
+	client := &blockingProxyClient{started: make(chan struct{}), release: make(chan struct{})}
+	h := &Handler{
+		ProxyClient:        client,
+		ConcurrencyLimiter: NewConcurrencyLimiter(1, 0),
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		r := httptest.NewRecorder()
+		h.ServeHTTP(r, request)
+		done <- r
+	}()
+	<-client.started
+
+	r := httptest.NewRecorder()
+	h.ServeHTTP(r, request)
+	assert.Equal(t, http.StatusTooManyRequests, r.Code)
+	assert.Equal(t, "1", r.Header().Get("Retry-After"))
+	assert.Equal(t, "too many requests in flight", r.Body.String())
+
+	close(client.release)
+	r = <-done
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "ok", r.Body.String())
+	assert.Equal(t, 0, h.ConcurrencyLimiter.InFlight())
+
+	go func() { <-client.started }()
+	r = httptest.NewRecorder()
+	h.ServeHTTP(r, request)
+	assert.Equal(t, http.StatusOK, r.Code)
+}
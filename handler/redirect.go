@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// isFollowableRedirect reports whether resp redirects to another endpoint
+// which the request can be sent to again unchanged, such as S3's redirects
+// to the region of a bucket.
+func isFollowableRedirect(resp *http.Response) bool {
+	return (resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect) &&
+		resp.Header.Get("Location") != ""
+}
+
+// redirectService returns the service to sign a request to target for, after
+// resp redirected a request for service there. Only redirects to another
+// endpoint of the same service are followed.
+func redirectService(resp *http.Response, target *url.URL, service *endpoints.ResolvedEndpoint) (*endpoints.ResolvedEndpoint, bool) {
+	redirected := *service
+	if s := determineAWSServiceFromHost(target.Host); s != nil && s.SigningName == service.SigningName {
+		redirected.SigningRegion = s.SigningRegion
+		redirected.SigningMethod = s.SigningMethod
+	} else if !strings.HasSuffix(target.Hostname(), ".amazonaws.com") || resp.Header.Get("X-Amz-Bucket-Region") == "" {
+		return nil, false
+	}
+	// S3 names the bucket's region, also for virtual hosted buckets
+	if region := resp.Header.Get("X-Amz-Bucket-Region"); region != "" {
+		redirected.SigningRegion = region
+	}
+	return &redirected, true
+}
+
+// followRedirects follows up to MaxRedirects redirects of resp, the response
+// to prev, sending prev again to their target signed for the new region.
+// signed and unsigned are the headers of prev before it was signed, and
+// those of the client sent along.
+func (p *ProxyClient) followRedirects(resp *http.Response, prev *http.Request, signed, unsigned http.Header, body *requestBody, signer *v4.Signer, service *endpoints.ResolvedEndpoint, received time.Time) (*http.Response, error) {
+	for i := 0; i < p.MaxRedirects && isFollowableRedirect(resp); i++ {
+		target, err := prev.URL.Parse(resp.Header.Get("Location"))
+		if err != nil || (target.Scheme != "https" && target.Scheme != prev.URL.Scheme) || !isUpstreamHostAllowed(target, p.AllowedUpstreamHosts) || p.checkUpstreamTLS(target) != nil {
+			loggerFrom(prev.Context()).WithField("location", resp.Header.Get("Location")).Warn("not following redirect to disallowed location")
+			return resp, nil
+		}
+		redirected, ok := redirectService(resp, target, service)
+		if !ok {
+			loggerFrom(prev.Context()).WithField("location", resp.Header.Get("Location")).Warn("not following redirect to another service")
+			return resp, nil
+		}
+
+		next, err := http.NewRequestWithContext(prev.Context(), prev.Method, target.String(), body.reader())
+		if err != nil {
+			return resp, nil
+		}
+		if body.spilled() {
+			next.ContentLength = body.size
+			next.GetBody = prev.GetBody
+		}
+		next.Header = signed.Clone()
+		if err := p.sign(next, body.reader(), signer, redirected, p.signingTime(received)); err != nil {
+			return resp, nil
+		}
+		copyHeaderWithoutOverwrite(next.Header, unsigned)
+
+		if resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		loggerFrom(prev.Context()).WithFields(log.Fields{"status": resp.StatusCode, "upstream": target.Host, "region": redirected.SigningRegion}).Debug("following redirect")
+
+		if resp, err = p.send(next, p.upstreamTimeout(redirected.SigningName)); err != nil {
+			return nil, err
+		}
+		requestInfoFrom(prev.Context()).Region = redirected.SigningRegion
+		prev, service = next, redirected
+	}
+	return resp, nil
+}
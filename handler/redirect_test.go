@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// redirectingClient redirects requests to the given hosts, answering any
+// other, and records the requests it receives with their body.
+type redirectingClient struct {
+	redirects map[string]*http.Response
+	requests  []*http.Request
+	bodies    []string
+}
+
+func (c *redirectingClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.requests = append(c.requests, req)
+	c.bodies = append(c.bodies, string(body))
+	if resp, ok := c.redirects[req.URL.Host]; ok {
+		return resp, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBufferString("stored"))}, nil
+}
+
+func redirect(status int, location, region string) *http.Response {
+	header := http.Header{"Location": []string{location}}
+	if region != "" {
+		header.Set("X-Amz-Bucket-Region", region)
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: ioutil.NopCloser(bytes.NewBufferString("<Error><Code>TemporaryRedirect</Code></Error>"))}
+}
+
+func TestProxyClient_Do_FollowsRegionRedirects(t *testing.T) {
+	credentials := credentials.NewCredentials(&mockProvider{})
+	client := &redirectingClient{redirects: map[string]*http.Response{
+		"s3.eu-central-1.amazonaws.com": redirect(http.StatusTemporaryRedirect, "https://s3.eu-west-3.amazonaws.com/my-bucket/photos/cat.jpg", "eu-west-3"),
+	}}
+	proxyClient := &ProxyClient{
+		Signer:          v4.NewSigner(credentials),
+		Client:          client,
+		FollowRedirects: true,
+		MaxRedirects:    3,
+	}
+
+	request, _ := http.NewRequest(http.MethodPut, "http://localhost:8080/my-bucket/photos/cat.jpg", bytes.NewBufferString("meow"))
+	request.Host = "s3.eu-central-1.amazonaws.com"
+	request.Header.Set("Content-Type", "image/jpeg")
+	resp, err := proxyClient.Do(request)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if !assert.Len(t, client.requests, 2) {
+		return
+	}
+	assert.Contains(t, client.requests[0].Header.Get("Authorization"), "/eu-central-1/s3/aws4_request")
+
+	followUp := client.requests[1]
+	assert.Equal(t, http.MethodPut, followUp.Method)
+	assert.Equal(t, "https://s3.eu-west-3.amazonaws.com/my-bucket/photos/cat.jpg", followUp.URL.String())
+	assert.Equal(t, "meow", client.bodies[1])
+	assert.Equal(t, "image/jpeg", followUp.Header.Get("Content-Type"))
+
+	// The follow-up is signed again for the bucket's region
+	signTime, err := time.Parse("20060102T150405Z", followUp.Header.Get("X-Amz-Date"))
+	assert.Nil(t, err)
+	expected, _ := http.NewRequest(http.MethodPut, "https://s3.eu-west-3.amazonaws.com/my-bucket/photos/cat.jpg", nil)
+	signer := v4.NewSigner(credentials, func(s *v4.Signer) { s.DisableURIPathEscaping = true })
+	_, err = signer.Sign(expected, bytes.NewReader([]byte("meow")), "s3", "eu-west-3", signTime)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Header.Get("Authorization"), followUp.Header.Get("Authorization"))
+}
+
+func TestProxyClient_Do_RelaysOtherRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		follow       bool
+		allowed      []string
+		redirects    map[string]*http.Response
+		wantStatus   int
+		wantRequests int
+	}{
+		{
+			name:         "relays redirects when not following them",
+			redirects:    map[string]*http.Response{"s3.eu-central-1.amazonaws.com": redirect(http.StatusTemporaryRedirect, "https://s3.eu-west-3.amazonaws.com/my-bucket/key", "eu-west-3")},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantRequests: 1,
+		},
+		{
+			name:         "relays redirects changing the method",
+			follow:       true,
+			redirects:    map[string]*http.Response{"s3.eu-central-1.amazonaws.com": redirect(http.StatusFound, "https://s3.eu-west-3.amazonaws.com/my-bucket/key", "eu-west-3")},
+			wantStatus:   http.StatusFound,
+			wantRequests: 1,
+		},
+		{
+			name:         "relays redirects to other hosts",
+			follow:       true,
+			redirects:    map[string]*http.Response{"s3.eu-central-1.amazonaws.com": redirect(http.StatusTemporaryRedirect, "https://attacker.example.com/my-bucket/key", "")},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantRequests: 1,
+		},
+		{
+			name:         "relays redirects to disallowed hosts",
+			follow:       true,
+			allowed:      []string{"s3.eu-central-1.amazonaws.com"},
+			redirects:    map[string]*http.Response{"s3.eu-central-1.amazonaws.com": redirect(http.StatusTemporaryRedirect, "https://s3.eu-west-3.amazonaws.com/my-bucket/key", "eu-west-3")},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantRequests: 1,
+		},
+		{
+			name:   "stops after the maximum redirects",
+			follow: true,
+			redirects: map[string]*http.Response{
+				"s3.eu-central-1.amazonaws.com": redirect(http.StatusTemporaryRedirect, "https://s3.eu-west-3.amazonaws.com/my-bucket/key", "eu-west-3"),
+				"s3.eu-west-3.amazonaws.com":    redirect(http.StatusTemporaryRedirect, "https://s3.eu-west-1.amazonaws.com/my-bucket/key", "eu-west-1"),
+				"s3.eu-west-1.amazonaws.com":    redirect(http.StatusTemporaryRedirect, "https://s3.eu-central-1.amazonaws.com/my-bucket/key", "eu-central-1"),
+			},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantRequests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &redirectingClient{redirects: tt.redirects}
+			proxyClient := &ProxyClient{
+				Signer:               v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:               client,
+				FollowRedirects:      tt.follow,
+				MaxRedirects:         2,
+				AllowedUpstreamHosts: tt.allowed,
+			}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/my-bucket/key", nil)
+			request.Host = "s3.eu-central-1.amazonaws.com"
+			resp, err := proxyClient.Do(request)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Len(t, client.requests, tt.wantRequests)
+		})
+	}
+}
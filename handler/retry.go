@@ -0,0 +1,200 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRetryStatusCodes are the response statuses retried by default.
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy configures how requests failing to reach the upstream, or
+// answered with a retryable status, are sent again.
+type RetryPolicy struct {
+	// MaxAttempts bounds the number of times a request is sent, the first
+	// included.
+	MaxAttempts int
+	// MaxElapsed, when not zero, is the time since a request was received
+	// past which it is not retried anymore.
+	MaxElapsed time.Duration
+	// BaseDelay is the delay before the first retry, doubled for every
+	// following one up to MaxDelay, of which a random share is waited.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// StatusCodes are the retried response statuses, DefaultRetryStatusCodes
+	// when empty.
+	StatusCodes []int
+
+	// sleep waits for d unless ctx is done first, sleepContext when nil.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	randOnce sync.Once
+	randMu   sync.Mutex
+	rand     *rand.Rand
+}
+
+// retryable reports whether a request answered with resp, or failing with
+// err, should be sent again.
+func (r *RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	codes := r.StatusCodes
+	if len(codes) == 0 {
+		codes = DefaultRetryStatusCodes
+	}
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before retry number retry, starting at 1,
+// of a request answered with resp: a random share of the exponential
+// backoff, or the Retry-After of resp if longer.
+func (r *RetryPolicy) delay(retry int, resp *http.Response, now time.Time) time.Duration {
+	backoff := r.BaseDelay
+	for i := 1; i < retry && (r.MaxDelay <= 0 || backoff < r.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if r.MaxDelay > 0 && backoff > r.MaxDelay {
+		backoff = r.MaxDelay
+	}
+
+	r.randOnce.Do(func() {
+		r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+	var d time.Duration
+	if backoff > 0 {
+		r.randMu.Lock()
+		d = time.Duration(r.rand.Int63n(int64(backoff) + 1))
+		r.randMu.Unlock()
+	}
+
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok && after > d {
+			d = after
+		}
+	}
+	return d
+}
+
+// retryAfter parses a Retry-After header, a number of seconds or a date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendWithRetries sends req, sending it again signed anew as allowed by
+// Retry. signed and unsigned are the headers of req before it was signed,
+// and those of the client sent along.
+func (p *ProxyClient) sendWithRetries(req *http.Request, signed, unsigned http.Header, body *requestBody, signer *v4.Signer, service *endpoints.ResolvedEndpoint, received time.Time) (*http.Response, error) {
+	timeout := p.upstreamTimeout(service.SigningName)
+	resp, err := p.send(req, timeout)
+
+	sleep := p.Retry.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	logger := loggerFrom(req.Context())
+	for attempt := 1; attempt < p.Retry.MaxAttempts; attempt++ {
+		// A client gone away is not retried for
+		if req.Context().Err() != nil || !p.Retry.retryable(resp, err) {
+			break
+		}
+		now := p.clock()
+		delay := p.Retry.delay(attempt, resp, now)
+		if p.Retry.MaxElapsed > 0 && now.Add(delay).Sub(received) > p.Retry.MaxElapsed {
+			break
+		}
+
+		fields := log.Fields{"attempt": attempt + 1, "delay": delay}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else {
+			fields["status"] = resp.StatusCode
+		}
+		logger.WithFields(fields).Debug("retrying request")
+
+		if sleep(req.Context(), delay) != nil {
+			break
+		}
+
+		next, nerr := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), body.reader())
+		if nerr != nil {
+			break
+		}
+		if body.spilled() {
+			next.ContentLength = body.size
+			next.GetBody = req.GetBody
+		}
+		next.Header = signed.Clone()
+		if nerr := p.resign(next, body.reader(), signer, service, received); nerr != nil {
+			break
+		}
+		copyHeaderWithoutOverwrite(next.Header, unsigned)
+
+		if resp != nil && resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		resp, err = p.send(next, timeout)
+		req = next
+	}
+	return resp, err
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// sequenceClient answers the requests it receives with responses in turn,
+// failing for nil ones, and records the requests.
+type sequenceClient struct {
+	responses []*http.Response
+	requests  []*http.Request
+	bodies    []string
+	closed    []bool
+}
+
+func (c *sequenceClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.requests = append(c.requests, req)
+	c.bodies = append(c.bodies, string(body))
+	resp := c.responses[len(c.requests)-1]
+	if resp == nil {
+		return nil, errors.New("connection reset by peer")
+	}
+	return resp, nil
+}
+
+// response returns a response with status whose body is recorded as closed
+// once closed.
+func (c *sequenceClient) response(status int, header http.Header) *http.Response {
+	i := len(c.closed)
+	c.closed = append(c.closed, false)
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       &closeRecorder{Reader: strings.NewReader(fmt.Sprint(status)), closed: func() { c.closed[i] = true }},
+	}
+}
+
+type closeRecorder struct {
+	*strings.Reader
+	closed func()
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed()
+	return nil
+}
+
+func TestProxyClient_Do_Retry(t *testing.T) {
+	client := &sequenceClient{}
+	client.responses = []*http.Response{
+		client.response(http.StatusServiceUnavailable, http.Header{}),
+		nil,
+		client.response(http.StatusOK, http.Header{}),
+	}
+	var delays []time.Duration
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	proxyClient := &ProxyClient{
+		Signer:         v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:         client,
+		PinSigningTime: true,
+		now:            func() time.Time { return now },
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   100 * time.Millisecond,
+			MaxDelay:    time.Second,
+			sleep: func(ctx context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				now = now.Add(d + time.Second)
+				return nil
+			},
+		},
+	}
+
+	resp, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/"},
+		Host:   "sqs.us-west-2.amazonaws.com",
+		Header: http.Header{"X-Client": {"kept"}},
+		Body:   ioutil.NopCloser(strings.NewReader("Action=SendMessage")),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, client.requests, 3)
+	assert.Equal(t, []bool{true, false}, client.closed)
+	assert.Len(t, delays, 2)
+	assert.True(t, delays[0] <= 100*time.Millisecond)
+	assert.True(t, delays[1] <= 200*time.Millisecond)
+
+	// Every attempt carries the body and is signed anew, keeping the pinned
+	// date within the allowed age
+	for i, req := range client.requests {
+		assert.Equal(t, "Action=SendMessage", client.bodies[i])
+		assert.Equal(t, "kept", req.Header.Get("X-Client"))
+		assert.Equal(t, "20201001T120000Z", req.Header.Get("X-Amz-Date"))
+		assert.Len(t, req.Header.Values("Authorization"), 1)
+		assert.NotContains(t, req.Header.Get("Authorization"), "x-client")
+	}
+}
+
+func TestProxyClient_Do_RetryPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retryAfter   string
+		policy       *RetryPolicy
+		wantAttempts int
+		wantStatus   int
+		wantDelay    time.Duration
+	}{
+		{
+			name:         "gives up after the attempts",
+			statuses:     []int{500, 502, 504, 200},
+			policy:       &RetryPolicy{MaxAttempts: 3},
+			wantAttempts: 3,
+			wantStatus:   504,
+		},
+		{
+			name:         "does not retry other statuses",
+			statuses:     []int{400, 200},
+			policy:       &RetryPolicy{MaxAttempts: 3},
+			wantAttempts: 1,
+			wantStatus:   400,
+		},
+		{
+			name:         "retries the configured statuses only",
+			statuses:     []int{503, 200},
+			policy:       &RetryPolicy{MaxAttempts: 3, StatusCodes: []int{409}},
+			wantAttempts: 1,
+			wantStatus:   503,
+		},
+		{
+			name:         "honors Retry-After",
+			statuses:     []int{429, 200},
+			retryAfter:   "2",
+			policy:       &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			wantAttempts: 2,
+			wantStatus:   200,
+			wantDelay:    2 * time.Second,
+		},
+		{
+			name:         "gives up when the retry would start too late",
+			statuses:     []int{429, 200},
+			retryAfter:   "10",
+			policy:       &RetryPolicy{MaxAttempts: 3, MaxElapsed: 5 * time.Second},
+			wantAttempts: 1,
+			wantStatus:   429,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &sequenceClient{}
+			for _, status := range tt.statuses {
+				header := http.Header{}
+				if tt.retryAfter != "" {
+					header.Set("Retry-After", tt.retryAfter)
+				}
+				client.responses = append(client.responses, client.response(status, header))
+			}
+			var delay time.Duration
+			tt.policy.sleep = func(ctx context.Context, d time.Duration) error {
+				delay += d
+				return nil
+			}
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client: client,
+				Retry:  tt.policy,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   "sqs.us-west-2.amazonaws.com",
+				Header: http.Header{},
+				Body:   http.NoBody,
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Len(t, client.requests, tt.wantAttempts)
+			assert.Equal(t, tt.wantDelay, delay)
+		})
+	}
+}
+
+func TestProxyClient_Do_RetryStreamed(t *testing.T) {
+	client := &sequenceClient{}
+	client.responses = []*http.Response{client.response(http.StatusServiceUnavailable, http.Header{}), client.response(http.StatusOK, http.Header{})}
+	proxyClient := &ProxyClient{
+		Signer:           v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:           client,
+		StreamingSigning: true,
+		Retry:            &RetryPolicy{MaxAttempts: 3},
+	}
+
+	resp, err := proxyClient.Do(&http.Request{
+		Method:        "PUT",
+		URL:           &url.URL{Path: "/bucket/key"},
+		Host:          "s3.eu-central-1.amazonaws.com",
+		Header:        http.Header{},
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(strings.NewReader("streamed body")),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// The backoff doubles from the first retry on, up to the maximum
+	for i, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		retry := i + 1
+		for j := 0; j < 20; j++ {
+			d := policy.delay(retry, nil, now)
+			assert.True(t, d >= 0 && d <= max, "retry %d waited %v", retry, d)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": {now.Add(3 * time.Second).Format(http.TimeFormat)}}}
+	assert.Equal(t, 3*time.Second, policy.delay(1, resp, now))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", want: 0, wantOK: false},
+		{value: "5", want: 5 * time.Second, wantOK: true},
+		{value: "Thu, 01 Oct 2020 12:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{value: "Thu, 01 Oct 2020 11:00:00 GMT", want: 0, wantOK: true},
+		{value: "soon", want: 0, wantOK: false},
+		{value: "-1", want: 0, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := retryAfter(tt.value, now)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOK, ok)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Route sends the requests matching its Host and PathPrefix to Upstream,
+// signed for Service in Region, so a single proxy can front several
+// services.
+type Route struct {
+	// Host matches the host of requests, wildcards such as *.example.com
+	// supported, and any host when empty.
+	Host string
+	// PathPrefix matches requests whose path starts with it, at a segment
+	// boundary, and any path when empty. With StripPrefix it is removed from
+	// the path before forwarding.
+	PathPrefix  string
+	StripPrefix bool
+	// Upstream is the URL requests are forwarded to, its path prefixing
+	// theirs.
+	Upstream *url.URL
+	// Service and Region are signed for, when empty they are determined from
+	// the Upstream host.
+	Service string
+	Region  string
+	// Signer, when set, signs the requests of the route instead of the
+	// ProxyClient's signer.
+	Signer *v4.Signer
+	// HeaderRules, when set, add, remove and rewrite the headers of the
+	// requests of the route and their responses.
+	HeaderRules *HeaderRules
+}
+
+// Validate checks that the service and region the route signs for can be
+// determined.
+func (r *Route) Validate() error {
+	_, err := r.service()
+	return err
+}
+
+// matches reports whether req is for the route.
+func (r *Route) matches(req *http.Request) bool {
+	if r.Host != "" {
+		host := strings.ToLower(req.Host)
+		ok, _ := path.Match(strings.ToLower(r.Host), host)
+		if h, _, err := net.SplitHostPort(host); !ok && err == nil {
+			ok, _ = path.Match(strings.ToLower(r.Host), h)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if prefix := strings.TrimSuffix(r.PathPrefix, "/"); prefix != "" {
+		p := req.URL.Path
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	return true
+}
+
+// apply points u, the URL of a request for the route, at its upstream.
+func (r *Route) apply(u *url.URL) {
+	if prefix := strings.TrimSuffix(r.PathPrefix, "/"); r.StripPrefix && prefix != "" {
+		u.Path = strings.TrimPrefix(u.Path, prefix)
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimPrefix(u.RawPath, (&url.URL{Path: prefix}).EscapedPath())
+		}
+		if u.Path == "" {
+			u.Path, u.RawPath = "/", ""
+		}
+	}
+	applyEndpoint(u, r.Upstream)
+}
+
+// service returns the service the route signs for.
+func (r *Route) service() (*endpoints.ResolvedEndpoint, error) {
+	service := &endpoints.ResolvedEndpoint{URL: r.Upstream.String(), SigningMethod: "v4", SigningName: r.Service, SigningRegion: r.Region}
+	if r.Service != "" && r.Region != "" {
+		return service, nil
+	}
+
+	detected := determineAWSServiceFromHost(r.Upstream.Host)
+	if detected == nil {
+		return nil, fmt.Errorf("unable to determine service from upstream %s, set the service and region of the route", r.Upstream.Host)
+	}
+	if service.SigningName == "" {
+		service.SigningName = detected.SigningName
+	}
+	if service.SigningRegion == "" {
+		service.SigningRegion = detected.SigningRegion
+	}
+	service.SigningMethod = detected.SigningMethod
+	return service, nil
+}
+
+// route returns the first of Routes req matches, nil if none does.
+func (p *ProxyClient) route(req *http.Request) *Route {
+	routes := p.currentRoutes()
+	for i := range routes {
+		if routes[i].matches(req) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// SetRoutes replaces the Routes of p. Requests already matched keep the
+// route they matched.
+func (p *ProxyClient) SetRoutes(routes []Route) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+	p.Routes = routes
+}
+
+func (p *ProxyClient) currentRoutes() []Route {
+	p.routesMu.RLock()
+	defer p.routesMu.RUnlock()
+	return p.Routes
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Do_Routes(t *testing.T) {
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&tenantProvider{tenant: "default"})),
+		Client: client,
+		Routes: []Route{
+			{
+				Host:     "search.local",
+				Upstream: &url.URL{Scheme: "https", Host: "search-logs.us-east-1.es.amazonaws.com"},
+				Service:  "es",
+				Region:   "us-east-1",
+			},
+			{
+				PathPrefix:  "/s3",
+				StripPrefix: true,
+				Upstream:    &url.URL{Scheme: "https", Host: "s3.eu-central-1.amazonaws.com"},
+				Signer:      v4.NewSigner(credentials.NewCredentials(&tenantProvider{tenant: "route"})),
+			},
+			{
+				Host:        "*.local",
+				PathPrefix:  "/api/",
+				StripPrefix: true,
+				Upstream:    &url.URL{Scheme: "https", Host: "abc123.execute-api.us-west-2.amazonaws.com", Path: "/prod"},
+				Service:     "execute-api",
+				Region:      "us-west-2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantURL    string
+		wantScope  string
+		wantAccess string
+	}{
+		{
+			name:       "routes by host",
+			host:       "search.local:8080",
+			path:       "/logs/_search",
+			wantURL:    "https://search-logs.us-east-1.es.amazonaws.com/logs/_search",
+			wantScope:  "/us-east-1/es/aws4_request",
+			wantAccess: "Credential=AKIDdefault",
+		},
+		{
+			name:       "routes by path prefix, signing for the upstream with the route's signer",
+			host:       "localhost:8080",
+			path:       "/s3/bucket/key",
+			wantURL:    "https://s3.eu-central-1.amazonaws.com/bucket/key",
+			wantScope:  "/eu-central-1/s3/aws4_request",
+			wantAccess: "Credential=AKIDroute",
+		},
+		{
+			name:       "routes by host and path prefix to the upstream path",
+			host:       "gateway.local",
+			path:       "/api/items",
+			wantURL:    "https://abc123.execute-api.us-west-2.amazonaws.com/prod/items",
+			wantScope:  "/us-west-2/execute-api/aws4_request",
+			wantAccess: "Credential=AKIDdefault",
+		},
+		{
+			name:       "matches path prefixes at segment boundaries",
+			host:       "sqs.us-west-2.amazonaws.com",
+			path:       "/s3bucket",
+			wantURL:    "https://sqs.us-west-2.amazonaws.com/s3bucket",
+			wantScope:  "/us-west-2/sqs/aws4_request",
+			wantAccess: "Credential=AKIDdefault",
+		},
+		{
+			name:       "signs requests matching no route for their host",
+			host:       "sqs.us-west-2.amazonaws.com",
+			path:       "/123456789012/queue",
+			wantURL:    "https://sqs.us-west-2.amazonaws.com/123456789012/queue",
+			wantScope:  "/us-west-2/sqs/aws4_request",
+			wantAccess: "Credential=AKIDdefault",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: tt.path},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantURL, client.Request.URL.String())
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScope)
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantAccess)
+		})
+	}
+}
+
+func TestRoute_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr error
+	}{
+		{
+			name:  "accepts routes naming their service and region",
+			route: Route{Upstream: &url.URL{Scheme: "https", Host: "search.internal"}, Service: "es", Region: "us-east-1"},
+		},
+		{
+			name:  "accepts routes determining them from their upstream",
+			route: Route{Upstream: &url.URL{Scheme: "https", Host: "sqs.us-west-2.amazonaws.com"}},
+		},
+		{
+			name:    "rejects routes to unknown upstreams without them",
+			route:   Route{Upstream: &url.URL{Scheme: "https", Host: "search.internal"}, Service: "es"},
+			wantErr: fmt.Errorf("unable to determine service from upstream search.internal, set the service and region of the route"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, tt.route.Validate())
+		})
+	}
+}
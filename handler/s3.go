@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// s3BucketName matches valid S3 bucket names.
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// mapS3Host points u at S3 when host, the host of the incoming request, is
+// S3VirtualHostSuffix or a bucket under it, returning the endpoint the
+// request is signed for, or nil if host is neither.
+//
+// Buckets are addressed virtual-hosted style, <bucket>.s3.<region>.amazonaws.com,
+// unless S3PathStyle is set or their name contains dots, which the wildcard
+// certificate of S3 does not cover.
+func (p *ProxyClient) mapS3Host(u *url.URL, host string) (*endpoints.ResolvedEndpoint, error) {
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	suffix := strings.Trim(strings.ToLower(p.S3VirtualHostSuffix), ".")
+	bucket := ""
+	if hostname != suffix {
+		if !strings.HasSuffix(hostname, "."+suffix) {
+			return nil, nil
+		}
+		if bucket = strings.TrimSuffix(hostname, "."+suffix); !s3BucketName.MatchString(bucket) {
+			return nil, nil
+		}
+	}
+
+	region := p.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	service, err := endpoints.DefaultResolver().EndpointFor("s3", region)
+	if err != nil {
+		return nil, err
+	}
+	if service.SigningName == "" {
+		service.SigningName = "s3"
+	}
+	upstream, err := url.Parse(service.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Scheme, u.Host = upstream.Scheme, upstream.Host
+	switch {
+	case bucket == "":
+	case p.S3PathStyle || strings.Contains(bucket, "."):
+		if u.RawPath != "" {
+			u.RawPath = "/" + bucket + u.RawPath
+		}
+		u.Path = "/" + bucket + u.Path
+	default:
+		u.Host = bucket + "." + upstream.Host
+	}
+	service.URL = u.Scheme + "://" + u.Host
+	return &service, nil
+}
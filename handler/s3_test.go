@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_Do_S3VirtualHosts(t *testing.T) {
+	tests := []struct {
+		name      string
+		region    string
+		pathStyle bool
+		host      string
+		path      string
+		rawPath   string
+		wantURL   string
+		wantScope string
+	}{
+		{
+			name:      "maps buckets to virtual-hosted S3",
+			region:    "eu-west-1",
+			host:      "my-bucket.localhost:8080",
+			path:      "/photos/cat.jpg",
+			wantURL:   "https://my-bucket.s3.eu-west-1.amazonaws.com/photos/cat.jpg",
+			wantScope: "/eu-west-1/s3/aws4_request",
+		},
+		{
+			name:      "defaults to us-east-1",
+			host:      "my-bucket.localhost",
+			path:      "/key",
+			wantURL:   "https://my-bucket.s3.amazonaws.com/key",
+			wantScope: "/us-east-1/s3/aws4_request",
+		},
+		{
+			name:      "sends the suffix itself to path-style S3",
+			region:    "eu-west-1",
+			host:      "localhost:8080",
+			path:      "/my-bucket/key",
+			wantURL:   "https://s3.eu-west-1.amazonaws.com/my-bucket/key",
+			wantScope: "/eu-west-1/s3/aws4_request",
+		},
+		{
+			name:      "addresses buckets path-style when asked to",
+			region:    "eu-west-1",
+			pathStyle: true,
+			host:      "my-bucket.localhost:8080",
+			path:      "/a b/c+d",
+			rawPath:   "/a%20b/c+d",
+			wantURL:   "https://s3.eu-west-1.amazonaws.com/my-bucket/a%20b/c+d",
+			wantScope: "/eu-west-1/s3/aws4_request",
+		},
+		{
+			name:      "addresses buckets with dots path-style",
+			region:    "eu-west-1",
+			host:      "logs.example.com.localhost:8080",
+			path:      "/key",
+			wantURL:   "https://s3.eu-west-1.amazonaws.com/logs.example.com/key",
+			wantScope: "/eu-west-1/s3/aws4_request",
+		},
+		{
+			name:      "leaves other hosts alone",
+			region:    "eu-west-1",
+			host:      "s3.us-west-2.amazonaws.com",
+			path:      "/my-bucket/key",
+			wantURL:   "https://s3.us-west-2.amazonaws.com/my-bucket/key",
+			wantScope: "/us-west-2/s3/aws4_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:              client,
+				S3VirtualHostSuffix: "localhost",
+				S3Region:            tt.region,
+				S3PathStyle:         tt.pathStyle,
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: tt.path, RawPath: tt.rawPath},
+				Host:   tt.host,
+				Header: http.Header{},
+			})
+
+			assert.Nil(t, err)
+			u := *client.Request.URL
+			assert.Contains(t, u.Query().Get("X-Amz-Credential"), tt.wantScope)
+			u.RawQuery = ""
+			assert.Equal(t, tt.wantURL, u.String())
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SelfTest signs a request to target the way proxied requests are signed
+// and, when send is set, sends it upstream, failing unless it succeeds.
+func (p *ProxyClient) SelfTest(method string, target *url.URL, send bool) error {
+	req := &http.Request{
+		Method: method,
+		URL:    &url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery},
+		Host:   target.Host,
+		Header: http.Header{},
+		Body:   http.NoBody,
+	}
+
+	if !send {
+		signed, err := http.NewRequest(method, target.String(), nil)
+		if err != nil {
+			return err
+		}
+		service, err := p.resolveService(req, signed.URL)
+		if err != nil {
+			return fmt.Errorf("unable to sign self-test request: %w", err)
+		}
+		if err := p.sign(signed, bytes.NewReader(nil), p.signer(nil, "", nil, service), service, p.clock()); err != nil {
+			return fmt.Errorf("unable to sign self-test request: %w", err)
+		}
+		log.WithFields(log.Fields{"service": service.SigningName, "region": service.SigningRegion}).Info("Signed self-test request")
+		return nil
+	}
+
+	resp, err := p.Do(req)
+	if err != nil {
+		return fmt.Errorf("self-test request failed: %w", err)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode >= 400 {
+		var body []byte
+		if resp.Body != nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		}
+		return fmt.Errorf("self-test request responded with %d: %s", resp.StatusCode, body)
+	}
+	log.WithFields(log.Fields{"method": method, "host": target.Host, "status": resp.StatusCode}).Info("Sent self-test request")
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_SelfTest(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		send       bool
+		provider   *mockProvider
+		response   *http.Response
+		wantErr    string
+		wantSent   bool
+		wantScoped string
+	}{
+		{
+			name:     "signs without sending",
+			method:   http.MethodGet,
+			target:   "https://sts.amazonaws.com/",
+			provider: &mockProvider{},
+		},
+		{
+			name:     "fails to sign without credentials",
+			method:   http.MethodGet,
+			target:   "https://sts.amazonaws.com/",
+			provider: &mockProvider{Fail: true},
+			wantErr:  "unable to sign self-test request: mockProvider.Retrieve failed",
+		},
+		{
+			name:     "fails to sign for unknown hosts",
+			method:   http.MethodGet,
+			target:   "https://example.com/",
+			provider: &mockProvider{},
+			wantErr:  "unable to sign self-test request: unable to determine service from host: example.com",
+		},
+		{
+			name:       "sends the request",
+			method:     http.MethodHead,
+			target:     "https://s3.eu-central-1.amazonaws.com/my-bucket",
+			send:       true,
+			provider:   &mockProvider{},
+			response:   &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBuffer(nil))},
+			wantSent:   true,
+			wantScoped: "/eu-central-1/s3/aws4_request",
+		},
+		{
+			name:     "fails when the upstream rejects the request",
+			method:   http.MethodGet,
+			target:   "https://sts.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15",
+			send:     true,
+			provider: &mockProvider{},
+			response: &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(bytes.NewBufferString("<Code>SignatureDoesNotMatch</Code>"))},
+			wantErr:  "self-test request responded with 403: <Code>SignatureDoesNotMatch</Code>",
+			wantSent: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{Response: tt.response}
+			proxyClient := &ProxyClient{Signer: v4.NewSigner(credentials.NewCredentials(tt.provider)), Client: client}
+			target, err := url.Parse(tt.target)
+			assert.Nil(t, err)
+
+			err = proxyClient.SelfTest(tt.method, target, tt.send)
+
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.wantSent, client.Request != nil)
+			if tt.wantSent {
+				assert.Equal(t, tt.method, client.Request.Method)
+				assert.Equal(t, fmt.Sprintf("https://%s%s", target.Host, target.RequestURI()), client.Request.URL.String())
+				assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantScoped)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// shedWindow is how long upstream latencies are taken into account.
+	shedWindow = 10 * time.Second
+	// shedSamples bounds the latencies kept within shedWindow.
+	shedSamples = 1024
+	// shedRecomputeInterval is how often the P99 latency is recomputed.
+	shedRecomputeInterval = 100 * time.Millisecond
+)
+
+// LoadShedder rejects a share of requests while the P99 upstream latency of
+// the last shedWindow exceeds a target, growing with the excess latency.
+type LoadShedder struct {
+	target         time.Duration
+	aggressiveness float64
+	now            func() time.Time
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	samples    [shedSamples]latencySample
+	count      int
+	next       int
+	p99        time.Duration
+	computedAt time.Time
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// NewLoadShedder returns a LoadShedder for latency target. The share of
+// requests rejected is aggressiveness times the relative excess of the P99
+// latency over target, e.g. all requests once it is twice the target with an
+// aggressiveness of 1.
+func NewLoadShedder(target time.Duration, aggressiveness float64) *LoadShedder {
+	return &LoadShedder{
+		target:         target,
+		aggressiveness: aggressiveness,
+		now:            time.Now,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Observe records the latency of an upstream request.
+func (s *LoadShedder) Observe(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples[s.next] = latencySample{at: s.now(), latency: latency}
+	s.next = (s.next + 1) % shedSamples
+	if s.count < shedSamples {
+		s.count++
+	}
+}
+
+// Allow reports whether a new request may be proxied.
+func (s *LoadShedder) Allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.computedAt) >= shedRecomputeInterval {
+		s.p99 = s.computeP99(now)
+		s.computedAt = now
+	}
+	if s.p99 <= s.target {
+		return true
+	}
+	shed := s.aggressiveness * float64(s.p99-s.target) / float64(s.target)
+	return s.rand.Float64() >= shed
+}
+
+// P99 returns the P99 upstream latency last computed.
+func (s *LoadShedder) P99() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.p99
+}
+
+// computeP99 returns the P99 of the latencies observed within shedWindow of
+// now, zero if there are none. Requests being rejected are not observed, so
+// old latencies expiring is what ends shedding once the upstream recovers.
+func (s *LoadShedder) computeP99(now time.Time) time.Duration {
+	latencies := make([]time.Duration, 0, s.count)
+	for _, sample := range s.samples[:s.count] {
+		if now.Sub(sample.at) < shedWindow {
+			latencies = append(latencies, sample.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[(len(latencies)*99-1)/100]
+}
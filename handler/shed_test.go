@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLoadShedder(target time.Duration, aggressiveness float64, now *time.Time) *LoadShedder {
+	s := NewLoadShedder(target, aggressiveness)
+	s.now = func() time.Time { return *now }
+	s.rand = rand.New(rand.NewSource(1))
+	return s
+}
+
+func TestLoadShedder_Allow(t *testing.T) {
+	tests := []struct {
+		name           string
+		aggressiveness float64
+		latency        time.Duration
+		wantShedMin    int
+		wantShedMax    int
+	}{
+		{
+			name:           "allows all requests under the target",
+			aggressiveness: 1,
+			latency:        90 * time.Millisecond,
+			wantShedMin:    0,
+			wantShedMax:    0,
+		},
+		{
+			name:           "sheds a share of requests proportional to the excess",
+			aggressiveness: 1,
+			latency:        150 * time.Millisecond,
+			wantShedMin:    400,
+			wantShedMax:    600,
+		},
+		{
+			name:           "sheds more with a higher aggressiveness",
+			aggressiveness: 2,
+			latency:        150 * time.Millisecond,
+			wantShedMin:    1000,
+			wantShedMax:    1000,
+		},
+		{
+			name:           "sheds all requests at twice the target",
+			aggressiveness: 1,
+			latency:        200 * time.Millisecond,
+			wantShedMin:    1000,
+			wantShedMax:    1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1600000000, 0)
+			s := newTestLoadShedder(100*time.Millisecond, tt.aggressiveness, &now)
+			for i := 0; i < 100; i++ {
+				s.Observe(tt.latency)
+			}
+
+			shed := 0
+			for i := 0; i < 1000; i++ {
+				if !s.Allow() {
+					shed++
+				}
+			}
+
+			assert.Equal(t, tt.latency, s.P99())
+			assert.True(t, shed >= tt.wantShedMin && shed <= tt.wantShedMax, "shed %d requests", shed)
+		})
+	}
+}
+
+func TestLoadShedder_P99IgnoresOutliers(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestLoadShedder(100*time.Millisecond, 1, &now)
+	for i := 0; i < 1000; i++ {
+		s.Observe(10 * time.Millisecond)
+	}
+	s.Observe(time.Second)
+
+	assert.True(t, s.Allow())
+	assert.Equal(t, 10*time.Millisecond, s.P99())
+}
+
+func TestLoadShedder_RecoversOnceLatenciesExpire(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestLoadShedder(100*time.Millisecond, 1, &now)
+	for i := 0; i < 100; i++ {
+		s.Observe(time.Second)
+	}
+	assert.False(t, s.Allow())
+
+	// The P99 is only recomputed every shedRecomputeInterval
+	now = now.Add(shedRecomputeInterval / 2)
+	s.Observe(10 * time.Millisecond)
+	assert.False(t, s.Allow())
+
+	now = now.Add(shedWindow - shedRecomputeInterval/2)
+	assert.True(t, s.Allow())
+	assert.Equal(t, 10*time.Millisecond, s.P99())
+
+	now = now.Add(shedWindow)
+	assert.True(t, s.Allow())
+	assert.Equal(t, time.Duration(0), s.P99())
+}
+
+func TestHandler_ServeHTTP_LoadShedding(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestLoadShedder(100*time.Millisecond, 1, &now)
+	h := &Handler{
+		ProxyClient: &mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("ok"))}},
+		LoadShedder: s,
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://sqs.eu-west-1.amazonaws.com/", nil)
+	r := httptest.NewRecorder()
+	h.ServeHTTP(r, request)
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "ok", r.Body.String())
+
+	for i := 0; i < 100; i++ {
+		s.Observe(time.Second)
+	}
+	now = now.Add(shedRecomputeInterval)
+
+	r = httptest.NewRecorder()
+	h.ServeHTTP(r, request)
+	assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+	assert.Equal(t, "1", r.Header().Get("Retry-After"))
+	assert.Equal(t, "proxy is overloaded", r.Body.String())
+}
+
+// upstreamTimedProxyClient reports an upstream latency of duration.
+type upstreamTimedProxyClient struct {
+	mockProxyClient
+	duration time.Duration
+}
+
+func (c *upstreamTimedProxyClient) Do(req *http.Request) (*http.Response, error) {
+	requestInfoFrom(req.Context()).UpstreamDuration = c.duration
+	return c.mockProxyClient.Do(req)
+}
+
+func TestHandler_ServeHTTP_LoadSheddingObservesUpstreamLatency(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestLoadShedder(100*time.Millisecond, 1, &now)
+	client := &upstreamTimedProxyClient{
+		mockProxyClient: mockProxyClient{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("ok"))}},
+		duration:        20 * time.Millisecond,
+	}
+	h := &Handler{ProxyClient: client, LoadShedder: s}
+
+	request, _ := http.NewRequest(http.MethodPut, "http://s3.eu-west-1.amazonaws.com/bucket/key", strings.NewReader("body"))
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	now = now.Add(shedRecomputeInterval)
+	assert.True(t, s.Allow())
+	assert.Equal(t, 20*time.Millisecond, s.P99())
+
+	// Requests never sent upstream, e.g. cache hits, are not observed
+	client.duration = 0
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	now = now.Add(shedRecomputeInterval)
+	assert.True(t, s.Allow())
+	assert.Equal(t, 20*time.Millisecond, s.P99())
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+)
+
+// SignVersion selects the signature algorithm requests are signed with.
+type SignVersion string
+
+const (
+	// SignVersionAuto signs with SigV4A for multi-region hosts, such as S3
+	// Multi-Region Access Points, and SigV4 otherwise.
+	SignVersionAuto SignVersion = ""
+	SignVersionV4   SignVersion = "sigv4"
+	SignVersionV4A  SignVersion = "sigv4a"
+)
+
+// sigV4AAlgorithm is the name of the SigV4A algorithm, also used as the label
+// of its key derivation.
+const sigV4AAlgorithm = "AWS4-ECDSA-P256-SHA256"
+
+// sigV4AIgnoredHeaders are never signed, like with SigV4.
+var sigV4AIgnoredHeaders = map[string]bool{
+	"Authorization":   true,
+	"User-Agent":      true,
+	"X-Amzn-Trace-Id": true,
+}
+
+// applySignVersion switches service to the signing method of version. SigV4
+// needs a single region, so forcing it for any region signs for us-east-1.
+func applySignVersion(service *endpoints.ResolvedEndpoint, version SignVersion) {
+	switch version {
+	case SignVersionV4A:
+		service.SigningMethod = "v4a"
+	case SignVersionV4:
+		if service.SigningMethod == "v4a" {
+			service.SigningMethod = "v4"
+			if service.SigningRegion == "*" {
+				service.SigningRegion = "us-east-1"
+			}
+		}
+	}
+}
+
+// maxSigV4AKeys is the most SigV4A keys cached, an arbitrary one is dropped
+// past it, e.g. those of rotated temporary credentials.
+const maxSigV4AKeys = 64
+
+// sigV4AKey is a SigV4A signing key and the secret it was derived from.
+type sigV4AKey struct {
+	secret string
+	key    *ecdsa.PrivateKey
+}
+
+// sigV4AKey returns the signing key derived from creds, deriving it only
+// once per key pair.
+func (p *ProxyClient) sigV4AKey(creds credentials.Value) (*ecdsa.PrivateKey, error) {
+	p.sigV4AKeysMu.Lock()
+	cached, ok := p.sigV4AKeys[creds.AccessKeyID]
+	p.sigV4AKeysMu.Unlock()
+	if ok && cached.secret == creds.SecretAccessKey {
+		return cached.key, nil
+	}
+
+	key, err := deriveSigV4AKey(creds.AccessKeyID, creds.SecretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sigV4AKeysMu.Lock()
+	defer p.sigV4AKeysMu.Unlock()
+	if p.sigV4AKeys == nil {
+		p.sigV4AKeys = map[string]sigV4AKey{}
+	}
+	if _, ok := p.sigV4AKeys[creds.AccessKeyID]; !ok && len(p.sigV4AKeys) >= maxSigV4AKeys {
+		for id := range p.sigV4AKeys {
+			delete(p.sigV4AKeys, id)
+			break
+		}
+	}
+	p.sigV4AKeys[creds.AccessKeyID] = sigV4AKey{secret: creds.SecretAccessKey, key: key}
+	return key, nil
+}
+
+// deriveSigV4AKey derives the P-256 key pair of an access key from its
+// secret, with the NIST SP 800-108 counter mode KDF, retrying with the next
+// external counter until the candidate is below n-2.
+func deriveSigV4AKey(accessKeyID, secretAccessKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	nMinusTwo := new(big.Int).Sub(curve.Params().N, big.NewInt(2))
+	inputKey := []byte("AWS4A" + secretAccessKey)
+
+	for counter := 1; counter <= 0xFF; counter++ {
+		context := append([]byte(accessKeyID), byte(counter))
+		candidate := new(big.Int).SetBytes(hmacKeyDerivation(inputKey, []byte(sigV4AAlgorithm), context, curve.Params().BitSize))
+		if candidate.Cmp(nMinusTwo) >= 0 {
+			continue
+		}
+
+		key := &ecdsa.PrivateKey{D: candidate.Add(candidate, big.NewInt(1))}
+		key.PublicKey.Curve = curve
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(key.D.Bytes())
+		return key, nil
+	}
+	return nil, errors.New("unable to derive SigV4A key, exhausted the external counter")
+}
+
+// hmacKeyDerivation derives bitLen bits from key with HMAC-SHA256 in the NIST
+// SP 800-108 counter mode.
+func hmacKeyDerivation(key, label, context []byte, bitLen int) []byte {
+	fixedInput := bytes.NewBuffer(nil)
+	fixedInput.Write(label)
+	fixedInput.WriteByte(0x00)
+	fixedInput.Write(context)
+	binary.Write(fixedInput, binary.BigEndian, int32(bitLen))
+
+	var output []byte
+	h := hmac.New(sha256.New, key)
+	for i := int32(1); len(output) < bitLen/8; i++ {
+		h.Reset()
+		binary.Write(h, binary.BigEndian, i)
+		h.Write(fixedInput.Bytes())
+		output = h.Sum(output)
+	}
+	return output[:bitLen/8]
+}
+
+// signV4A signs req for service with SigV4A, valid in every region of its
+// signing region set (* for all), with the credentials of signer.
+func (p *ProxyClient) signV4A(req *http.Request, body io.ReadSeeker, signer *v4.Signer, service *endpoints.ResolvedEndpoint, signTime time.Time) error {
+	creds, err := signer.Credentials.Get()
+	if err != nil {
+		return err
+	}
+	key, err := p.sigV4AKey(creds)
+	if err != nil {
+		return err
+	}
+
+	signTime = signTime.UTC()
+	amzDate := signTime.Format("20060102T150405Z")
+	scope := strings.Join([]string{signTime.Format("20060102"), service.SigningName, "aws4_request"}, "/")
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Region-Set", service.SigningRegion)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		if payloadHash, err = hashPayload(body); err != nil {
+			return err
+		}
+		if service.SigningName == "s3" {
+			req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		}
+	}
+
+	signedHeaders, canonicalHeaders := sigV4ACanonicalHeaders(req)
+	req.URL.RawQuery = strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if !signer.DisableURIPathEscaping {
+		uri = rest.EscapePath(uri, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.RawQuery,
+		canonicalHeaders + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4AAlgorithm, amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	if signer.Debug.Matches(aws.LogDebugWithSigning) && signer.Logger != nil {
+		signer.Logger.Log(fmt.Sprintf(signingInfoLogFormat, canonicalRequest, stringToSign, ""))
+	}
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", sigV4AAlgorithm+" Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(signature))
+	return nil
+}
+
+// hashPayload returns the hex encoded SHA-256 of body, rewound afterwards.
+func hashPayload(body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if body != nil {
+		start, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sigV4ACanonicalHeaders returns the signed headers of req and their
+// canonical form, as SigV4 computes them.
+func sigV4ACanonicalHeaders(req *http.Request) (string, string) {
+	values := map[string][]string{}
+	names := []string{"host"}
+	for name, vv := range req.Header {
+		if sigV4AIgnoredHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		lower := strings.ToLower(name)
+		if _, ok := values[lower]; !ok {
+			names = append(names, lower)
+		}
+		values[lower] = append(values[lower], vv...)
+	}
+	sort.Strings(names)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	lines := make([]string, len(names))
+	for i, name := range names {
+		value := host
+		if name != "host" {
+			value = strings.Join(values[name], ",")
+		}
+		lines[i] = name + ":" + strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(names, ";"), strings.Join(lines, "\n")
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveSigV4AKey(t *testing.T) {
+	key, err := deriveSigV4AKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "7fd3bd010c0d9c292141c2b77bfbde1042c92e6836fff749d1269ec890fca1bd", hex.EncodeToString(key.D.Bytes()))
+	assert.Equal(t, "15d242ceebf8d8169fd6a8b5a746c41140414c3b07579038da06af89190fffcb", hex.EncodeToString(key.X.Bytes()))
+	assert.Equal(t, "0515242cedd82e94799482e4c0514b505afccf2c0c98d6a553bf539f424c5ec0", hex.EncodeToString(key.Y.Bytes()))
+}
+
+// sigV4AAuthorization matches a SigV4A Authorization header, capturing the
+// credential scope, signed headers and signature.
+var sigV4AAuthorization = regexp.MustCompile(`^AWS4-ECDSA-P256-SHA256 Credential=AKISORANDOMAASORANDOM/([^,]+), SignedHeaders=([^,]+), Signature=([0-9a-f]+)$`)
+
+func TestProxyClient_sigV4AKey_Cache(t *testing.T) {
+	p := &ProxyClient{}
+	first, err := p.sigV4AKey(credentials.Value{AccessKeyID: "AKID0", SecretAccessKey: "secret"})
+	assert.Nil(t, err)
+	cached, err := p.sigV4AKey(credentials.Value{AccessKeyID: "AKID0", SecretAccessKey: "secret"})
+	assert.Nil(t, err)
+	assert.True(t, first == cached)
+
+	// A new secret for the same access key derives a new key
+	rotated, err := p.sigV4AKey(credentials.Value{AccessKeyID: "AKID0", SecretAccessKey: "rotated"})
+	assert.Nil(t, err)
+	assert.False(t, first.D.Cmp(rotated.D) == 0)
+
+	// The cache is bounded
+	for i := 1; i <= 2*maxSigV4AKeys; i++ {
+		_, err := p.sigV4AKey(credentials.Value{AccessKeyID: "AKID" + strconv.Itoa(i), SecretAccessKey: "secret"})
+		assert.Nil(t, err)
+	}
+	assert.Len(t, p.sigV4AKeys, maxSigV4AKeys)
+}
+
+func TestProxyClient_Do_SigV4A(t *testing.T) {
+	signTime := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		host          string
+		version       SignVersion
+		wantAlgorithm string
+		wantScope     string
+		wantRegionSet string
+	}{
+		{
+			name:          "signs multi-region access points with SigV4A",
+			host:          "mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com",
+			wantAlgorithm: "AWS4-ECDSA-P256-SHA256",
+			wantScope:     "20210301/s3/aws4_request",
+			wantRegionSet: "*",
+		},
+		{
+			name:          "signs regional hosts with SigV4",
+			host:          "sqs.us-west-2.amazonaws.com",
+			wantAlgorithm: "AWS4-HMAC-SHA256",
+			wantScope:     "20210301/us-west-2/sqs/aws4_request",
+		},
+		{
+			name:          "forces SigV4A for the region of regional hosts",
+			host:          "sqs.us-west-2.amazonaws.com",
+			version:       SignVersionV4A,
+			wantAlgorithm: "AWS4-ECDSA-P256-SHA256",
+			wantScope:     "20210301/sqs/aws4_request",
+			wantRegionSet: "us-west-2",
+		},
+		{
+			name:          "forces SigV4 for multi-region access points",
+			host:          "mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com",
+			version:       SignVersionV4,
+			wantAlgorithm: "AWS4-HMAC-SHA256",
+			wantScope:     "20210301/us-east-1/s3/aws4_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:      v4.NewSigner(credentials.NewStaticCredentials("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom", "")),
+				Client:      client,
+				SignVersion: tt.version,
+				now:         func() time.Time { return signTime },
+			}
+
+			_, err := proxyClient.Do(&http.Request{
+				Method: http.MethodPut,
+				URL:    &url.URL{Path: "/key", RawQuery: "b=2&a=1"},
+				Host:   tt.host,
+				Header: http.Header{"Content-Type": {"text/plain"}},
+				Body:   http.NoBody,
+			})
+
+			assert.Nil(t, err)
+			auth := client.Request.Header.Get("Authorization")
+			assert.True(t, strings.HasPrefix(auth, tt.wantAlgorithm+" Credential=AKISORANDOMAASORANDOM/"+tt.wantScope+", "), auth)
+			assert.Equal(t, tt.wantRegionSet, client.Request.Header.Get("X-Amz-Region-Set"))
+		})
+	}
+}
+
+func TestProxyClient_signV4A_Verifies(t *testing.T) {
+	signTime := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	proxyClient := &ProxyClient{}
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom", "TOKEN"))
+	signer.DisableURIPathEscaping = true
+
+	req, _ := http.NewRequest(http.MethodGet, "https://mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com/a%20key?versionId=1", nil)
+	req.Header.Set("User-Agent", "test")
+	service := determineAWSServiceFromHost(req.Host)
+	err := proxyClient.signV4A(req, strings.NewReader(""), signer, service, signTime)
+	assert.Nil(t, err)
+
+	m := sigV4AAuthorization.FindStringSubmatch(req.Header.Get("Authorization"))
+	if !assert.NotNil(t, m) {
+		return
+	}
+	assert.Equal(t, "20210301/s3/aws4_request", m[1])
+	assert.Equal(t, "host;x-amz-content-sha256;x-amz-date;x-amz-region-set;x-amz-security-token", m[2])
+	assert.Equal(t, "20210301T120000Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "TOKEN", req.Header.Get("X-Amz-Security-Token"))
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/a%20key",
+		"versionId=1",
+		"host:mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com\n" +
+			"x-amz-content-sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n" +
+			"x-amz-date:20210301T120000Z\n" +
+			"x-amz-region-set:*\n" +
+			"x-amz-security-token:TOKEN\n",
+		m[2],
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	digest := sha256.Sum256([]byte("AWS4-ECDSA-P256-SHA256\n20210301T120000Z\n20210301/s3/aws4_request\n" + hex.EncodeToString(canonicalHash[:])))
+	signature, _ := hex.DecodeString(m[3])
+
+	key, _ := deriveSigV4AKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+}
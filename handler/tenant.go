@@ -0,0 +1,43 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// tenant returns the tenant named by the TenantHeader of req, which must be
+// one of TenantSigners, and removes the header so it is never forwarded.
+func (p *ProxyClient) tenant(req *http.Request) (string, error) {
+	tenant := req.Header.Get(p.TenantHeader)
+	req.Header.Del(p.TenantHeader)
+
+	if tenant == "" {
+		return "", &statusError{
+			status: http.StatusBadRequest,
+			err:    fmt.Errorf("missing tenant header %s", http.CanonicalHeaderKey(p.TenantHeader)),
+		}
+	}
+	if _, ok := p.TenantSigners[tenant]; !ok {
+		loggerFrom(req.Context()).WithField("tenant", tenant).Warn("rejecting request of unknown tenant")
+		return "", &statusError{
+			status: http.StatusForbidden,
+			err:    fmt.Errorf("unknown tenant in %s", http.CanonicalHeaderKey(p.TenantHeader)),
+		}
+	}
+	return tenant, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// tenantProvider hands out the credentials of a tenant, counting retrievals.
+type tenantProvider struct {
+	credentials.Expiry
+	tenant     string
+	retrievals int
+}
+
+func (p *tenantProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	p.SetExpiration(time.Now().Add(time.Hour), 0)
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("AKID%s%d", p.tenant, p.retrievals),
+		SecretAccessKey: "secret",
+		ProviderName:    "tenantProvider",
+	}, nil
+}
+
+func TestProxyClient_Do_TenantCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		tenant     string
+		wantErr    error
+		wantAccess string
+	}{
+		{name: "signs with the credentials of known tenants", tenant: "a", wantAccess: "Credential=AKIDA1/"},
+		{name: "signs each tenant with its own credentials", tenant: "b", wantAccess: "Credential=AKIDB1/"},
+		{
+			name:    "rejects unknown tenants",
+			tenant:  "c",
+			wantErr: &statusError{status: http.StatusForbidden, err: fmt.Errorf("unknown tenant in X-Tenant")},
+		},
+		{
+			name:    "rejects requests without a tenant",
+			wantErr: &statusError{status: http.StatusBadRequest, err: fmt.Errorf("missing tenant header X-Tenant")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:       v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:       client,
+				TenantHeader: "x-tenant",
+				TenantSigners: map[string]*v4.Signer{
+					"a": v4.NewSigner(credentials.NewCredentials(&tenantProvider{tenant: "A"})),
+					"b": v4.NewSigner(credentials.NewCredentials(&tenantProvider{tenant: "B"})),
+				},
+			}
+
+			request, _ := http.NewRequest(http.MethodGet, "http://sqs.us-west-2.amazonaws.com/", nil)
+			if tt.tenant != "" {
+				request.Header.Set("X-Tenant", tt.tenant)
+			}
+			_, err := proxyClient.Do(request)
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr != nil {
+				assert.Nil(t, client.Request)
+				return
+			}
+			assert.Contains(t, client.Request.Header.Get("Authorization"), tt.wantAccess)
+			assert.Empty(t, client.Request.Header.Values("X-Tenant"))
+		})
+	}
+}
+
+func TestProxyClient_Do_CachesTenantCredentials(t *testing.T) {
+	providerA, providerB := &tenantProvider{tenant: "A"}, &tenantProvider{tenant: "B"}
+	credsA := credentials.NewCredentials(providerA)
+	client := &mockHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer:       v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:       client,
+		TenantHeader: "X-Tenant",
+		TenantSigners: map[string]*v4.Signer{
+			"a": v4.NewSigner(credsA),
+			"b": v4.NewSigner(credentials.NewCredentials(providerB)),
+		},
+	}
+
+	send := func(tenant string) string {
+		request, _ := http.NewRequest(http.MethodGet, "http://sqs.us-west-2.amazonaws.com/", nil)
+		request.Header.Set("X-Tenant", tenant)
+		_, err := proxyClient.Do(request)
+		assert.Nil(t, err)
+		return client.Request.Header.Get("Authorization")
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Contains(t, send("a"), "Credential=AKIDA1/")
+	}
+	assert.Contains(t, send("b"), "Credential=AKIDB1/")
+	assert.Equal(t, 1, providerA.retrievals)
+	assert.Equal(t, 1, providerB.retrievals)
+
+	// Expired credentials are refreshed for their tenant only
+	credsA.Expire()
+	assert.Contains(t, send("a"), "Credential=AKIDA2/")
+	assert.Contains(t, send("b"), "Credential=AKIDB1/")
+	assert.Equal(t, 2, providerA.retrievals)
+	assert.Equal(t, 1, providerB.retrievals)
+}
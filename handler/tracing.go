@@ -0,0 +1,379 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxExportBatch and exportInterval bound how many spans are exported
+	// at once and how long they wait for others.
+	maxExportBatch = 512
+	exportInterval = 5 * time.Second
+
+	spanKindServer  = 2
+	statusCodeError = 2
+)
+
+// traceContext identifies a span the way the W3C traceparent header does.
+type traceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceparent parses a traceparent header value, false if it is not
+// valid. Versions after 00 are read as 00, as the specification requires.
+func parseTraceparent(v string) (traceContext, bool) {
+	var tc traceContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return tc, false
+	}
+	version := v[:2]
+	if version == "ff" || !isLowerHex(version) || (version == "00" && len(v) != 55) || (len(v) > 55 && v[55] != '-') {
+		return tc, false
+	}
+	if !isLowerHex(v[3:35]) || !isLowerHex(v[36:52]) || !isLowerHex(v[53:55]) {
+		return tc, false
+	}
+	hex.Decode(tc.TraceID[:], []byte(v[3:35]))
+	hex.Decode(tc.SpanID[:], []byte(v[36:52]))
+	if tc.TraceID == ([16]byte{}) || tc.SpanID == ([8]byte{}) {
+		return tc, false
+	}
+	flags, _ := strconv.ParseUint(v[53:55], 16, 8)
+	tc.Sampled = flags&1 == 1
+	return tc, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// traceparent returns the traceparent header value identifying tc.
+func (tc traceContext) traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) + "-" + flags
+}
+
+// setTraceparent replaces the traceparent in h by that of s, when the
+// request is traced, so the upstream's spans are children of the proxy's.
+// The tracestate is passed on unchanged.
+func setTraceparent(h http.Header, s *span) {
+	if s != nil {
+		h.Set("Traceparent", s.traceparent())
+	}
+}
+
+// span is the server span of a proxied request.
+type span struct {
+	traceContext
+	// ParentSpanID is zero for the spans starting a trace.
+	ParentSpanID [8]byte
+	Start        time.Time
+}
+
+// Tracer records a span for every proxied request and exports them in the
+// background to an OTLP/HTTP endpoint, encoded as JSON. Like audit events,
+// spans are dropped when the buffer is full rather than delaying requests.
+type Tracer struct {
+	// Endpoint is the URL spans are POSTed to, e.g.
+	// http://localhost:4318/v1/traces, along with Headers.
+	Endpoint string
+	Headers  map[string]string
+	Client   Client
+	// ServiceName is the service.name of the exported spans.
+	ServiceName string
+	// SampleRatio is the share of traces started by the proxy which are
+	// recorded. With ParentBased, requests carrying a traceparent are
+	// recorded only if their parent is.
+	SampleRatio float64
+	ParentBased bool
+
+	spans    chan otlpSpan
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	dropped  uint64
+	failed   uint64
+}
+
+// NewTracer returns a Tracer exporting to endpoint, recording every trace
+// unless its parent is not, buffering up to bufferSize spans, and starts
+// exporting them. Its fields must be set before it records any span.
+func NewTracer(endpoint string, client Client, bufferSize int) *Tracer {
+	t := &Tracer{
+		Endpoint:    endpoint,
+		Client:      client,
+		ServiceName: "aws-sigv4-proxy",
+		SampleRatio: 1,
+		ParentBased: true,
+		spans:       make(chan otlpSpan, bufferSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close exports the spans queued so far, waiting for them until ctx is
+// done. Spans ended afterwards are not exported.
+func (t *Tracer) Close(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start starts the span of r, a child of the one in its traceparent header
+// when valid.
+func (t *Tracer) start(r *http.Request) *span {
+	s := &span{Start: time.Now()}
+	parent, ok := parseTraceparent(r.Header.Get("Traceparent"))
+	if ok {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+
+	switch {
+	case ok && t.ParentBased:
+		s.Sampled = parent.Sampled
+	case t.SampleRatio >= 1:
+		s.Sampled = true
+	case t.SampleRatio > 0:
+		// The lower half of trace IDs is random, as for the OpenTelemetry
+		// ratio sampler
+		s.Sampled = binary.BigEndian.Uint64(s.TraceID[8:])>>1 < uint64(t.SampleRatio*(1<<63))
+	}
+	return s
+}
+
+// end queues s for export, if sampled, once r was answered with status.
+func (t *Tracer) end(s *span, r *http.Request, info *requestInfo, status int) {
+	if !s.Sampled {
+		return
+	}
+
+	os := otlpSpan{
+		TraceID:           hex.EncodeToString(s.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.SpanID[:]),
+		Name:              r.Method,
+		Kind:              spanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if s.ParentSpanID != ([8]byte{}) {
+		os.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+	}
+	os.addString("http.request.method", r.Method)
+	if r.URL != nil {
+		os.addString("url.path", r.URL.Path)
+	}
+	os.addString("aws.service", info.Service)
+	os.addString("aws.region", info.Region)
+	os.addString("upstream.host", info.UpstreamHost)
+	os.Attributes = append(os.Attributes, otlpAttribute{Key: "http.response.status_code", Value: otlpValue{IntValue: strconv.Itoa(status)}})
+	if status >= 500 {
+		os.Status.Code = statusCodeError
+	}
+
+	select {
+	case t.spans <- os:
+	default:
+		if atomic.AddUint64(&t.dropped, 1) == 1 {
+			log.Warn("trace buffer is full, dropping spans")
+		}
+	}
+}
+
+// Dropped returns the number of spans dropped because the buffer was full.
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Failed returns the number of spans which could not be exported.
+func (t *Tracer) Failed() uint64 {
+	return atomic.LoadUint64(&t.failed)
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpSpan, 0, maxExportBatch)
+	flush := func() {
+		if err := t.export(batch); err != nil {
+			atomic.AddUint64(&t.failed, uint64(len(batch)))
+			log.WithError(err).Error("unable to export spans")
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == maxExportBatch {
+				flush()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flush()
+			}
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+					if len(batch) == maxExportBatch {
+						flush()
+					}
+				default:
+					if len(batch) > 0 {
+						flush()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(spans []otlpSpan) error {
+	resource := otlpResource{}
+	resource.addString("service.name", t.ServiceName)
+	b, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "aws-sigv4-proxy"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("trace collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans, IDs being hex encoded and times
+// decimal strings.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+// addString adds a string attribute, unless empty.
+func (s *otlpSpan) addString(key, value string) {
+	if value != "" {
+		s.Attributes = append(s.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+}
+
+func (r *otlpResource) addString(key, value string) {
+	if value != "" {
+		r.Attributes = append(r.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true, sampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", valid: true},
+		{name: "future version", value: "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds", valid: true, sampled: true},
+		{name: "version 00 with more", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-more"},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "upper case", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{name: "zero trace ID", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span ID", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, ok := parseTraceparent(tt.value)
+			assert.Equal(t, tt.valid, ok)
+			if tt.valid {
+				assert.Equal(t, tt.sampled, tc.Sampled)
+				assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.traceparent()[3:35])
+				assert.Equal(t, "00f067aa0ba902b7", tc.traceparent()[36:52])
+			}
+		})
+	}
+}
+
+func TestTracer_start(t *testing.T) {
+	sampledParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	unsampledParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+
+	tests := []struct {
+		name        string
+		ratio       float64
+		parentBased bool
+		traceparent string
+		sampled     bool
+	}{
+		{name: "root always on", ratio: 1, parentBased: true, sampled: true},
+		{name: "root always off", ratio: 0, parentBased: true},
+		{name: "sampled parent", ratio: 0, parentBased: true, traceparent: sampledParent, sampled: true},
+		{name: "unsampled parent", ratio: 1, parentBased: true, traceparent: unsampledParent},
+		{name: "parent ignored", ratio: 1, traceparent: unsampledParent, sampled: true},
+		{name: "invalid parent", ratio: 1, parentBased: true, traceparent: "00-xyz", sampled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := &Tracer{SampleRatio: tt.ratio, ParentBased: tt.parentBased}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("Traceparent", tt.traceparent)
+			}
+
+			s := tracer.start(r)
+			assert.Equal(t, tt.sampled, s.Sampled)
+			assert.NotEqual(t, [16]byte{}, s.TraceID)
+			assert.NotEqual(t, [8]byte{}, s.SpanID)
+			if parent, ok := parseTraceparent(tt.traceparent); ok {
+				assert.Equal(t, parent.TraceID, s.TraceID)
+				assert.Equal(t, parent.SpanID, s.ParentSpanID)
+			} else {
+				assert.Equal(t, [8]byte{}, s.ParentSpanID)
+			}
+		})
+	}
+}
+
+func TestTracer_startRatio(t *testing.T) {
+	tracer := &Tracer{SampleRatio: 0.25}
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if tracer.start(httptest.NewRequest(http.MethodGet, "/", nil)).Sampled {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 1000, sampled, 150)
+}
+
+func TestHandler_ServeHTTP_Tracing(t *testing.T) {
+	tracer := &Tracer{SampleRatio: 1, ParentBased: true, spans: make(chan otlpSpan, 1)}
+	client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader("slow down"))}}
+	h := &Handler{
+		ProxyClient: &ProxyClient{
+			Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+			Client: client,
+		},
+		Tracer: tracer,
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader("Action=SendMessage"))
+	r.Host = "sqs.us-west-2.amazonaws.com"
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("Tracestate", "vendor=value")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var span otlpSpan
+	select {
+	case span = <-tracer.spans:
+	default:
+		t.Fatal("no span was recorded")
+	}
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentSpanID)
+	assert.Len(t, span.SpanID, 16)
+	assert.Equal(t, "POST", span.Name)
+	assert.Equal(t, spanKindServer, span.Kind)
+	assert.Equal(t, statusCodeError, span.Status.Code)
+	assert.Equal(t, []otlpAttribute{
+		{Key: "http.request.method", Value: otlpValue{StringValue: "POST"}},
+		{Key: "url.path", Value: otlpValue{StringValue: "/queue"}},
+		{Key: "aws.service", Value: otlpValue{StringValue: "sqs"}},
+		{Key: "aws.region", Value: otlpValue{StringValue: "us-west-2"}},
+		{Key: "upstream.host", Value: otlpValue{StringValue: "sqs.us-west-2.amazonaws.com"}},
+		{Key: "http.response.status_code", Value: otlpValue{IntValue: "503"}},
+	}, span.Attributes)
+
+	// The upstream's parent is the proxy's span, not the client's
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanID+"-01", client.Request.Header.Get("Traceparent"))
+	assert.Equal(t, "vendor=value", client.Request.Header.Get("Tracestate"))
+	assert.NotContains(t, client.Request.Header.Get("Authorization"), "traceparent")
+}
+
+func TestHandler_ServeHTTP_TracingNotSampled(t *testing.T) {
+	tracer := &Tracer{SampleRatio: 1, ParentBased: true, spans: make(chan otlpSpan, 1)}
+	client := &mockHTTPClient{Response: &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}}
+	h := &Handler{
+		ProxyClient: &ProxyClient{
+			Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+			Client: client,
+		},
+		Tracer: tracer,
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "sqs.us-west-2.amazonaws.com"
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Len(t, tracer.spans, 0)
+	traceparent := client.Request.Header.Get("Traceparent")
+	assert.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+	assert.True(t, strings.HasSuffix(traceparent, "-00"))
+	assert.NotContains(t, traceparent, "00f067aa0ba902b7")
+}
+
+func TestTracer_export(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/v1/traces", &http.Client{Timeout: time.Second}, 1)
+	tracer.Headers = map[string]string{"Authorization": "Bearer token"}
+	span := otlpSpan{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Name: "GET", Kind: spanKindServer}
+	assert.Nil(t, tracer.export([]otlpSpan{span}))
+
+	r := <-received
+	assert.Equal(t, "/v1/traces", r.URL.Path)
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+	var export otlpExport
+	assert.Nil(t, json.Unmarshal(<-bodies, &export))
+	assert.Equal(t, otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "aws-sigv4-proxy"}}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "aws-sigv4-proxy"}, Spans: []otlpSpan{span}}},
+	}}}, export)
+}
+
+func TestTracer_exportFailure(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer collector.Close()
+
+	tracer := &Tracer{Endpoint: collector.URL, Client: &http.Client{Timeout: time.Second}}
+	assert.EqualError(t, tracer.export(nil), "trace collector responded with 400 Bad Request")
+}
+
+func TestTracer_Close(t *testing.T) {
+	exports := make(chan otlpExport, 2)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var export otlpExport
+		json.NewDecoder(r.Body).Decode(&export)
+		exports <- export
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL, &http.Client{Timeout: time.Second}, 10)
+	for _, id := range []string{"00f067aa0ba902b7", "00f067aa0ba902b8"} {
+		tracer.spans <- otlpSpan{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: id}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, tracer.Close(ctx))
+
+	// The queued spans are exported at once, without waiting for the interval
+	export := <-exports
+	if assert.Len(t, export.ResourceSpans, 1) && assert.Len(t, export.ResourceSpans[0].ScopeSpans, 1) {
+		assert.Len(t, export.ResourceSpans[0].ScopeSpans[0].Spans, 2)
+	}
+}
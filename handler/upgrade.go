@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errUpgradeIdle is returned once an upgraded connection was closed for
+// being idle.
+var errUpgradeIdle = errors.New("upgraded connection was idle for too long")
+
+// upgradeProtocol returns the protocol, e.g. websocket, h asks to switch
+// to, if any.
+func upgradeProtocol(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// upgradedConn is the upstream connection of a response switching
+// protocols, releasing the request context once closed.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	cancel func()
+}
+
+func (c *upgradedConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	return err
+}
+
+// serveUpgrade completes the protocol switch of resp with the client, then
+// relays the connection both ways until either side closes it, or it has
+// been idle for UpgradeIdleTimeout.
+func (h *Handler) serveUpgrade(w http.ResponseWriter, resp *http.Response) error {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		h.write(w, http.StatusBadGateway, []byte("upstream switched protocols without a usable connection"))
+		return errors.New("upstream switched protocols without a usable connection")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		h.write(w, http.StatusBadGateway, []byte("client connection cannot switch protocols"))
+		return errors.New("client connection cannot switch protocols")
+	}
+
+	copyHeader(w.Header(), resp.Header)
+	// Tracked before the hijack, while the http.Server still waits for the
+	// connection on shutdown
+	h.upgrades.Add(1)
+	defer h.upgrades.Done()
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("unable to take over client connection: %w", err)
+	}
+	h.trackUpgrade(conn, true)
+	defer h.trackUpgrade(conn, false)
+
+	// The ResponseWriter is unusable once hijacked, the handshake response is
+	// written to the connection itself
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	w.Header().Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		upstream.Close()
+		return err
+	}
+
+	return relay(conn, brw.Reader, upstream, h.UpgradeIdleTimeout)
+}
+
+// trackUpgrade adds or removes conn from the upgraded connections closed by
+// Shutdown.
+func (h *Handler) trackUpgrade(conn net.Conn, add bool) {
+	h.upgradesMu.Lock()
+	defer h.upgradesMu.Unlock()
+	if !add {
+		delete(h.upgradeConns, conn)
+		return
+	}
+	if h.upgradeConns == nil {
+		h.upgradeConns = map[net.Conn]struct{}{}
+	}
+	h.upgradeConns[conn] = struct{}{}
+}
+
+// relay copies client, read through r which may hold bytes it already
+// sent, to upstream and back until either side is done, then closes both.
+// Both are also closed once no bytes went either way for idle, if not zero.
+func relay(client net.Conn, r *bufio.Reader, upstream io.ReadWriteCloser, idle time.Duration) error {
+	var idled int32
+	closeBoth := func() {
+		client.Close()
+		upstream.Close()
+	}
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&idled, 1)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+
+	errc := make(chan error, 2)
+	copyActive := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(&activityWriter{Writer: dst, timer: timer, idle: idle}, src)
+		errc <- err
+	}
+	go copyActive(upstream, r)
+	go copyActive(client, upstream)
+
+	// Either side closing tears down the other
+	err := <-errc
+	closeBoth()
+	<-errc
+
+	if atomic.LoadInt32(&idled) == 1 {
+		return errUpgradeIdle
+	}
+	return err
+}
+
+// activityWriter pushes back the idle timer of a relayed connection on
+// every write.
+type activityWriter struct {
+	io.Writer
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	if w.timer != nil {
+		w.timer.Reset(w.idle)
+	}
+	return w.Writer.Write(b)
+}
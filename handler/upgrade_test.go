@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoUpgradeServer switches signed requests to an echo protocol answering
+// every line in upper case, and closes closed once the client went away.
+func echoUpgradeServer(closed chan struct{}) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" || r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-Websocket-Key") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer close(closed)
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(strings.ToUpper(line))
+			brw.Flush()
+		}
+	}))
+}
+
+// dialUpgrade asks the proxy at addr to switch to a WebSocket.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert.Nil(t, err)
+	return conn, r, resp
+}
+
+func upgradeProxy(upstream *httptest.Server) *ProxyClient {
+	return &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              upstream.Client(),
+		SigningNameOverride: "execute-api",
+		RegionOverride:      "us-west-2",
+		HostOverride:        upstream.Listener.Addr().String(),
+		// Only bounds the handshake
+		UpstreamTimeout: 50 * time.Millisecond,
+	}
+}
+
+func TestHandler_ServeHTTP_Upgrade(t *testing.T) {
+	closed := make(chan struct{})
+	upstream := echoUpgradeServer(closed)
+	defer upstream.Close()
+	proxy := httptest.NewServer(&Handler{ProxyClient: upgradeProxy(upstream)})
+	defer proxy.Close()
+
+	conn, r, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	time.Sleep(100 * time.Millisecond)
+	for _, line := range []string{"hello\n", "world\n"} {
+		io.WriteString(conn, line)
+		echoed, err := r.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, strings.ToUpper(line), echoed)
+	}
+
+	// Closing the client side tears down the upstream side
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("upstream connection was not closed")
+	}
+}
+
+func TestHandler_ServeHTTP_UpgradeIdleTimeout(t *testing.T) {
+	closed := make(chan struct{})
+	upstream := echoUpgradeServer(closed)
+	defer upstream.Close()
+	proxy := httptest.NewServer(&Handler{ProxyClient: upgradeProxy(upstream), UpgradeIdleTimeout: 100 * time.Millisecond})
+	defer proxy.Close()
+
+	conn, r, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// Activity keeps the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		io.WriteString(conn, "ping\n")
+		echoed, err := r.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "PING\n", echoed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	<-closed
+}
+
+func TestUpgradeProtocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{name: "websocket", header: http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}}, want: "websocket"},
+		{name: "no connection token", header: http.Header{"Upgrade": {"websocket"}}, want: ""},
+		{name: "no upgrade", header: http.Header{"Connection": {"upgrade"}}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, upgradeProtocol(tt.header))
+		})
+	}
+}
+
+func TestHandler_Shutdown_Upgrades(t *testing.T) {
+	upstream := echoUpgradeServer(make(chan struct{}, 2))
+	defer upstream.Close()
+	h := &Handler{ProxyClient: upgradeProxy(upstream)}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	// Connections closed by clients are not waited for
+	conn, _, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, h.Shutdown(ctx, ctx))
+
+	// Those still open past the grace period are closed
+	conn, r, resp := dialUpgrade(t, proxy.Listener.Addr().String())
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	defer conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, h.Shutdown(ctx, ctx))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
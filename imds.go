@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	imdsTokenHeader    = "x-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "x-aws-ec2-metadata-token-ttl-seconds"
+	imdsTokenTTL       = 6 * time.Hour
+)
+
+// imdsV2Only makes requests to the EC2 instance metadata service carry an
+// IMDSv2 session token, failing those it cannot get one for instead of
+// falling back to IMDSv1 as the SDK does, e.g. after a token request timed
+// out.
+type imdsV2Only struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// handler returns the handler to run before requests are sent.
+func (i *imdsV2Only) handler() request.NamedHandler {
+	return request.NamedHandler{Name: "aws-sigv4-proxy.IMDSv2Only", Fn: i.requireToken}
+}
+
+// requireToken adds a session token to requests to the metadata service
+// sent without the one the SDK fetches.
+func (i *imdsV2Only) requireToken(r *request.Request) {
+	if r.ClientInfo.ServiceName != ec2metadata.ServiceName || r.Operation.Name == "GetToken" {
+		return
+	}
+	if r.HTTPRequest.Header.Get(imdsTokenHeader) != "" {
+		return
+	}
+	token, err := i.getToken(r)
+	if err != nil {
+		r.Error = awserr.New("IMDSv2Unavailable", "unable to get an IMDSv2 session token, IMDSv1 is disabled by --imds-v2-only", err)
+		return
+	}
+	r.HTTPRequest.Header.Set(imdsTokenHeader, token)
+}
+
+// getToken returns the session token, fetched again once expired.
+func (i *imdsV2Only) getToken(r *request.Request) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.token != "" && i.now().Before(i.expiry) {
+		return i.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(r.ClientInfo.Endpoint, "/")+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(imdsTokenTTLHeader, strconv.Itoa(int(imdsTokenTTL/time.Second)))
+	resp, err := r.Config.HTTPClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	// The token is fetched again a minute before it expires
+	i.token, i.expiry = string(body), i.now().Add(imdsTokenTTL-time.Minute)
+	return i.token, nil
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenerOptions holds the flag configurable TCP settings applied to
+// accepted client connections.
+type listenerOptions struct {
+	// NoDelay sets TCP_NODELAY, which Go enables by default.
+	NoDelay bool
+	// KeepAlivePeriod is the TCP keep-alive period, zero for Go's default
+	// and negative to disable keep-alives.
+	KeepAlivePeriod time.Duration
+	// MaxConnections caps the number of simultaneously open client
+	// connections, zero for no limit.
+	MaxConnections int
+	// SocketMode, SocketUser and SocketGroup, when set, are the permissions
+	// and owner of unix sockets, by name or ID.
+	SocketMode  os.FileMode
+	SocketUser  string
+	SocketGroup string
+}
+
+// sdListenFDsStart is the first file descriptor systemd passes sockets as.
+var sdListenFDsStart = 3
+
+// listen announces on addr, applying o to every accepted connection. addr
+// is a TCP address, unix:// followed by the path of a unix socket, or
+// systemd for the socket passed by systemd socket activation.
+func listen(addr string, o listenerOptions) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		l, err = listenUnix(strings.TrimPrefix(addr, "unix://"), o)
+	case addr == "systemd":
+		l, err = listenSystemd()
+	default:
+		lc := net.ListenConfig{KeepAlive: o.KeepAlivePeriod}
+		l, err = lc.Listen(context.Background(), "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l = &tcpListener{Listener: l, noDelay: o.NoDelay}
+	if o.MaxConnections > 0 {
+		l = &limitListener{Listener: l, slots: make(chan struct{}, o.MaxConnections)}
+	}
+	return l, nil
+}
+
+// listenUnix announces on the unix socket at path, with the permissions and
+// owner of o. The socket is removed once the listener is closed.
+func listenUnix(path string, o listenerOptions) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("missing unix socket path")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketOwner(path, o); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the unix socket a previous process left at path,
+// failing if path is not a socket or one is still accepting connections on
+// it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// setSocketOwner applies the permissions and owner of o to the unix socket
+// at path.
+func setSocketOwner(path string, o listenerOptions) error {
+	if o.SocketMode != 0 {
+		if err := os.Chmod(path, o.SocketMode); err != nil {
+			return err
+		}
+	}
+	if o.SocketUser == "" && o.SocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	var err error
+	if o.SocketUser != "" {
+		if uid, err = lookupID(o.SocketUser, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return fmt.Errorf("invalid socket user: %w", err)
+		}
+	}
+	if o.SocketGroup != "" {
+		if gid, err = lookupID(o.SocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return fmt.Errorf("invalid socket group: %w", err)
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupID returns the numeric ID of a user or group, given as is or by the
+// name lookup returns the ID of.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// listenSystemd returns the first socket passed by systemd socket
+// activation, see sd_listen_fds(3).
+func listenSystemd() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, errors.New("no socket was passed by systemd socket activation")
+	}
+	// The sockets are not passed on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds > 1 {
+		log.WithField("sockets", fds).Warn("Serving only the first socket passed by systemd")
+	}
+
+	f := os.NewFile(uintptr(sdListenFDsStart), "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// tcpListener sets TCP_NODELAY on the connections it accepts.
+type tcpListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		if err := c.SetNoDelay(l.noDelay); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// limitListener caps the number of open connections it accepted. Past the
+// cap, connections are accepted and closed right away so clients fail fast
+// rather than the process running out of file descriptors.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			log.WithFields(log.Fields{"remote": conn.RemoteAddr().String(), "max-connections": cap(l.slots)}).Warn("Rejecting connection, at capacity")
+			conn.Close()
+		}
+	}
+}
+
+// limitConn frees its limitListener slot once closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
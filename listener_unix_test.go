@@ -0,0 +1,111 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListen_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	l, err := listen("unix://"+path, listenerOptions{SocketMode: 0600, SocketGroup: strconv.Itoa(os.Getgid())})
+	assert.Nil(t, err)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeSocket|0600, fi.Mode())
+
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	conn.Close()
+
+	// A socket still in use is never replaced
+	_, err = listen("unix://"+path, listenerOptions{})
+	assert.EqualError(t, err, path+" is in use by another process")
+
+	// The socket is removed once closed
+	l.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, ioutil.WriteFile(path, nil, 0600))
+	_, err = listen("unix://"+path, listenerOptions{})
+	assert.EqualError(t, err, path+" exists and is not a unix socket")
+
+	_, err = listen("unix://", listenerOptions{})
+	assert.EqualError(t, err, "missing unix socket path")
+}
+
+func TestListen_StaleUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	// A socket left behind by a previous process is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.Nil(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix://"+path, listenerOptions{})
+	assert.Nil(t, err)
+	l.Close()
+}
+
+func TestListen_Systemd(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	assert.Nil(t, err)
+
+	defer func(start int) { sdListenFDsStart = start }(sdListenFDsStart)
+	sdListenFDsStart = fd
+	_, err = listen("systemd", listenerOptions{})
+	assert.EqualError(t, err, "no socket was passed by systemd socket activation")
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	l, err := listen("systemd", listenerOptions{})
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.Equal(t, tcp.Addr().String(), l.Addr().String())
+	assert.Equal(t, "", os.Getenv("LISTEN_PID"))
+	assert.Equal(t, "", os.Getenv("LISTEN_FDS"))
+}
@@ -17,9 +17,16 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"aws-sigv4-proxy/handler"
@@ -27,6 +34,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
@@ -35,30 +43,197 @@ import (
 )
 
 var (
-	debug                  = kingpin.Flag("verbose", "enable additional logging").Short('v').Bool()
-	port                   = kingpin.Flag("port", "port to serve http on").Default(":8080").String()
-	strip                  = kingpin.Flag("strip", "Headers to strip from incoming request").Short('s').Strings()
-	roleArn                = kingpin.Flag("role-arn", "Amazon Resource Name (ARN) of the role to assume").String()
-	signingNameOverride    = kingpin.Flag("name", "AWS Service to sign for").String()
-	hostOverride           = kingpin.Flag("host", "Host to proxy to").String()
-	regionOverride         = kingpin.Flag("region", "AWS region to sign for").String()
-	disableSSLVerification = kingpin.Flag("no-verify-ssl", "Disable peer SSL certificate validation").Bool()
+	debug                   = kingpin.Flag("verbose", "enable additional logging").Short('v').Bool()
+	configFile              = kingpin.Flag("config", "JSON file of routes sending requests by host and path prefix to upstreams, each signed for its own service and region").String()
+	logFormat               = kingpin.Flag("log-format", "Format of the logs, text, json to also write a JSON access log record to stdout for every proxied request, or clf to write a Common Log Format line instead").Default("text").Enum("text", "json", "clf")
+	accessLogRedactHeaders  = kingpin.Flag("access-log-redact-header", "Request header whose value is redacted from --log-format json access log records").Default("Authorization", "Proxy-Authorization", "Cookie", "X-Amz-Security-Token").Strings()
+	accessLogRedactQuery    = kingpin.Flag("access-log-redact-query", "Query parameters whose values are redacted from the --log-format json and clf access logs, as exact names or regular expressions").Default("X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token").Strings()
+	checkConfig             = kingpin.Flag("check-config", "Validate the configuration, resolving credentials with --require-credentials, then exit without serving").Bool()
+	selfTest                = kingpin.Flag("self-test", "Sign a sample request at startup, and send it if --self-test-url is set, exiting if that fails").Bool()
+	selfTestURL             = kingpin.Flag("self-test-url", "URL of a harmless request sent by --self-test, e.g. https://sts.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15").String()
+	selfTestMethod          = kingpin.Flag("self-test-method", "Method of the --self-test request").Default("GET").String()
+	port                    = kingpin.Flag("port", "port to serve http on").Default(":8080").String()
+	listenAddr              = kingpin.Flag("listen", "Address to serve on instead of --port: unix:// followed by a socket path, or systemd for the socket passed by systemd socket activation").String()
+	listenSocketMode        = kingpin.Flag("listen-socket-mode", "Permissions of the --listen unix socket, in octal").Default("0660").String()
+	listenSocketUser        = kingpin.Flag("listen-socket-user", "User owning the --listen unix socket, by name or ID (default the proxy's)").String()
+	listenSocketGroup       = kingpin.Flag("listen-socket-group", "Group owning the --listen unix socket, by name or ID (default the proxy's)").String()
+	healthResponseBody      = kingpin.Flag("health-response-body", "Body of /health responses").String()
+	healthResponseStatus    = kingpin.Flag("health-response-status", "Status code of /health responses").Default("200").Int()
+	tcpNoDelay              = kingpin.Flag("tcp-nodelay", "Set TCP_NODELAY on client connections, disabling Nagle's algorithm (use --no-tcp-nodelay to enable it)").Default("true").Bool()
+	tcpKeepAlivePeriod      = kingpin.Flag("tcp-keepalive-period", "TCP keep-alive period of client connections (0 for Go's default, negative to disable)").Default("0s").Duration()
+	maxConnections          = kingpin.Flag("max-connections", "Maximum number of open client connections, further connections are closed right away (0 for unlimited)").Default("0").Int()
+	shutdownDelay           = kingpin.Flag("shutdown-delay", "How long /health and /ready fail on SIGTERM before new connections are refused, for load balancers to stop routing to the proxy").Default("0s").Duration()
+	shutdownGracePeriod     = kingpin.Flag("shutdown-grace-period", "How long in-flight requests may take to complete on SIGTERM before their connections are closed").Default("30s").Duration()
+	strip                   = kingpin.Flag("strip", "Headers to strip from incoming request").Short('s').Strings()
+	setHeaders              = kingpin.Flag("set-header", "Header set on upstream requests before signing, replacing the client's, e.g. x-amz-acl=private (repeatable)").PlaceHolder("NAME=VALUE").StringMap()
+	setResponseHeaders      = kingpin.Flag("set-response-header", "Header set on responses, replacing the upstream's (repeatable)").PlaceHolder("NAME=VALUE").StringMap()
+	rewriteResponseHeaders  = kingpin.Flag("rewrite-response-header", "Rewrite the parts of a response header matching a regular expression, e.g. 'Location=^https://[^/]+/=/'").PlaceHolder("NAME=PATTERN=REPLACEMENT").Strings()
+	removeResponseHeaders   = kingpin.Flag("remove-response-header", "Header to remove from responses").Strings()
+	signedHeaders           = kingpin.Flag("signed-header", "Incoming headers to include in the signature, in addition to host and x-amz-* headers set by the signer").Strings()
+	signWhenHeader          = kingpin.Flag("sign-when-header", "Only sign requests carrying this marker header, optionally with a value, e.g. X-Sign=true; others are forwarded unsigned to --unsigned-upstream").String()
+	unsignedUpstream        = kingpin.Flag("unsigned-upstream", "URL requests without the --sign-when-header marker are forwarded to, unsigned").String()
+	mirrorTo                = kingpin.Flag("mirror-to", "Upstream URL to send a signed copy of every signed request to, discarding its response").String()
+	mirrorMaxBodySize       = kingpin.Flag("mirror-max-body-size", "Largest request body, in bytes, copied to --mirror-to (0 for no limit)").Default("1048576").Int64()
+	mirrorMaxInFlight       = kingpin.Flag("mirror-max-in-flight", "Most copies sent to --mirror-to at once, further ones being dropped (0 for no limit)").Default("64").Int()
+	mirrorTimeout           = kingpin.Flag("mirror-timeout", "How long a copy sent to --mirror-to may take (0 for no limit)").Default("30s").Duration()
+	stripQuery              = kingpin.Flag("strip-query", "Query parameters to strip from incoming request, as exact names or regular expressions").Strings()
+	rewritePaths            = kingpin.Flag("rewrite-path", "Rewrite request paths matching a prefix or regular expression before signing, e.g. /objects/=/my-bucket/ or '/v1/(.*)=/prod/$1'").Strings()
+	credentialSource        = kingpin.Flag("credential-source", "Where AWS credentials come from: auto for the SDK's chain, also handling SSO profiles and refreshing web identity tokens ahead of expiry, or only env, shared, process, sso, web-identity, ec2 or ecs").Default("auto").Enum(credentialSources...)
+	roleArn                 = kingpin.Flag("role-arn", "Amazon Resource Name (ARN) of the role to assume").String()
+	roleSessionDuration     = kingpin.Flag("role-session-duration", "Duration of the sessions of assumed roles, between 15m and 12h and at most the role's maximum (0 for the default of 15m)").Default("0s").Duration()
+	tenantHeader            = kingpin.Flag("tenant-header", "Trusted header naming the tenant of each request, signed with the tenant's --tenant-role and never forwarded").String()
+	tenantRoles             = kingpin.Flag("tenant-role", "Role to assume for a tenant named by --tenant-header, e.g. team-a=arn:aws:iam::123456789012:role/team-a").PlaceHolder("TENANT=ROLE_ARN").StringMap()
+	allowedRoleARNs         = kingpin.Flag("allowed-role-arn", "Role requests may be signed as by naming it in an X-Assume-Role-Arn header, wildcards such as arn:aws:iam::123456789012:role/app-* are supported").Strings()
+	signingNameOverride     = kingpin.Flag("name", "AWS Service to sign for").String()
+	hostOverride            = kingpin.Flag("host", "Host to proxy to").String()
+	regionOverride          = kingpin.Flag("region", "AWS region to sign for").String()
+	defaultRegionForGlobal  = kingpin.Flag("default-region-for-global", "AWS region to sign for when the host carries none, e.g. global services (canonically us-east-1); unlike --region it never replaces a detected region").String()
+	endpointSuffixes        = kingpin.Flag("endpoint-suffix", "Custom DNS suffix routing to AWS services, stripped from the host to determine the service and region, e.g. aws.corp.example.com (repeatable)").Strings()
+	s3VirtualHostSuffix     = kingpin.Flag("s3-virtual-host-suffix", "Host whose subdomains name S3 buckets, e.g. localhost for my-bucket.localhost:8080, sent to the bucket's virtual-hosted endpoint; the host itself is sent to path-style S3").String()
+	s3Region                = kingpin.Flag("s3-region", "Region of the buckets of --s3-virtual-host-suffix").Default("us-east-1").String()
+	s3PathStyle             = kingpin.Flag("s3-path-style", "Address the buckets of --s3-virtual-host-suffix path-style upstream, as buckets with dots always are").Bool()
+	signingNameAliases      = kingpin.Flag("signing-name-alias", "Sign for another name than the one detected, e.g. api.ecr=ecr (repeatable)").StringMap()
+	deriveFromIncomingAuth  = kingpin.Flag("derive-from-incoming-auth", "Sign for the service and region found in the credential scope of an incoming SigV4 signature, replacing that signature").Bool()
+	echoSigningInfo         = kingpin.Flag("echo-signing-info", "Add the service and region each request was signed for to its response, in X-Sigv4-Proxy-Service and X-Sigv4-Proxy-Region headers").Bool()
+	exposeUpstreamTiming    = kingpin.Flag("expose-upstream-timing", "Add how long the upstream took to respond to responses, in the X-Upstream-Duration-Ms header").Bool()
+	logErrorBodies          = kingpin.Flag("log-error-bodies", "Log the start of the body of non-2xx upstream responses").Bool()
+	normalizePath           = kingpin.Flag("normalize-path", "Remove dot segments and duplicate slashes from paths before signing, except for s3").Bool()
+	trailingSlash           = kingpin.Flag("trailing-slash", "Keep, strip or add the trailing slash of paths before signing, except for s3").Default("keep").Enum("keep", "strip", "add")
+	signVersion             = kingpin.Flag("sign-version", "Signature algorithm, auto signs multi-region hosts such as S3 Multi-Region Access Points with sigv4a and others with sigv4").Default("auto").Enum("auto", "sigv4", "sigv4a")
+	followRedirects         = kingpin.Flag("follow-redirects", "Follow 307 and 308 redirects to other endpoints of the same service, e.g. S3 bucket region redirects, signing requests again for them").Bool()
+	maxRedirects            = kingpin.Flag("max-redirects", "Most redirects followed for a request with --follow-redirects").Default("3").Int()
+	headAsGet               = kingpin.Flag("head-as-get", "Send HEAD requests upstream as GET, returning only the response headers to the client").Bool()
+	echoRequestHeaders      = kingpin.Flag("echo-request-header", "Request header to copy onto the response, e.g. X-Trace-Id (repeatable)").Strings()
+	requiredHeaders         = kingpin.Flag("require-header", "Header every request must carry, requests without it are rejected with 400 (repeatable)").Strings()
+	allowedMethods          = kingpin.Flag("allowed-method", "Method requests may use, others are rejected with 405, all methods are allowed by default (repeatable)").Strings()
+	maxURLLength            = kingpin.Flag("max-url-length", "Longest path and query, in bytes, of proxied requests, longer ones are rejected with 414 (0 for no limit)").Default("16384").Int()
+	maxRequestBodySize      = kingpin.Flag("max-request-body-size", "Largest request body, in bytes, larger ones are rejected with 413 (0 for no limit)").Default("0").Int64()
+	maxResponseBodySize     = kingpin.Flag("max-response-body-size", "Largest response body buffered, in bytes, larger ones are answered with 502; streamed responses are not limited (0 for no limit)").Default("0").Int64()
+	shedLatencyTarget       = kingpin.Flag("shed-latency-target", "P99 upstream latency above which requests are shed with 503 (0 to never shed)").Default("0s").Duration()
+	shedAggressiveness      = kingpin.Flag("shed-aggressiveness", "Share of requests shed per multiple of --shed-latency-target the P99 latency exceeds it by").Default("1").Float64()
+	maxInFlight             = kingpin.Flag("max-in-flight", "Most requests proxied at the same time, others are rejected with 429 (0 for no limit)").Default("0").Int()
+	maxInFlightWait         = kingpin.Flag("max-in-flight-wait", "Longest a request over --max-in-flight waits for another to complete before being rejected").Default("0s").Duration()
+	rateLimit               = kingpin.Flag("rate-limit", "Requests per second each client may make, others are rejected with 429 (0 for no limit)").Default("0").Float64()
+	rateLimitBurst          = kingpin.Flag("rate-limit-burst", "Requests each client may make at once on top of --rate-limit").Default("1").Int()
+	rateLimitKey            = kingpin.Flag("rate-limit-key", "What tells clients apart for --rate-limit: ip, the /64 network for IPv6, or identity for the API key or JWT subject, falling back to the IP").Default("ip").Enum("ip", "identity")
+	allowedUpstreamHosts    = kingpin.Flag("allowed-upstream-host", "Upstream hosts requests may be proxied to, wildcards such as *.amazonaws.com are supported (default all)").Strings()
+	requireUpstreamTLS      = kingpin.Flag("require-upstream-tls", "Refuse to send signed requests to upstreams over plaintext http, except to --plaintext-upstream-host").Bool()
+	plaintextUpstreamHosts  = kingpin.Flag("plaintext-upstream-host", "Upstream host signed requests may be sent to over http with --require-upstream-tls, e.g. localhost:4566 for LocalStack, wildcards are supported").Strings()
+	costTags                = kingpin.Flag("cost-tag", "Copy a trusted incoming header into a signed outgoing header, e.g. x-tenant-id=x-amz-meta-tenant").StringMap()
+	costTagValues           = kingpin.Flag("cost-tag-value", "Values a --cost-tag header may carry, wildcards such as team-* are supported").Strings()
+	forwardClientCert       = kingpin.Flag("forward-client-cert", "Add the subject and SANs of the verified client certificate as signed X-Client-Cert-Subject and X-Client-Cert-San headers").Bool()
+	preserveAuthorizationAs = kingpin.Flag("preserve-authorization-as", "Header to forward the client's Authorization header as, e.g. X-Original-Authorization, it is dropped otherwise").String()
+	disableSSLVerification  = kingpin.Flag("no-verify-ssl", "Disable peer SSL certificate validation").Bool()
+	upstreamForceHTTP1      = kingpin.Flag("upstream-force-http1", "Disable HTTP/2 and always use HTTP/1.1 for upstream connections").Bool()
+	upstreamTLSMinVersion   = kingpin.Flag("upstream-tls-min-version", "Minimum TLS version for upstream connections (1.0, 1.1, 1.2 or 1.3)").Default("1.2").String()
+	upstreamMaxIdlePerHost  = kingpin.Flag("upstream-max-idle-conns-per-host", "Maximum idle connections kept per upstream host (0 for Go's default of 2)").Default("0").Int()
+	upstreamMaxConnsPerHost = kingpin.Flag("upstream-max-conns-per-host", "Maximum connections per upstream host, including in use ones (0 for unlimited)").Default("0").Int()
+	upstreamMaxIdleConns    = kingpin.Flag("upstream-max-idle-conns", "Maximum idle upstream connections kept across all hosts (0 for Go's default of 100)").Default("0").Int()
+	upstreamDialTimeout     = kingpin.Flag("upstream-dial-timeout", "Timeout for connecting to upstreams, failing with 504 (0 for Go's default of 30s)").Default("0s").Duration()
+	upstreamTLSTimeout      = kingpin.Flag("upstream-tls-handshake-timeout", "Timeout for the TLS handshake with upstreams, failing with 504 (0 for Go's default of 10s)").Default("0s").Duration()
+	upstreamHeaderTimeout   = kingpin.Flag("upstream-response-header-timeout", "Timeout for the response headers of upstreams once a request was sent, failing with 504 (0 for none)").Default("0s").Duration()
+	upstreamIdleConnTimeout = kingpin.Flag("upstream-idle-conn-timeout", "How long idle upstream connections are kept before being closed, below the upstream's own timeout (0 for Go's default of 90s)").Default("0s").Duration()
+	upstreamNoKeepAlives    = kingpin.Flag("upstream-disable-keep-alives", "Use a new upstream connection for every request").Bool()
+	dnsCacheTTL             = kingpin.Flag("dns-cache-ttl", "How long the addresses of upstream hosts are cached, refreshing them in the background once expired (0 to resolve on every new connection)").Default("0s").Duration()
+	upstreamRetryStaleConns = kingpin.Flag("upstream-retry-stale-conns", "Retry a GET, HEAD, OPTIONS or TRACE request, or one with an Idempotency-Key header, once on a new connection when its reused upstream connection was closed (use --no-upstream-retry-stale-conns to disable)").Default("true").Bool()
+	retryMaxAttempts        = kingpin.Flag("retry-max-attempts", "Times a request is sent, the first included, when it fails to reach the upstream or gets a --retry-status (1 to never retry)").Default("1").Int()
+	retryMaxElapsed         = kingpin.Flag("retry-max-elapsed", "Time since a request was received past which it is not retried anymore (0 for no limit)").Default("30s").Duration()
+	retryBaseDelay          = kingpin.Flag("retry-base-delay", "Delay before the first retry, doubled for every following one, of which a random share is waited").Default("100ms").Duration()
+	retryMaxDelay           = kingpin.Flag("retry-max-delay", "Maximum delay between retries, unless the upstream asks for more with Retry-After").Default("5s").Duration()
+	retryStatuses           = kingpin.Flag("retry-status", "Response status retried with --retry-max-attempts").Default("429", "500", "502", "503", "504").Ints()
+	cacheTTL                = kingpin.Flag("cache-ttl", "How long GET and HEAD responses are cached, less if the upstream asks for it (0 to disable the cache)").Default("0s").Duration()
+	cacheMaxSize            = kingpin.Flag("cache-max-size", "Bytes of responses held by the cache, in memory or in --cache-dir, before the least recently used are evicted").Default("67108864").Int64()
+	cacheMaxEntrySize       = kingpin.Flag("cache-max-entry-size", "Largest response body cached, in bytes (0 for no limit)").Default("1048576").Int64()
+	cacheDir                = kingpin.Flag("cache-dir", "Directory cached responses are kept in instead of memory, e.g. one shared by several proxies").String()
+	cacheBypassHeader       = kingpin.Flag("cache-bypass-header", "Request header making a request bypass the cache and refresh it, like Cache-Control: no-cache, never forwarded").String()
+	requireCredentials      = kingpin.Flag("require-credentials", "Exit at startup if no AWS credentials can be resolved").Bool()
+	refreshJitter           = kingpin.Flag("refresh-jitter", "Refresh expiring credentials up to this long, at most half of their lifetime, before they expire, picked at random to spread refreshes across proxies").Default("0s").Duration()
+	refreshMinInterval      = kingpin.Flag("refresh-min-interval", "Minimum time between credential refresh attempts, including failed ones").Default("0s").Duration()
+	credentialsWarnAt       = kingpin.Flag("credentials-warn-threshold", "Log a warning once the AWS credentials expire in less than this long (0 to never warn)").Default("0s").Duration()
+	refreshAhead            = kingpin.Flag("refresh-ahead", "Refresh expiring credentials in the background this long before they expire, so requests never wait for or fail on a refresh (0 to refresh them when requests need them)").Default("5m").Duration()
+	requireIMDSv2           = kingpin.Flag("imds-v2-only", "Only retrieve credentials from the EC2 instance metadata service with IMDSv2 session tokens, never falling back to IMDSv1").Bool()
+	upstreamTimeout         = kingpin.Flag("upstream-timeout", "Timeout for upstream requests, including reading the response (0 for none)").Default("0s").Duration()
+	upgradeIdleTimeout      = kingpin.Flag("upgrade-idle-timeout", "How long connections switched to another protocol, e.g. WebSockets, may go without data either way before they are closed (0 for none)").Default("10m").Duration()
+	serviceTimeouts         = kingpin.Flag("upstream-timeout-service", "Upstream timeout override for a service, e.g. ssm=30s").StringMap()
+	serviceEndpoints        = kingpin.Flag("endpoint", "Upstream URL for a service, still signed for that service, e.g. sqs=http://localstack:4566").StringMap()
+	serviceCredentials      = kingpin.Flag("service-credentials", "Credentials to sign a service's requests with instead of the default ones, e.g. sqs=accessKey:secretKey[:sessionToken] or sqs=profile:name").PlaceHolder("SERVICE=CREDENTIALS").StringMap()
+	recomputeContentLength  = kingpin.Flag("recompute-content-length", "Forward requests whose body does not match their Content-Length with the actual length instead of rejecting them").Bool()
+	clientBodyTimeout       = kingpin.Flag("client-body-timeout", "Maximum time to receive a request body from the client before failing with 408 (0 for none)").Default("0s").Duration()
+	bodySpillThreshold      = kingpin.Flag("body-spill-threshold", "Request body size in bytes past which bodies are written to a temporary file rather than held in memory (0 to never spill)").Default("0").Int64()
+	bodySpillDir            = kingpin.Flag("body-spill-dir", "Directory for request bodies spilled to disk, the system temporary directory by default").String()
+	streamingSigning        = kingpin.Flag("enable-streaming-signing", "Relay S3 request bodies as they are received, signed chunk by chunk as aws-chunked, or unsigned when their length is unknown, instead of buffering them").Bool()
+	dryRun                  = kingpin.Flag("dry-run", "Answer every request with its canonical request, string to sign and signed headers as JSON instead of sending it upstream").Bool()
+	allowDebugHeader        = kingpin.Flag("allow-debug-header", "Answer requests carrying X-Sigv4Proxy-Debug: true as with --dry-run").Bool()
+	pprofAddr               = kingpin.Flag("pprof-addr", "Address to serve pprof profiling endpoints on, never exposed on the proxy port (disabled by default)").String()
+	metricsAddr             = kingpin.Flag("metrics-addr", "Address to serve Prometheus metrics on at /metrics, never exposed on the proxy port (disabled by default)").String()
+	enableTracing           = kingpin.Flag("enable-tracing", "Record a span for every proxied request, passed on to upstreams in traceparent, exported over OTLP/HTTP as JSON as set by the OTEL_* environment variables").Bool()
+	tlsCert                 = kingpin.Flag("tls-cert", "PEM certificate (chain) to serve HTTPS with on the proxy port, reloaded on SIGHUP or once the file changes").String()
+	tlsKey                  = kingpin.Flag("tls-key", "PEM private key of --tls-cert").String()
+	tlsClientCA             = kingpin.Flag("tls-client-ca", "PEM CA certificates client certificates must be signed by, requiring clients to present one").String()
+	tlsMinVersion           = kingpin.Flag("tls-min-version", "Minimum TLS version accepted from clients with --tls-cert (1.0, 1.1, 1.2 or 1.3)").Default("1.2").String()
+	enableHTTP2             = kingpin.Flag("enable-http2", "Serve HTTP/2 to clients, e.g. for gRPC, negotiated with --tls-cert or otherwise without TLS (h2c) to clients starting with it").Bool()
+	enableAdmin             = kingpin.Flag("enable-admin", "Serve the operator endpoints under /admin/ on the proxy port, authenticated with --admin-token, refused when signing for S3").Bool()
+	adminToken              = kingpin.Flag("admin-token", "Bearer token required by the /admin/ endpoints").Envar("AWS_SIGV4_PROXY_ADMIN_TOKEN").String()
+	adminAddr               = kingpin.Flag("admin-addr", "Address to serve the /admin/ endpoints on, apart from the proxy port, authenticated with --admin-token (disabled by default)").String()
+	authAPIKeyHeader        = kingpin.Flag("auth-api-key-header", "Header clients send their --auth-api-key in, never forwarded").Default("X-Api-Key").String()
+	authAPIKeys             = kingpin.Flag("auth-api-key", "API key clients must send in --auth-api-key-header before requests are signed").Envar("AWS_SIGV4_PROXY_API_KEYS").Strings()
+	authJWKSURL             = kingpin.Flag("auth-jwks-url", "URL of the JWKS the bearer JWT clients must send is verified against before requests are signed").String()
+	authJWTIssuer           = kingpin.Flag("auth-jwt-issuer", "Issuer (iss) bearer JWTs must have with --auth-jwks-url").String()
+	authJWTAudience         = kingpin.Flag("auth-jwt-audience", "Audience (aud) bearer JWTs must be meant for with --auth-jwks-url").String()
+	authAllowedCIDRs        = kingpin.Flag("auth-allowed-cidr", "CIDR clients must connect from before requests are signed, the connection's address is used and forwarding headers are not trusted").Strings()
+	auditWebhook            = kingpin.Flag("audit-webhook", "URL to POST a JSON audit event to for every proxied request").String()
+	auditBufferSize         = kingpin.Flag("audit-buffer-size", "Number of audit events buffered before new events are dropped").Default("1024").Int()
+	signingConcurrency      = kingpin.Flag("signing-concurrency", "Maximum number of requests signed concurrently (0 for unlimited)").Default("0").Int()
+	pinSigningTime          = kingpin.Flag("pin-signing-time", "Sign requests with the time they were received, reused when they are signed again while AWS accepts it").Bool()
+	compressResponses       = kingpin.Flag("compress-responses", "Gzip responses for clients accepting gzip, unless already encoded or streamed").Bool()
+	compressMinSize         = kingpin.Flag("compress-min-size", "Minimum response body size in bytes compressed by --compress-responses").Default("1024").Int()
+	compressRequests        = kingpin.Flag("compress-request", "Gzip request bodies before signing them, for services accepting gzip request bodies (CloudWatch metrics, OpenSearch)").Bool()
+	handleCORS              = kingpin.Flag("handle-cors", "Answer CORS preflight requests locally and add CORS headers to responses instead of forwarding OPTIONS requests").Bool()
+	corsAllowOrigins        = kingpin.Flag("cors-allow-origin", "Origins allowed by --handle-cors, * for any").Default("*").Strings()
+	corsAllowMethods        = kingpin.Flag("cors-allow-method", "Methods allowed by --handle-cors").Default("GET", "HEAD", "PUT", "POST", "DELETE", "PATCH").Strings()
+	corsAllowHeaders        = kingpin.Flag("cors-allow-header", "Request headers allowed by --handle-cors (default those requested by the browser)").Strings()
+	corsExposeHeaders       = kingpin.Flag("cors-expose-header", "Response headers browsers may read with --handle-cors").Strings()
+	corsMaxAge              = kingpin.Flag("cors-max-age", "How long browsers may cache preflight responses with --handle-cors (0 for their default)").Default("0s").Duration()
 )
 
+// fileCacheSweepInterval is how often expired and least recently used
+// entries are removed from --cache-dir.
+const fileCacheSweepInterval = time.Minute
+
 func main() {
-	kingpin.Parse()
+	args, err := expandEnvReferences(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kingpin.MustParse(kingpin.CommandLine.Parse(args))
 
 	log.SetLevel(log.InfoLevel)
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	if *logFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
 
 	sessionConfig := aws.Config{}
 	if v := os.Getenv("AWS_STS_REGIONAL_ENDPOINTS"); len(v) == 0 {
 		sessionConfig.STSRegionalEndpoint = endpoints.RegionalSTSEndpoint
 	}
 
-	session, err := session.NewSession(&sessionConfig)
+	// Configuration problems are collected, so all of them are reported at
+	// once, before anything is started
+	var problems []string
+	problem := func(err error) {
+		problems = append(problems, err.Error())
+	}
+
+	// Profiles of the shared config file are read too, e.g. for their
+	// credential_process
+	handlers := defaults.Handlers()
+	if *requireIMDSv2 {
+		handlers.Send.PushFrontNamed((&imdsV2Only{now: time.Now}).handler())
+	}
+	session, err := session.NewSessionWithOptions(session.Options{Config: sessionConfig, SharedConfigState: session.SharedConfigEnable, Handlers: handlers})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -78,32 +253,613 @@ func main() {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	// Roles are assumed with the credentials of the source
+	if creds, source, err := resolveCredentials(session, *credentialSource, os.LookupEnv); err != nil {
+		problem(fmt.Errorf("unable to use credential source %s: %v", *credentialSource, err))
+	} else {
+		log.WithField("source", source).Info("Selected credential source")
+		session.Config.Credentials = creds
+	}
+
 	var credentials *credentials.Credentials
 	if *roleArn != "" {
-		credentials = stscreds.NewCredentials(session, *roleArn, func(p *stscreds.AssumeRoleProvider) {
-			p.RoleSessionName = roleSessionName()
-		})
+		credentials = stscreds.NewCredentials(session, *roleArn, assumeRoleOptions(*roleSessionDuration))
 	} else {
 		credentials = session.Config.Credentials
 	}
 
+	var metrics *handler.Metrics
+	var onRefreshError []func(error)
+	if *metricsAddr != "" {
+		metrics = handler.NewMetrics()
+		onRefreshError = append(onRefreshError, metrics.CountRefreshFailure)
+	}
+	var admin *handler.Admin
+	if *enableAdmin || *adminAddr != "" {
+		admin = &handler.Admin{Token: *adminToken}
+		onRefreshError = append(onRefreshError, admin.RecordRefreshError)
+	}
+
+	if *refreshJitter > 0 || *refreshMinInterval > 0 || len(onRefreshError) > 0 {
+		credentials = handler.NewRefreshLimitedCredentials(credentials, *refreshJitter, *refreshMinInterval, onRefreshError...)
+	}
+
+	var refresher *handler.CredentialsRefresher
+	if *refreshAhead < 0 {
+		problem(fmt.Errorf("--refresh-ahead must not be negative"))
+	} else if *refreshAhead > 0 {
+		refresher = handler.NewCredentialsRefresher(credentials, *refreshAhead)
+		credentials = refresher.Credentials()
+	}
+
+	if metrics != nil {
+		metrics.CredentialsExpiry = handler.NewCredentialsExpiryWatcher(credentials, 0).SecondsUntilExpiry
+	}
+
+	if admin != nil {
+		admin.Credentials = credentials
+	}
+
+	// Credentials are resolved at startup to report the provider selected,
+	// check-config only does so with --require-credentials
+	if *requireCredentials || !*checkConfig {
+		value, err := credentials.Get()
+		switch {
+		case err == nil:
+			log.WithField("provider", value.ProviderName).Info("Resolved AWS credentials")
+		case *requireCredentials:
+			problem(fmt.Errorf("unable to resolve AWS credentials: %v", err))
+		default:
+			log.WithError(err).Warn("Unable to resolve AWS credentials yet, requests are rejected until they can be")
+		}
+	}
+
 	signer := v4.NewSigner(credentials)
 
+	stripQueryParameters, err := compileNamePatterns(*stripQuery)
+	if err != nil {
+		problem(err)
+	}
+
+	redactQueryParameters, err := compileNamePatterns(*accessLogRedactQuery)
+	if err != nil {
+		problem(err)
+	}
+
+	pathRewrites, err := parsePathRewrites(*rewritePaths)
+	if err != nil {
+		problem(err)
+	}
+
+	headerRewrites, err := parseHeaderRewrites(*rewriteResponseHeaders)
+	if err != nil {
+		problem(err)
+	}
+	headerRules, err := (&headerRulesConfig{
+		SetRequest:      *setHeaders,
+		SetResponse:     *setResponseHeaders,
+		RewriteResponse: headerRewrites,
+		RemoveResponse:  *removeResponseHeaders,
+	}).rules()
+	if err != nil {
+		problem(err)
+	}
+
+	upstreamServiceTimeouts, err := parseDurationMap(*serviceTimeouts)
+	if err != nil {
+		problem(err)
+	}
+
+	upstreamEndpoints, err := parseEndpointMap(*serviceEndpoints)
+	if err != nil {
+		problem(err)
+	}
+
+	var routes []handler.Route
+	if *configFile != "" {
+		if c, err := loadConfig(*configFile); err != nil {
+			problem(err)
+		} else if routes, err = c.routes(); err != nil {
+			problem(err)
+		}
+	}
+
+	if *roleArn != "" || len(*tenantRoles) > 0 || len(*allowedRoleARNs) > 0 {
+		if err := validateRoleSessionDuration(*roleSessionDuration, *refreshJitter); err != nil {
+			problem(err)
+		}
+	} else if *roleSessionDuration != 0 {
+		problem(errors.New("--role-session-duration requires --role-arn, --tenant-role or --allowed-role-arn"))
+	}
+
+	if *s3VirtualHostSuffix != "" && *hostOverride != "" {
+		problem(errors.New("--s3-virtual-host-suffix and --host cannot be set together"))
+	}
+
+	if (*tenantHeader == "") != (len(*tenantRoles) == 0) {
+		problem(errors.New("--tenant-header and --tenant-role must be set together"))
+	}
+	tenantSigners := make(map[string]*v4.Signer, len(*tenantRoles))
+	for tenant, arn := range *tenantRoles {
+		c := stscreds.NewCredentials(session, arn, assumeRoleOptions(*roleSessionDuration))
+		if *refreshJitter > 0 || *refreshMinInterval > 0 || len(onRefreshError) > 0 {
+			c = handler.NewRefreshLimitedCredentials(c, *refreshJitter, *refreshMinInterval, roleRefreshErrorHooks(arn, onRefreshError)...)
+		}
+		tenantSigners[tenant] = v4.NewSigner(c)
+	}
+
+	// Roles named by requests are only assumed once a request needs them
+	assumeRoleCredentials := roleCredentialsFunc(session, onRefreshError)
+	if len(*allowedRoleARNs) == 0 {
+		assumeRoleCredentials = nil
+	}
+
+	serviceSigners := map[string]*v4.Signer{}
+	if creds, err := parseServiceCredentials(*serviceCredentials); err != nil {
+		problem(err)
+	} else {
+		for name, c := range creds {
+			if *requireCredentials {
+				if _, err := c.Get(); err != nil {
+					problem(fmt.Errorf("unable to resolve AWS credentials for %s: %v", name, err))
+				}
+			}
+			log.WithField("service", name).Info("Signing with service specific credentials")
+			serviceSigners[name] = v4.NewSigner(c)
+		}
+	}
+
+	var unsignedUpstreamURL *url.URL
+	if *signWhenHeader != "" {
+		if unsignedUpstreamURL, err = parseUpstreamURL(*unsignedUpstream); err != nil {
+			problem(fmt.Errorf("--sign-when-header requires a valid --unsigned-upstream: %v", err))
+		}
+	}
+	signWhenHeaderName, signWhenHeaderValue := splitHeaderFlag(*signWhenHeader)
+
+	// Without a URL to send to, the self-test only signs a request for the
+	// proxied host
+	selfTestTarget := &url.URL{Scheme: "https", Host: "sts.amazonaws.com", Path: "/"}
+	if *hostOverride != "" {
+		selfTestTarget.Host = *hostOverride
+	}
+	if *selfTestURL != "" {
+		if selfTestTarget, err = parseUpstreamURL(*selfTestURL); err != nil {
+			problem(fmt.Errorf("invalid --self-test-url: %v", err))
+		}
+	}
+
+	var mirrorURL *url.URL
+	if *mirrorTo != "" {
+		if mirrorURL, err = parseUpstreamURL(*mirrorTo); err != nil {
+			problem(fmt.Errorf("invalid --mirror-to: %v", err))
+		}
+	}
+
+	upstreamTLSVersion, err := parseTLSVersion(*upstreamTLSMinVersion)
+	if err != nil {
+		problem(err)
+	}
+
+	if *healthResponseStatus < 100 || *healthResponseStatus > 599 {
+		problem(fmt.Errorf("invalid --health-response-status %d", *healthResponseStatus))
+	}
+
+	if len(*costTags) > 0 && len(*costTagValues) == 0 {
+		problem(errors.New("--cost-tag requires at least one --cost-tag-value"))
+	}
+
+	if *shedLatencyTarget > 0 && *shedAggressiveness <= 0 {
+		problem(fmt.Errorf("invalid --shed-aggressiveness %v, must be positive", *shedAggressiveness))
+	}
+
+	if *maxInFlight < 0 {
+		problem(fmt.Errorf("invalid --max-in-flight %d, must not be negative", *maxInFlight))
+	}
+
+	if *rateLimit < 0 {
+		problem(fmt.Errorf("invalid --rate-limit %v, must not be negative", *rateLimit))
+	}
+
+	if *rateLimit > 0 && *rateLimitBurst < 1 {
+		problem(fmt.Errorf("invalid --rate-limit-burst %d, must be at least 1", *rateLimitBurst))
+	}
+
+	if *shutdownDelay < 0 || *shutdownGracePeriod < 0 {
+		problem(errors.New("--shutdown-delay and --shutdown-grace-period must not be negative"))
+	}
+
+	var certs *certReloader
+	var listenerTLSVersion uint16
+	if *tlsCert != "" || *tlsKey != "" {
+		if certs, err = newCertReloader(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			problem(err)
+		}
+		if listenerTLSVersion, err = parseTLSVersion(*tlsMinVersion); err != nil {
+			problem(fmt.Errorf("invalid --tls-min-version: %v", err))
+		}
+	} else if *tlsClientCA != "" {
+		problem(errors.New("--tls-client-ca requires --tls-cert and --tls-key"))
+	}
+
+	if *enableHTTP2 && certs == nil && !h2cSupported {
+		problem(errors.New("--enable-http2 requires --tls-cert and --tls-key, serving HTTP/2 without TLS needs a build with Go 1.24 or later"))
+	}
+
+	var retry *handler.RetryPolicy
+	if *retryMaxAttempts > 1 {
+		retry = &handler.RetryPolicy{
+			MaxAttempts: *retryMaxAttempts,
+			MaxElapsed:  *retryMaxElapsed,
+			BaseDelay:   *retryBaseDelay,
+			MaxDelay:    *retryMaxDelay,
+			StatusCodes: *retryStatuses,
+		}
+	} else if *retryMaxAttempts < 1 {
+		problem(fmt.Errorf("invalid --retry-max-attempts %d, must be at least 1", *retryMaxAttempts))
+	}
+
+	var cache *handler.ResponseCache
+	var fileCache *handler.FileCacheStore
+	if *cacheTTL > 0 {
+		cache = &handler.ResponseCache{TTL: *cacheTTL, MaxEntrySize: *cacheMaxEntrySize, BypassHeader: *cacheBypassHeader}
+		if *cacheMaxSize <= 0 {
+			problem(fmt.Errorf("invalid --cache-max-size %d, must be positive", *cacheMaxSize))
+		} else if *cacheDir != "" {
+			if info, err := os.Stat(*cacheDir); err != nil || !info.IsDir() {
+				problem(fmt.Errorf("--cache-dir %s is not a directory", *cacheDir))
+			}
+			fileCache = &handler.FileCacheStore{Dir: *cacheDir, MaxBytes: *cacheMaxSize}
+			cache.Store = fileCache
+		} else {
+			cache.Store = handler.NewMemoryCacheStore(*cacheMaxSize)
+		}
+		if metrics != nil {
+			metrics.Cache = cache
+		}
+	}
+
+	serveAddr := *port
+	if *listenAddr != "" {
+		serveAddr = *listenAddr
+	}
+	socketMode, err := strconv.ParseUint(*listenSocketMode, 8, 32)
+	if err != nil || socketMode > 0777 {
+		problem(fmt.Errorf("invalid --listen-socket-mode %q, expected octal permissions such as 0660", *listenSocketMode))
+	}
+	if serveAddr == "unix://" {
+		problem(errors.New("--listen unix:// requires a socket path, e.g. unix:///var/run/aws-sigv4-proxy.sock"))
+	}
+
+	if *metricsAddr != "" && *metricsAddr == serveAddr {
+		problem(errors.New("--metrics-addr must differ from --port"))
+	}
+	if *adminAddr != "" && (*adminAddr == serveAddr || *adminAddr == *metricsAddr) {
+		problem(errors.New("--admin-addr must differ from --port and --metrics-addr"))
+	}
+	// Path-style requests name the bucket in the first path segment
+	signsS3 := proxiesS3(*signingNameOverride, *hostOverride, *s3VirtualHostSuffix)
+	for _, route := range routes {
+		signsS3 = signsS3 || proxiesS3(route.Service, route.Upstream.Host, "")
+	}
+	if signsS3 && *enableAdmin {
+		problem(errors.New("--enable-admin would shadow the S3 bucket named admin on the proxy port, serve the admin endpoints on --admin-addr instead"))
+	}
+
+	var tracing tracingConfig
+	if *enableTracing {
+		if tracing, err = tracingConfigFromEnv(os.LookupEnv); err != nil {
+			problem(err)
+		}
+	}
+
+	var authenticators []handler.Authenticator
+	if len(*authAllowedCIDRs) > 0 {
+		if allowed, err := parseCIDRs(*authAllowedCIDRs); err != nil {
+			problem(err)
+		} else {
+			authenticators = append(authenticators, &handler.CIDRAuth{Allowed: allowed})
+		}
+	}
+	if len(*authAPIKeys) > 0 {
+		authenticators = append(authenticators, &handler.APIKeyAuth{Header: *authAPIKeyHeader, Keys: *authAPIKeys})
+	}
+	if *authJWKSURL != "" {
+		if _, err := parseUpstreamURL(*authJWKSURL); err != nil {
+			problem(fmt.Errorf("invalid --auth-jwks-url: %v", err))
+		}
+		authenticators = append(authenticators, handler.NewJWTAuth(*authJWKSURL, *authJWTIssuer, *authJWTAudience, &http.Client{Timeout: 10 * time.Second}))
+	} else if *authJWTIssuer != "" || *authJWTAudience != "" {
+		problem(errors.New("--auth-jwt-issuer and --auth-jwt-audience require --auth-jwks-url"))
+	}
+
+	if admin != nil && *adminToken == "" {
+		problem(errors.New("--enable-admin and --admin-addr require --admin-token or AWS_SIGV4_PROXY_ADMIN_TOKEN"))
+	}
+
+	if *checkConfig {
+		for _, p := range problems {
+			log.Error(p)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("Configuration is invalid, %d problem(s) found", len(problems))
+		}
+		log.Info("Configuration is valid")
+		return
+	}
+	if len(problems) > 0 {
+		log.Fatal(strings.Join(problems, "; "))
+	}
+
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+
+	if metrics != nil {
+		go serveMetrics(*metricsAddr, metrics)
+	}
+
+	if refresher != nil {
+		go refresher.Run(credentialsRefreshInterval)
+	}
+
+	if fileCache != nil {
+		go fileCache.Run(fileCacheSweepInterval)
+	}
+
+	if *credentialsWarnAt > 0 {
+		go handler.NewCredentialsExpiryWatcher(credentials, *credentialsWarnAt).Run(time.Second)
+	}
+
 	log.WithFields(log.Fields{"StripHeaders": *strip}).Infof("Stripping headers %s", *strip)
-	log.WithFields(log.Fields{"port": *port}).Infof("Listening on %s", *port)
-
-	log.Fatal(
-		http.ListenAndServe(*port, &handler.Handler{
-			ProxyClient: &handler.ProxyClient{
-				Signer:              signer,
-				Client:              http.DefaultClient,
-				StripRequestHeaders: *strip,
-				SigningNameOverride: *signingNameOverride,
-				HostOverride:        *hostOverride,
-				RegionOverride:      *regionOverride,
-			},
-		}),
-	)
+	log.WithFields(log.Fields{"port": serveAddr}).Infof("Listening on %s", serveAddr)
+
+	var transport http.RoundTripper = newTransport(transportOptions{
+		ForceHTTP1:          *upstreamForceHTTP1,
+		MaxIdleConnsPerHost: *upstreamMaxIdlePerHost,
+		MaxConnsPerHost:     *upstreamMaxConnsPerHost,
+		TLSMinVersion:       upstreamTLSVersion,
+		IdleConnTimeout:     *upstreamIdleConnTimeout,
+		DisableKeepAlives:   *upstreamNoKeepAlives,
+		MaxIdleConns:        *upstreamMaxIdleConns,
+		DNSCacheTTL:         *dnsCacheTTL,
+
+		DialTimeout:           *upstreamDialTimeout,
+		TLSHandshakeTimeout:   *upstreamTLSTimeout,
+		ResponseHeaderTimeout: *upstreamHeaderTimeout,
+	})
+	if *upstreamRetryStaleConns {
+		transport = &staleConnRetrier{RoundTripper: transport}
+	}
+
+	upstreamClient := newUpstreamClient(transport, *followRedirects)
+
+	h := &handler.Handler{
+		Authenticators: authenticators,
+		ProxyClient: &handler.ProxyClient{
+			Signer:                 signer,
+			Client:                 upstreamClient,
+			StripRequestHeaders:    *strip,
+			StripQueryParameters:   stripQueryParameters,
+			PathRewrites:           pathRewrites,
+			HeaderRules:            headerRules,
+			SignedHeaders:          *signedHeaders,
+			DeriveFromIncomingAuth: *deriveFromIncomingAuth,
+			SigningNameOverride:    *signingNameOverride,
+			HostOverride:           *hostOverride,
+			RegionOverride:         *regionOverride,
+			DefaultRegionForGlobal: *defaultRegionForGlobal,
+			EndpointSuffixes:       *endpointSuffixes,
+			S3VirtualHostSuffix:    *s3VirtualHostSuffix,
+			S3Region:               *s3Region,
+			S3PathStyle:            *s3PathStyle,
+			SigningNameAliases:     *signingNameAliases,
+			SignWhenHeader:         signWhenHeaderName,
+			SignWhenHeaderValue:    signWhenHeaderValue,
+			UnsignedUpstream:       unsignedUpstreamURL,
+			MirrorUpstream:         mirrorURL,
+			MirrorMaxBodySize:      *mirrorMaxBodySize,
+			MirrorMaxInFlight:      *mirrorMaxInFlight,
+			MirrorTimeout:          *mirrorTimeout,
+			AllowedUpstreamHosts:   *allowedUpstreamHosts,
+			RequireUpstreamTLS:     *requireUpstreamTLS,
+			PlaintextUpstreamHosts: *plaintextUpstreamHosts,
+			CostTagHeaders:         *costTags,
+			CostTagValues:          *costTagValues,
+			ForwardClientCert:      *forwardClientCert,
+			ForwardAuthorizationAs: *preserveAuthorizationAs,
+			UpstreamTimeout:        *upstreamTimeout,
+			ServiceTimeouts:        upstreamServiceTimeouts,
+			Endpoints:              upstreamEndpoints,
+			ServiceSigners:         serviceSigners,
+			TenantHeader:           *tenantHeader,
+			TenantSigners:          tenantSigners,
+			AssumeRoleCredentials:  assumeRoleCredentials,
+			AllowedRoleARNs:        *allowedRoleARNs,
+			RecomputeContentLength: *recomputeContentLength,
+			ClientBodyTimeout:      *clientBodyTimeout,
+			BodySpillThreshold:     *bodySpillThreshold,
+			BodySpillDir:           *bodySpillDir,
+			StreamingSigning:       *streamingSigning,
+			DryRun:                 *dryRun,
+			AllowDebugHeader:       *allowDebugHeader,
+			Retry:                  retry,
+			Cache:                  cache,
+			SigningConcurrency:     *signingConcurrency,
+			PinSigningTime:         *pinSigningTime,
+			LogErrorBodies:         *logErrorBodies,
+			HeadAsGet:              *headAsGet,
+			FollowRedirects:        *followRedirects,
+			MaxRedirects:           *maxRedirects,
+			NormalizePath:          *normalizePath,
+			TrailingSlash:          trailingSlashPolicy(*trailingSlash),
+			SignVersion:            signVersionFlag(*signVersion),
+			Routes:                 routes,
+			CompressRequests:       *compressRequests,
+		},
+		EchoSigningInfo:      *echoSigningInfo,
+		ExposeUpstreamTiming: *exposeUpstreamTiming,
+		EchoRequestHeaders:   *echoRequestHeaders,
+		RequiredHeaders:      *requiredHeaders,
+		AllowedMethods:       upperCase(*allowedMethods),
+		MaxURLLength:         *maxURLLength,
+		MaxRequestBodySize:   *maxRequestBodySize,
+		MaxResponseBodySize:  *maxResponseBodySize,
+		HealthResponseBody:   *healthResponseBody,
+		HealthResponseStatus: *healthResponseStatus,
+		DisableReady:         signsS3,
+		CompressResponses:    *compressResponses,
+		CompressMinSize:      *compressMinSize,
+		Metrics:              metrics,
+		UpgradeIdleTimeout:   *upgradeIdleTimeout,
+	}
+
+	if *logFormat == "clf" {
+		h.AccessLog = os.Stdout
+		h.AccessLogRedactQuery = redactQueryParameters
+	}
+	if *logFormat == "json" {
+		// API keys are never logged either
+		redactHeaders := *accessLogRedactHeaders
+		if len(*authAPIKeys) > 0 {
+			redactHeaders = append(redactHeaders, *authAPIKeyHeader)
+		}
+		h.JSONAccessLog = &handler.JSONAccessLog{Writer: os.Stdout, RedactHeaders: redactHeaders, RedactQuery: redactQueryParameters}
+	}
+
+	if *auditWebhook != "" {
+		log.WithField("audit-webhook", *auditWebhook).Info("Sending audit events")
+		h.AuditWebhook = handler.NewAuditWebhook(*auditWebhook, &http.Client{Timeout: 10 * time.Second}, *auditBufferSize)
+	}
+
+	if *enableTracing && !tracing.Disabled {
+		log.WithFields(log.Fields{"endpoint": tracing.Endpoint, "service": tracing.ServiceName}).Info("Exporting traces")
+		h.Tracer = tracing.tracer()
+	}
+
+	if *shedLatencyTarget > 0 {
+		log.WithFields(log.Fields{"target": *shedLatencyTarget, "aggressiveness": *shedAggressiveness}).Info("Shedding load on high upstream latency")
+		h.LoadShedder = handler.NewLoadShedder(*shedLatencyTarget, *shedAggressiveness)
+	}
+
+	if *maxInFlight > 0 {
+		log.WithFields(log.Fields{"max": *maxInFlight, "wait": *maxInFlightWait}).Info("Limiting requests in flight")
+		h.ConcurrencyLimiter = handler.NewConcurrencyLimiter(*maxInFlight, *maxInFlightWait)
+	}
+
+	if *rateLimit > 0 {
+		log.WithFields(log.Fields{"rate": *rateLimit, "burst": *rateLimitBurst, "key": *rateLimitKey}).Info("Rate limiting clients")
+		h.RateLimiter = handler.NewRateLimiter(*rateLimit, *rateLimitBurst)
+		h.RateLimitByIdentity = *rateLimitKey == "identity"
+	}
+
+	if metrics != nil && mirrorURL != nil {
+		metrics.MirrorsDropped = h.ProxyClient.(*handler.ProxyClient).MirrorsDropped
+	}
+
+	if metrics != nil && h.AuditWebhook != nil {
+		metrics.AuditDropped = h.AuditWebhook.Dropped
+		metrics.AuditFailed = h.AuditWebhook.Failed
+	}
+
+	if admin != nil {
+		proxyClient := h.ProxyClient.(*handler.ProxyClient)
+		admin.Proxy = proxyClient
+		if *configFile != "" {
+			admin.Reload = func() error { return reloadConfig(*configFile, proxyClient) }
+		}
+		if *enableAdmin {
+			h.Admin = admin
+		}
+		if *adminAddr != "" {
+			go serveAdmin(*adminAddr, admin, h)
+		}
+	}
+
+	if *handleCORS {
+		h.CORS = &handler.CORS{
+			AllowOrigins:  *corsAllowOrigins,
+			AllowMethods:  *corsAllowMethods,
+			AllowHeaders:  *corsAllowHeaders,
+			ExposeHeaders: *corsExposeHeaders,
+			MaxAge:        *corsMaxAge,
+		}
+	}
+
+	if *selfTest {
+		if err := h.ProxyClient.(*handler.ProxyClient).SelfTest(strings.ToUpper(*selfTestMethod), selfTestTarget, *selfTestURL != ""); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	handleDrainSignal(h)
+	handleReloadCredentialsSignal(credentials)
+
+	listener, err := listen(serveAddr, listenerOptions{
+		NoDelay:         *tcpNoDelay,
+		KeepAlivePeriod: *tcpKeepAlivePeriod,
+		MaxConnections:  *maxConnections,
+		SocketMode:      os.FileMode(socketMode),
+		SocketUser:      *listenSocketUser,
+		SocketGroup:     *listenSocketGroup,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if certs != nil {
+		handleReloadTLSSignal(certs)
+		go certs.Watch(certReloadInterval)
+		listener = tls.NewListener(listener, certs.tlsConfig(listenerTLSVersion, *enableHTTP2))
+	}
+
+	server := &http.Server{Handler: h}
+	if *enableHTTP2 && certs == nil {
+		log.Info("Serving HTTP/2 without TLS")
+		enableH2C(server)
+	}
+	stopped := handleShutdownSignal(server, h, upstreamClient, shutdownOptions{
+		Delay:       *shutdownDelay,
+		GracePeriod: *shutdownGracePeriod,
+	})
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// servePprof serves the runtime profiling endpoints on their own listener so
+// they are never reachable through the proxy port.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.WithFields(log.Fields{"pprof-addr": addr}).Warnf("Serving pprof on %s, only expose it to trusted networks", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// serveMetrics serves the Prometheus metrics on their own listener, like
+// servePprof.
+func serveMetrics(addr string, metrics *handler.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	log.WithFields(log.Fields{"metrics-addr": addr}).Infof("Serving metrics on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// serveAdmin serves the admin endpoints on their own listener, like
+// servePprof, along with the /ready endpoint of h.
+func serveAdmin(addr string, admin *handler.Admin, h *handler.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", admin)
+	mux.HandleFunc("/ready", h.ServeReady)
+
+	log.WithFields(log.Fields{"admin-addr": addr}).Infof("Serving admin endpoints on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
 }
 
 func roleSessionName() string {
@@ -116,3 +872,291 @@ func roleSessionName() string {
 
 	return "aws-sigv4-proxy-" + suffix
 }
+
+// assumeRoleOptions configures the sessions of an assumed role, keeping the
+// SDK's default duration when duration is zero.
+func assumeRoleOptions(duration time.Duration) func(*stscreds.AssumeRoleProvider) {
+	return func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = roleSessionName()
+		if duration != 0 {
+			p.Duration = duration
+		}
+	}
+}
+
+// roleCredentialsFunc returns a function assuming a role with sess, with an
+// external ID when not empty, refreshed as the flags configure and reporting
+// failures to refresh them to onRefreshError.
+func roleCredentialsFunc(sess *session.Session, onRefreshError []func(error)) func(arn, externalID string) *credentials.Credentials {
+	return func(arn, externalID string) *credentials.Credentials {
+		options := assumeRoleOptions(*roleSessionDuration)
+		c := stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {
+			options(p)
+			if externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+		if *refreshJitter > 0 || *refreshMinInterval > 0 || len(onRefreshError) > 0 {
+			c = handler.NewRefreshLimitedCredentials(c, *refreshJitter, *refreshMinInterval, roleRefreshErrorHooks(arn, onRefreshError)...)
+		}
+		return c
+	}
+}
+
+// roleRefreshErrorHooks returns hooks passing the failures to refresh the
+// credentials of the role arn to hooks, naming the role.
+func roleRefreshErrorHooks(arn string, hooks []func(error)) []func(error) {
+	wrapped := make([]func(error), len(hooks))
+	for i, hook := range hooks {
+		hook := hook
+		wrapped[i] = func(err error) { hook(fmt.Errorf("role %s: %w", arn, err)) }
+	}
+	return wrapped
+}
+
+// validateRoleSessionDuration checks duration against the bounds AssumeRole
+// accepts, and that credentials lasting that long are not refreshed on every
+// request because of refreshJitter.
+func validateRoleSessionDuration(duration, refreshJitter time.Duration) error {
+	if duration == 0 {
+		duration = stscreds.DefaultDuration
+	} else if duration < 15*time.Minute || duration > 12*time.Hour {
+		return fmt.Errorf("--role-session-duration must be between 15m and 12h, got %v", duration)
+	}
+	if refreshJitter >= duration {
+		return fmt.Errorf("--refresh-jitter of %v must be shorter than the role session duration of %v", refreshJitter, duration)
+	}
+	return nil
+}
+
+// compileNamePatterns compiles each pattern into an expression that must
+// match a name in full, so plain names only match themselves.
+func compileNamePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// parseCIDRs parses the values of the --auth-allowed-cidr flag, a single
+// address standing for itself.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parsePathRewrites parses the values of the --rewrite-path flag,
+// from=to, where from must match the start of a path.
+func parsePathRewrites(values []string) ([]handler.PathRewrite, error) {
+	var rewrites []handler.PathRewrite
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected from=to", v)
+		}
+		re, err := regexp.Compile("^(?:" + v[:i] + ")")
+		if err != nil {
+			return nil, fmt.Errorf("invalid path rewrite %q: %v", v, err)
+		}
+		rewrites = append(rewrites, handler.PathRewrite{Pattern: re, Replacement: v[i+1:]})
+	}
+	return rewrites, nil
+}
+
+// parseHeaderRewrites parses the values of the --rewrite-response-header
+// flag, name=pattern=replacement, where the pattern ends at its first =.
+func parseHeaderRewrites(values []string) ([]headerRewriteConfig, error) {
+	var rewrites []headerRewriteConfig
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid response header rewrite %q, expected name=pattern=replacement", v)
+		}
+		rewrites = append(rewrites, headerRewriteConfig{Name: parts[0], Pattern: parts[1], Replacement: parts[2]})
+	}
+	return rewrites, nil
+}
+
+// parseDurationMap parses the values of a key=duration flag.
+func parseDurationMap(values map[string]string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(values))
+	for k, v := range values {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %v", k, err)
+		}
+		durations[k] = d
+	}
+	return durations, nil
+}
+
+// credentialsStatusFields returns the log fields describing status.
+func credentialsStatusFields(status handler.CredentialsStatus) log.Fields {
+	fields := log.Fields{"provider": status.Provider, "expiry": "static"}
+	if !status.Expiry.IsZero() {
+		fields["expiry"] = status.Expiry.Format(time.RFC3339)
+	}
+	return fields
+}
+
+// parseEndpointMap parses the values of a service=url flag.
+func parseEndpointMap(values map[string]string) (map[string]*url.URL, error) {
+	parsed := make(map[string]*url.URL, len(values))
+	for k, v := range values {
+		u, err := parseUpstreamURL(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint for %s: %v", k, err)
+		}
+		parsed[k] = u
+	}
+	return parsed, nil
+}
+
+// trailingSlashPolicy returns the policy named by the --trailing-slash flag.
+func trailingSlashPolicy(name string) handler.TrailingSlashPolicy {
+	if name == "keep" {
+		return handler.TrailingSlashKeep
+	}
+	return handler.TrailingSlashPolicy(name)
+}
+
+// signVersionFlag returns the version named by the --sign-version flag.
+func signVersionFlag(name string) handler.SignVersion {
+	if name == "auto" {
+		return handler.SignVersionAuto
+	}
+	return handler.SignVersion(name)
+}
+
+// parseServiceCredentials parses the values of a service=credentials flag,
+// static keys as accessKey:secretKey[:sessionToken] or a shared config
+// profile as profile:name. Errors never include the keys.
+func parseServiceCredentials(values map[string]string) (map[string]*credentials.Credentials, error) {
+	parsed := make(map[string]*credentials.Credentials, len(values))
+	for k, v := range values {
+		if profile := strings.TrimPrefix(v, "profile:"); profile != v && profile != "" {
+			parsed[k] = credentials.NewSharedCredentials("", profile)
+			continue
+		}
+		parts := strings.Split(v, ":")
+		if (len(parts) != 2 && len(parts) != 3) || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid credentials for %s, expected accessKey:secretKey[:sessionToken] or profile:name", k)
+		}
+		token := ""
+		if len(parts) == 3 {
+			token = parts[2]
+		}
+		parsed[k] = credentials.NewStaticCredentials(parts[0], parts[1], token)
+	}
+	return parsed, nil
+}
+
+// newUpstreamClient returns the client sending signed requests upstream.
+// With followRedirects, redirects are returned for the ProxyClient to follow
+// and sign again, which the client cannot do, they are otherwise followed by
+// the client as usual.
+func newUpstreamClient(transport http.RoundTripper, followRedirects bool) *http.Client {
+	client := &http.Client{Transport: transport}
+	if followRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// proxiesS3 reports whether the proxy signs requests for S3, given the
+// --name, --host and --s3-virtual-host-suffix flags.
+func proxiesS3(signingName, host, s3VirtualHostSuffix string) bool {
+	if signingName == "s3" || s3VirtualHostSuffix != "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "s3" || strings.HasPrefix(label, "s3-") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUpstreamURL parses an absolute http(s) URL.
+func parseUpstreamURL(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http(s) URL", v)
+	}
+	return u, nil
+}
+
+// envReference matches the ${VAR} references expanded in arguments, and the
+// $${VAR} escapes kept as ${VAR}.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvReferences replaces the ${VAR} references in args with the value
+// of the variable, as returned by lookup. $${VAR} is replaced with ${VAR},
+// for the named groups of regular expression replacements, other uses of $
+// are kept as is, a reference to an unset variable is an error.
+func expandEnvReferences(args []string, lookup func(string) (string, bool)) ([]string, error) {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		var err error
+		expanded[i] = envReference.ReplaceAllStringFunc(arg, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			name := envReference.FindStringSubmatch(ref)[1]
+			v, ok := lookup(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s referenced in %q is not set", name, arg)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// upperCase returns values in upper case.
+func upperCase(values []string) []string {
+	upper := make([]string, len(values))
+	for i, v := range values {
+		upper[i] = strings.ToUpper(v)
+	}
+	return upper
+}
+
+// splitHeaderFlag splits a name[=value] header flag.
+func splitHeaderFlag(v string) (string, string) {
+	if i := strings.Index(v, "="); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
@@ -0,0 +1,1691 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	t.Run("keeps HTTP/2 enabled by default", func(t *testing.T) {
+		transport := newTransport(transportOptions{})
+
+		assert.True(t, transport.ForceAttemptHTTP2)
+		assert.Nil(t, transport.TLSNextProto)
+	})
+
+	t.Run("pins upstream connections to HTTP/1.1", func(t *testing.T) {
+		transport := newTransport(transportOptions{ForceHTTP1: true})
+
+		assert.False(t, transport.ForceAttemptHTTP2)
+		assert.NotNil(t, transport.TLSNextProto)
+		assert.Empty(t, transport.TLSNextProto)
+	})
+
+	t.Run("sets per host connection limits", func(t *testing.T) {
+		transport := newTransport(transportOptions{MaxIdleConnsPerHost: 32, MaxConnsPerHost: 64})
+
+		assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, 64, transport.MaxConnsPerHost)
+	})
+
+	t.Run("keeps Go defaults for connection limits", func(t *testing.T) {
+		transport := newTransport(transportOptions{})
+
+		assert.Equal(t, 0, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, 0, transport.MaxConnsPerHost)
+	})
+
+	t.Run("sets idle connection management", func(t *testing.T) {
+		transport := newTransport(transportOptions{IdleConnTimeout: 20 * time.Second, DisableKeepAlives: true})
+
+		assert.Equal(t, 20*time.Second, transport.IdleConnTimeout)
+		assert.True(t, transport.DisableKeepAlives)
+	})
+
+	t.Run("keeps Go defaults for idle connections", func(t *testing.T) {
+		transport := newTransport(transportOptions{})
+
+		assert.Equal(t, http.DefaultTransport.(*http.Transport).IdleConnTimeout, transport.IdleConnTimeout)
+		assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, transport.MaxIdleConns)
+		assert.False(t, transport.DisableKeepAlives)
+	})
+
+	t.Run("sets timeouts", func(t *testing.T) {
+		transport := newTransport(transportOptions{MaxIdleConns: 500, TLSHandshakeTimeout: 3 * time.Second, ResponseHeaderTimeout: 5 * time.Second})
+
+		assert.Equal(t, 500, transport.MaxIdleConns)
+		assert.Equal(t, 3*time.Second, transport.TLSHandshakeTimeout)
+		assert.Equal(t, 5*time.Second, transport.ResponseHeaderTimeout)
+	})
+
+	t.Run("keeps Go defaults for timeouts", func(t *testing.T) {
+		transport := newTransport(transportOptions{})
+
+		assert.Equal(t, http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+		assert.Equal(t, time.Duration(0), transport.ResponseHeaderTimeout)
+	})
+}
+
+// serveClosingIdleConns serves HTTP/1.1 on l, closing the first connection
+// without responding to its second request, like an upstream closing an idle
+// keep-alive connection the client is reusing. It sends the bodies of the
+// requests it responds to on bodies.
+func serveClosingIdleConns(l net.Listener, bodies chan<- string) {
+	for n := 0; ; n++ {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(n int, conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for i := 0; ; i++ {
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				if n == 0 && i == 1 {
+					return
+				}
+				bodies <- string(body)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}
+		}(n, conn)
+	}
+}
+
+func TestNewUpstreamClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/key" {
+			http.Redirect(w, r, "/moved/key", http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		followRedirects bool
+		wantStatus      int
+	}{
+		{followRedirects: false, wantStatus: http.StatusOK},
+		{followRedirects: true, wantStatus: http.StatusTemporaryRedirect},
+	} {
+		resp, err := newUpstreamClient(http.DefaultTransport, tt.followRedirects).Get(server.URL + "/bucket/key")
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode, "followRedirects: %v", tt.followRedirects)
+		}
+	}
+}
+
+func TestStaleConnRetrier(t *testing.T) {
+	send := func(client *http.Client, method, url string, header http.Header) (string, error) {
+		req, err := http.NewRequest(method, url, strings.NewReader("payload"))
+		if err != nil {
+			return "", err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	tests := []struct {
+		name        string
+		retry       bool
+		method      string
+		header      http.Header
+		wantRetried bool
+	}{
+		{
+			name:   "fails without the retrier",
+			method: http.MethodPut,
+		},
+		{
+			name:        "retries idempotent requests",
+			retry:       true,
+			method:      http.MethodGet,
+			wantRetried: true,
+		},
+		{
+			name:        "retries requests with an idempotency key",
+			retry:       true,
+			method:      http.MethodPost,
+			header:      http.Header{"Idempotency-Key": {"a1b2"}},
+			wantRetried: true,
+		},
+		{
+			name:   "does not replay other requests",
+			retry:  true,
+			method: http.MethodPost,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err)
+			defer l.Close()
+			bodies := make(chan string, 3)
+			go serveClosingIdleConns(l, bodies)
+
+			var transport http.RoundTripper = newTransport(transportOptions{})
+			if tt.retry {
+				transport = &staleConnRetrier{RoundTripper: transport}
+			}
+			client := &http.Client{Transport: transport}
+			url := "http://" + l.Addr().String() + "/"
+
+			body, err := send(client, tt.method, url, tt.header)
+			assert.Nil(t, err)
+			assert.Equal(t, "ok", body)
+			assert.Equal(t, "payload", <-bodies)
+
+			body, err = send(client, tt.method, url, tt.header)
+			if tt.wantRetried {
+				assert.Nil(t, err)
+				assert.Equal(t, "ok", body)
+				assert.Equal(t, "payload", <-bodies)
+			} else {
+				assert.NotNil(t, err)
+				assert.Len(t, bodies, 0)
+			}
+		})
+	}
+}
+
+// fakeResolver counts lookups and resolves every host to its current
+// addresses, blocking lookups while held.
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	lookups int
+	held    chan struct{}
+}
+
+func (r *fakeResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	held := r.held
+	r.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, nil
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestDNSCache(t *testing.T) {
+	newCache := func(resolver *fakeResolver, now *time.Time, mu *sync.Mutex) (*dnsCache, func() []string) {
+		cache := newDNSCache(time.Minute)
+		cache.lookup = resolver.lookup
+		cache.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return *now
+		}
+
+		var dialed []string
+		dial := cache.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, nil
+		})
+		return cache, func() []string {
+			_, err := dial(context.Background(), "tcp", "sqs.us-west-2.amazonaws.com:443")
+			assert.Nil(t, err)
+			return dialed
+		}
+	}
+
+	t.Run("repeated dials within the TTL hit the cache", func(t *testing.T) {
+		var mu sync.Mutex
+		now := time.Unix(0, 0)
+		resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+		_, dial := newCache(resolver, &now, &mu)
+
+		dial()
+		dial()
+		mu.Lock()
+		now = now.Add(59 * time.Second)
+		mu.Unlock()
+		dialed := dial()
+
+		assert.Equal(t, 1, resolver.count())
+		assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.1:443", "10.0.0.1:443"}, dialed)
+	})
+
+	t.Run("expired entries are refreshed in the background", func(t *testing.T) {
+		var mu sync.Mutex
+		now := time.Unix(0, 0)
+		resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+		cache, dial := newCache(resolver, &now, &mu)
+		dial()
+
+		held := make(chan struct{})
+		resolver.mu.Lock()
+		resolver.addrs = []string{"10.0.0.2"}
+		resolver.held = held
+		resolver.mu.Unlock()
+		mu.Lock()
+		now = now.Add(time.Minute)
+		mu.Unlock()
+
+		// The refresh is held, so these must not wait for it
+		dial()
+		dialed := dial()
+		assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.1:443", "10.0.0.1:443"}, dialed)
+
+		close(held)
+		var addrs []string
+		for i := 0; i < 100; i++ {
+			if addrs, _ = cache.resolve(context.Background(), "sqs.us-west-2.amazonaws.com"); addrs[0] == "10.0.0.2" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assert.Equal(t, 2, resolver.count())
+		assert.Equal(t, []string{"10.0.0.2"}, addrs)
+	})
+
+	t.Run("drops entries unused since they expired", func(t *testing.T) {
+		var mu sync.Mutex
+		now := time.Unix(0, 0)
+		resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+		cache, _ := newCache(resolver, &now, &mu)
+		cache.resolve(context.Background(), "sqs.us-west-2.amazonaws.com")
+		now = now.Add(time.Minute)
+		cache.resolve(context.Background(), "sns.us-west-2.amazonaws.com")
+
+		now = now.Add(time.Minute)
+		cache.resolve(context.Background(), "sts.amazonaws.com")
+		assert.Len(t, cache.entries, 2)
+		assert.NotContains(t, cache.entries, "sqs.us-west-2.amazonaws.com")
+	})
+
+	t.Run("dials the next address when one fails or hangs", func(t *testing.T) {
+		for _, hang := range []bool{false, true} {
+			cache := newDNSCache(time.Minute)
+			cache.lookup = (&fakeResolver{addrs: []string{"10.0.0.1", "10.0.0.2"}}).lookup
+			canceled := make(chan struct{})
+			server, client := net.Pipe()
+			dial := cache.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr == "10.0.0.2:443" {
+					return client, nil
+				}
+				if hang {
+					<-ctx.Done()
+					close(canceled)
+				}
+				return nil, errors.New("connection refused")
+			})
+
+			conn, err := dial(context.Background(), "tcp", "sqs.us-west-2.amazonaws.com:443")
+			assert.Nil(t, err)
+			assert.Equal(t, client, conn)
+			if hang {
+				<-canceled
+			}
+			server.Close()
+		}
+	})
+
+	t.Run("dials IP addresses directly", func(t *testing.T) {
+		resolver := &fakeResolver{}
+		cache := newDNSCache(time.Minute)
+		cache.lookup = resolver.lookup
+		dial := cache.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			assert.Equal(t, "127.0.0.1:8080", addr)
+			return nil, nil
+		})
+
+		_, err := dial(context.Background(), "tcp", "127.0.0.1:8080")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, resolver.count())
+	})
+}
+
+func TestNewTransport_TLSMinVersion(t *testing.T) {
+	transport := newTransport(transportOptions{TLSMinVersion: tls.VersionTLS13})
+
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"})
+	assert.Nil(t, err)
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "::1/128"}, got)
+
+	_, err = parseCIDRs([]string{"10.0.0.0/33"})
+	assert.EqualError(t, err, `invalid CIDR "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33`)
+}
+
+func TestParsePathRewrites(t *testing.T) {
+	rewrites, err := parsePathRewrites([]string{"/objects/=/my-bucket/", "/v1/(.*)=/prod/$1"})
+	assert.Nil(t, err)
+	if assert.Len(t, rewrites, 2) {
+		assert.Equal(t, "/my-bucket/foo", rewrites[0].Pattern.ReplaceAllString("/objects/foo", rewrites[0].Replacement))
+		assert.False(t, rewrites[0].Pattern.MatchString("/api/objects/foo"))
+		assert.Equal(t, "/prod/items", rewrites[1].Pattern.ReplaceAllString("/v1/items", rewrites[1].Replacement))
+	}
+
+	_, err = parsePathRewrites([]string{"/objects/"})
+	assert.NotNil(t, err)
+	_, err = parsePathRewrites([]string{"/objects/(=/x"})
+	assert.NotNil(t, err)
+}
+
+func TestParseHeaderRewrites(t *testing.T) {
+	rewrites, err := parseHeaderRewrites([]string{"Location=^https://[^/]+/=/", "Link=(a)=b=c"})
+	assert.Nil(t, err)
+	assert.Equal(t, []headerRewriteConfig{
+		{Name: "Location", Pattern: "^https://[^/]+/", Replacement: "/"},
+		{Name: "Link", Pattern: "(a)", Replacement: "b=c"},
+	}, rewrites)
+
+	for _, value := range []string{"Location", "Location=pattern", "=pattern=replacement"} {
+		_, err := parseHeaderRewrites([]string{value})
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestHeaderRulesConfig(t *testing.T) {
+	rules, err := (&headerRulesConfig{}).rules()
+	assert.Nil(t, err)
+	assert.Nil(t, rules)
+
+	rules, err = (&headerRulesConfig{
+		SetRequest:      map[string]string{"x-amz-acl": "private"},
+		RemoveRequest:   []string{"X-Debug"},
+		SetResponse:     map[string]string{"cache-control": "no-store"},
+		RewriteResponse: []headerRewriteConfig{{Name: "Location", Pattern: "^https://[^/]+/", Replacement: "/"}},
+		RemoveResponse:  []string{"Server"},
+	}).rules()
+	assert.Nil(t, err)
+	if assert.NotNil(t, rules) {
+		assert.Equal(t, http.Header{"X-Amz-Acl": {"private"}}, rules.SetRequestHeaders)
+		assert.Equal(t, []string{"X-Debug"}, rules.RemoveRequestHeaders)
+		assert.Equal(t, http.Header{"Cache-Control": {"no-store"}}, rules.SetResponseHeaders)
+		assert.Equal(t, "/key", rules.RewriteResponseHeaders[0].Pattern.ReplaceAllString("https://bucket.s3.amazonaws.com/key", "/"))
+		assert.Equal(t, []string{"Server"}, rules.RemoveResponseHeaders)
+	}
+
+	_, err = (&headerRulesConfig{SetRequest: map[string]string{"authorization": "Bearer x"}}).rules()
+	assert.EqualError(t, err, "cannot set request header Authorization, it is set when signing")
+	_, err = (&headerRulesConfig{RewriteResponse: []headerRewriteConfig{{Name: "Location", Pattern: "("}}}).rules()
+	assert.NotNil(t, err)
+}
+
+func TestParseServiceCredentials(t *testing.T) {
+	creds, err := parseServiceCredentials(map[string]string{
+		"sqs": "AKIDSQS:sqs-secret",
+		"sns": "AKIDSNS:sns-secret:sns-token",
+		"s3":  "profile:storage",
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, creds, 3) {
+		v, err := creds["sqs"].Get()
+		assert.Nil(t, err)
+		assert.Equal(t, credentials.Value{AccessKeyID: "AKIDSQS", SecretAccessKey: "sqs-secret", ProviderName: credentials.StaticProviderName}, v)
+
+		v, err = creds["sns"].Get()
+		assert.Nil(t, err)
+		assert.Equal(t, "sns-token", v.SessionToken)
+	}
+
+	for _, value := range []string{"AKIDSQS", "AKIDSQS:wJalrXUtnFEMI:token:extra", ":wJalrXUtnFEMI", "profile:"} {
+		_, err := parseServiceCredentials(map[string]string{"sqs": value})
+		if assert.NotNil(t, err, value) {
+			assert.NotContains(t, err.Error(), "AKIDSQS")
+			assert.NotContains(t, err.Error(), "wJalrXUtnFEMI")
+		}
+	}
+}
+
+// fakeAssumeRoler records the AssumeRole calls made for a role.
+type fakeAssumeRoler struct {
+	inputs []*sts.AssumeRoleInput
+}
+
+func (f *fakeAssumeRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("AKID"),
+		SecretAccessKey: aws.String("SECRET"),
+		SessionToken:    aws.String("TOKEN"),
+		Expiration:      aws.Time(time.Now().Add(time.Duration(*input.DurationSeconds) * time.Second)),
+	}}, nil
+}
+
+func TestAssumeRoleOptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		duration       time.Duration
+		expectDuration int64
+	}{
+		{name: "should pass the session duration to AssumeRole", duration: 2 * time.Hour, expectDuration: 7200},
+		{name: "should keep the SDK default without a duration", expectDuration: 900},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeAssumeRoler{}
+			creds := stscreds.NewCredentialsWithClient(client, "arn:aws:iam::123456789012:role/proxy", assumeRoleOptions(tt.duration))
+
+			_, err := creds.Get()
+			assert.Nil(t, err)
+
+			assert.Len(t, client.inputs, 1)
+			assert.Equal(t, tt.expectDuration, *client.inputs[0].DurationSeconds)
+			assert.Contains(t, *client.inputs[0].RoleSessionName, "aws-sigv4-proxy-")
+			expiresAt, err := creds.ExpiresAt()
+			assert.Nil(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Duration(tt.expectDuration)*time.Second), expiresAt, time.Minute)
+		})
+	}
+}
+
+func TestRoleCredentialsFunc_ReportsRefreshErrors(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized</Message></Error></ErrorResponse>`)
+	}))
+	defer sts.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(sts.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "secret", ""),
+	}))
+
+	var errs []error
+	creds := roleCredentialsFunc(sess, []func(error){func(err error) { errs = append(errs, err) }})("arn:aws:iam::123456789012:role/tenant", "")
+
+	_, err := creds.Get()
+	assert.NotNil(t, err)
+	if assert.Len(t, errs, 1) {
+		assert.True(t, strings.HasPrefix(errs[0].Error(), "role arn:aws:iam::123456789012:role/tenant: AccessDenied"), errs[0].Error())
+	}
+}
+
+func TestValidateRoleSessionDuration(t *testing.T) {
+	tests := []struct {
+		name          string
+		duration      time.Duration
+		refreshJitter time.Duration
+		expectErr     string
+	}{
+		{name: "should accept the default", duration: 0},
+		{name: "should accept the lower bound", duration: 15 * time.Minute},
+		{name: "should accept the upper bound", duration: 12 * time.Hour},
+		{name: "should reject durations under 15 minutes", duration: 10 * time.Minute, expectErr: "--role-session-duration must be between 15m and 12h, got 10m0s"},
+		{name: "should reject durations over 12 hours", duration: 13 * time.Hour, expectErr: "--role-session-duration must be between 15m and 12h, got 13h0m0s"},
+		{name: "should reject a refresh jitter of the whole session", duration: time.Hour, refreshJitter: time.Hour, expectErr: "--refresh-jitter of 1h0m0s must be shorter than the role session duration of 1h0m0s"},
+		{name: "should compare the refresh jitter with the default", refreshJitter: 20 * time.Minute, expectErr: "--refresh-jitter of 20m0s must be shorter than the role session duration of 15m0s"},
+		{name: "should accept a shorter refresh jitter", duration: time.Hour, refreshJitter: 20 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRoleSessionDuration(tt.duration, tt.refreshJitter)
+			if tt.expectErr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expectErr)
+			}
+		})
+	}
+}
+
+func TestProxiesS3(t *testing.T) {
+	tests := []struct {
+		signingName, host, s3VirtualHostSuffix string
+		want                                   bool
+	}{
+		{signingName: "s3", want: true},
+		{host: "s3.eu-west-1.amazonaws.com", want: true},
+		{host: "s3-us-west-2.amazonaws.com:443", want: true},
+		{host: "my-bucket.s3.amazonaws.com", want: true},
+		{s3VirtualHostSuffix: "localhost", want: true},
+		{host: "sqs.us-west-2.amazonaws.com", want: false},
+		{host: "s3proxy.internal", want: false},
+		{want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, proxiesS3(tt.signingName, tt.host, tt.s3VirtualHostSuffix), "%+v", tt)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantRoutes int
+		wantErr    string
+	}{
+		{
+			name: "loads routes",
+			content: `{"routes": [
+				{"host": "search.local", "upstream": "https://search-logs.us-east-1.es.amazonaws.com", "service": "es", "region": "us-east-1"},
+				{"path_prefix": "/s3", "strip_prefix": true, "upstream": "https://s3.eu-central-1.amazonaws.com", "profile": "storage",
+				 "headers": {"set_request": {"x-amz-server-side-encryption": "aws:kms"}, "remove_response": ["Server"]}}
+			]}`,
+			wantRoutes: 2,
+		},
+		{
+			name:    "rejects invalid header rules",
+			content: `{"routes": [{"upstream": "https://sqs.us-west-2.amazonaws.com", "headers": {"set_request": {"Host": "example.com"}}}]}`,
+			wantErr: "invalid headers of route 1: cannot set request header Host, it is set when signing",
+		},
+		{
+			name:    "rejects unknown fields",
+			content: `{"routes": [{"hots": "search.local", "upstream": "https://sqs.us-west-2.amazonaws.com"}]}`,
+			wantErr: `json: unknown field "hots"`,
+		},
+		{
+			name:    "rejects routes without an upstream",
+			content: `{"routes": [{"host": "search.local"}]}`,
+			wantErr: `invalid upstream of route 1: "" is not an absolute http(s) URL`,
+		},
+		{
+			name:    "rejects routes whose service cannot be determined",
+			content: `{"routes": [{"host": "search.local", "upstream": "https://search.internal"}]}`,
+			wantErr: "invalid route 1: unable to determine service from upstream search.internal, set the service and region of the route",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "config-*.json")
+			assert.Nil(t, err)
+			defer os.Remove(f.Name())
+			f.WriteString(tt.content)
+			f.Close()
+
+			var routes []handler.Route
+			c, err := loadConfig(f.Name())
+			if err == nil {
+				routes, err = c.routes()
+			}
+
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, routes, tt.wantRoutes)
+			assert.Nil(t, routes[0].Signer)
+			assert.NotNil(t, routes[1].Signer)
+			assert.True(t, routes[1].StripPrefix)
+			assert.Nil(t, routes[0].HeaderRules)
+			if assert.NotNil(t, routes[1].HeaderRules) {
+				assert.Equal(t, []string{"Server"}, routes[1].HeaderRules.RemoveResponseHeaders)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ProfileFromSharedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	process := filepath.Join(dir, "credentials.sh")
+	assert.Nil(t, ioutil.WriteFile(process, []byte("#!/bin/sh\necho '{\"Version\": 1, \"AccessKeyId\": \"AKIDSTORAGE\", \"SecretAccessKey\": \"secret\"}'\n"), 0700))
+	configFile := filepath.Join(dir, "config")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("[profile storage]\ncredential_process = "+process+"\n"), 0600))
+	for name, value := range map[string]string{"AWS_CONFIG_FILE": configFile, "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials")} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	c := &config{Routes: []routeConfig{{PathPrefix: "/s3", Upstream: "https://s3.eu-central-1.amazonaws.com", Profile: "storage"}}}
+	routes, err := c.routes()
+	assert.Nil(t, err)
+	if assert.Len(t, routes, 1) && assert.NotNil(t, routes[0].Signer) {
+		// The profile only exists in the shared config file
+		v, err := routes[0].Signer.Credentials.Get()
+		assert.Nil(t, err)
+		assert.Equal(t, "AKIDSTORAGE", v.AccessKeyID)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config-*.json")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"routes": [{"host": "search.local", "upstream": "https://search-logs.us-east-1.es.amazonaws.com", "service": "es", "region": "us-east-1"}]}`)
+	f.Close()
+
+	p := &handler.ProxyClient{}
+	assert.Nil(t, reloadConfig(f.Name(), p))
+	if assert.Len(t, p.Routes, 1) {
+		assert.Equal(t, "search.local", p.Routes[0].Host)
+	}
+
+	// Invalid configurations leave the routes as they are
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(`{"routes": [{"host": "search.local"}]}`), 0600))
+	assert.NotNil(t, reloadConfig(f.Name(), p))
+	assert.Len(t, p.Routes, 1)
+}
+
+func TestExpandEnvReferences(t *testing.T) {
+	env := map[string]string{"TARGET_HOST": "sqs.us-west-2.amazonaws.com", "REGION": "us-west-2", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "expands set variables",
+			args: []string{"--host=${TARGET_HOST}", "--region", "${REGION}", "--role-session-name=proxy-${REGION}-${REGION}"},
+			want: []string{"--host=sqs.us-west-2.amazonaws.com", "--region", "us-west-2", "--role-session-name=proxy-us-west-2-us-west-2"},
+		},
+		{
+			name: "expands empty variables",
+			args: []string{"--name=${EMPTY}"},
+			want: []string{"--name="},
+		},
+		{
+			name: "keeps other uses of $",
+			args: []string{"--rewrite-path", "/v1/(.*)=/prod/$1", "--strip-query", "$REGION", "${}", "${1X}"},
+			want: []string{"--rewrite-path", "/v1/(.*)=/prod/$1", "--strip-query", "$REGION", "${}", "${1X}"},
+		},
+		{
+			name: "keeps escaped references",
+			args: []string{"--rewrite-path", "/v1/(?P<rest>.*)=/${REGION}/$${rest}", "--host=$${TARGET_HOST}"},
+			want: []string{"--rewrite-path", "/v1/(?P<rest>.*)=/us-west-2/${rest}", "--host=${TARGET_HOST}"},
+		},
+		{
+			name:    "fails on unset variables",
+			args:    []string{"--region", "${REGION}", "--host=${MISSING_HOST}"},
+			wantErr: `environment variable MISSING_HOST referenced in "--host=${MISSING_HOST}" is not set`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnvReferences(tt.args, lookup)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTracingConfigFromEnv(t *testing.T) {
+	defaults := tracingConfig{
+		Endpoint:    "http://localhost:4318/v1/traces",
+		Headers:     map[string]string{},
+		Timeout:     10 * time.Second,
+		ServiceName: "aws-sigv4-proxy",
+		SampleRatio: 1,
+		ParentBased: true,
+		QueueSize:   2048,
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    func(c *tracingConfig)
+		wantErr string
+	}{
+		{name: "defaults", want: func(c *tracingConfig) {}},
+		{
+			name: "configured",
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT":       "https://collector:4318/",
+				"OTEL_EXPORTER_OTLP_HEADERS":        "api-key=a%20b, tenant=one",
+				"OTEL_EXPORTER_OTLP_TRACES_HEADERS": "tenant=two",
+				"OTEL_EXPORTER_OTLP_TIMEOUT":        "2500",
+				"OTEL_EXPORTER_OTLP_PROTOCOL":       "http/json",
+				"OTEL_BSP_MAX_QUEUE_SIZE":           "16",
+				"OTEL_SERVICE_NAME":                 "s3-proxy",
+				"OTEL_TRACES_SAMPLER":               "traceidratio",
+				"OTEL_TRACES_SAMPLER_ARG":           "0.1",
+			},
+			want: func(c *tracingConfig) {
+				c.Endpoint = "https://collector:4318/v1/traces"
+				c.Headers = map[string]string{"api-key": "a b", "tenant": "two"}
+				c.Timeout = 2500 * time.Millisecond
+				c.QueueSize = 16
+				c.ServiceName = "s3-proxy"
+				c.SampleRatio = 0.1
+				c.ParentBased = false
+			},
+		},
+		{
+			name: "traces endpoint used as is",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://ignored:4318", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/custom"},
+			want: func(c *tracingConfig) { c.Endpoint = "http://collector:4318/custom" },
+		},
+		{
+			name: "parent based off",
+			env:  map[string]string{"OTEL_TRACES_SAMPLER": "parentbased_always_off"},
+			want: func(c *tracingConfig) { c.SampleRatio = 0 },
+		},
+		{name: "exporter none", env: map[string]string{"OTEL_TRACES_EXPORTER": "none"}, want: func(c *tracingConfig) { c.Disabled = true }},
+		{name: "sdk disabled", env: map[string]string{"OTEL_SDK_DISABLED": "true"}, want: func(c *tracingConfig) { c.Disabled = true }},
+		{name: "unsupported exporter", env: map[string]string{"OTEL_TRACES_EXPORTER": "zipkin"}, wantErr: `unsupported OTEL_TRACES_EXPORTER "zipkin", only otlp is supported`},
+		{name: "unsupported protocol", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "grpc"}, wantErr: `unsupported OTLP protocol "grpc", only http/json is supported`},
+		{name: "invalid endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "collector:4318"}, wantErr: `invalid OTLP endpoint "collector:4318"`},
+		{name: "invalid headers", env: map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "api-key"}, wantErr: `invalid OTEL_EXPORTER_OTLP_HEADERS: header is not a key=value pair: "api-key"`},
+		{name: "invalid timeout", env: map[string]string{"OTEL_EXPORTER_OTLP_TIMEOUT": "10s"}, wantErr: `invalid OTLP timeout "10s", milliseconds expected`},
+		{name: "invalid ratio", env: map[string]string{"OTEL_TRACES_SAMPLER": "traceidratio", "OTEL_TRACES_SAMPLER_ARG": "2"}, wantErr: `invalid OTEL_TRACES_SAMPLER_ARG "2", a ratio between 0 and 1 expected`},
+		{name: "unsupported sampler", env: map[string]string{"OTEL_TRACES_SAMPLER": "jaeger_remote"}, wantErr: `unsupported OTEL_TRACES_SAMPLER "jaeger_remote"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tracingConfigFromEnv(func(name string) (string, bool) {
+				v, ok := tt.env[name]
+				return v, ok
+			})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			want := defaults
+			want.Headers = map[string]string{}
+			tt.want(&want)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := parseTLSVersion("1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+
+	version, err = parseTLSVersion("1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	_, err = parseTLSVersion("TLS1.2")
+	assert.NotNil(t, err)
+}
+
+// noDelayConn records the TCP_NODELAY setting applied to it.
+type noDelayConn struct {
+	net.Conn
+	noDelay *bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = &noDelay
+	return nil
+}
+
+// connListener accepts a single preset connection.
+type connListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestTCPListener_SetsNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		conn := &noDelayConn{}
+		l := &tcpListener{Listener: &connListener{conn: conn}, noDelay: noDelay}
+
+		accepted, err := l.Accept()
+
+		assert.Nil(t, err)
+		assert.Equal(t, conn, accepted)
+		if assert.NotNil(t, conn.noDelay) {
+			assert.Equal(t, noDelay, *conn.noDelay)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := listen("127.0.0.1:0", listenerOptions{NoDelay: false, KeepAlivePeriod: -1})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	assert.IsType(t, &net.TCPConn{}, conn)
+	conn.Close()
+}
+
+func TestListen_MaxConnections(t *testing.T) {
+	l, err := listen("127.0.0.1:0", listenerOptions{NoDelay: true, MaxConnections: 2})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// dial connects to l and reports whether the connection was closed by
+	// the listener.
+	dial := func() (net.Conn, bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.Nil(t, err)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		return conn, err == io.EOF
+	}
+
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, closed := dial()
+		assert.False(t, closed)
+		open = append(open, conn, <-accepted)
+	}
+
+	conn, closed := dial()
+	assert.True(t, closed)
+	conn.Close()
+
+	// Closing an accepted connection frees its slot
+	open[1].Close()
+	conn, closed = dial()
+	assert.False(t, closed)
+	open = append(open, conn, <-accepted)
+
+	for _, conn := range open {
+		conn.Close()
+	}
+}
+
+// idleClosingTransport records its idle connections being closed.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed int32
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	atomic.StoreInt32(&t.closed, 1)
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		wantBody    string
+	}{
+		{
+			name:        "waits for in-flight requests",
+			gracePeriod: time.Minute,
+			wantBody:    "done",
+		},
+		{
+			name:        "closes connections past the grace period",
+			gracePeriod: 50 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err)
+			h := &handler.Handler{}
+			started, release := make(chan struct{}), make(chan struct{})
+			defer close(release)
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/upload" {
+					h.ServeHTTP(w, r)
+					return
+				}
+				close(started)
+				select {
+				case <-release:
+				case <-time.After(time.Second):
+				}
+				io.WriteString(w, "done")
+			})}
+			go server.Serve(l)
+			url := "http://" + l.Addr().String()
+
+			uploaded := make(chan string)
+			go func() {
+				resp, err := http.Get(url + "/upload")
+				if err != nil {
+					uploaded <- ""
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				uploaded <- string(body)
+			}()
+			<-started
+
+			transport := &idleClosingTransport{}
+			stopped := make(chan struct{})
+			go func() {
+				shutdown(server, h, &http.Client{Transport: transport}, shutdownOptions{Delay: 200 * time.Millisecond, GracePeriod: tt.gracePeriod})
+				close(stopped)
+			}()
+
+			// Health checks fail until new connections are refused
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			healthy := true
+			for start := time.Now(); healthy && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+				if resp, err := client.Get(url + "/health"); err == nil {
+					resp.Body.Close()
+					healthy = resp.StatusCode == http.StatusOK
+				}
+			}
+			assert.False(t, healthy)
+			refused := false
+			for start := time.Now(); !refused && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+				_, err := client.Get(url + "/health")
+				refused = err != nil
+			}
+			assert.True(t, refused)
+
+			if tt.wantBody != "" {
+				release <- struct{}{}
+			}
+			assert.Equal(t, tt.wantBody, <-uploaded)
+			<-stopped
+			assert.Equal(t, int32(1), atomic.LoadInt32(&transport.closed))
+		})
+	}
+}
+
+func TestLookupID(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "proxy" {
+			return "1000", nil
+		}
+		return "", errors.New("unknown user " + name)
+	}
+
+	id, err := lookupID("42", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, 42, id)
+	id, err = lookupID("proxy", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, id)
+	_, err = lookupID("nobody-here", lookup)
+	assert.NotNil(t, err)
+}
+
+// writeCert writes a certificate with serial, signed by parent and its key
+// if not nil, and its key as PEM files in dir, returning their paths and
+// the certificate.
+func writeCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert, key
+}
+
+// serveTLS serves the names of the verified client certificates with
+// config, returning the address.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go http.Serve(tls.NewListener(l, config), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chain := range r.TLS.VerifiedChains {
+			io.WriteString(w, chain[0].Subject.CommonName)
+		}
+	}))
+	return l.Addr().String()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _, _ := writeCert(t, dir, "proxy", 1, nil, nil)
+
+	certs, err := newCertReloader(certFile, keyFile, "")
+	assert.Nil(t, err)
+	addr := serveTLS(t, certs.tlsConfig(tls.VersionTLS12, false))
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), servedSerial())
+	assert.False(t, certs.changed())
+
+	// Rotated certificates are served once reloaded
+	writeCert(t, dir, "proxy", 2, nil, nil)
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future))
+	assert.True(t, certs.changed())
+	assert.Nil(t, certs.reload())
+	assert.False(t, certs.changed())
+	assert.Equal(t, int64(2), servedSerial())
+
+	// Invalid files keep the previous certificate
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	assert.NotNil(t, certs.reload())
+	assert.Equal(t, int64(2), servedSerial())
+
+	_, err = newCertReloader(certFile, "", "")
+	assert.EqualError(t, err, "--tls-cert and --tls-key must be set together")
+	_, err = newCertReloader(certFile, filepath.Join(dir, "missing.key"), "")
+	assert.NotNil(t, err)
+}
+
+func TestCertReloader_HTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _, _ := writeCert(t, dir, "proxy", 1, nil, nil)
+	certs, err := newCertReloader(certFile, keyFile, "")
+	assert.Nil(t, err)
+
+	for _, http2 := range []bool{false, true} {
+		addr := serveTLS(t, certs.tlsConfig(tls.VersionTLS12, http2))
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		assert.Nil(t, err)
+		want := "http/1.1"
+		if http2 {
+			want = "h2"
+		}
+		assert.Equal(t, want, conn.ConnectionState().NegotiatedProtocol)
+		conn.Close()
+	}
+}
+
+func TestCertReloader_ClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _, _ := writeCert(t, dir, "proxy", 1, nil, nil)
+	caFile, _, ca, caKey := writeCert(t, dir, "clients", 2, nil, nil)
+	clientCertFile, clientKeyFile, _, _ := writeCert(t, dir, "client", 3, ca, caKey)
+	otherCertFile, otherKeyFile, _, _ := writeCert(t, dir, "other", 4, nil, nil)
+
+	certs, err := newCertReloader(certFile, keyFile, caFile)
+	assert.Nil(t, err)
+	addr := serveTLS(t, certs.tlsConfig(tls.VersionTLS12, false))
+
+	get := func(certFile, keyFile string) (string, error) {
+		config := &tls.Config{InsecureSkipVerify: true}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			assert.Nil(t, err)
+			config.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	name, err := get(clientCertFile, clientKeyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", name)
+	_, err = get("", "")
+	assert.NotNil(t, err)
+	_, err = get(otherCertFile, otherKeyFile)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	assert.EqualError(t, certs.reload(), "no certificates found in --tls-client-ca "+caFile)
+}
+
+func TestParseINISection(t *testing.T) {
+	ini := []byte(`
+# comment
+[default]
+region = us-east-1
+
+[profile  dev]
+sso_start_url = https://example.awsapps.com/start
+; comment
+sso_region=eu-west-1
+credential_process = /usr/bin/creds --profile dev=x
+region = eu-west-1
+region = eu-west-2
+[profile devops]
+region = us-west-2
+`)
+
+	assert.Equal(t, map[string]string{"region": "us-east-1"}, parseINISection(ini, "default"))
+	assert.Equal(t, map[string]string{
+		"sso_start_url":      "https://example.awsapps.com/start",
+		"sso_region":         "eu-west-1",
+		"credential_process": "/usr/bin/creds --profile dev=x",
+		"region":             "eu-west-2",
+	}, parseINISection(ini, "profile dev"))
+	assert.Empty(t, parseINISection(ini, "profile missing"))
+}
+
+func TestLoadSharedProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aws")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config")
+	credentialsFile := filepath.Join(dir, "credentials")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("[default]\nregion = us-east-1\n[profile dev]\nregion = eu-west-1\ncredential_process = config\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(credentialsFile, []byte("[dev]\ncredential_process = credentials\n[profile dev]\nignored = true\n"), 0600))
+	env := map[string]string{"AWS_CONFIG_FILE": configFile, "AWS_SHARED_CREDENTIALS_FILE": credentialsFile}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	profile, err := loadSharedProfile("dev", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"region": "eu-west-1", "credential_process": "credentials"}, profile)
+
+	profile, err = loadSharedProfile("default", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"region": "us-east-1"}, profile)
+
+	// Missing files hold no profile
+	env["AWS_CONFIG_FILE"] = filepath.Join(dir, "missing")
+	profile, err = loadSharedProfile("default", lookup)
+	assert.Nil(t, err)
+	assert.Empty(t, profile)
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aws")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`[profile process]
+credential_process = echo '{"Version": 1, "AccessKeyId": "AKIDPROCESS", "SecretAccessKey": "secret"}'
+[profile sso]
+sso_start_url = https://example.awsapps.com/start
+sso_region = eu-west-1
+sso_account_id = 123456789012
+sso_role_name = ReadOnly
+[profile partial-sso]
+sso_start_url = https://example.awsapps.com/start
+`), 0600))
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials("AKIDDEFAULT", "secret", "")})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		source     string
+		env        map[string]string
+		wantSource string
+		wantKey    string
+		wantErr    string
+	}{
+		{name: "auto uses the SDK's chain", source: "auto", wantSource: "auto", wantKey: "AKIDDEFAULT"},
+		{name: "auto prefers keys of the environment", source: "auto", env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_WEB_IDENTITY_TOKEN_FILE": "/token"}, wantSource: "env", wantKey: "AKIDDEFAULT"},
+		{name: "auto picks web identity", source: "auto", env: map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": "/token", "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/proxy"}, wantSource: "web-identity"},
+		{name: "auto picks SSO profiles", source: "auto", env: map[string]string{"AWS_PROFILE": "sso"}, wantSource: "sso"},
+		{name: "env", source: "env", env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "secret"}, wantSource: "env", wantKey: "AKIDENV"},
+		{name: "process", source: "process", env: map[string]string{"AWS_PROFILE": "process"}, wantSource: "process", wantKey: "AKIDPROCESS"},
+		{name: "process without command", source: "process", wantErr: "profile default has no credential_process"},
+		{name: "incomplete SSO profile", source: "auto", env: map[string]string{"AWS_PROFILE": "partial-sso"}, wantErr: "profile partial-sso has no sso_region"},
+		{name: "web identity without token", source: "web-identity", wantErr: "web identity credentials require AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, or a profile with web_identity_token_file and role_arn"},
+		{name: "ecs", source: "ecs", env: map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/id"}, wantSource: "ecs"},
+		{name: "ecs without URI", source: "ecs", wantErr: "ECS credentials require AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI"},
+		{name: "ecs with EKS Pod Identity", source: "ecs", env: map[string]string{"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://169.254.170.23/v1/credentials", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": "/token"}, wantSource: "ecs"},
+		{name: "ecs with remote full URI", source: "ecs", env: map[string]string{"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://example.com/credentials"}, wantErr: "AWS_CONTAINER_CREDENTIALS_FULL_URI must use HTTPS or a loopback, ECS or EKS Pod Identity host, not http://example.com/credentials"},
+		{name: "auto picks container credentials", source: "auto", env: map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/id"}, wantSource: "ecs"},
+		{name: "ec2", source: "ec2", wantSource: "ec2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"AWS_CONFIG_FILE": configFile, "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials")}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+
+			creds, source, err := resolveCredentials(sess, tt.source, func(name string) (string, bool) {
+				v, ok := env[name]
+				return v, ok
+			})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantSource, source)
+			assert.NotNil(t, creds)
+			if tt.wantKey != "" {
+				if tt.source == "env" {
+					// The environment provider reads the process environment
+					os.Setenv("AWS_ACCESS_KEY_ID", tt.env["AWS_ACCESS_KEY_ID"])
+					os.Setenv("AWS_SECRET_ACCESS_KEY", tt.env["AWS_SECRET_ACCESS_KEY"])
+					defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+					defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+				}
+				v, err := creds.Get()
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantKey, v.AccessKeyID)
+			}
+		})
+	}
+}
+
+func TestValidateContainerCredentialsURI(t *testing.T) {
+	tests := []struct {
+		uri     string
+		wantErr bool
+	}{
+		{uri: "https://credentials.example.com/role"},
+		{uri: "http://127.0.0.1:8080/role"},
+		{uri: "http://[::1]/role"},
+		{uri: "http://localhost/role"},
+		{uri: "http://169.254.170.2/v2/credentials"},
+		{uri: "http://169.254.170.23/v1/credentials"},
+		{uri: "http://[fd00:ec2::23]/v1/credentials"},
+		{uri: "http://credentials.example.com/role", wantErr: true},
+		{uri: "http://10.0.0.1/role", wantErr: true},
+		{uri: "ftp://127.0.0.1/role", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			err := validateContainerCredentialsURI(tt.uri)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestResolveCredentials_ContainerTokenFile(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"AccessKeyId": "AKIDCONTAINER", "SecretAccessKey": "secret", "Token": "token", "Expiration": "2100-01-01T00:00:00Z"}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "token")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+
+	env := map[string]string{
+		"AWS_CONFIG_FILE":                        filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE":            filepath.Join(dir, "credentials"),
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "ignored",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": tokenFile,
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	assert.Nil(t, err)
+	creds, source, err := resolveCredentials(sess, "ecs", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "ecs", source)
+
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIDCONTAINER", v.AccessKeyID)
+	assert.Equal(t, "first", authorization)
+
+	// The rotated token is read again on the next retrieval
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("second"), 0600))
+	creds.Expire()
+	_, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", authorization)
+
+	assert.Nil(t, os.Remove(tokenFile))
+	creds.Expire()
+	_, err = creds.Get()
+	assert.NotNil(t, err)
+}
+
+func TestResolveCredentials_SharedReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aws")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	credentialsFile := filepath.Join(dir, "credentials")
+	assert.Nil(t, ioutil.WriteFile(credentialsFile, []byte("[default]\naws_access_key_id = AKIDFIRST\naws_secret_access_key = secret\n"), 0600))
+
+	env := map[string]string{
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	assert.Nil(t, err)
+	creds, _, err := resolveCredentials(sess, "shared", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	assert.Nil(t, err)
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIDFIRST", v.AccessKeyID)
+
+	// Rotated keys are read again on reloads, as on SIGUSR2
+	assert.Nil(t, ioutil.WriteFile(credentialsFile, []byte("[default]\naws_access_key_id = AKIDROTATED\naws_secret_access_key = secret\n"), 0600))
+	_, err = handler.ReloadCredentials(creds)
+	assert.Nil(t, err)
+	v, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIDROTATED", v.AccessKeyID)
+}
+
+func TestIMDSv2Only(t *testing.T) {
+	tests := []struct {
+		name      string
+		v2Only    bool
+		tokens    bool
+		wantErr   string
+		wantToken string
+	}{
+		{name: "IMDSv2", v2Only: true, tokens: true, wantToken: "token"},
+		{name: "IMDSv1 fallback", tokens: false},
+		{name: "IMDSv1 refused", v2Only: true, tokens: false, wantErr: "IMDSv2Unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotToken string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/latest/api/token" {
+					if !tt.tokens || r.Method != http.MethodPut || r.Header.Get(imdsTokenTTLHeader) == "" {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					w.Write([]byte("token"))
+					return
+				}
+				gotToken = r.Header.Get(imdsTokenHeader)
+				w.Write([]byte("proxy-role"))
+			}))
+			defer server.Close()
+
+			handlers := defaults.Handlers()
+			if tt.v2Only {
+				handlers.Send.PushFrontNamed((&imdsV2Only{now: time.Now}).handler())
+			}
+			sess, err := session.NewSessionWithOptions(session.Options{
+				Config:   aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String(server.URL)},
+				Handlers: handlers,
+			})
+			assert.Nil(t, err)
+
+			role, err := ec2metadata.New(sess).GetMetadata("iam/security-credentials/")
+			if tt.wantErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "proxy-role", role)
+			assert.Equal(t, tt.wantToken, gotToken)
+		})
+	}
+}
+
+// mockSSO returns the credentials of the role the token is good for.
+type mockSSO struct {
+	ssoiface.SSOAPI
+	input *sso.GetRoleCredentialsInput
+}
+
+func (m *mockSSO) GetRoleCredentials(input *sso.GetRoleCredentialsInput) (*sso.GetRoleCredentialsOutput, error) {
+	m.input = input
+	return &sso.GetRoleCredentialsOutput{RoleCredentials: &sso.RoleCredentials{
+		AccessKeyId:     aws.String("AKIDSSO"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Int64(time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)),
+	}}, nil
+}
+
+func TestSSOProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sso")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &mockSSO{}
+	p := &ssoProvider{client: client, startURL: "https://example.awsapps.com/start", accountID: "123456789012", roleName: "ReadOnly", cacheDir: dir}
+	creds := credentials.NewCredentials(p)
+
+	// The file is named after the SHA-1 of the start URL
+	tokenFile := filepath.Join(dir, "e8be5486177c5b5392bd9aa76563515b29358e6e.json")
+	_, err = creds.Get()
+	assert.Contains(t, err.Error(), "no cached SSO token for https://example.awsapps.com/start, run aws sso login")
+
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(`{"accessToken": "expired", "expiresAt": "2020-10-01T00:00:00Z"}`), 0600))
+	_, err = creds.Get()
+	assert.EqualError(t, err, "cached SSO token for https://example.awsapps.com/start expired, run aws sso login")
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte(`{"accessToken": "valid", "expiresAt": "`+expiresAt+`"}`), 0600))
+	v, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, credentials.Value{AccessKeyID: "AKIDSSO", SecretAccessKey: "secret", SessionToken: "token", ProviderName: "SSOProvider"}, v)
+	assert.Equal(t, &sso.GetRoleCredentialsInput{AccessToken: aws.String("valid"), AccountId: aws.String("123456789012"), RoleName: aws.String("ReadOnly")}, client.input)
+
+	// Refreshed ahead of expiry
+	expiry, err := creds.ExpiresAt()
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour-credentialsExpiryWindow), expiry, 5*time.Second)
+}
+
+// TestMainProcess runs main with the arguments after -- when started by
+// runMain, so tests can check how the proxy exits
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("AWS_SIGV4_PROXY_TEST_MAIN") != "1" {
+		return
+	}
+	os.Args = append([]string{"aws-sigv4-proxy"}, flag.Args()...)
+	main()
+}
+
+// runMain runs the proxy with args in a process without AWS configuration
+// from the environment, other than env, and returns its output and error
+func runMain(t *testing.T, env []string, args ...string) (string, error) {
+	dir, err := ioutil.TempDir("", "main")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=^TestMainProcess$", "--"}, args...)...)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "AWS_") {
+			cmd.Env = append(cmd.Env, v)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"AWS_SIGV4_PROXY_TEST_MAIN=1",
+		"AWS_CONFIG_FILE="+filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE="+filepath.Join(dir, "credentials"),
+		"AWS_EC2_METADATA_DISABLED=true",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, ctx.Err(), "the proxy did not exit")
+	return string(out), err
+}
+
+func TestMain_RequireCredentials(t *testing.T) {
+	keys := []string{"AWS_ACCESS_KEY_ID=AKID", "AWS_SECRET_ACCESS_KEY=secret"}
+
+	t.Run("fails without credentials", func(t *testing.T) {
+		out, err := runMain(t, nil, "--require-credentials", "--port", "127.0.0.1:0")
+		assert.NotNil(t, err)
+		assert.Contains(t, out, "unable to resolve AWS credentials")
+		assert.NotContains(t, out, "Listening on")
+	})
+
+	t.Run("resolves credentials", func(t *testing.T) {
+		out, err := runMain(t, keys, "--require-credentials", "--check-config")
+		assert.Nil(t, err)
+		assert.Contains(t, out, "Resolved AWS credentials")
+		assert.Contains(t, out, "provider=EnvConfigCredentials")
+	})
+
+	t.Run("fails without service specific credentials", func(t *testing.T) {
+		out, err := runMain(t, keys, "--require-credentials", "--check-config", "--service-credentials", "s3=profile:missing")
+		assert.NotNil(t, err)
+		assert.Contains(t, out, "unable to resolve AWS credentials for s3")
+	})
+
+	t.Run("only warns without the flag", func(t *testing.T) {
+		out, err := runMain(t, nil, "--check-config")
+		assert.Nil(t, err)
+		assert.NotContains(t, out, "unable to resolve AWS credentials")
+	})
+}
+
+func TestMain_CheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.json")
+	assert.Nil(t, ioutil.WriteFile(valid, []byte(`{"routes": [{"host": "search.local", "upstream": "https://search-logs.us-east-1.es.amazonaws.com", "service": "es", "region": "us-east-1"}]}`), 0600))
+	invalid := filepath.Join(dir, "invalid.json")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte(`{"routes": [{"host": "search.local"}]}`), 0600))
+
+	// The port is taken, so serving on it would fail
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	t.Run("valid", func(t *testing.T) {
+		out, err := runMain(t, nil, "--check-config", "--config", valid, "--port", l.Addr().String())
+		assert.Nil(t, err)
+		assert.Contains(t, out, "Configuration is valid")
+		assert.NotContains(t, out, "Listening on")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		out, err := runMain(t, nil, "--check-config", "--config", invalid, "--strip-query", "(", "--port", l.Addr().String())
+		assert.NotNil(t, err)
+		assert.Contains(t, out, `invalid upstream of route 1: \"\" is not an absolute http(s) URL`)
+		assert.Contains(t, out, "error parsing regexp")
+		assert.Contains(t, out, "Configuration is invalid, 2 problem(s) found")
+		assert.NotContains(t, out, "Listening on")
+	})
+}
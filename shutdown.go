@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"aws-sigv4-proxy/handler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownFlushTimeout bounds the delivery of the audit events and spans
+// queued on shutdown.
+const shutdownFlushTimeout = 5 * time.Second
+
+// shutdownOptions holds the flag configurable settings of graceful
+// shutdowns.
+type shutdownOptions struct {
+	// Delay is how long /health and /ready fail before new connections are
+	// refused, for load balancers to stop routing to the proxy.
+	Delay time.Duration
+	// GracePeriod bounds the wait for in-flight requests to complete, after
+	// which their connections are closed.
+	GracePeriod time.Duration
+}
+
+// handleShutdownSignal gracefully shuts server down, see shutdown, once
+// SIGINT or SIGTERM is received. The returned channel is closed once it is
+// done.
+func handleShutdownSignal(server *http.Server, h *handler.Handler, upstream *http.Client, o shutdownOptions) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.WithFields(log.Fields{"signal": sig.String(), "delay": o.Delay, "grace-period": o.GracePeriod}).Info("Shutting down")
+		shutdown(server, h, upstream, o)
+		close(done)
+	}()
+	return done
+}
+
+// shutdown fails the health checks of h for o.Delay, then closes the
+// listeners of server, removing unix sockets, waits up to o.GracePeriod for
+// in-flight requests, upgraded connections and mirrored requests to
+// complete, delivers the queued audit events and spans and closes the idle
+// connections of upstream.
+func shutdown(server *http.Server, h *handler.Handler, upstream *http.Client, o shutdownOptions) {
+	h.SetShuttingDown()
+	time.Sleep(o.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.GracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("In-flight requests did not complete within the grace period, closing their connections")
+		server.Close()
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancelFlush()
+	if err := h.Shutdown(ctx, flushCtx); err != nil {
+		log.WithError(err).Warn("Upgraded connections or mirrored requests did not complete within the grace period")
+	}
+	upstream.CloseIdleConnections()
+	log.Info("Shut down")
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleDrainSignal toggles drain mode on h every time SIGUSR1 is received.
+func handleDrainSignal(h *handler.Handler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			h.SetDraining(!h.Draining())
+			log.WithField("draining", h.Draining()).Info("Toggled drain mode")
+		}
+	}()
+}
+
+// handleReloadCredentialsSignal reloads creds from their source every time
+// SIGUSR2 is received, e.g. after the keys of the shared credentials file
+// read with --credential-source shared were rotated. Static keys resolved by
+// the SDK's chain at startup are not read again.
+func handleReloadCredentialsSignal(creds *credentials.Credentials) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			status, err := handler.ReloadCredentials(creds)
+			if err != nil {
+				log.WithError(err).Error("Unable to reload credentials")
+				continue
+			}
+			log.WithFields(credentialsStatusFields(status)).Info("Reloaded credentials")
+		}
+	}()
+}
+
+// handleReloadTLSSignal reloads the listener's certificates every time
+// SIGHUP is received.
+func handleReloadTLSSignal(r *certReloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			r.logReload()
+		}
+	}()
+}
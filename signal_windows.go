@@ -0,0 +1,32 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// handleDrainSignal is a no-op, SIGUSR1 does not exist on Windows.
+func handleDrainSignal(h *handler.Handler) {}
+
+// handleReloadCredentialsSignal is a no-op, SIGUSR2 does not exist on Windows.
+func handleReloadCredentialsSignal(creds *credentials.Credentials) {}
+
+// handleReloadTLSSignal is a no-op, Windows has no SIGHUP, certificates are
+// still reloaded once their files change.
+func handleReloadTLSSignal(r *certReloader) {}
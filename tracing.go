@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"aws-sigv4-proxy/handler"
+)
+
+// tracingConfig configures the handler.Tracer, from the standard
+// OpenTelemetry environment variables.
+type tracingConfig struct {
+	// Disabled is set when the variables turn tracing off.
+	Disabled    bool
+	Endpoint    string
+	Headers     map[string]string
+	Timeout     time.Duration
+	ServiceName string
+	SampleRatio float64
+	ParentBased bool
+	QueueSize   int
+}
+
+// tracingConfigFromEnv reads the tracing configuration with lookup. Spans are
+// exported over OTLP/HTTP encoded as JSON, the only exporter and protocol
+// supported.
+func tracingConfigFromEnv(lookup func(string) (string, bool)) (tracingConfig, error) {
+	get := func(names ...string) string {
+		for _, name := range names {
+			if v, ok := lookup(name); ok && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+
+	c := tracingConfig{
+		Endpoint:    "http://localhost:4318/v1/traces",
+		Headers:     map[string]string{},
+		Timeout:     10 * time.Second,
+		ServiceName: "aws-sigv4-proxy",
+		SampleRatio: 1,
+		ParentBased: true,
+		QueueSize:   2048,
+	}
+
+	if strings.EqualFold(get("OTEL_SDK_DISABLED"), "true") {
+		c.Disabled = true
+		return c, nil
+	}
+	switch exporter := get("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "otlp":
+	case "none":
+		c.Disabled = true
+		return c, nil
+	default:
+		return c, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q, only otlp is supported", exporter)
+	}
+	if protocol := get("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return c, fmt.Errorf("unsupported OTLP protocol %q, only http/json is supported", protocol)
+	}
+
+	if endpoint := get("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		c.Endpoint = endpoint
+	} else if endpoint := get("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		c.Endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c, fmt.Errorf("invalid OTLP endpoint %q", c.Endpoint)
+	}
+
+	// Signal specific headers add to, and override, the general ones
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		headers, err := parseOTLPHeaders(get(name))
+		if err != nil {
+			return c, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		for k, v := range headers {
+			c.Headers[k] = v
+		}
+	}
+
+	if v := get("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return c, fmt.Errorf("invalid OTLP timeout %q, milliseconds expected", v)
+		}
+		c.Timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if v := get("OTEL_BSP_MAX_QUEUE_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return c, fmt.Errorf("invalid OTEL_BSP_MAX_QUEUE_SIZE %q", v)
+		}
+		c.QueueSize = size
+	}
+
+	if v := get("OTEL_SERVICE_NAME"); v != "" {
+		c.ServiceName = v
+	}
+
+	ratio := 1.0
+	if v := get("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(v, 64); err != nil || ratio < 0 || ratio > 1 {
+			return c, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, a ratio between 0 and 1 expected", v)
+		}
+	}
+	switch sampler := get("OTEL_TRACES_SAMPLER"); sampler {
+	case "", "parentbased_always_on":
+	case "parentbased_always_off":
+		c.SampleRatio = 0
+	case "parentbased_traceidratio":
+		c.SampleRatio = ratio
+	case "always_on":
+		c.ParentBased = false
+	case "always_off":
+		c.ParentBased, c.SampleRatio = false, 0
+	case "traceidratio":
+		c.ParentBased, c.SampleRatio = false, ratio
+	default:
+		return c, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", sampler)
+	}
+	return c, nil
+}
+
+// parseOTLPHeaders parses a comma separated list of key=value pairs whose
+// values are URL encoded, as in OTEL_EXPORTER_OTLP_HEADERS.
+func parseOTLPHeaders(v string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("header is not a key=value pair: %q", pair)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", strings.TrimSpace(pair[:i]), err)
+		}
+		headers[strings.TrimSpace(pair[:i])] = value
+	}
+	return headers, nil
+}
+
+// tracer returns a handler.Tracer configured with c, exporting spans.
+func (c tracingConfig) tracer() *handler.Tracer {
+	t := handler.NewTracer(c.Endpoint, &http.Client{Timeout: c.Timeout}, c.QueueSize)
+	t.Headers = c.Headers
+	t.ServiceName = c.ServiceName
+	t.SampleRatio = c.SampleRatio
+	t.ParentBased = c.ParentBased
+	return t
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transportOptions holds the flag configurable settings of the transport used
+// to reach upstreams.
+type transportOptions struct {
+	ForceHTTP1          bool
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	TLSMinVersion       uint16
+	IdleConnTimeout     time.Duration
+	DisableKeepAlives   bool
+	MaxIdleConns        int
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout, when not
+	// zero, bound connecting to upstreams, their TLS handshake and the wait
+	// for their response headers once a request was sent.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// DNSCacheTTL, when not zero, caches the addresses upstream hosts
+	// resolve to for that long.
+	DNSCacheTTL time.Duration
+}
+
+// tlsVersions maps the accepted --*tls-min-version values to their versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as "1.2".
+func parseTLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, expected one of 1.0, 1.1, 1.2 or 1.3", v)
+	}
+	return version, nil
+}
+
+// newTransport returns the transport used to reach upstreams, derived from
+// http.DefaultTransport.
+func newTransport(o transportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if o.ForceHTTP1 {
+		// A non-nil, empty TLSNextProto disables HTTP/2 negotiation.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if o.TLSMinVersion != 0 {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.MinVersion = o.TLSMinVersion
+	}
+
+	if o.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+
+	if o.MaxIdleConns > 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	t.DisableKeepAlives = o.DisableKeepAlives
+
+	if o.DialTimeout > 0 {
+		// Keeps the keep-alive period of http.DefaultTransport's dialer
+		t.DialContext = (&net.Dialer{Timeout: o.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+
+	if o.DNSCacheTTL > 0 {
+		t.DialContext = newDNSCache(o.DNSCacheTTL).dialContext(t.DialContext)
+	}
+
+	return t
+}
+
+// staleConnRetrier retries a request once on a new connection when it failed
+// because the reused keep-alive connection it was sent on had been closed by
+// the upstream. As the upstream may have processed it already, only requests
+// which are safe to send twice are retried, see isReplayable.
+type staleConnRetrier struct {
+	http.RoundTripper
+}
+
+func (t *staleConnRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil || !reused || !isStaleConnError(err) || !isReplayable(req) || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+
+	log.WithError(err).Debug("Retrying request on a new connection after its reused connection was closed")
+	return t.RoundTripper.RoundTrip(retry)
+}
+
+// isReplayable reports whether req may be sent again, as net/http does:
+// requests of idempotent methods which have no side effects, or those
+// carrying an idempotency key.
+func isReplayable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, key := req.Header["Idempotency-Key"]
+	_, xKey := req.Header["X-Idempotency-Key"]
+	return key || xKey
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// RoundTripper, if it keeps any.
+func (t *staleConnRetrier) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// isStaleConnError reports whether err is what a transport returns when the
+// upstream closed a connection before or while the request was sent on it.
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}